@@ -0,0 +1,280 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+	"github.com/potix/utils/signal"
+	"github.com/potix/utils/configurator"
+	"github.com/potix/regapweb/device"
+	"github.com/potix/regapweb/message"
+)
+
+type regapdeviceServerConfig struct {
+	AddrPort    string `toml:"addrPort"`
+	UseTls      bool   `toml:"useTls"`
+	ServerName  string `toml:"serverName"`
+	SkipVerify  bool   `toml:"skipVerify"`
+	// ca of the server certificate, system roots are used if empty
+	TlsCaPath   string `toml:"tlsCaPath"`
+	// client certificate for the mutual tls
+	TlsCertPath string `toml:"tlsCertPath"`
+	TlsKeyPath  string `toml:"tlsKeyPath"`
+}
+
+type regapdeviceGamepadConfig struct {
+	Name           string `toml:"name"`
+	ControllerType string `toml:"controllerType"`
+	Buttons        int    `toml:"buttons"`
+	Axes           int    `toml:"axes"`
+	Rumble         bool   `toml:"rumble"`
+}
+
+type regapdeviceDeviceConfig struct {
+	Name           string `toml:"name"`
+	DeviceId       string `toml:"deviceId"`
+	Secret         string `toml:"secret"`
+	Room           string `toml:"room"`
+	// the credential issued by the enrollment is saved to the credential path and used as the secret
+	PairingCode    string `toml:"pairingCode"`
+	CredentialPath string `toml:"credentialPath"`
+	Firmware       string `toml:"firmware"`
+	Framing        string `toml:"framing"`
+	// capabilities of the single gamepad, gamepads declare their own capabilities
+	ControllerType string `toml:"controllerType"`
+	Buttons        int    `toml:"buttons"`
+	Axes           int    `toml:"axes"`
+	Rumble         bool   `toml:"rumble"`
+	Gamepads       []*regapdeviceGamepadConfig `toml:"gamepads"`
+	// seconds, used with pingMaxMissed, 0 of pingMaxMissed disables the dead server detection
+	PingInterval   int    `toml:"pingInterval"`
+	PingMaxMissed  int    `toml:"pingMaxMissed"`
+	// seconds
+	MinBackoff     int    `toml:"minBackoff"`
+	MaxBackoff     int    `toml:"maxBackoff"`
+}
+
+type regapdeviceSinkConfig struct {
+	// log, uinput or hidGadget
+	Type           string   `toml:"type"`
+	UinputPath     string   `toml:"uinputPath"`
+	HidDevicePaths []string `toml:"hidDevicePaths"`
+}
+
+type regapdeviceLogConfig struct {
+	UseSyslog bool `toml:"useSyslog"`
+}
+
+type regapdeviceConfig struct {
+	Verbose bool                     `toml:"verbose"`
+	Server  *regapdeviceServerConfig `toml:"server"`
+	Device  *regapdeviceDeviceConfig `toml:"device"`
+	Sink    *regapdeviceSinkConfig   `toml:"sink"`
+	Log     *regapdeviceLogConfig    `toml:"log"`
+}
+
+type commandArguments struct {
+	configFile          string
+	hidReportDescriptor bool
+}
+
+func verboseLoadedConfig(config *regapdeviceConfig) {
+	if !config.Verbose {
+		return
+	}
+	j, err := json.Marshal(config)
+	if err != nil {
+		log.Printf("can not dump config: %v", err)
+		return
+	}
+	log.Printf("loaded config: %v", string(j))
+}
+
+func newTlsConfig(conf *regapdeviceServerConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         conf.ServerName,
+		InsecureSkipVerify: conf.SkipVerify,
+	}
+	if conf.TlsCaPath != "" {
+		caPem, err := os.ReadFile(conf.TlsCaPath)
+		if err != nil {
+			return nil, fmt.Errorf("can not read ca: %w", err)
+		}
+		rootCAs := x509.NewCertPool()
+		if !rootCAs.AppendCertsFromPEM(caPem) {
+			return nil, fmt.Errorf("no certificate in ca: %v", conf.TlsCaPath)
+		}
+		tlsConfig.RootCAs = rootCAs
+	}
+	if conf.TlsCertPath != "" {
+		cert, err := tls.LoadX509KeyPair(conf.TlsCertPath, conf.TlsKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("can not load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{ cert }
+	}
+	return tlsConfig, nil
+}
+
+func newSink(conf *regapdeviceSinkConfig, name string) (device.Sink, error) {
+	if conf == nil || conf.Type == "" || conf.Type == "log" {
+		return device.NewLogSink(), nil
+	}
+	if conf.Type == "uinput" {
+		return device.NewUinputSink(name, conf.UinputPath)
+	}
+	if conf.Type == "hidGadget" {
+		return device.NewHidGadgetSink(conf.HidDevicePaths)
+	}
+	return nil, fmt.Errorf("unsupported sink type: %v", conf.Type)
+}
+
+func main() {
+	cmdArgs := new(commandArguments)
+	flag.StringVar(&cmdArgs.configFile, "config", "./regapdevice.conf", "config file")
+	flag.BoolVar(&cmdArgs.hidReportDescriptor, "hidReportDescriptor", false, "write the report descriptor of the hid gadget to stdout and exit")
+	flag.Parse()
+	if cmdArgs.hidReportDescriptor {
+		// for the setup script of the usb gadget
+		if _, err := os.Stdout.Write(device.HidGadgetReportDescriptor); err != nil {
+			log.Fatalf("can not write report descriptor: %v", err)
+		}
+		return
+	}
+	cf, err := configurator.NewConfigurator(cmdArgs.configFile)
+	if err != nil {
+		log.Fatalf("can not create configurator: %v", err)
+	}
+	var conf regapdeviceConfig
+	err = cf.Load(&conf)
+	if err != nil {
+		log.Fatalf("can not load config: %v", err)
+	}
+	if conf.Server == nil || conf.Device == nil {
+		log.Fatalf("invalid config")
+	}
+	if conf.Log != nil && conf.Log.UseSyslog {
+		if err := setupSyslog(); err != nil {
+			log.Fatalf("can not setup syslog: %v", err)
+		}
+	}
+	verboseLoadedConfig(&conf)
+	name := conf.Device.Name
+	if name == "" {
+		name = "regapdevice"
+	}
+	// setup sink
+	sink, err := newSink(conf.Sink, name)
+	if err != nil {
+		log.Fatalf("can not create sink: %v", err)
+	}
+	// setup client
+	secret := conf.Device.Secret
+	pairingCode := conf.Device.PairingCode
+	if conf.Device.CredentialPath != "" {
+		credential, err := os.ReadFile(conf.Device.CredentialPath)
+		if err == nil {
+			// already enrolled
+			secret = strings.TrimSpace(string(credential))
+			pairingCode = ""
+		} else if !os.IsNotExist(err) {
+			log.Fatalf("can not read credential: %v", err)
+		}
+	}
+	var dcPairingCodeOpt device.ClientOption
+	if pairingCode != "" {
+		if conf.Device.CredentialPath == "" {
+			log.Fatalf("no credential path to save the credential of the enrollment")
+		}
+		dcPairingCodeOpt = device.ClientPairingCode(pairingCode, func(credential string) {
+			if err := os.WriteFile(conf.Device.CredentialPath, []byte(credential), 0600); err != nil {
+				log.Printf("can not save credential: %v", err)
+			}
+		})
+	}
+	var dcTlsConfigOpt device.ClientOption
+	if conf.Server.UseTls {
+		tlsConfig, err := newTlsConfig(conf.Server)
+		if err != nil {
+			log.Fatalf("can not create tls config: %v", err)
+		}
+		dcTlsConfigOpt = device.ClientTlsConfig(tlsConfig)
+	}
+	var dcCapabilitiesOpt device.ClientOption
+	if conf.Device.Buttons > 0 || conf.Device.Axes > 0 {
+		if len(conf.Device.Gamepads) > 0 {
+			log.Fatalf("capabilities of the device are not used with gamepads, declare them in each gamepad")
+		}
+		dcCapabilitiesOpt = device.ClientGamepadCapabilities(&message.GamepadCapabilities{
+			ControllerType: conf.Device.ControllerType,
+			Buttons:        conf.Device.Buttons,
+			Axes:           conf.Device.Axes,
+			Rumble:         conf.Device.Rumble,
+		})
+	}
+	var dcVirtualGamepadsOpt device.ClientOption
+	if len(conf.Device.Gamepads) > 0 {
+		virtualGamepads := make([]*message.VirtualGamepad, 0, len(conf.Device.Gamepads))
+		for _, gamepad := range conf.Device.Gamepads {
+			virtualGamepad := &message.VirtualGamepad{
+				Name: gamepad.Name,
+			}
+			if gamepad.Buttons > 0 || gamepad.Axes > 0 {
+				virtualGamepad.GamepadCapabilities = &message.GamepadCapabilities{
+					ControllerType: gamepad.ControllerType,
+					Buttons:        gamepad.Buttons,
+					Axes:           gamepad.Axes,
+					Rumble:         gamepad.Rumble,
+				}
+			}
+			virtualGamepads = append(virtualGamepads, virtualGamepad)
+		}
+		dcVirtualGamepadsOpt = device.ClientVirtualGamepads(virtualGamepads)
+	}
+	var dcFramingOpt device.ClientOption
+	if conf.Device.Framing != "" {
+		dcFramingOpt = device.ClientFraming(conf.Device.Framing)
+	}
+	var dcHeartbeatOpt device.ClientOption
+	if conf.Device.PingInterval > 0 {
+		dcHeartbeatOpt = device.ClientHeartbeat(time.Duration(conf.Device.PingInterval) * time.Second, conf.Device.PingMaxMissed)
+	}
+	var dcBackoffOpt device.ClientOption
+	if conf.Device.MinBackoff > 0 && conf.Device.MaxBackoff > 0 {
+		dcBackoffOpt = device.ClientBackoff(time.Duration(conf.Device.MinBackoff) * time.Second, time.Duration(conf.Device.MaxBackoff) * time.Second)
+	}
+	newClient, err := device.NewClient(
+		conf.Server.AddrPort,
+		secret,
+		sink,
+		device.ClientVerbose(conf.Verbose),
+		device.ClientName(name),
+		device.ClientDeviceId(conf.Device.DeviceId),
+		device.ClientRoom(conf.Device.Room),
+		device.ClientFirmware(conf.Device.Firmware),
+		dcPairingCodeOpt,
+		dcTlsConfigOpt,
+		dcCapabilitiesOpt,
+		dcVirtualGamepadsOpt,
+		dcFramingOpt,
+		dcHeartbeatOpt,
+		dcBackoffOpt,
+	)
+	if err != nil {
+		log.Fatalf("can not create device client: %v", err)
+	}
+	err = newClient.Start()
+	if err != nil {
+		log.Fatalf("can not start device client: %v", err)
+	}
+	signal.SignalWait(nil)
+	log.Printf("shutting down")
+	newClient.Stop()
+	log.Printf("shutdown completed")
+}
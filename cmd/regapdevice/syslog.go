@@ -0,0 +1,18 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"log/syslog"
+)
+
+func setupSyslog() error {
+	logger, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "regapdevice")
+	if err != nil {
+		return fmt.Errorf("can not create syslog: %w", err)
+	}
+	log.SetOutput(logger)
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build windows || plan9
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// syslog is not available on windows and plan9.
+func setupSyslog() error {
+	return fmt.Errorf("syslog is not supported on %v", runtime.GOOS)
+}
@@ -0,0 +1,607 @@
+package device
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+	"github.com/potix/regapweb/message"
+)
+
+type clientOptions struct {
+	verbose         bool
+	name            string
+	deviceId        string
+	room            string
+	pairingCode     string
+	onCredential    func(credential string)
+	firmware        string
+	capabilities    *message.GamepadCapabilities
+	virtualGamepads []*message.VirtualGamepad
+	framing         string
+	tlsConfig       *tls.Config
+	dialTimeout     time.Duration
+	pingInterval    time.Duration
+	pingMaxMissed   int
+	minBackoff      time.Duration
+	maxBackoff      time.Duration
+}
+
+func defaultClientOptions() *clientOptions {
+	return &clientOptions {
+		verbose:       false,
+		name:          "gamepad",
+		framing:       message.FramingLine,
+		dialTimeout:   10 * time.Second,
+		pingInterval:  10 * time.Second,
+		pingMaxMissed: 3,
+		minBackoff:    time.Second,
+		maxBackoff:    time.Minute,
+	}
+}
+
+type ClientOption func(*clientOptions)
+
+func ClientVerbose(verbose bool) ClientOption {
+	return func(opts *clientOptions) {
+		opts.verbose = verbose
+	}
+}
+
+// ClientName sets the name of the device shown to deliverers.
+func ClientName(name string) ClientOption {
+	return func(opts *clientOptions) {
+		opts.name = name
+	}
+}
+
+// ClientDeviceId sets the persistent uuid of the device, the device without it gets random gamepad ids.
+func ClientDeviceId(deviceId string) ClientOption {
+	return func(opts *clientOptions) {
+		opts.deviceId = deviceId
+	}
+}
+
+// ClientRoom sets the room that gamepads join, the secret must be the secret of the room.
+func ClientRoom(room string) ClientOption {
+	return func(opts *clientOptions) {
+		opts.room = room
+	}
+}
+
+// ClientPairingCode enrolls the device by the one-time code in the first handshake.
+// onCredential is called with the issued credential, that is the secret after the enrollment.
+// Persist it, the pairing code can not be used again.
+func ClientPairingCode(pairingCode string, onCredential func(credential string)) ClientOption {
+	return func(opts *clientOptions) {
+		opts.pairingCode = pairingCode
+		opts.onCredential = onCredential
+	}
+}
+
+func ClientFirmware(firmware string) ClientOption {
+	return func(opts *clientOptions) {
+		opts.firmware = firmware
+	}
+}
+
+// ClientGamepadCapabilities declares what the single gamepad can emulate,
+// gamepads of ClientVirtualGamepads declare their own capabilities instead.
+func ClientGamepadCapabilities(capabilities *message.GamepadCapabilities) ClientOption {
+	return func(opts *clientOptions) {
+		opts.capabilities = capabilities
+	}
+}
+
+// ClientVirtualGamepads sets gamepads that the device emulates, the device emulates the single gamepad by default.
+func ClientVirtualGamepads(virtualGamepads []*message.VirtualGamepad) ClientOption {
+	return func(opts *clientOptions) {
+		opts.virtualGamepads = virtualGamepads
+	}
+}
+
+// ClientFraming requests the framing after the handshake, the server may keep the line.
+func ClientFraming(framing string) ClientOption {
+	return func(opts *clientOptions) {
+		opts.framing = framing
+	}
+}
+
+// ClientTlsConfig connects to the server over tls, set the client certificate for the mutual tls.
+func ClientTlsConfig(tlsConfig *tls.Config) ClientOption {
+	return func(opts *clientOptions) {
+		opts.tlsConfig = tlsConfig
+	}
+}
+
+// ClientHeartbeat sets the interval of pings, and how many intervals without any message from the server are allowed.
+// The silent connection is closed and reconnected, 0 of maxMissed disables it.
+func ClientHeartbeat(pingInterval time.Duration, maxMissed int) ClientOption {
+	return func(opts *clientOptions) {
+		opts.pingInterval = pingInterval
+		opts.pingMaxMissed = maxMissed
+	}
+}
+
+// ClientBackoff sets the range of waits before reconnecting, the wait is doubled on each failure.
+func ClientBackoff(minBackoff time.Duration, maxBackoff time.Duration) ClientOption {
+	return func(opts *clientOptions) {
+		opts.minBackoff = minBackoff
+		opts.maxBackoff = maxBackoff
+	}
+}
+
+// the upper limit of messages from the server
+const maxFrameSize int = 1024 * 1024
+
+// Client connects the gamepad device to the tcp handler of regapweb,
+// and outputs states of gamepads to the sink. The connection is retried with the backoff until Stop.
+type Client struct {
+	verbose         bool
+	addrPort        string
+	name            string
+	deviceId        string
+	room            string
+	firmware        string
+	capabilities    *message.GamepadCapabilities
+	virtualGamepads []*message.VirtualGamepad
+	framing         string
+	tlsConfig       *tls.Config
+	dialTimeout     time.Duration
+	pingInterval    time.Duration
+	pingMaxMissed   int
+	minBackoff      time.Duration
+	maxBackoff      time.Duration
+	onCredential    func(credential string)
+	sink            Sink
+	random          *rand.Rand
+	// the secret and the pairing code are replaced by the credential after the enrollment
+	secret          string
+	pairingCode     string
+	sessionMutex    sync.Mutex
+	session         *clientSession
+	ctx             context.Context
+	cancel          context.CancelFunc
+	wg              sync.WaitGroup
+}
+
+// clientSession is the state of one connection after the handshake.
+type clientSession struct {
+	conn         net.Conn
+	writeMutex   sync.Mutex
+	writeFraming string
+	readFraming  string
+	gamepadIds   []string
+	// controllers bound to gamepads by gpConnectReq, removed by gpDisconnected
+	bindings     map[string]*message.GamepadConnectRequest
+	lastReceived int64
+}
+
+func (s *clientSession) write(msg *message.Message) error {
+	msgBytes, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("can not marshal to json: %w", err)
+	}
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	s.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := s.conn.Write(message.EncodeFrame(msgBytes, s.writeFraming)); err != nil {
+		return fmt.Errorf("can not write to server: %w", err)
+	}
+	return nil
+}
+
+func (s *clientSession) hasGamepad(gamepadId string) bool {
+	for _, id := range s.gamepadIds {
+		if id == gamepadId {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Client) Start() error {
+	c.wg.Add(1)
+	go c.run()
+	return nil
+}
+
+func (c *Client) Stop() {
+	c.cancel()
+	c.sessionMutex.Lock()
+	if c.session != nil {
+		c.session.conn.Close()
+	}
+	c.sessionMutex.Unlock()
+	c.wg.Wait()
+	if c.verbose {
+		log.Printf("stopped device client")
+	}
+}
+
+// SendVibration sends the vibration of the gamepad to the bound controller.
+func (c *Client) SendVibration(gamepadId string, vibration *message.GamepadVibration) error {
+	c.sessionMutex.Lock()
+	session := c.session
+	var binding *message.GamepadConnectRequest
+	if session != nil {
+		binding = session.bindings[gamepadId]
+	}
+	c.sessionMutex.Unlock()
+	if binding == nil {
+		return fmt.Errorf("gamepad is not bound: %v", gamepadId)
+	}
+	vibration.DelivererId = binding.DelivererId
+	vibration.ControllerId = binding.ControllerId
+	vibration.GamepadId = gamepadId
+	return session.write(&message.Message{
+		MsgType:          message.MsgTypeGamepadVibration,
+		GamepadVibration: vibration,
+	})
+}
+
+// SendDeviceStatus sends the telemetry of the device, the server pushes only changes to controllers.
+func (c *Client) SendDeviceStatus(deviceStatus *message.GamepadDeviceStatus) error {
+	c.sessionMutex.Lock()
+	session := c.session
+	c.sessionMutex.Unlock()
+	if session == nil {
+		return fmt.Errorf("not connected")
+	}
+	return session.write(&message.Message{
+		MsgType:             message.MsgTypeGamepadDeviceStatus,
+		GamepadDeviceStatus: deviceStatus,
+	})
+}
+
+// run connects to the server until Stop, the backoff is reset after the successful handshake.
+func (c *Client) run() {
+	defer c.wg.Done()
+	backoff := c.minBackoff
+	for {
+		handshaked, err := c.serve()
+		if c.ctx.Err() != nil {
+			return
+		}
+		log.Printf("disconnected from server: %v", err)
+		if handshaked {
+			backoff = c.minBackoff
+		}
+		// jitter avoids reconnections of many devices at once after the server restarts
+		wait := backoff / 2 + time.Duration(c.random.Int63n(int64(backoff / 2) + 1))
+		if c.verbose {
+			log.Printf("reconnect after %v", wait)
+		}
+		select {
+		case <-time.After(wait):
+		case <-c.ctx.Done():
+			return
+		}
+		backoff *= 2
+		if backoff > c.maxBackoff {
+			backoff = c.maxBackoff
+		}
+	}
+}
+
+func (c *Client) dial() (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout: c.dialTimeout,
+	}
+	conn, err := dialer.DialContext(c.ctx, "tcp", c.addrPort)
+	if err != nil {
+		return nil, fmt.Errorf("can not connect to server: %w", err)
+	}
+	if c.tlsConfig == nil {
+		return conn, nil
+	}
+	tlsConn := tls.Client(conn, c.tlsConfig)
+	handshakeCtx, handshakeCancel := context.WithTimeout(c.ctx, c.dialTimeout)
+	defer handshakeCancel()
+	if err := tlsConn.HandshakeContext(handshakeCtx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("can not handshake tls: %w", err)
+	}
+	return tlsConn, nil
+}
+
+// serve runs one connection, and returns true if the handshake is succeeded.
+func (c *Client) serve() (bool, error) {
+	conn, err := c.dial()
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	session := &clientSession{
+		conn:         conn,
+		writeFraming: message.FramingLine,
+		readFraming:  message.FramingLine,
+		bindings:     make(map[string]*message.GamepadConnectRequest),
+		lastReceived: time.Now().UnixNano(),
+	}
+	c.sessionMutex.Lock()
+	if c.ctx.Err() != nil {
+		c.sessionMutex.Unlock()
+		return false, c.ctx.Err()
+	}
+	c.session = session
+	c.sessionMutex.Unlock()
+	defer func() {
+		c.sessionMutex.Lock()
+		c.session = nil
+		c.sessionMutex.Unlock()
+	}()
+	rbufio := bufio.NewReader(conn)
+	if err := c.handshake(session, rbufio); err != nil {
+		return false, err
+	}
+	if err := c.sink.Open(session.gamepadIds); err != nil {
+		return true, fmt.Errorf("can not open sink: %w", err)
+	}
+	defer func() {
+		if err := c.sink.Close(); err != nil {
+			log.Printf("can not close sink: %v", err)
+		}
+	}()
+	log.Printf("connected to server: gamepadIds = %v", session.gamepadIds)
+	sessionCtx, sessionCancel := context.WithCancel(c.ctx)
+	defer sessionCancel()
+	c.wg.Add(1)
+	go c.startPingLoop(sessionCtx, session)
+	return true, c.readLoop(session, rbufio)
+}
+
+func (c *Client) readMessage(session *clientSession, rbufio *bufio.Reader) (*message.Message, error) {
+	msgBytes, err := message.ReadFrame(rbufio, session.readFraming, maxFrameSize)
+	if err != nil {
+		return nil, fmt.Errorf("can not read message: %w", err)
+	}
+	atomic.StoreInt64(&session.lastReceived, time.Now().UnixNano())
+	var msg message.Message
+	if err := json.Unmarshal(msgBytes, &msg); err != nil {
+		return nil, fmt.Errorf("can not unmarshal message: %w", err)
+	}
+	return &msg, nil
+}
+
+// handshake authenticates the device by the challenge, and switches the framing negotiated.
+func (c *Client) handshake(session *clientSession, rbufio *bufio.Reader) error {
+	session.conn.SetReadDeadline(time.Now().Add(c.dialTimeout))
+	defer session.conn.SetReadDeadline(time.Time{})
+	reqMsg := &message.Message{
+		MsgType: message.MsgTypeGamepadHandshakeReq,
+		GamepadHandshakeRequest: &message.GamepadHandshakeRequest{
+			Name:            c.name,
+			DeviceId:        c.deviceId,
+			PairingCode:     c.pairingCode,
+			GamepadCapabilities: c.capabilities,
+			VirtualGamepads: c.virtualGamepads,
+			Framing:         c.framing,
+			Room:            c.room,
+			Firmware:        c.firmware,
+		},
+	}
+	if err := session.write(reqMsg); err != nil {
+		return fmt.Errorf("can not write gpHandshakeReq: %w", err)
+	}
+	for {
+		msg, err := c.readMessage(session, rbufio)
+		if err != nil {
+			return err
+		}
+		if msg.MsgType == message.MsgTypeGamepadChallengeReq && msg.GamepadChallengeRequest != nil {
+			resMsg := &message.Message{
+				MsgType: message.MsgTypeGamepadChallengeRes,
+				GamepadChallengeResponse: &message.GamepadChallengeResponse{
+					Digest: message.ChallengeDigest(c.secret, msg.GamepadChallengeRequest.Nonce, c.deviceId),
+				},
+			}
+			if err := session.write(resMsg); err != nil {
+				return fmt.Errorf("can not write gpChallengeRes: %w", err)
+			}
+			continue
+		}
+		if msg.MsgType != message.MsgTypeGamepadHandshakeRes {
+			if msg.Error != nil {
+				return fmt.Errorf("handshake is failed: %v, %v", msg.MsgType, msg.Error.Message)
+			}
+			return fmt.Errorf("recieved invalid message: %v", msg.MsgType)
+		}
+		if msg.Error != nil {
+			return fmt.Errorf("handshake is rejected: %v", msg.Error.Message)
+		}
+		if msg.GamepadHandshakeResponse == nil {
+			return fmt.Errorf("no parameter in gpHandshakeRes")
+		}
+		return c.handshakeCompleted(session, msg.GamepadHandshakeResponse)
+	}
+}
+
+func (c *Client) handshakeCompleted(session *clientSession, res *message.GamepadHandshakeResponse) error {
+	if res.Credential != "" {
+		log.Printf("device is enrolled: deviceId = %v", c.deviceId)
+		c.secret = res.Credential
+		c.pairingCode = ""
+		if c.onCredential != nil {
+			c.onCredential(res.Credential)
+		}
+	}
+	if res.Framing != "" {
+		session.writeMutex.Lock()
+		session.writeFraming = res.Framing
+		session.writeMutex.Unlock()
+		session.readFraming = res.Framing
+	}
+	gamepadIds := res.GamepadIds
+	if len(gamepadIds) == 0 {
+		gamepadIds = []string{ res.GamepadId }
+	}
+	c.sessionMutex.Lock()
+	session.gamepadIds = gamepadIds
+	c.sessionMutex.Unlock()
+	return nil
+}
+
+func (c *Client) readLoop(session *clientSession, rbufio *bufio.Reader) error {
+	for {
+		msg, err := c.readMessage(session, rbufio)
+		if err != nil {
+			return err
+		}
+		switch msg.MsgType {
+		case message.MsgTypePing:
+			if c.verbose {
+				log.Printf("recieved ping")
+			}
+		case message.MsgTypeGamepadConnectReq:
+			if err := c.onConnectRequest(session, msg.GamepadConnectRequest); err != nil {
+				return err
+			}
+		case message.MsgTypeGamepadDisconnected:
+			c.onDisconnected(session, msg.GamepadDisconnected)
+		case message.MsgTypeGamepadState:
+			if msg.GamepadState == nil || !session.hasGamepad(msg.GamepadState.GamepadId) {
+				log.Printf("recieved state of unknown gamepad")
+				continue
+			}
+			if err := c.sink.Write(msg.GamepadState); err != nil {
+				log.Printf("can not write gamepad state to sink: %v", err)
+			}
+		case message.MsgTypeGamepadConnectServerError:
+			if msg.Error != nil {
+				log.Printf("gamepad connect server error: %v", msg.Error.Message)
+			}
+		case message.MsgTypeShutdown, message.MsgTypeGamepadRevoked, message.MsgTypeProtocolError:
+			if msg.Error != nil {
+				return fmt.Errorf("closed by server: %v, %v", msg.MsgType, msg.Error.Message)
+			}
+			return fmt.Errorf("closed by server: %v", msg.MsgType)
+		default:
+			log.Printf("unsupported message: %v", msg.MsgType)
+		}
+	}
+}
+
+// onConnectRequest binds the controller to the gamepad, and answers the request.
+func (c *Client) onConnectRequest(session *clientSession, req *message.GamepadConnectRequest) error {
+	if req == nil || !session.hasGamepad(req.GamepadId) {
+		log.Printf("recieved connect request of unknown gamepad")
+		return nil
+	}
+	c.sessionMutex.Lock()
+	session.bindings[req.GamepadId] = req
+	c.sessionMutex.Unlock()
+	if c.verbose {
+		log.Printf("gamepad is bound: gamepadId = %v, controllerId = %v", req.GamepadId, req.ControllerId)
+	}
+	resMsg := &message.Message{
+		MsgType: message.MsgTypeGamepadConnectRes,
+		GamepadConnectResponse: &message.GamepadConnectResponse{
+			DelivererId:  req.DelivererId,
+			ControllerId: req.ControllerId,
+			GamepadId:    req.GamepadId,
+		},
+	}
+	if err := session.write(resMsg); err != nil {
+		return fmt.Errorf("can not write gpConnectRes: %w", err)
+	}
+	return nil
+}
+
+// onDisconnected unbinds the controller released by the server, a binding of the newer request is kept.
+func (c *Client) onDisconnected(session *clientSession, disconnected *message.GamepadDisconnected) {
+	if disconnected == nil {
+		return
+	}
+	c.sessionMutex.Lock()
+	defer c.sessionMutex.Unlock()
+	binding, ok := session.bindings[disconnected.GamepadId]
+	if !ok || binding.DelivererId != disconnected.DelivererId || binding.ControllerId != disconnected.ControllerId {
+		return
+	}
+	delete(session.bindings, disconnected.GamepadId)
+	if c.verbose {
+		log.Printf("gamepad is unbound: gamepadId = %v, controllerId = %v", disconnected.GamepadId, disconnected.ControllerId)
+	}
+}
+
+// startPingLoop sends pings, and closes the connection if no message is received in the missed heartbeats.
+func (c *Client) startPingLoop(ctx context.Context, session *clientSession) {
+	defer c.wg.Done()
+	ticker := time.NewTicker(c.pingInterval)
+	defer ticker.Stop()
+	deadTimeout := c.pingInterval * time.Duration(c.pingMaxMissed)
+	for {
+		select {
+		case <-ticker.C:
+			silent := time.Since(time.Unix(0, atomic.LoadInt64(&session.lastReceived)))
+			if c.pingMaxMissed > 0 && silent > deadTimeout {
+				log.Printf("close dead server connection: silent = %v", silent)
+				session.conn.Close()
+				return
+			}
+			msg := &message.Message{
+				MsgType: message.MsgTypePing,
+			}
+			if err := session.write(msg); err != nil {
+				log.Printf("can not write ping message: %v", err)
+				session.conn.Close()
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// NewClient creates the client of the device, secret is the shared secret, the secret of the room or the credential.
+func NewClient(addrPort string, secret string, sink Sink, opts ...ClientOption) (*Client, error) {
+	baseOpts := defaultClientOptions()
+	for _, opt := range opts {
+		if opt == nil {
+			continue
+		}
+		opt(baseOpts)
+	}
+	if baseOpts.pingInterval <= 0 {
+		return nil, fmt.Errorf("invalid ping interval: %v", baseOpts.pingInterval)
+	}
+	if baseOpts.minBackoff <= 0 || baseOpts.maxBackoff < baseOpts.minBackoff {
+		return nil, fmt.Errorf("invalid backoff: %v, %v", baseOpts.minBackoff, baseOpts.maxBackoff)
+	}
+	if baseOpts.framing != message.FramingLine && baseOpts.framing != message.FramingLength {
+		return nil, fmt.Errorf("invalid framing: %v", baseOpts.framing)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Client{
+		verbose:         baseOpts.verbose,
+		addrPort:        addrPort,
+		name:            baseOpts.name,
+		deviceId:        baseOpts.deviceId,
+		room:            baseOpts.room,
+		firmware:        baseOpts.firmware,
+		capabilities:    baseOpts.capabilities,
+		virtualGamepads: baseOpts.virtualGamepads,
+		framing:         baseOpts.framing,
+		tlsConfig:       baseOpts.tlsConfig,
+		dialTimeout:     baseOpts.dialTimeout,
+		pingInterval:    baseOpts.pingInterval,
+		pingMaxMissed:   baseOpts.pingMaxMissed,
+		minBackoff:      baseOpts.minBackoff,
+		maxBackoff:      baseOpts.maxBackoff,
+		onCredential:    baseOpts.onCredential,
+		sink:            sink,
+		random:          rand.New(rand.NewSource(time.Now().UnixNano())),
+		secret:          secret,
+		pairingCode:     baseOpts.pairingCode,
+		ctx:             ctx,
+		cancel:          cancel,
+	}, nil
+}
@@ -0,0 +1,250 @@
+package device
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+	"github.com/potix/regapweb/message"
+)
+
+type testSink struct {
+	opened chan []string
+	states chan *message.GamepadState
+}
+
+func (s *testSink) Open(gamepadIds []string) error {
+	s.opened <- gamepadIds
+	return nil
+}
+
+func (s *testSink) Write(state *message.GamepadState) error {
+	s.states <- state
+	return nil
+}
+
+func (s *testSink) Close() error {
+	return nil
+}
+
+// testServer plays the server side of one connection of the client.
+type testServer struct {
+	t       *testing.T
+	conn    net.Conn
+	rbufio  *bufio.Reader
+	framing string
+}
+
+func (s *testServer) write(msg *message.Message) {
+	msgBytes, err := json.Marshal(msg)
+	if err != nil {
+		s.t.Fatalf("can not marshal message: %v", err)
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := s.conn.Write(message.EncodeFrame(msgBytes, s.framing)); err != nil {
+		s.t.Fatalf("can not write message: %v", err)
+	}
+}
+
+func (s *testServer) read(msgType string) *message.Message {
+	s.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		msgBytes, err := message.ReadFrame(s.rbufio, s.framing, maxFrameSize)
+		if err != nil {
+			s.t.Fatalf("can not read message: %v", err)
+		}
+		var msg message.Message
+		if err := json.Unmarshal(msgBytes, &msg); err != nil {
+			s.t.Fatalf("can not unmarshal message: %v", err)
+		}
+		if msg.MsgType == message.MsgTypePing {
+			continue
+		}
+		if msg.MsgType != msgType {
+			s.t.Fatalf("unexpected message: got %v, want %v", msg.MsgType, msgType)
+		}
+		return &msg
+	}
+}
+
+// waitState waits for the state written to the sink, messages before it are already handled by the client.
+func waitState(t *testing.T, sink *testSink, gamepadId string) {
+	select {
+	case state := <-sink.states:
+		if state.GamepadId != gamepadId {
+			t.Fatalf("unexpected state: got %v, want %v", state.GamepadId, gamepadId)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("state is not written to the sink")
+	}
+}
+
+func TestClientSession(t *testing.T) {
+	const deviceId = "4b8e6c1e-2a6f-4f55-9d53-0f5f1c1e7a01"
+	const gamepadId = "gamepad-1"
+	tests := []struct {
+		name    string
+		framing string
+	}{
+		{ name: "line", framing: message.FramingLine },
+		{ name: "length", framing: message.FramingLength },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("can not listen: %v", err)
+			}
+			defer listener.Close()
+			sink := &testSink{
+				opened: make(chan []string, 1),
+				states: make(chan *message.GamepadState, 1),
+			}
+			client, err := NewClient(listener.Addr().String(), "secret", sink, ClientDeviceId(deviceId), ClientFraming(tt.framing))
+			if err != nil {
+				t.Fatalf("can not create client: %v", err)
+			}
+			if err := client.Start(); err != nil {
+				t.Fatalf("can not start client: %v", err)
+			}
+			defer client.Stop()
+			conn, err := listener.Accept()
+			if err != nil {
+				t.Fatalf("can not accept: %v", err)
+			}
+			defer conn.Close()
+			server := &testServer{ t: t, conn: conn, rbufio: bufio.NewReader(conn), framing: message.FramingLine }
+
+			// the handshake is framed by lines
+			reqMsg := server.read(message.MsgTypeGamepadHandshakeReq)
+			if reqMsg.GamepadHandshakeRequest.DeviceId != deviceId || reqMsg.GamepadHandshakeRequest.Digest != "" {
+				t.Fatalf("unexpected gpHandshakeReq: %+v", reqMsg.GamepadHandshakeRequest)
+			}
+			if reqMsg.GamepadHandshakeRequest.Framing != tt.framing {
+				t.Fatalf("unexpected framing: got %v, want %v", reqMsg.GamepadHandshakeRequest.Framing, tt.framing)
+			}
+			server.write(&message.Message{
+				MsgType: message.MsgTypeGamepadChallengeReq,
+				GamepadChallengeRequest: &message.GamepadChallengeRequest{ Nonce: "nonce" },
+			})
+			challengeMsg := server.read(message.MsgTypeGamepadChallengeRes)
+			if digest := message.ChallengeDigest("secret", "nonce", deviceId); challengeMsg.GamepadChallengeResponse.Digest != digest {
+				t.Fatalf("unexpected digest: got %v, want %v", challengeMsg.GamepadChallengeResponse.Digest, digest)
+			}
+			server.write(&message.Message{
+				MsgType: message.MsgTypeGamepadHandshakeRes,
+				GamepadHandshakeResponse: &message.GamepadHandshakeResponse{
+					GamepadId: gamepadId,
+					Framing:   tt.framing,
+				},
+			})
+			select {
+			case gamepadIds := <-sink.opened:
+				if len(gamepadIds) != 1 || gamepadIds[0] != gamepadId {
+					t.Fatalf("unexpected gamepad ids: got %v, want %v", gamepadIds, []string{ gamepadId })
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("sink is not opened")
+			}
+
+			// both sides switch to the negotiated framing
+			server.framing = tt.framing
+			for _, controllerId := range []string{ "controller-1", "controller-2" } {
+				server.write(&message.Message{
+					MsgType: message.MsgTypeGamepadConnectReq,
+					GamepadConnectRequest: &message.GamepadConnectRequest{
+						DelivererId:  "deliverer",
+						ControllerId: controllerId,
+						GamepadId:    gamepadId,
+					},
+				})
+				resMsg := server.read(message.MsgTypeGamepadConnectRes)
+				if resMsg.GamepadConnectResponse.ControllerId != controllerId {
+					t.Fatalf("unexpected gpConnectRes: got %v, want %v", resMsg.GamepadConnectResponse.ControllerId, controllerId)
+				}
+			}
+
+			// the release of the previous controller does not unbind the rebound gamepad
+			server.write(&message.Message{
+				MsgType: message.MsgTypeGamepadDisconnected,
+				GamepadDisconnected: &message.GamepadDisconnected{
+					DelivererId:  "deliverer",
+					ControllerId: "controller-1",
+					GamepadId:    gamepadId,
+				},
+			})
+			server.write(&message.Message{
+				MsgType:      message.MsgTypeGamepadState,
+				GamepadState: &message.GamepadState{ GamepadId: gamepadId },
+			})
+			waitState(t, sink, gamepadId)
+			if err := client.SendVibration(gamepadId, &message.GamepadVibration{ Duration: 100 }); err != nil {
+				t.Fatalf("can not send vibration: %v", err)
+			}
+			vibrationMsg := server.read(message.MsgTypeGamepadVibration)
+			if vibrationMsg.GamepadVibration.ControllerId != "controller-2" {
+				t.Fatalf("unexpected controller of gpVibration: got %v, want %v", vibrationMsg.GamepadVibration.ControllerId, "controller-2")
+			}
+
+			server.write(&message.Message{
+				MsgType: message.MsgTypeGamepadDisconnected,
+				GamepadDisconnected: &message.GamepadDisconnected{
+					DelivererId:  "deliverer",
+					ControllerId: "controller-2",
+					GamepadId:    gamepadId,
+				},
+			})
+			server.write(&message.Message{
+				MsgType:      message.MsgTypeGamepadState,
+				GamepadState: &message.GamepadState{ GamepadId: gamepadId },
+			})
+			waitState(t, sink, gamepadId)
+			if err := client.SendVibration(gamepadId, &message.GamepadVibration{ Duration: 100 }); err == nil {
+				t.Fatalf("vibration is sent to the released controller")
+			}
+		})
+	}
+}
+
+func TestClientHandshakeRejected(t *testing.T) {
+	sink := &testSink{
+		opened: make(chan []string, 1),
+		states: make(chan *message.GamepadState, 1),
+	}
+	// the client is not started, the handshake runs over the pipe
+	client, err := NewClient("127.0.0.1:0", "secret", sink, ClientFraming(message.FramingLength))
+	if err != nil {
+		t.Fatalf("can not create client: %v", err)
+	}
+	session := &clientSession{
+		writeFraming: message.FramingLine,
+		readFraming:  message.FramingLine,
+		bindings:     make(map[string]*message.GamepadConnectRequest),
+	}
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	session.conn = clientConn
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- client.handshake(session, bufio.NewReader(clientConn))
+	}()
+	server := &testServer{ t: t, conn: serverConn, rbufio: bufio.NewReader(serverConn), framing: message.FramingLine }
+	server.read(message.MsgTypeGamepadHandshakeReq)
+	server.write(&message.Message{
+		MsgType: message.MsgTypeGamepadHandshakeRes,
+		Error:   &message.Error{ Message: "invalid digest" },
+	})
+	select {
+	case err := <-errChan:
+		if err == nil {
+			t.Fatalf("rejected handshake is succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("handshake is not finished")
+	}
+	if session.readFraming != message.FramingLine || session.writeFraming != message.FramingLine {
+		t.Fatalf("framing is switched by the rejected handshake: %v, %v", session.readFraming, session.writeFraming)
+	}
+}
@@ -0,0 +1,66 @@
+//go:build linux
+
+package device
+
+import (
+	"fmt"
+	"syscall"
+	"github.com/potix/regapweb/message"
+)
+
+// HidGadgetSink emulates gamepads on the usb host by hid functions of the usb gadget,
+// such as /dev/hidg0 configured with HidGadgetReportDescriptor.
+// Gamepads are assigned to device paths in the order of virtual gamepads.
+type HidGadgetSink struct {
+	devicePaths []string
+	fds         map[string]int
+}
+
+func (h *HidGadgetSink) Open(gamepadIds []string) error {
+	if len(gamepadIds) > len(h.devicePaths) {
+		return fmt.Errorf("not enough hid devices: gamepads = %v, devices = %v", len(gamepadIds), len(h.devicePaths))
+	}
+	for i, gamepadId := range gamepadIds {
+		// the write must not block the client while the usb host does not poll the device
+		fd, err := syscall.Open(h.devicePaths[i], syscall.O_WRONLY|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+		if err != nil {
+			h.Close()
+			return fmt.Errorf("can not open hid device: %v, %w", h.devicePaths[i], err)
+		}
+		h.fds[gamepadId] = fd
+	}
+	return nil
+}
+
+func (h *HidGadgetSink) Write(state *message.GamepadState) error {
+	fd, ok := h.fds[state.GamepadId]
+	if !ok {
+		return fmt.Errorf("no hid device: %v", state.GamepadId)
+	}
+	if _, err := syscall.Write(fd, newHidReport(state)); err != nil {
+		if err == syscall.EAGAIN || err == syscall.ESHUTDOWN {
+			// the usb host is not connected or does not read reports, the next state supersedes it
+			return nil
+		}
+		return fmt.Errorf("can not write hid report: %w", err)
+	}
+	return nil
+}
+
+func (h *HidGadgetSink) Close() error {
+	for gamepadId, fd := range h.fds {
+		syscall.Close(fd)
+		delete(h.fds, gamepadId)
+	}
+	return nil
+}
+
+func NewHidGadgetSink(devicePaths []string) (*HidGadgetSink, error) {
+	if len(devicePaths) == 0 {
+		return nil, fmt.Errorf("no hid device")
+	}
+	return &HidGadgetSink{
+		devicePaths: devicePaths,
+		fds:         make(map[string]int),
+	}, nil
+}
@@ -0,0 +1,66 @@
+package device
+
+import (
+	"github.com/potix/regapweb/message"
+)
+
+// the size of the input report of HidGadgetReportDescriptor
+const hidReportSize int = 9
+
+// HidGadgetReportDescriptor is the report descriptor of the gamepad emulated by HidGadgetSink.
+// Write it to report_desc of the hid function of the usb gadget, with 9 of report_length.
+// The report has 17 buttons of the standard mapping, 4 axes of sticks and 2 analog triggers.
+var HidGadgetReportDescriptor = []byte{
+	0x05, 0x01,       // Usage Page (Generic Desktop)
+	0x09, 0x05,       // Usage (Game Pad)
+	0xa1, 0x01,       // Collection (Application)
+	0x05, 0x09,       //   Usage Page (Button)
+	0x19, 0x01,       //   Usage Minimum (1)
+	0x29, 0x11,       //   Usage Maximum (17)
+	0x15, 0x00,       //   Logical Minimum (0)
+	0x25, 0x01,       //   Logical Maximum (1)
+	0x75, 0x01,       //   Report Size (1)
+	0x95, 0x11,       //   Report Count (17)
+	0x81, 0x02,       //   Input (Data, Variable, Absolute)
+	0x75, 0x01,       //   Report Size (1)
+	0x95, 0x07,       //   Report Count (7)
+	0x81, 0x03,       //   Input (Constant, Variable, Absolute)
+	0x05, 0x01,       //   Usage Page (Generic Desktop)
+	0x09, 0x30,       //   Usage (X)
+	0x09, 0x31,       //   Usage (Y)
+	0x09, 0x33,       //   Usage (Rx)
+	0x09, 0x34,       //   Usage (Ry)
+	0x15, 0x81,       //   Logical Minimum (-127)
+	0x25, 0x7f,       //   Logical Maximum (127)
+	0x75, 0x08,       //   Report Size (8)
+	0x95, 0x04,       //   Report Count (4)
+	0x81, 0x02,       //   Input (Data, Variable, Absolute)
+	0x09, 0x32,       //   Usage (Z)
+	0x09, 0x35,       //   Usage (Rz)
+	0x15, 0x00,       //   Logical Minimum (0)
+	0x26, 0xff, 0x00, //   Logical Maximum (255)
+	0x75, 0x08,       //   Report Size (8)
+	0x95, 0x02,       //   Report Count (2)
+	0x81, 0x02,       //   Input (Data, Variable, Absolute)
+	0xc0,             // End Collection
+}
+
+// newHidReport encodes the state to the input report of HidGadgetReportDescriptor.
+func newHidReport(state *message.GamepadState) []byte {
+	report := make([]byte, hidReportSize)
+	for i := 0; i < standardButtonCount; i++ {
+		button := standardGamepadButton(state, i)
+		if button != nil && button.Pressed {
+			report[i / 8] |= 1 << uint(i % 8)
+		}
+	}
+	for i := 0; i < standardAxisCount; i++ {
+		report[3 + i] = byte(int8(clampAxis(standardGamepadAxis(state, i)) * 127))
+	}
+	for i, index := range []int{ standardButtonTriggerLeft, standardButtonTriggerRight } {
+		if button := standardGamepadButton(state, index); button != nil {
+			report[7 + i] = byte(clampTrigger(button.Value) * 255)
+		}
+	}
+	return report
+}
@@ -0,0 +1,101 @@
+package device
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"github.com/potix/regapweb/message"
+)
+
+// Sink outputs states of gamepads to the host that the device emulates gamepads for.
+// Methods are called from one goroutine of the client.
+type Sink interface {
+	// Open prepares outputs after the handshake, ids are in the order of virtual gamepads.
+	Open(gamepadIds []string) error
+	// Write outputs the state of the gamepad.
+	Write(state *message.GamepadState) error
+	// Close releases outputs after the connection is lost.
+	Close() error
+}
+
+// LogSink logs states of gamepads when they are changed, for the development of devices.
+type LogSink struct {
+	lastStates map[string]string
+}
+
+func (l *LogSink) Open(gamepadIds []string) error {
+	l.lastStates = make(map[string]string)
+	log.Printf("open gamepads: %v", gamepadIds)
+	return nil
+}
+
+func (l *LogSink) Write(state *message.GamepadState) error {
+	stateBytes, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if l.lastStates[state.GamepadId] == string(stateBytes) {
+		return nil
+	}
+	l.lastStates[state.GamepadId] = string(stateBytes)
+	log.Printf("gamepad state: %v", string(stateBytes))
+	return nil
+}
+
+func (l *LogSink) Close() error {
+	log.Printf("close gamepads")
+	return nil
+}
+
+func NewLogSink() *LogSink {
+	return &LogSink{
+		lastStates: make(map[string]string),
+	}
+}
+
+// standardGamepadButton returns the state of the button of the standard mapping, or nil if the state does not have it.
+func standardGamepadButton(state *message.GamepadState, index int) *message.GamepadButtonState {
+	if index >= len(state.Buttons) {
+		return nil
+	}
+	return state.Buttons[index]
+}
+
+func standardGamepadAxis(state *message.GamepadState, index int) float64 {
+	if index >= len(state.Axes) {
+		return 0
+	}
+	return state.Axes[index]
+}
+
+// clampAxis clamps the axis to -1..1, the server normalizes states only for gamepads declaring capabilities.
+func clampAxis(value float64) float64 {
+	if math.IsNaN(value) {
+		return 0
+	}
+	if value < -1 {
+		return -1
+	}
+	if value > 1 {
+		return 1
+	}
+	return value
+}
+
+func clampTrigger(value float64) float64 {
+	if value < 0 || math.IsNaN(value) {
+		return 0
+	}
+	if value > 1 {
+		return 1
+	}
+	return value
+}
+
+// indexes of the standard mapping of the gamepad api
+const (
+	standardButtonTriggerLeft  int = 6
+	standardButtonTriggerRight int = 7
+	standardButtonCount        int = 17
+	standardAxisCount          int = 4
+)
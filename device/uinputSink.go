@@ -0,0 +1,209 @@
+//go:build linux
+
+package device
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+	"github.com/potix/regapweb/message"
+)
+
+// ioctls of linux/uinput.h
+const (
+	uinputSetEvBit   uintptr = 0x40045564
+	uinputSetKeyBit  uintptr = 0x40045565
+	uinputSetAbsBit  uintptr = 0x40045567
+	uinputDevCreate  uintptr = 0x5501
+	uinputDevDestroy uintptr = 0x5502
+)
+
+// codes of linux/input-event-codes.h
+const (
+	inputEvSyn     uint16 = 0x00
+	inputEvKey     uint16 = 0x01
+	inputEvAbs     uint16 = 0x03
+	inputSynReport uint16 = 0x00
+	inputAbsX      uint16 = 0x00
+	inputAbsY      uint16 = 0x01
+	inputAbsZ      uint16 = 0x02
+	inputAbsRx     uint16 = 0x03
+	inputAbsRy     uint16 = 0x04
+	inputAbsRz     uint16 = 0x05
+	inputAbsCount  int    = 0x40
+	inputBusVirtual uint16 = 0x06
+)
+
+// key codes of buttons in the standard mapping
+var uinputButtonCodes = [standardButtonCount]uint16{
+	0x130, // BTN_SOUTH
+	0x131, // BTN_EAST
+	0x134, // BTN_WEST
+	0x133, // BTN_NORTH
+	0x136, // BTN_TL
+	0x137, // BTN_TR
+	0x138, // BTN_TL2
+	0x139, // BTN_TR2
+	0x13a, // BTN_SELECT
+	0x13b, // BTN_START
+	0x13d, // BTN_THUMBL
+	0x13e, // BTN_THUMBR
+	0x220, // BTN_DPAD_UP
+	0x221, // BTN_DPAD_DOWN
+	0x222, // BTN_DPAD_LEFT
+	0x223, // BTN_DPAD_RIGHT
+	0x13c, // BTN_MODE
+}
+
+// abs codes of axes in the standard mapping
+var uinputAxisCodes = [standardAxisCount]uint16{ inputAbsX, inputAbsY, inputAbsRx, inputAbsRy }
+
+// uinputUserDev is struct uinput_user_dev.
+type uinputUserDev struct {
+	Name         [80]byte
+	Bustype      uint16
+	Vendor       uint16
+	Product      uint16
+	Version      uint16
+	FfEffectsMax uint32
+	Absmax       [inputAbsCount]int32
+	Absmin       [inputAbsCount]int32
+	Absfuzz      [inputAbsCount]int32
+	Absflat      [inputAbsCount]int32
+}
+
+// inputEvent is struct input_event, the size of the time depends on the architecture.
+type inputEvent struct {
+	Time  syscall.Timeval
+	Type  uint16
+	Code  uint16
+	Value int32
+}
+
+func uinputIoctl(file *os.File, request uintptr, arg uintptr) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), request, arg)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// UinputSink emulates gamepads on the linux host running the daemon by uinput.
+// Each gamepad is a virtual input device with buttons and axes of the standard mapping.
+type UinputSink struct {
+	name       string
+	devicePath string
+	files      map[string]*os.File
+}
+
+func (u *UinputSink) create(name string) (*os.File, error) {
+	file, err := os.OpenFile(u.devicePath, os.O_WRONLY, 0)
+	if err != nil {
+		return nil, fmt.Errorf("can not open uinput: %w", err)
+	}
+	ioctls := [][2]uintptr{
+		{ uinputSetEvBit, uintptr(inputEvKey) },
+		{ uinputSetEvBit, uintptr(inputEvAbs) },
+	}
+	for _, code := range uinputButtonCodes {
+		ioctls = append(ioctls, [2]uintptr{ uinputSetKeyBit, uintptr(code) })
+	}
+	userDev := &uinputUserDev{
+		Bustype: inputBusVirtual,
+		Version: 1,
+	}
+	copy(userDev.Name[:len(userDev.Name) - 1], name)
+	for _, code := range uinputAxisCodes {
+		ioctls = append(ioctls, [2]uintptr{ uinputSetAbsBit, uintptr(code) })
+		userDev.Absmin[code] = -32767
+		userDev.Absmax[code] = 32767
+	}
+	for _, code := range []uint16{ inputAbsZ, inputAbsRz } {
+		ioctls = append(ioctls, [2]uintptr{ uinputSetAbsBit, uintptr(code) })
+		userDev.Absmax[code] = 255
+	}
+	for _, ioctl := range ioctls {
+		if err := uinputIoctl(file, ioctl[0], ioctl[1]); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("can not setup uinput: %w", err)
+		}
+	}
+	userDevBytes := (*[unsafe.Sizeof(uinputUserDev{})]byte)(unsafe.Pointer(userDev))[:]
+	if _, err := file.Write(userDevBytes); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("can not write uinput device: %w", err)
+	}
+	if err := uinputIoctl(file, uinputDevCreate, 0); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("can not create uinput device: %w", err)
+	}
+	return file, nil
+}
+
+func (u *UinputSink) Open(gamepadIds []string) error {
+	for i, gamepadId := range gamepadIds {
+		file, err := u.create(fmt.Sprintf("%v %v", u.name, i + 1))
+		if err != nil {
+			u.Close()
+			return err
+		}
+		u.files[gamepadId] = file
+	}
+	return nil
+}
+
+func (u *UinputSink) Write(state *message.GamepadState) error {
+	file, ok := u.files[state.GamepadId]
+	if !ok {
+		return fmt.Errorf("no uinput device: %v", state.GamepadId)
+	}
+	events := make([]inputEvent, 0, standardButtonCount + standardAxisCount + 3)
+	for i, code := range uinputButtonCodes {
+		value := int32(0)
+		if button := standardGamepadButton(state, i); button != nil && button.Pressed {
+			value = 1
+		}
+		events = append(events, inputEvent{ Type: inputEvKey, Code: code, Value: value })
+	}
+	for i, code := range uinputAxisCodes {
+		value := int32(clampAxis(standardGamepadAxis(state, i)) * 32767)
+		events = append(events, inputEvent{ Type: inputEvAbs, Code: code, Value: value })
+	}
+	for i, code := range []uint16{ inputAbsZ, inputAbsRz } {
+		value := int32(0)
+		if button := standardGamepadButton(state, standardButtonTriggerLeft + i); button != nil {
+			value = int32(clampTrigger(button.Value) * 255)
+		}
+		events = append(events, inputEvent{ Type: inputEvAbs, Code: code, Value: value })
+	}
+	// the input core drops events that do not change values
+	events = append(events, inputEvent{ Type: inputEvSyn, Code: inputSynReport })
+	eventsSize := len(events) * int(unsafe.Sizeof(inputEvent{}))
+	eventsBytes := unsafe.Slice((*byte)(unsafe.Pointer(&events[0])), eventsSize)
+	if _, err := file.Write(eventsBytes); err != nil {
+		return fmt.Errorf("can not write uinput events: %w", err)
+	}
+	return nil
+}
+
+func (u *UinputSink) Close() error {
+	for gamepadId, file := range u.files {
+		uinputIoctl(file, uinputDevDestroy, 0)
+		file.Close()
+		delete(u.files, gamepadId)
+	}
+	return nil
+}
+
+// NewUinputSink creates the sink of uinput, virtual devices are named by the name and the index of the gamepad.
+func NewUinputSink(name string, devicePath string) (*UinputSink, error) {
+	if devicePath == "" {
+		devicePath = "/dev/uinput"
+	}
+	return &UinputSink{
+		name:       name,
+		devicePath: devicePath,
+		files:      make(map[string]*os.File),
+	}, nil
+}
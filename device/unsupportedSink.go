@@ -0,0 +1,47 @@
+//go:build !linux
+
+package device
+
+import (
+	"fmt"
+	"runtime"
+	"github.com/potix/regapweb/message"
+)
+
+// UinputSink is available only on linux.
+type UinputSink struct{}
+
+func (u *UinputSink) Open(gamepadIds []string) error {
+	return fmt.Errorf("uinput is not supported on %v", runtime.GOOS)
+}
+
+func (u *UinputSink) Write(state *message.GamepadState) error {
+	return fmt.Errorf("uinput is not supported on %v", runtime.GOOS)
+}
+
+func (u *UinputSink) Close() error {
+	return nil
+}
+
+func NewUinputSink(name string, devicePath string) (*UinputSink, error) {
+	return nil, fmt.Errorf("uinput is not supported on %v", runtime.GOOS)
+}
+
+// HidGadgetSink is available only on linux.
+type HidGadgetSink struct{}
+
+func (h *HidGadgetSink) Open(gamepadIds []string) error {
+	return fmt.Errorf("usb gadget is not supported on %v", runtime.GOOS)
+}
+
+func (h *HidGadgetSink) Write(state *message.GamepadState) error {
+	return fmt.Errorf("usb gadget is not supported on %v", runtime.GOOS)
+}
+
+func (h *HidGadgetSink) Close() error {
+	return nil
+}
+
+func NewHidGadgetSink(devicePaths []string) (*HidGadgetSink, error) {
+	return nil, fmt.Errorf("usb gadget is not supported on %v", runtime.GOOS)
+}
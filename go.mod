@@ -9,6 +9,7 @@ require (
 	github.com/potix/utils/configurator v0.0.0-20230227071827-76c10ec5df3c
 	github.com/potix/utils/server v0.0.0-20230227071827-76c10ec5df3c
 	github.com/potix/utils/signal v0.0.0-20230227071827-76c10ec5df3c
+	go.etcd.io/bbolt v1.3.7
 )
 
 require (
@@ -20,7 +21,6 @@ require (
 	github.com/go-playground/universal-translator v0.18.1 // indirect
 	github.com/go-playground/validator/v10 v10.11.2 // indirect
 	github.com/goccy/go-json v0.10.0 // indirect
-	github.com/golang/protobuf v1.5.2 // indirect
 	github.com/json-iterator/go v1.1.12 // indirect
 	github.com/klauspost/cpuid/v2 v2.2.4 // indirect
 	github.com/leodido/go-urn v1.2.1 // indirect
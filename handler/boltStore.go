@@ -0,0 +1,417 @@
+package handler
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+	"github.com/potix/regapweb/message"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltDevicesBucket = []byte("devices")
+	boltHistoryBucket = []byte("history")
+)
+
+const (
+	historyEventAdd     string = "add"
+	historyEventDelete         = "delete"
+	historyEventReserve        = "reserve"
+	historyEventOccupy         = "occupy"
+	historyEventRelease        = "release"
+)
+
+// the number of writes queued to the writer of the bolt database
+const boltWriteQueueSize int = 1024
+
+// the upper limit of writes committed in one transaction
+const boltWriteBatchSize int = 128
+
+type boltWrite struct {
+	update    func(tx *bolt.Tx) error
+	// closed after the transaction of the write is committed
+	committed chan struct{}
+}
+
+type DeviceRecord struct {
+	ClientType string
+	ClientId   string
+	Name       string
+	FirstSeen  int64
+	LastSeen   int64
+	Metadata   *message.ClientMetadata `json:"Metadata,omitempty"`
+}
+
+type HistoryRecord struct {
+	Time         int64
+	Event        string
+	ClientType   string
+	ClientId     string
+	DelivererId  string
+	ControllerId string
+}
+
+// ClientsHistory reads gamepads and history persisted by the clients store.
+type ClientsHistory interface {
+	GetDevices() ([]*DeviceRecord, error)
+	GetHistory(limit int) ([]*HistoryRecord, error)
+}
+
+// BoltClientsStore is the ClientsStore that keeps live clients in memory
+// and persists names and last seen times of gamepads and history to the bolt database.
+// Deliverers and controllers are not persisted as devices, their ids are random for each session.
+// Writes are committed in batches by the background writer, so that store operations never wait for the disk.
+type BoltClientsStore struct {
+	*MemoryClientsStore
+	verbose      bool
+	historyLimit int
+	db           *bolt.DB
+	writeMutex   sync.Mutex
+	writeClosed  bool
+	writeChan    chan *boltWrite
+	writeDone    chan struct{}
+}
+
+// write queues the update to the writer, and returns false if the store is closed.
+func (b *BoltClientsStore) write(update func(tx *bolt.Tx) error) bool {
+	return b.enqueueWrite(&boltWrite{ update: update })
+}
+
+func (b *BoltClientsStore) enqueueWrite(w *boltWrite) bool {
+	b.writeMutex.Lock()
+	defer b.writeMutex.Unlock()
+	if b.writeClosed {
+		return false
+	}
+	// it waits only while the writer is behind by the queue size
+	b.writeChan <- w
+	return true
+}
+
+// flush waits for writes queued before it to be committed.
+func (b *BoltClientsStore) flush() {
+	w := &boltWrite{ committed: make(chan struct{}) }
+	if b.enqueueWrite(w) {
+		<-w.committed
+	}
+}
+
+func (b *BoltClientsStore) writeLoop() {
+	defer close(b.writeDone)
+	for w := range b.writeChan {
+		writes := []*boltWrite{ w }
+	batch:
+		for len(writes) < boltWriteBatchSize {
+			select {
+			case w, ok := <-b.writeChan:
+				if !ok {
+					break batch
+				}
+				writes = append(writes, w)
+			default:
+				break batch
+			}
+		}
+		err := b.db.Update(func(tx *bolt.Tx) error {
+			for _, w := range writes {
+				if w.update == nil {
+					continue
+				}
+				if err := w.update(tx); err != nil {
+					log.Printf("can not write to bolt database: %v", err)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("can not commit to bolt database: %v", err)
+		}
+		for _, w := range writes {
+			if w.committed != nil {
+				close(w.committed)
+			}
+		}
+	}
+}
+
+func (b *BoltClientsStore) updateDevice(clientType string, clientId string, clientName string, metadata *message.ClientMetadata) {
+	b.write(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltDevicesBucket)
+		now := time.Now().Unix()
+		record := &DeviceRecord{
+			ClientType: clientType,
+			ClientId:   clientId,
+			FirstSeen:  now,
+		}
+		recordBytes := bucket.Get([]byte(clientId))
+		if recordBytes != nil {
+			if err := json.Unmarshal(recordBytes, record); err != nil {
+				return fmt.Errorf("can not unmarshal device record: %w", err)
+			}
+		}
+		if clientName != "" {
+			record.Name = clientName
+		}
+		if metadata != nil {
+			record.Metadata = metadata
+		}
+		record.LastSeen = now
+		newRecordBytes, err := json.Marshal(record)
+		if err != nil {
+			return fmt.Errorf("can not marshal device record: %w", err)
+		}
+		if err := bucket.Put([]byte(clientId), newRecordBytes); err != nil {
+			return fmt.Errorf("can not put device record: %w", err)
+		}
+		return nil
+	})
+}
+
+func (b *BoltClientsStore) addHistory(event string, clientType string, clientId string, delivererId string, controllerId string) {
+	b.write(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltHistoryBucket)
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return fmt.Errorf("can not get next sequence: %w", err)
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+		record := &HistoryRecord{
+			Time:         time.Now().Unix(),
+			Event:        event,
+			ClientType:   clientType,
+			ClientId:     clientId,
+			DelivererId:  delivererId,
+			ControllerId: controllerId,
+		}
+		recordBytes, err := json.Marshal(record)
+		if err != nil {
+			return fmt.Errorf("can not marshal history record: %w", err)
+		}
+		if err := bucket.Put(key, recordBytes); err != nil {
+			return fmt.Errorf("can not put history record: %w", err)
+		}
+		if b.historyLimit <= 0 {
+			return nil
+		}
+		// drop oldest records
+		if seq <= uint64(b.historyLimit) {
+			return nil
+		}
+		oldest := seq - uint64(b.historyLimit)
+		oldKeys := make([][]byte, 0)
+		cursor := bucket.Cursor()
+		for k, _ := cursor.First(); k != nil && binary.BigEndian.Uint64(k) <= oldest; k, _ = cursor.Next() {
+			oldKeys = append(oldKeys, k)
+		}
+		for _, k := range oldKeys {
+			if err := bucket.Delete(k); err != nil {
+				return fmt.Errorf("can not delete history record: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+// storedName returns the persisted name if the client does not declare its name.
+func (b *BoltClientsStore) storedName(clientId string, clientName string) string {
+	if clientName != "" {
+		return clientName
+	}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		recordBytes := tx.Bucket(boltDevicesBucket).Get([]byte(clientId))
+		if recordBytes == nil {
+			return nil
+		}
+		var record DeviceRecord
+		if err := json.Unmarshal(recordBytes, &record); err != nil {
+			return fmt.Errorf("can not unmarshal device record: %w", err)
+		}
+		clientName = record.Name
+		return nil
+	})
+	if err != nil {
+		log.Printf("can not get stored name: %v", err)
+	}
+	return clientName
+}
+
+func (b *BoltClientsStore) AddDeliverer(clientId string, clientName string, room string, metadata *message.ClientMetadata) {
+	b.MemoryClientsStore.AddDeliverer(clientId, clientName, room, metadata)
+	b.addHistory(historyEventAdd, message.ClientTypeDeliverer, clientId, "", "")
+}
+
+func (b *BoltClientsStore) AddController(clientId string, clientName string, room string, metadata *message.ClientMetadata) {
+	b.MemoryClientsStore.AddController(clientId, clientName, room, metadata)
+	b.addHistory(historyEventAdd, message.ClientTypeController, clientId, "", "")
+}
+
+func (b *BoltClientsStore) AddGamepad(clientId string, clientName string, room string, metadata *message.ClientMetadata) {
+	clientName = b.storedName(clientId, clientName)
+	b.MemoryClientsStore.AddGamepad(clientId, clientName, room, metadata)
+	b.updateDevice(message.ClientTypeGamepad, clientId, clientName, metadata)
+	b.addHistory(historyEventAdd, message.ClientTypeGamepad, clientId, "", "")
+}
+
+func (b *BoltClientsStore) DeleteDeliverer(clientId string) {
+	b.MemoryClientsStore.DeleteDeliverer(clientId)
+	b.addHistory(historyEventDelete, message.ClientTypeDeliverer, clientId, "", "")
+}
+
+func (b *BoltClientsStore) DeleteController(clientId string) {
+	b.MemoryClientsStore.DeleteController(clientId)
+	b.addHistory(historyEventDelete, message.ClientTypeController, clientId, "", "")
+}
+
+func (b *BoltClientsStore) DeleteGamepad(clientId string) {
+	b.MemoryClientsStore.DeleteGamepad(clientId)
+	b.updateDevice(message.ClientTypeGamepad, clientId, "", nil)
+	b.addHistory(historyEventDelete, message.ClientTypeGamepad, clientId, "", "")
+}
+
+func (b *BoltClientsStore) ReserveGamepad(gamepadId string, delivererId string, controllerId string) error {
+	err := b.MemoryClientsStore.ReserveGamepad(gamepadId, delivererId, controllerId)
+	if err != nil {
+		return err
+	}
+	b.addHistory(historyEventReserve, message.ClientTypeGamepad, gamepadId, delivererId, controllerId)
+	return nil
+}
+
+func (b *BoltClientsStore) OccupyGamepad(gamepadId string, delivererId string, controllerId string) error {
+	err := b.MemoryClientsStore.OccupyGamepad(gamepadId, delivererId, controllerId)
+	if err != nil {
+		return err
+	}
+	b.addHistory(historyEventOccupy, message.ClientTypeGamepad, gamepadId, delivererId, controllerId)
+	return nil
+}
+
+func (b *BoltClientsStore) ReleaseGamepad(gamepadId string, delivererId string, controllerId string) {
+	if !b.MemoryClientsStore.releaseGamepad(gamepadId, delivererId, controllerId) {
+		return
+	}
+	b.addHistory(historyEventRelease, message.ClientTypeGamepad, gamepadId, delivererId, controllerId)
+}
+
+func (b *BoltClientsStore) ReleaseGamepadsByClient(clientId string) {
+	for _, gamepad := range b.MemoryClientsStore.releaseGamepadsByClient(clientId) {
+		b.addHistory(historyEventRelease, message.ClientTypeGamepad, gamepad.Id, gamepad.DelivererId, gamepad.ControllerId)
+	}
+}
+
+// GetDevices returns all persisted gamepads including disconnected ones.
+func (b *BoltClientsStore) GetDevices() ([]*DeviceRecord, error) {
+	b.flush()
+	records := make([]*DeviceRecord, 0)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltDevicesBucket).ForEach(func(k, v []byte) error {
+			record := new(DeviceRecord)
+			if err := json.Unmarshal(v, record); err != nil {
+				return fmt.Errorf("can not unmarshal device record: %w", err)
+			}
+			records = append(records, record)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("can not get devices: %w", err)
+	}
+	return records, nil
+}
+
+// GetHistory returns the latest history records in chronological order.
+func (b *BoltClientsStore) GetHistory(limit int) ([]*HistoryRecord, error) {
+	b.flush()
+	records := make([]*HistoryRecord, 0)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(boltHistoryBucket).Cursor()
+		for k, v := cursor.Last(); k != nil && (limit <= 0 || len(records) < limit); k, v = cursor.Prev() {
+			record := new(HistoryRecord)
+			if err := json.Unmarshal(v, record); err != nil {
+				return fmt.Errorf("can not unmarshal history record: %w", err)
+			}
+			records = append(records, record)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("can not get history: %w", err)
+	}
+	for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+		records[i], records[j] = records[j], records[i]
+	}
+	return records, nil
+}
+
+// Close commits queued writes and closes the database.
+func (b *BoltClientsStore) Close() error {
+	b.writeMutex.Lock()
+	if !b.writeClosed {
+		b.writeClosed = true
+		close(b.writeChan)
+	}
+	b.writeMutex.Unlock()
+	<-b.writeDone
+	return b.db.Close()
+}
+
+// pruneClientRecords deletes records of deliverers and controllers persisted by older versions.
+func pruneClientRecords(bucket *bolt.Bucket) error {
+	oldKeys := make([][]byte, 0)
+	err := bucket.ForEach(func(k, v []byte) error {
+		var record DeviceRecord
+		if err := json.Unmarshal(v, &record); err != nil || record.ClientType != message.ClientTypeGamepad {
+			oldKeys = append(oldKeys, k)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("can not scan device records: %w", err)
+	}
+	for _, k := range oldKeys {
+		if err := bucket.Delete(k); err != nil {
+			return fmt.Errorf("can not delete device record: %w", err)
+		}
+	}
+	return nil
+}
+
+func NewBoltClientsStore(dbPath string, opts ...ClientsStoreOption) (*BoltClientsStore, error) {
+	baseOpts := defaultClientsStoreOptions()
+	for _, opt := range opts {
+		if opt == nil {
+			continue
+		}
+		opt(baseOpts)
+	}
+	db, err := bolt.Open(dbPath, 0600, &bolt.Options{ Timeout: 5 * time.Second })
+	if err != nil {
+		return nil, fmt.Errorf("can not open bolt database: %w", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{ boltDevicesBucket, boltHistoryBucket } {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return fmt.Errorf("can not create bucket %s: %w", name, err)
+			}
+		}
+		return pruneClientRecords(tx.Bucket(boltDevicesBucket))
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("can not initialize bolt database: %w", err)
+	}
+	b := &BoltClientsStore{
+		MemoryClientsStore: NewMemoryClientsStore(opts...),
+		verbose:            baseOpts.verbose,
+		historyLimit:       baseOpts.historyLimit,
+		db:                 db,
+		writeChan:          make(chan *boltWrite, boltWriteQueueSize),
+		writeDone:          make(chan struct{}),
+	}
+	go b.writeLoop()
+	return b, nil
+}
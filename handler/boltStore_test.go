@@ -0,0 +1,76 @@
+package handler
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"github.com/potix/regapweb/message"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestBoltClientsStoreDevices(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "clients.db")
+	store, err := NewBoltClientsStore(dbPath)
+	if err != nil {
+		t.Fatalf("can not create store: %v", err)
+	}
+	store.AddDeliverer("d1", "deliverer", message.DefaultRoom, nil)
+	store.AddController("c1", "controller", message.DefaultRoom, nil)
+	store.AddGamepad("g1", "gamepad", message.DefaultRoom, nil)
+	store.DeleteDeliverer("d1")
+	store.DeleteController("c1")
+	store.DeleteGamepad("g1")
+	devices, err := store.GetDevices()
+	if err != nil {
+		t.Fatalf("can not get devices: %v", err)
+	}
+	if len(devices) != 1 || devices[0].ClientId != "g1" || devices[0].Name != "gamepad" {
+		t.Fatalf("unexpected devices: %+v", devices)
+	}
+	history, err := store.GetHistory(0)
+	if err != nil {
+		t.Fatalf("can not get history: %v", err)
+	}
+	if len(history) != 6 {
+		t.Fatalf("unexpected history: %+v", history)
+	}
+	// the gamepad without the name gets the persisted name
+	store.AddGamepad("g1", "", message.DefaultRoom, nil)
+	if clnt := store.GetClient(message.ClientTypeGamepad, "g1"); clnt == nil || clnt.Name != "gamepad" {
+		t.Fatalf("unexpected gamepad: %+v", clnt)
+	}
+	store.Close()
+}
+
+func TestBoltClientsStorePruneClientRecords(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "clients.db")
+	store, err := NewBoltClientsStore(dbPath)
+	if err != nil {
+		t.Fatalf("can not create store: %v", err)
+	}
+	store.AddGamepad("g1", "gamepad", message.DefaultRoom, nil)
+	// the record of the controller persisted by older versions
+	err = store.db.Update(func(tx *bolt.Tx) error {
+		recordBytes, err := json.Marshal(&DeviceRecord{ ClientType: message.ClientTypeController, ClientId: "c1" })
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(boltDevicesBucket).Put([]byte("c1"), recordBytes)
+	})
+	if err != nil {
+		t.Fatalf("can not put record: %v", err)
+	}
+	store.Close()
+	store, err = NewBoltClientsStore(dbPath)
+	if err != nil {
+		t.Fatalf("can not reopen store: %v", err)
+	}
+	defer store.Close()
+	devices, err := store.GetDevices()
+	if err != nil {
+		t.Fatalf("can not get devices: %v", err)
+	}
+	if len(devices) != 1 || devices[0].ClientId != "g1" {
+		t.Fatalf("unexpected devices: %+v", devices)
+	}
+}
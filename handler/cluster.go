@@ -0,0 +1,735 @@
+package handler
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"sync"
+	"time"
+	"github.com/google/uuid"
+	"github.com/potix/regapweb/message"
+)
+
+type clusterOptions struct {
+	verbose          bool
+	presenceInterval time.Duration
+	requestTimeout   time.Duration
+}
+
+func defaultClusterOptions() *clusterOptions {
+	return &clusterOptions{
+		verbose:          false,
+		presenceInterval: 3 * time.Second,
+		requestTimeout:   5 * time.Second,
+	}
+}
+
+type ClusterOption func(*clusterOptions)
+
+func ClusterVerbose(verbose bool) ClusterOption {
+	return func(opts *clusterOptions) {
+		opts.verbose = verbose
+	}
+}
+
+// ClusterPresenceInterval sets the interval of presence announcements.
+// Presence of a node is expired if it is not announced for three intervals.
+func ClusterPresenceInterval(presenceInterval time.Duration) ClusterOption {
+	return func(opts *clusterOptions) {
+		opts.presenceInterval = presenceInterval
+	}
+}
+
+func ClusterRequestTimeout(requestTimeout time.Duration) ClusterOption {
+	return func(opts *clusterOptions) {
+		opts.requestTimeout = requestTimeout
+	}
+}
+
+type OnClusterSignaling func(fromNodeId string, targetClientId string, sourceClientId string, msg *message.Message)
+
+type OnClusterForward func(msg *message.Message) error
+
+type remoteNode struct {
+	presence *message.ClusterPresence
+	lastSeen time.Time
+}
+
+type clusterSubscription struct {
+	localSubscriptionId int
+	onEvent             OnClientsEvent
+}
+
+// Cluster shares presence between regapweb nodes and routes messages
+// to the node that owns the target connection.
+type Cluster struct {
+	verbose           bool
+	nodeId            string
+	presenceInterval  time.Duration
+	requestTimeout    time.Duration
+	bus               ClusterBus
+	localStore        ClientsStore
+	remoteNodesMutex  sync.Mutex
+	remoteNodes       map[string]*remoteNode
+	requestsMutex     sync.Mutex
+	requests          map[string]chan *message.ClusterMessage
+	handlersMutex     sync.Mutex
+	onSignaling       OnClusterSignaling
+	onFromWs          OnClusterForward
+	onFromTcp         OnClusterForward
+	subscribersMutex  sync.Mutex
+	subscribers       map[int]*clusterSubscription
+	nextSubscriptionId int
+	// changes of local clients are coalesced into the next announcement
+	announceChan      chan struct{}
+	stopChan          chan int
+}
+
+func (c *Cluster) NodeId() string {
+	return c.nodeId
+}
+
+func (c *Cluster) SetSignalingHandler(fn OnClusterSignaling) {
+	c.handlersMutex.Lock()
+	defer c.handlersMutex.Unlock()
+	c.onSignaling = fn
+}
+
+func (c *Cluster) SetFromWsHandler(fn OnClusterForward) {
+	c.handlersMutex.Lock()
+	defer c.handlersMutex.Unlock()
+	c.onFromWs = fn
+}
+
+func (c *Cluster) SetFromTcpHandler(fn OnClusterForward) {
+	c.handlersMutex.Lock()
+	defer c.handlersMutex.Unlock()
+	c.onFromTcp = fn
+}
+
+func (c *Cluster) Start() error {
+	err := c.bus.Start(c.onMessage)
+	if err != nil {
+		return fmt.Errorf("can not start cluster bus: %w", err)
+	}
+	go c.presenceLoop()
+	return nil
+}
+
+func (c *Cluster) Stop() {
+	close(c.stopChan)
+	c.bus.Stop()
+}
+
+func (c *Cluster) presenceLoop() {
+	ticker := time.NewTicker(c.presenceInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.announce()
+			c.expireRemoteNodes()
+		case <-c.announceChan:
+			c.announce()
+		case <-c.stopChan:
+			return
+		}
+	}
+}
+
+// requestAnnounce marks local presence as changed, the presence loop announces it.
+func (c *Cluster) requestAnnounce() {
+	select {
+	case c.announceChan <- struct{}{}:
+	default:
+	}
+}
+
+func (c *Cluster) announce() {
+	msg := &message.ClusterMessage{
+		Kind:       message.ClusterKindPresence,
+		FromNodeId: c.nodeId,
+		Presence: &message.ClusterPresence{
+			Deliverers:  c.localStore.GetDeliverers(),
+			Controllers: c.localStore.GetControllers(),
+			Gamepads:    c.localStore.GetGamepads(),
+		},
+	}
+	err := c.bus.Broadcast(msg)
+	if err != nil {
+		log.Printf("can not announce presence: %v", err)
+	}
+}
+
+func (c *Cluster) subscribe(onEvent OnClientsEvent) int {
+	localSubscriptionId := c.localStore.Subscribe(onEvent)
+	c.subscribersMutex.Lock()
+	defer c.subscribersMutex.Unlock()
+	c.nextSubscriptionId += 1
+	c.subscribers[c.nextSubscriptionId] = &clusterSubscription{
+		localSubscriptionId: localSubscriptionId,
+		onEvent:             onEvent,
+	}
+	return c.nextSubscriptionId
+}
+
+func (c *Cluster) unsubscribe(subscriptionId int) {
+	c.subscribersMutex.Lock()
+	defer c.subscribersMutex.Unlock()
+	subscription, ok := c.subscribers[subscriptionId]
+	if !ok {
+		return
+	}
+	c.localStore.Unsubscribe(subscription.localSubscriptionId)
+	delete(c.subscribers, subscriptionId)
+}
+
+func (c *Cluster) publish(events []*message.PresenceEvent) {
+	c.subscribersMutex.Lock()
+	defer c.subscribersMutex.Unlock()
+	for _, event := range events {
+		for _, subscription := range c.subscribers {
+			subscription.onEvent(event)
+		}
+	}
+}
+
+// metadataChanged compares metadata except the last activity, remote nodes see the activity on every presence.
+func metadataChanged(oldMetadata *message.ClientMetadata, newMetadata *message.ClientMetadata) bool {
+	if oldMetadata == nil || newMetadata == nil {
+		return oldMetadata != newMetadata
+	}
+	oldCopied := *oldMetadata
+	newCopied := *newMetadata
+	oldCopied.LastActivity = 0
+	newCopied.LastActivity = 0
+	return !reflect.DeepEqual(&oldCopied, &newCopied)
+}
+
+func diffClients(events []*message.PresenceEvent, clientType string, oldClients []*message.NameAndId, newClients []*message.NameAndId) []*message.PresenceEvent {
+	oldClientsMap := make(map[string]*message.NameAndId)
+	for _, oldClient := range oldClients {
+		oldClientsMap[oldClient.Id] = oldClient
+	}
+	for _, newClient := range newClients {
+		oldClient, ok := oldClientsMap[newClient.Id]
+		if !ok {
+			events = append(events, &message.PresenceEvent{ Event: message.PresenceEventAdd, ClientType: clientType, Client: newClient })
+		} else if oldClient.Name != newClient.Name ||
+			  oldClient.Room != newClient.Room ||
+			  metadataChanged(oldClient.Metadata, newClient.Metadata) {
+			events = append(events, &message.PresenceEvent{ Event: message.PresenceEventUpdate, ClientType: clientType, Client: newClient })
+		}
+		delete(oldClientsMap, newClient.Id)
+	}
+	for _, oldClient := range oldClientsMap {
+		events = append(events, &message.PresenceEvent{ Event: message.PresenceEventDelete, ClientType: clientType, Client: oldClient })
+	}
+	return events
+}
+
+func diffGamepads(events []*message.PresenceEvent, oldGamepads []*message.GamepadInfo, newGamepads []*message.GamepadInfo) []*message.PresenceEvent {
+	oldGamepadsMap := make(map[string]*message.GamepadInfo)
+	for _, oldGamepad := range oldGamepads {
+		oldGamepadsMap[oldGamepad.Id] = oldGamepad
+	}
+	for _, newGamepad := range newGamepads {
+		oldGamepad, ok := oldGamepadsMap[newGamepad.Id]
+		if !ok {
+			events = append(events, &message.PresenceEvent{ Event: message.PresenceEventAdd, ClientType: message.ClientTypeGamepad, Gamepad: newGamepad })
+		} else if oldGamepad.Name != newGamepad.Name ||
+			  oldGamepad.Status != newGamepad.Status ||
+			  oldGamepad.DelivererId != newGamepad.DelivererId ||
+			  oldGamepad.ControllerId != newGamepad.ControllerId ||
+			  oldGamepad.Room != newGamepad.Room ||
+			  metadataChanged(oldGamepad.Metadata, newGamepad.Metadata) {
+			events = append(events, &message.PresenceEvent{ Event: message.PresenceEventUpdate, ClientType: message.ClientTypeGamepad, Gamepad: newGamepad })
+		}
+		delete(oldGamepadsMap, newGamepad.Id)
+	}
+	for _, oldGamepad := range oldGamepadsMap {
+		events = append(events, &message.PresenceEvent{ Event: message.PresenceEventDelete, ClientType: message.ClientTypeGamepad, Gamepad: oldGamepad })
+	}
+	return events
+}
+
+// diffPresence returns events that change the old presence into the new presence.
+// Changes of the last activity only are not reported.
+func diffPresence(oldPresence *message.ClusterPresence, newPresence *message.ClusterPresence) []*message.PresenceEvent {
+	if oldPresence == nil {
+		oldPresence = &message.ClusterPresence{}
+	}
+	if newPresence == nil {
+		newPresence = &message.ClusterPresence{}
+	}
+	events := make([]*message.PresenceEvent, 0)
+	events = diffClients(events, message.ClientTypeDeliverer, oldPresence.Deliverers, newPresence.Deliverers)
+	events = diffClients(events, message.ClientTypeController, oldPresence.Controllers, newPresence.Controllers)
+	events = diffGamepads(events, oldPresence.Gamepads, newPresence.Gamepads)
+	return events
+}
+
+func (c *Cluster) expireRemoteNodes() {
+	events := make([]*message.PresenceEvent, 0)
+	c.remoteNodesMutex.Lock()
+	for nodeId, node := range c.remoteNodes {
+		if time.Since(node.lastSeen) < 3 * c.presenceInterval {
+			continue
+		}
+		delete(c.remoteNodes, nodeId)
+		events = append(events, diffPresence(node.presence, nil)...)
+		if c.verbose {
+			log.Printf("expire remote node: nodeId = %v", nodeId)
+		}
+	}
+	c.remoteNodesMutex.Unlock()
+	c.publish(events)
+}
+
+func (c *Cluster) onMessage(msg *message.ClusterMessage) {
+	if msg.FromNodeId == c.nodeId {
+		return
+	}
+	if msg.Kind == message.ClusterKindPresence {
+		if msg.Presence == nil {
+			return
+		}
+		c.remoteNodesMutex.Lock()
+		var oldPresence *message.ClusterPresence
+		if oldNode, ok := c.remoteNodes[msg.FromNodeId]; ok {
+			oldPresence = oldNode.presence
+		}
+		c.remoteNodes[msg.FromNodeId] = &remoteNode{
+			presence: msg.Presence,
+			lastSeen: time.Now(),
+		}
+		c.remoteNodesMutex.Unlock()
+		c.publish(diffPresence(oldPresence, msg.Presence))
+	} else if msg.Kind == message.ClusterKindSignaling {
+		c.handlersMutex.Lock()
+		onSignaling := c.onSignaling
+		c.handlersMutex.Unlock()
+		if onSignaling == nil || msg.Message == nil {
+			log.Printf("can not handle cluster signaling: %v", msg.Kind)
+			return
+		}
+		// signaling may wait for store requests of other nodes
+		go onSignaling(msg.FromNodeId, msg.TargetClientId, msg.SourceClientId, msg.Message)
+	} else if msg.Kind == message.ClusterKindFromWs || msg.Kind == message.ClusterKindFromTcp {
+		c.handlersMutex.Lock()
+		onForward := c.onFromWs
+		if msg.Kind == message.ClusterKindFromTcp {
+			onForward = c.onFromTcp
+		}
+		c.handlersMutex.Unlock()
+		if onForward == nil || msg.Message == nil {
+			log.Printf("can not handle cluster forward: %v", msg.Kind)
+			return
+		}
+		err := onForward(msg.Message)
+		if err != nil {
+			log.Printf("can not forward cluster message: %v", err)
+		}
+	} else if msg.Kind == message.ClusterKindStoreReq {
+		go c.onStoreRequest(msg)
+	} else if msg.Kind == message.ClusterKindStoreRes {
+		c.requestsMutex.Lock()
+		resChan, ok := c.requests[msg.RequestId]
+		c.requestsMutex.Unlock()
+		if !ok {
+			log.Printf("not found cluster request: %v", msg.RequestId)
+			return
+		}
+		select {
+		case resChan <- msg:
+		default:
+			log.Printf("duplicated cluster response: %v", msg.RequestId)
+		}
+	} else {
+		log.Printf("unsupported cluster message: %v", msg.Kind)
+	}
+}
+
+func (c *Cluster) onStoreRequest(msg *message.ClusterMessage) {
+	req := msg.StoreRequest
+	if req == nil {
+		return
+	}
+	var err error
+	if req.Op == message.ClusterStoreOpReserve {
+		err = c.localStore.ReserveGamepad(req.GamepadId, req.DelivererId, req.ControllerId)
+	} else if req.Op == message.ClusterStoreOpOccupy {
+		err = c.localStore.OccupyGamepad(req.GamepadId, req.DelivererId, req.ControllerId)
+	} else if req.Op == message.ClusterStoreOpRelease {
+		c.localStore.ReleaseGamepad(req.GamepadId, req.DelivererId, req.ControllerId)
+	} else if req.Op == message.ClusterStoreOpReleaseByClient {
+		c.localStore.ReleaseGamepadsByClient(req.ClientId)
+	} else {
+		err = fmt.Errorf("unsupported store operation: %v", req.Op)
+	}
+	if msg.RequestId == "" {
+		// no response required
+		return
+	}
+	resMsg := &message.ClusterMessage{
+		Kind:       message.ClusterKindStoreRes,
+		FromNodeId: c.nodeId,
+		ToNodeId:   msg.FromNodeId,
+		RequestId:  msg.RequestId,
+	}
+	if err != nil {
+		resMsg.Error = &message.Error{
+			Message: err.Error(),
+		}
+	}
+	err = c.bus.Send(msg.FromNodeId, resMsg)
+	if err != nil {
+		log.Printf("can not send store response: %v", err)
+	}
+}
+
+func (c *Cluster) requestStore(nodeId string, req *message.ClusterStoreRequest) error {
+	requestUuid, err := uuid.NewRandom()
+	if err != nil {
+		return fmt.Errorf("can not create request id: %w", err)
+	}
+	requestId := requestUuid.String()
+	resChan := make(chan *message.ClusterMessage, 1)
+	c.requestsMutex.Lock()
+	c.requests[requestId] = resChan
+	c.requestsMutex.Unlock()
+	defer func() {
+		c.requestsMutex.Lock()
+		delete(c.requests, requestId)
+		c.requestsMutex.Unlock()
+	}()
+	msg := &message.ClusterMessage{
+		Kind:         message.ClusterKindStoreReq,
+		FromNodeId:   c.nodeId,
+		ToNodeId:     nodeId,
+		RequestId:    requestId,
+		StoreRequest: req,
+	}
+	err = c.bus.Send(nodeId, msg)
+	if err != nil {
+		return fmt.Errorf("can not send store request: %w", err)
+	}
+	select {
+	case resMsg := <-resChan:
+		if resMsg.Error != nil && resMsg.Error.Message != "" {
+			return fmt.Errorf("%v", resMsg.Error.Message)
+		}
+		return nil
+	case <-time.After(c.requestTimeout):
+		return fmt.Errorf("store request timeout: nodeId = %v, op = %v", nodeId, req.Op)
+	}
+}
+
+// LookupNode returns the id of remote node that owns the client, or empty string if no node owns it.
+func (c *Cluster) LookupNode(clientId string) string {
+	c.remoteNodesMutex.Lock()
+	defer c.remoteNodesMutex.Unlock()
+	for nodeId, node := range c.remoteNodes {
+		for _, deliverer := range node.presence.Deliverers {
+			if deliverer.Id == clientId {
+				return nodeId
+			}
+		}
+		for _, controller := range node.presence.Controllers {
+			if controller.Id == clientId {
+				return nodeId
+			}
+		}
+		for _, gamepad := range node.presence.Gamepads {
+			if gamepad.Id == clientId {
+				return nodeId
+			}
+		}
+	}
+	return ""
+}
+
+// lookupRemoteClient returns the client of the type in presences of remote nodes, or nil if not found.
+func (c *Cluster) lookupRemoteClient(clientType string, clientId string) *message.NameAndId {
+	c.remoteNodesMutex.Lock()
+	defer c.remoteNodesMutex.Unlock()
+	for _, node := range c.remoteNodes {
+		if clientType == message.ClientTypeGamepad {
+			for _, gamepad := range node.presence.Gamepads {
+				if gamepad.Id == clientId {
+					return &message.NameAndId{ Name: gamepad.Name, Id: gamepad.Id, Room: gamepad.Room, Metadata: gamepad.Metadata }
+				}
+			}
+			continue
+		}
+		clients := node.presence.Controllers
+		if clientType == message.ClientTypeDeliverer {
+			clients = node.presence.Deliverers
+		}
+		for _, clnt := range clients {
+			if clnt.Id == clientId {
+				return clnt
+			}
+		}
+	}
+	return nil
+}
+
+func (c *Cluster) lookupRemoteGamepad(gamepadId string) *message.GamepadInfo {
+	c.remoteNodesMutex.Lock()
+	defer c.remoteNodesMutex.Unlock()
+	for _, node := range c.remoteNodes {
+		for _, gamepad := range node.presence.Gamepads {
+			if gamepad.Id == gamepadId {
+				copiedGamepad := *gamepad
+				return &copiedGamepad
+			}
+		}
+	}
+	return nil
+}
+
+func (c *Cluster) RouteSignaling(nodeId string, targetClientId string, sourceClientId string, msg *message.Message) error {
+	return c.bus.Send(nodeId, &message.ClusterMessage{
+		Kind:           message.ClusterKindSignaling,
+		FromNodeId:     c.nodeId,
+		ToNodeId:       nodeId,
+		TargetClientId: targetClientId,
+		SourceClientId: sourceClientId,
+		Message:        msg,
+	})
+}
+
+func (c *Cluster) RouteFromWs(nodeId string, msg *message.Message) error {
+	return c.bus.Send(nodeId, &message.ClusterMessage{
+		Kind:       message.ClusterKindFromWs,
+		FromNodeId: c.nodeId,
+		ToNodeId:   nodeId,
+		Message:    msg,
+	})
+}
+
+func (c *Cluster) RouteFromTcp(nodeId string, msg *message.Message) error {
+	return c.bus.Send(nodeId, &message.ClusterMessage{
+		Kind:       message.ClusterKindFromTcp,
+		FromNodeId: c.nodeId,
+		ToNodeId:   nodeId,
+		Message:    msg,
+	})
+}
+
+func (c *Cluster) getRemotePresences() []*message.ClusterPresence {
+	c.remoteNodesMutex.Lock()
+	defer c.remoteNodesMutex.Unlock()
+	presences := make([]*message.ClusterPresence, 0, len(c.remoteNodes))
+	for _, node := range c.remoteNodes {
+		presences = append(presences, node.presence)
+	}
+	return presences
+}
+
+// ClientsStore returns the ClientsStore that merges clients of all nodes.
+func (c *Cluster) ClientsStore() ClientsStore {
+	return &clusterClientsStore{
+		cluster: c,
+	}
+}
+
+func NewCluster(nodeId string, bus ClusterBus, localStore ClientsStore, opts ...ClusterOption) (*Cluster, error) {
+	baseOpts := defaultClusterOptions()
+	for _, opt := range opts {
+		if opt == nil {
+			continue
+		}
+		opt(baseOpts)
+	}
+	if nodeId == "" {
+		return nil, fmt.Errorf("no node id")
+	}
+	return &Cluster{
+		verbose:          baseOpts.verbose,
+		nodeId:           nodeId,
+		presenceInterval: baseOpts.presenceInterval,
+		requestTimeout:   baseOpts.requestTimeout,
+		bus:              bus,
+		localStore:       localStore,
+		remoteNodes:      make(map[string]*remoteNode),
+		subscribers:      make(map[int]*clusterSubscription),
+		requests:         make(map[string]chan *message.ClusterMessage),
+		announceChan:     make(chan struct{}, 1),
+		stopChan:         make(chan int),
+	}, nil
+}
+
+// clusterClientsStore keeps local clients in the local store and
+// sends gamepad operations to the node that owns the gamepad.
+type clusterClientsStore struct {
+	cluster *Cluster
+}
+
+func (c *clusterClientsStore) AddDeliverer(clientId string, clientName string, room string, metadata *message.ClientMetadata) {
+	c.cluster.localStore.AddDeliverer(clientId, clientName, room, metadata)
+	c.cluster.requestAnnounce()
+}
+
+func (c *clusterClientsStore) AddController(clientId string, clientName string, room string, metadata *message.ClientMetadata) {
+	c.cluster.localStore.AddController(clientId, clientName, room, metadata)
+	c.cluster.requestAnnounce()
+}
+
+func (c *clusterClientsStore) AddGamepad(clientId string, clientName string, room string, metadata *message.ClientMetadata) {
+	c.cluster.localStore.AddGamepad(clientId, clientName, room, metadata)
+	c.cluster.requestAnnounce()
+}
+
+// TouchClient only touches local clients, remote nodes see the activity on the next presence.
+func (c *clusterClientsStore) TouchClient(clientId string) {
+	c.cluster.localStore.TouchClient(clientId)
+}
+
+func (c *clusterClientsStore) UpdateDeviceStatus(gamepadId string, deviceStatus *message.GamepadDeviceStatus) {
+	c.cluster.localStore.UpdateDeviceStatus(gamepadId, deviceStatus)
+	c.cluster.requestAnnounce()
+}
+
+// Subscribe registers the handler of events of local clients and remote clients.
+func (c *clusterClientsStore) Subscribe(onEvent OnClientsEvent) int {
+	return c.cluster.subscribe(onEvent)
+}
+
+func (c *clusterClientsStore) Unsubscribe(subscriptionId int) {
+	c.cluster.unsubscribe(subscriptionId)
+}
+
+func (c *clusterClientsStore) DeleteDeliverer(clientId string) {
+	c.cluster.localStore.DeleteDeliverer(clientId)
+	c.cluster.requestAnnounce()
+}
+
+func (c *clusterClientsStore) DeleteController(clientId string) {
+	c.cluster.localStore.DeleteController(clientId)
+	c.cluster.requestAnnounce()
+}
+
+func (c *clusterClientsStore) DeleteGamepad(clientId string) {
+	c.cluster.localStore.DeleteGamepad(clientId)
+	c.cluster.requestAnnounce()
+}
+
+func (c *clusterClientsStore) GetDeliverers() []*message.NameAndId {
+	deliverers := c.cluster.localStore.GetDeliverers()
+	for _, presence := range c.cluster.getRemotePresences() {
+		deliverers = append(deliverers, presence.Deliverers...)
+	}
+	return deliverers
+}
+
+func (c *clusterClientsStore) GetControllers() []*message.NameAndId {
+	controllers := c.cluster.localStore.GetControllers()
+	for _, presence := range c.cluster.getRemotePresences() {
+		controllers = append(controllers, presence.Controllers...)
+	}
+	return controllers
+}
+
+func (c *clusterClientsStore) GetGamepads() []*message.GamepadInfo {
+	gamepads := c.cluster.localStore.GetGamepads()
+	for _, presence := range c.cluster.getRemotePresences() {
+		gamepads = append(gamepads, presence.Gamepads...)
+	}
+	return gamepads
+}
+
+func (c *clusterClientsStore) GetClient(clientType string, clientId string) *message.NameAndId {
+	if clnt := c.cluster.localStore.GetClient(clientType, clientId); clnt != nil {
+		return clnt
+	}
+	return c.cluster.lookupRemoteClient(clientType, clientId)
+}
+
+func (c *clusterClientsStore) GetGamepad(gamepadId string) *message.GamepadInfo {
+	if gamepad := c.cluster.localStore.GetGamepad(gamepadId); gamepad != nil {
+		return gamepad
+	}
+	return c.cluster.lookupRemoteGamepad(gamepadId)
+}
+
+func (c *clusterClientsStore) ReserveGamepad(gamepadId string, delivererId string, controllerId string) error {
+	nodeId := c.cluster.LookupNode(gamepadId)
+	if nodeId == "" {
+		return c.cluster.localStore.ReserveGamepad(gamepadId, delivererId, controllerId)
+	}
+	return c.cluster.requestStore(nodeId, &message.ClusterStoreRequest{
+		Op:           message.ClusterStoreOpReserve,
+		GamepadId:    gamepadId,
+		DelivererId:  delivererId,
+		ControllerId: controllerId,
+	})
+}
+
+func (c *clusterClientsStore) OccupyGamepad(gamepadId string, delivererId string, controllerId string) error {
+	nodeId := c.cluster.LookupNode(gamepadId)
+	if nodeId == "" {
+		return c.cluster.localStore.OccupyGamepad(gamepadId, delivererId, controllerId)
+	}
+	return c.cluster.requestStore(nodeId, &message.ClusterStoreRequest{
+		Op:           message.ClusterStoreOpOccupy,
+		GamepadId:    gamepadId,
+		DelivererId:  delivererId,
+		ControllerId: controllerId,
+	})
+}
+
+func (c *clusterClientsStore) ReleaseGamepad(gamepadId string, delivererId string, controllerId string) {
+	nodeId := c.cluster.LookupNode(gamepadId)
+	if nodeId == "" {
+		c.cluster.localStore.ReleaseGamepad(gamepadId, delivererId, controllerId)
+		return
+	}
+	err := c.cluster.requestStore(nodeId, &message.ClusterStoreRequest{
+		Op:           message.ClusterStoreOpRelease,
+		GamepadId:    gamepadId,
+		DelivererId:  delivererId,
+		ControllerId: controllerId,
+	})
+	if err != nil {
+		log.Printf("can not release remote gamepad: %v", err)
+	}
+}
+
+func (c *clusterClientsStore) ReleaseGamepadsByClient(clientId string) {
+	c.cluster.localStore.ReleaseGamepadsByClient(clientId)
+	err := c.cluster.bus.Broadcast(&message.ClusterMessage{
+		Kind:       message.ClusterKindStoreReq,
+		FromNodeId: c.cluster.nodeId,
+		StoreRequest: &message.ClusterStoreRequest{
+			Op:       message.ClusterStoreOpReleaseByClient,
+			ClientId: clientId,
+		},
+	})
+	if err != nil {
+		log.Printf("can not release remote gamepads: %v", err)
+	}
+}
+
+func (c *clusterClientsStore) Close() error {
+	return c.cluster.localStore.Close()
+}
+
+// gamepadMessageIds returns ids of the session in the gamepad message.
+func gamepadMessageIds(msg *message.Message) (string, string, string) {
+	if msg.GamepadConnectRequest != nil {
+		return msg.GamepadConnectRequest.DelivererId, msg.GamepadConnectRequest.ControllerId, msg.GamepadConnectRequest.GamepadId
+	} else if msg.GamepadConnectResponse != nil {
+		return msg.GamepadConnectResponse.DelivererId, msg.GamepadConnectResponse.ControllerId, msg.GamepadConnectResponse.GamepadId
+	} else if msg.GamepadState != nil {
+		return msg.GamepadState.DelivererId, msg.GamepadState.ControllerId, msg.GamepadState.GamepadId
+	} else if msg.GamepadVibration != nil {
+		return msg.GamepadVibration.DelivererId, msg.GamepadVibration.ControllerId, msg.GamepadVibration.GamepadId
+	} else if msg.GamepadDisconnected != nil {
+		return msg.GamepadDisconnected.DelivererId, msg.GamepadDisconnected.ControllerId, msg.GamepadDisconnected.GamepadId
+	} else if msg.GamepadDeviceStatus != nil {
+		return msg.GamepadDeviceStatus.DelivererId, msg.GamepadDeviceStatus.ControllerId, msg.GamepadDeviceStatus.GamepadId
+	}
+	return "", "", ""
+}
@@ -0,0 +1,595 @@
+package handler
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+	"github.com/potix/regapweb/message"
+)
+
+type OnClusterMessage func(*message.ClusterMessage)
+
+// ClusterBus delivers cluster messages between regapweb nodes.
+type ClusterBus interface {
+	Start(onMessage OnClusterMessage) error
+	Stop()
+	Send(nodeId string, msg *message.ClusterMessage) error
+	Broadcast(msg *message.ClusterMessage) error
+}
+
+// LoopbackClusterHub connects loopback buses of in-process nodes.
+type LoopbackClusterHub struct {
+	busesMutex sync.Mutex
+	buses      map[string]*LoopbackClusterBus
+}
+
+func (l *LoopbackClusterHub) NewBus(nodeId string) *LoopbackClusterBus {
+	l.busesMutex.Lock()
+	defer l.busesMutex.Unlock()
+	bus := &LoopbackClusterBus{
+		nodeId: nodeId,
+		hub:    l,
+	}
+	l.buses[nodeId] = bus
+	return bus
+}
+
+func (l *LoopbackClusterHub) getBus(nodeId string) *LoopbackClusterBus {
+	l.busesMutex.Lock()
+	defer l.busesMutex.Unlock()
+	return l.buses[nodeId]
+}
+
+func (l *LoopbackClusterHub) getOtherBuses(nodeId string) []*LoopbackClusterBus {
+	l.busesMutex.Lock()
+	defer l.busesMutex.Unlock()
+	buses := make([]*LoopbackClusterBus, 0, len(l.buses))
+	for id, bus := range l.buses {
+		if id == nodeId {
+			continue
+		}
+		buses = append(buses, bus)
+	}
+	return buses
+}
+
+func NewLoopbackClusterHub() *LoopbackClusterHub {
+	return &LoopbackClusterHub{
+		buses: make(map[string]*LoopbackClusterBus),
+	}
+}
+
+type LoopbackClusterBus struct {
+	nodeId         string
+	hub            *LoopbackClusterHub
+	onMessageMutex sync.Mutex
+	onMessage      OnClusterMessage
+}
+
+func (l *LoopbackClusterBus) Start(onMessage OnClusterMessage) error {
+	l.onMessageMutex.Lock()
+	defer l.onMessageMutex.Unlock()
+	l.onMessage = onMessage
+	return nil
+}
+
+func (l *LoopbackClusterBus) Stop() {
+	l.onMessageMutex.Lock()
+	defer l.onMessageMutex.Unlock()
+	l.onMessage = nil
+}
+
+func (l *LoopbackClusterBus) deliver(msg *message.ClusterMessage) error {
+	l.onMessageMutex.Lock()
+	onMessage := l.onMessage
+	l.onMessageMutex.Unlock()
+	if onMessage == nil {
+		return fmt.Errorf("bus is not started: nodeId = %v", l.nodeId)
+	}
+	// copy to behave like the network
+	msgBytes, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("can not marshal cluster message: %w", err)
+	}
+	var copiedMsg message.ClusterMessage
+	if err := json.Unmarshal(msgBytes, &copiedMsg); err != nil {
+		return fmt.Errorf("can not unmarshal cluster message: %w", err)
+	}
+	go onMessage(&copiedMsg)
+	return nil
+}
+
+func (l *LoopbackClusterBus) Send(nodeId string, msg *message.ClusterMessage) error {
+	bus := l.hub.getBus(nodeId)
+	if bus == nil {
+		return fmt.Errorf("not found node: nodeId = %v", nodeId)
+	}
+	return bus.deliver(msg)
+}
+
+func (l *LoopbackClusterBus) Broadcast(msg *message.ClusterMessage) error {
+	for _, bus := range l.hub.getOtherBuses(l.nodeId) {
+		if err := bus.deliver(msg); err != nil {
+			log.Printf("can not broadcast cluster message: %v", err)
+		}
+	}
+	return nil
+}
+
+type tcpClusterBusOptions struct {
+	verbose       bool
+	dialTimeout   time.Duration
+	sendQueueSize int
+}
+
+func defaultTcpClusterBusOptions() *tcpClusterBusOptions {
+	return &tcpClusterBusOptions{
+		verbose:       false,
+		dialTimeout:   5 * time.Second,
+		sendQueueSize: 1024,
+	}
+}
+
+type TcpClusterBusOption func(*tcpClusterBusOptions)
+
+func TcpClusterBusVerbose(verbose bool) TcpClusterBusOption {
+	return func(opts *tcpClusterBusOptions) {
+		opts.verbose = verbose
+	}
+}
+
+// TcpClusterBusDialTimeout sets the timeout of dialing and writing to peers,
+// messages to the peer are dropped for the timeout after it fails to dial.
+func TcpClusterBusDialTimeout(dialTimeout time.Duration) TcpClusterBusOption {
+	return func(opts *tcpClusterBusOptions) {
+		opts.dialTimeout = dialTimeout
+	}
+}
+
+// TcpClusterBusSendQueueSize sets the number of messages that can be queued for each peer.
+func TcpClusterBusSendQueueSize(sendQueueSize int) TcpClusterBusOption {
+	return func(opts *tcpClusterBusOptions) {
+		opts.sendQueueSize = sendQueueSize
+	}
+}
+
+// the upper limit of hello messages, which are read before the peer is authenticated
+const clusterHelloMaxSize int = 4096
+
+// the upper limit of cluster messages, presence of all clients of a node must fit in it
+const clusterMaxFrameSize int = 4 * 1024 * 1024
+
+// roles of the digest in the hello
+const (
+	clusterHelloRoleDial   string = "dial"
+	clusterHelloRoleAccept        = "accept"
+)
+
+// tcpClusterPeer has the send queue drained by its own writer,
+// so that senders never wait for dialing or writing to the peer.
+type tcpClusterPeer struct {
+	nodeId    string
+	addrPort  string
+	sendChan  chan []byte
+	connMutex sync.Mutex
+	conn      net.Conn
+}
+
+// TcpClusterBus exchanges json line messages with peer nodes over tcp.
+// Each node dials peers to send messages and accepts peers to receive messages.
+type TcpClusterBus struct {
+	verbose     bool
+	dialTimeout time.Duration
+	nodeId      string
+	addrPort    string
+	secret      string
+	peers       map[string]*tcpClusterPeer
+	listen      net.Listener
+	onMessage   OnClusterMessage
+	connsMutex  sync.Mutex
+	conns       map[net.Conn]bool
+	stopped     chan int
+	wg          sync.WaitGroup
+}
+
+// digest answers the nonce of the other side, the role keeps the answer
+// of one side from being replayed as the answer of the other side.
+func (t *TcpClusterBus) digest(role string, nonce string, nodeId string) string {
+	mac := hmac.New(sha256.New, []byte(t.secret))
+	mac.Write([]byte(role))
+	mac.Write([]byte(nonce))
+	mac.Write([]byte(nodeId))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func newClusterNonce() (string, error) {
+	nonceBytes := make([]byte, 32)
+	if _, err := rand.Read(nonceBytes); err != nil {
+		return "", fmt.Errorf("can not create nonce: %w", err)
+	}
+	return hex.EncodeToString(nonceBytes), nil
+}
+
+func (t *TcpClusterBus) encodeMessage(msg *message.ClusterMessage) ([]byte, error) {
+	msgBytes, err := json.Marshal(msg)
+	if err != nil {
+		return nil, fmt.Errorf("can not marshal cluster message: %w", err)
+	}
+	if len(msgBytes) > clusterMaxFrameSize {
+		// peers drop the connection sending it
+		return nil, fmt.Errorf("cluster message is too large: kind = %v, size = %v", msg.Kind, len(msgBytes))
+	}
+	return append(msgBytes, byte('\n')), nil
+}
+
+func (t *TcpClusterBus) writeMessage(conn net.Conn, msg *message.ClusterMessage) error {
+	msgBytes, err := t.encodeMessage(msg)
+	if err != nil {
+		return err
+	}
+	return t.writeBytes(conn, msgBytes)
+}
+
+func (t *TcpClusterBus) writeBytes(conn net.Conn, msgBytes []byte) error {
+	err := conn.SetWriteDeadline(time.Now().Add(t.dialTimeout))
+	if err != nil {
+		return fmt.Errorf("can not set write deadline: %w", err)
+	}
+	_, err = conn.Write(msgBytes)
+	if err != nil {
+		return fmt.Errorf("can not write cluster message: %w", err)
+	}
+	return nil
+}
+
+func (t *TcpClusterBus) readHello(conn net.Conn, rbufio *bufio.Reader) (*message.ClusterHello, error) {
+	lineBytes, err := message.ReadLineFrame(rbufio, clusterHelloMaxSize)
+	if err != nil {
+		return nil, fmt.Errorf("can not read cluster hello: %w", err)
+	}
+	var msg message.ClusterMessage
+	if err := json.Unmarshal(lineBytes, &msg); err != nil {
+		return nil, fmt.Errorf("can not unmarshal cluster hello: %w", err)
+	}
+	if msg.Kind != message.ClusterKindHello || msg.Hello == nil {
+		return nil, fmt.Errorf("not cluster hello from %v: %v", conn.RemoteAddr(), msg.Kind)
+	}
+	return msg.Hello, nil
+}
+
+// acceptHello runs the challenge response of the accepting side and returns the node id of the peer.
+// The accepting side sends the nonce, then the dialing side answers it with its own nonce,
+// and the accepting side answers the nonce of the dialing side.
+func (t *TcpClusterBus) acceptHello(conn net.Conn, rbufio *bufio.Reader) (string, error) {
+	err := conn.SetReadDeadline(time.Now().Add(t.dialTimeout))
+	if err != nil {
+		return "", fmt.Errorf("can not set read deadline: %w", err)
+	}
+	defer conn.SetReadDeadline(time.Time{})
+	nonce, err := newClusterNonce()
+	if err != nil {
+		return "", err
+	}
+	challengeMsg := &message.ClusterMessage{
+		Kind:       message.ClusterKindHello,
+		FromNodeId: t.nodeId,
+		Hello:      &message.ClusterHello{ NodeId: t.nodeId, Nonce: nonce },
+	}
+	if err := t.writeMessage(conn, challengeMsg); err != nil {
+		return "", err
+	}
+	hello, err := t.readHello(conn, rbufio)
+	if err != nil {
+		return "", err
+	}
+	if hello.Nonce == "" ||
+	   !hmac.Equal([]byte(hello.Digest), []byte(t.digest(clusterHelloRoleDial, nonce, hello.NodeId))) {
+		return "", fmt.Errorf("invalid cluster hello from %v", conn.RemoteAddr())
+	}
+	answerMsg := &message.ClusterMessage{
+		Kind:       message.ClusterKindHello,
+		FromNodeId: t.nodeId,
+		Hello: &message.ClusterHello{
+			NodeId: t.nodeId,
+			Digest: t.digest(clusterHelloRoleAccept, hello.Nonce, t.nodeId),
+		},
+	}
+	if err := t.writeMessage(conn, answerMsg); err != nil {
+		return "", err
+	}
+	return hello.NodeId, nil
+}
+
+// dialHello runs the challenge response of the dialing side, the peer must answer as the node id.
+func (t *TcpClusterBus) dialHello(conn net.Conn, nodeId string) error {
+	err := conn.SetReadDeadline(time.Now().Add(t.dialTimeout))
+	if err != nil {
+		return fmt.Errorf("can not set read deadline: %w", err)
+	}
+	defer conn.SetReadDeadline(time.Time{})
+	rbufio := bufio.NewReader(conn)
+	challenge, err := t.readHello(conn, rbufio)
+	if err != nil {
+		return err
+	}
+	if challenge.Nonce == "" {
+		return fmt.Errorf("no nonce in cluster hello from %v", conn.RemoteAddr())
+	}
+	nonce, err := newClusterNonce()
+	if err != nil {
+		return err
+	}
+	helloMsg := &message.ClusterMessage{
+		Kind:       message.ClusterKindHello,
+		FromNodeId: t.nodeId,
+		Hello: &message.ClusterHello{
+			NodeId: t.nodeId,
+			Nonce:  nonce,
+			Digest: t.digest(clusterHelloRoleDial, challenge.Nonce, t.nodeId),
+		},
+	}
+	if err := t.writeMessage(conn, helloMsg); err != nil {
+		return err
+	}
+	answer, err := t.readHello(conn, rbufio)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(answer.Digest), []byte(t.digest(clusterHelloRoleAccept, nonce, nodeId))) {
+		return fmt.Errorf("invalid cluster hello from %v", conn.RemoteAddr())
+	}
+	return nil
+}
+
+func (t *TcpClusterBus) Start(onMessage OnClusterMessage) error {
+	t.onMessage = onMessage
+	l, err := net.Listen("tcp", t.addrPort)
+	if err != nil {
+		return fmt.Errorf("can not listen: %w", err)
+	}
+	t.listen = l
+	t.wg.Add(1)
+	go t.acceptLoop()
+	for _, peer := range t.peers {
+		t.wg.Add(1)
+		go t.sendLoop(peer)
+	}
+	return nil
+}
+
+func (t *TcpClusterBus) Stop() {
+	close(t.stopped)
+	t.listen.Close()
+	t.connsMutex.Lock()
+	for conn := range t.conns {
+		conn.Close()
+	}
+	t.connsMutex.Unlock()
+	for _, peer := range t.peers {
+		peer.connMutex.Lock()
+		if peer.conn != nil {
+			peer.conn.Close()
+		}
+		peer.connMutex.Unlock()
+	}
+	t.wg.Wait()
+}
+
+func (t *TcpClusterBus) isStopped() bool {
+	select {
+	case <-t.stopped:
+		return true
+	default:
+		return false
+	}
+}
+
+func (t *TcpClusterBus) acceptLoop() {
+	defer t.wg.Done()
+	for {
+		conn, err := t.listen.Accept()
+		if err != nil {
+			if t.isStopped() {
+				return
+			}
+			log.Printf("can not accept cluster peer: %v", err)
+			continue
+		}
+		t.connsMutex.Lock()
+		t.conns[conn] = true
+		t.connsMutex.Unlock()
+		t.wg.Add(1)
+		go func() {
+			defer t.wg.Done()
+			t.receiveLoop(conn)
+			t.connsMutex.Lock()
+			delete(t.conns, conn)
+			t.connsMutex.Unlock()
+			conn.Close()
+		}()
+	}
+}
+
+func (t *TcpClusterBus) receiveLoop(conn net.Conn) {
+	rbufio := bufio.NewReader(conn)
+	nodeId, err := t.acceptHello(conn, rbufio)
+	if err != nil {
+		log.Printf("can not accept cluster peer: %v", err)
+		return
+	}
+	if t.verbose {
+		log.Printf("accepted cluster peer: nodeId = %v", nodeId)
+	}
+	for {
+		lineBytes, err := message.ReadLineFrame(rbufio, clusterMaxFrameSize)
+		if err != nil {
+			if errors.Is(err, message.ErrFrameTooLarge) {
+				log.Printf("close cluster peer sending too large message: nodeId = %v", nodeId)
+			} else if t.verbose {
+				log.Printf("can not read cluster message: %v", err)
+			}
+			return
+		}
+		var msg message.ClusterMessage
+		if err := json.Unmarshal(lineBytes, &msg); err != nil {
+			log.Printf("can not unmarshal cluster message: %v", err)
+			continue
+		}
+		// the peer is authenticated as the node of the hello, it must not speak for other nodes
+		if msg.FromNodeId != nodeId {
+			log.Printf("close cluster peer sending message of another node: nodeId = %v, fromNodeId = %v", nodeId, msg.FromNodeId)
+			return
+		}
+		t.onMessage(&msg)
+	}
+}
+
+func (t *TcpClusterBus) dial(peer *tcpClusterPeer) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", peer.addrPort, t.dialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("can not dial peer: nodeId = %v, %w", peer.nodeId, err)
+	}
+	if err := t.dialHello(conn, peer.nodeId); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("can not hello to peer: nodeId = %v, %w", peer.nodeId, err)
+	}
+	peer.connMutex.Lock()
+	defer peer.connMutex.Unlock()
+	if t.isStopped() {
+		// Stop has already closed connections
+		conn.Close()
+		return nil, fmt.Errorf("cluster bus is stopped")
+	}
+	peer.conn = conn
+	return conn, nil
+}
+
+func (t *TcpClusterBus) closePeerConn(peer *tcpClusterPeer) {
+	peer.connMutex.Lock()
+	defer peer.connMutex.Unlock()
+	if peer.conn != nil {
+		peer.conn.Close()
+		peer.conn = nil
+	}
+}
+
+// sendLoop writes queued messages to the peer, it dials the peer on demand.
+func (t *TcpClusterBus) sendLoop(peer *tcpClusterPeer) {
+	defer t.wg.Done()
+	defer t.closePeerConn(peer)
+	var conn net.Conn
+	var dialFailedAt time.Time
+	for {
+		var msgBytes []byte
+		select {
+		case msgBytes = <-peer.sendChan:
+		case <-t.stopped:
+			return
+		}
+		if conn == nil {
+			if time.Since(dialFailedAt) < t.dialTimeout {
+				// the peer is down, messages are stale before it comes back
+				continue
+			}
+			newConn, err := t.dial(peer)
+			if err != nil {
+				if t.verbose {
+					log.Printf("can not connect to cluster peer: %v", err)
+				}
+				dialFailedAt = time.Now()
+				continue
+			}
+			conn = newConn
+		}
+		if err := t.writeBytes(conn, msgBytes); err != nil {
+			if t.verbose {
+				log.Printf("can not send to peer: nodeId = %v, %v", peer.nodeId, err)
+			}
+			// reconnect on next message
+			t.closePeerConn(peer)
+			conn = nil
+		}
+	}
+}
+
+func (t *TcpClusterBus) enqueue(peer *tcpClusterPeer, msgBytes []byte) error {
+	select {
+	case peer.sendChan <- msgBytes:
+		return nil
+	default:
+		return fmt.Errorf("send queue of peer is full: nodeId = %v", peer.nodeId)
+	}
+}
+
+// Send queues the message to the peer, it does not wait for the peer to receive it.
+func (t *TcpClusterBus) Send(nodeId string, msg *message.ClusterMessage) error {
+	peer, ok := t.peers[nodeId]
+	if !ok {
+		return fmt.Errorf("not found peer: nodeId = %v", nodeId)
+	}
+	msgBytes, err := t.encodeMessage(msg)
+	if err != nil {
+		return err
+	}
+	return t.enqueue(peer, msgBytes)
+}
+
+func (t *TcpClusterBus) Broadcast(msg *message.ClusterMessage) error {
+	msgBytes, err := t.encodeMessage(msg)
+	if err != nil {
+		return err
+	}
+	for _, peer := range t.peers {
+		if err := t.enqueue(peer, msgBytes); err != nil && t.verbose {
+			log.Printf("can not broadcast cluster message: %v", err)
+		}
+	}
+	return nil
+}
+
+func NewTcpClusterBus(nodeId string, addrPort string, secret string, peers map[string]string, opts ...TcpClusterBusOption) (*TcpClusterBus, error) {
+	baseOpts := defaultTcpClusterBusOptions()
+	for _, opt := range opts {
+		if opt == nil {
+			continue
+		}
+		opt(baseOpts)
+	}
+	if secret == "" {
+		return nil, fmt.Errorf("no cluster secret")
+	}
+	if baseOpts.dialTimeout <= 0 || baseOpts.sendQueueSize <= 0 {
+		return nil, fmt.Errorf("invalid cluster bus options: dialTimeout = %v, sendQueueSize = %v",
+			baseOpts.dialTimeout, baseOpts.sendQueueSize)
+	}
+	tcpPeers := make(map[string]*tcpClusterPeer)
+	for peerNodeId, peerAddrPort := range peers {
+		if peerNodeId == nodeId {
+			continue
+		}
+		tcpPeers[peerNodeId] = &tcpClusterPeer{
+			nodeId:   peerNodeId,
+			addrPort: peerAddrPort,
+			sendChan: make(chan []byte, baseOpts.sendQueueSize),
+		}
+	}
+	return &TcpClusterBus{
+		verbose:     baseOpts.verbose,
+		dialTimeout: baseOpts.dialTimeout,
+		nodeId:      nodeId,
+		addrPort:    addrPort,
+		secret:      secret,
+		peers:       tcpPeers,
+		conns:       make(map[net.Conn]bool),
+		stopped:     make(chan int),
+	}, nil
+}
@@ -0,0 +1,98 @@
+package handler
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+	"github.com/potix/regapweb/message"
+)
+
+func TestTcpClusterBusReceive(t *testing.T) {
+	received := make(chan *message.ClusterMessage, 16)
+	busA, err := NewTcpClusterBus("node-a", "127.0.0.1:0", "secret", nil)
+	if err != nil {
+		t.Fatalf("can not create cluster bus: %v", err)
+	}
+	if err := busA.Start(func(msg *message.ClusterMessage) { received <- msg }); err != nil {
+		t.Fatalf("can not start cluster bus: %v", err)
+	}
+	defer busA.Stop()
+	// the bus of node-b is used only to hello to node-a
+	busB, err := NewTcpClusterBus("node-b", "127.0.0.1:0", "secret", nil)
+	if err != nil {
+		t.Fatalf("can not create cluster bus: %v", err)
+	}
+	encode := func(msg *message.ClusterMessage) string {
+		msgBytes, err := json.Marshal(msg)
+		if err != nil {
+			t.Fatalf("can not marshal cluster message: %v", err)
+		}
+		return string(msgBytes) + "\n"
+	}
+	presence := &message.ClusterMessage{ Kind: message.ClusterKindPresence, FromNodeId: "node-b", Presence: &message.ClusterPresence{} }
+	spoofed := &message.ClusterMessage{ Kind: message.ClusterKindPresence, FromNodeId: "node-c", Presence: &message.ClusterPresence{} }
+	tests := []struct {
+		name      string
+		data      string
+		delivered bool
+		closed    bool
+	}{
+		{ name: "message", data: encode(presence), delivered: true },
+		{ name: "message of another node", data: encode(spoofed), closed: true },
+		{ name: "too large message", data: strings.Repeat("a", clusterMaxFrameSize + 1) + "\n", closed: true },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", busA.listen.Addr().String())
+			if err != nil {
+				t.Fatalf("can not dial: %v", err)
+			}
+			defer conn.Close()
+			if err := busB.dialHello(conn, "node-a"); err != nil {
+				t.Fatalf("can not hello: %v", err)
+			}
+			if _, err := conn.Write([]byte(tt.data)); err != nil {
+				t.Fatalf("can not write: %v", err)
+			}
+			conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+			_, err = conn.Read(make([]byte, 1))
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				if tt.closed {
+					t.Fatalf("connection is not closed")
+				}
+			} else if !tt.closed {
+				t.Fatalf("connection is closed: %v", err)
+			}
+			select {
+			case msg := <-received:
+				if !tt.delivered {
+					t.Fatalf("message is delivered: %+v", msg)
+				}
+				if msg.FromNodeId != "node-b" {
+					t.Fatalf("unexpected message: %+v", msg)
+				}
+			default:
+				if tt.delivered {
+					t.Fatalf("message is not delivered")
+				}
+			}
+		})
+	}
+}
+
+func TestTcpClusterBusTooLargeMessage(t *testing.T) {
+	busA, err := NewTcpClusterBus("node-a", "127.0.0.1:0", "secret", map[string]string{ "node-b": "127.0.0.1:1" })
+	if err != nil {
+		t.Fatalf("can not create cluster bus: %v", err)
+	}
+	msg := &message.ClusterMessage{
+		Kind:       message.ClusterKindSignaling,
+		FromNodeId: "node-a",
+		Message:    &message.Message{ Error: &message.Error{ Message: strings.Repeat("a", clusterMaxFrameSize) } },
+	}
+	if err := busA.Send("node-b", msg); err == nil {
+		t.Fatalf("too large message is queued")
+	}
+}
@@ -0,0 +1,200 @@
+package handler
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+	"github.com/potix/regapweb/message"
+)
+
+func TestDiffPresence(t *testing.T) {
+	deliverer := &message.NameAndId{ Name: "deliverer", Id: "d1" }
+	renamedDeliverer := &message.NameAndId{ Name: "renamed", Id: "d1" }
+	controller := &message.NameAndId{ Name: "controller", Id: "c1" }
+	gamepad := &message.GamepadInfo{ Name: "gamepad", Id: "g1", Status: message.GamepadStatusAvailable }
+	reservedGamepad := &message.GamepadInfo{ Name: "gamepad", Id: "g1", Status: message.GamepadStatusReserved, DelivererId: "d1", ControllerId: "c1" }
+	tests := []struct {
+		name        string
+		oldPresence *message.ClusterPresence
+		newPresence *message.ClusterPresence
+		expected    []string
+	}{
+		{
+			name:     "both nil",
+			expected: []string{},
+		},
+		{
+			name:        "add",
+			newPresence: &message.ClusterPresence{ Deliverers: []*message.NameAndId{ deliverer }, Gamepads: []*message.GamepadInfo{ gamepad } },
+			expected:    []string{ "add:deliverer:d1", "add:gamepad:g1" },
+		},
+		{
+			name:        "delete",
+			oldPresence: &message.ClusterPresence{ Controllers: []*message.NameAndId{ controller }, Gamepads: []*message.GamepadInfo{ gamepad } },
+			expected:    []string{ "delete:controller:c1", "delete:gamepad:g1" },
+		},
+		{
+			name:        "unchanged",
+			oldPresence: &message.ClusterPresence{ Deliverers: []*message.NameAndId{ deliverer }, Gamepads: []*message.GamepadInfo{ gamepad } },
+			newPresence: &message.ClusterPresence{ Deliverers: []*message.NameAndId{ deliverer }, Gamepads: []*message.GamepadInfo{ gamepad } },
+			expected:    []string{},
+		},
+		{
+			name:        "last activity only",
+			oldPresence: &message.ClusterPresence{ Deliverers: []*message.NameAndId{ { Name: "deliverer", Id: "d1", Metadata: &message.ClientMetadata{ LastActivity: 1 } } } },
+			newPresence: &message.ClusterPresence{ Deliverers: []*message.NameAndId{ { Name: "deliverer", Id: "d1", Metadata: &message.ClientMetadata{ LastActivity: 2 } } } },
+			expected:    []string{},
+		},
+		{
+			name:        "metadata",
+			oldPresence: &message.ClusterPresence{ Deliverers: []*message.NameAndId{ deliverer }, Gamepads: []*message.GamepadInfo{ gamepad } },
+			newPresence: &message.ClusterPresence{
+				Deliverers: []*message.NameAndId{ { Name: "deliverer", Id: "d1", Metadata: &message.ClientMetadata{ Account: "account" } } },
+				Gamepads:   []*message.GamepadInfo{ { Name: "gamepad", Id: "g1", Status: message.GamepadStatusAvailable, Metadata: &message.ClientMetadata{ Firmware: "1.0" } } },
+			},
+			expected:    []string{ "update:deliverer:d1", "update:gamepad:g1" },
+		},
+		{
+			name:        "room",
+			oldPresence: &message.ClusterPresence{ Controllers: []*message.NameAndId{ controller }, Gamepads: []*message.GamepadInfo{ gamepad } },
+			newPresence: &message.ClusterPresence{
+				Controllers: []*message.NameAndId{ { Name: "controller", Id: "c1", Room: "room" } },
+				Gamepads:    []*message.GamepadInfo{ { Name: "gamepad", Id: "g1", Status: message.GamepadStatusAvailable, Room: "room" } },
+			},
+			expected:    []string{ "update:controller:c1", "update:gamepad:g1" },
+		},
+		{
+			name:        "update",
+			oldPresence: &message.ClusterPresence{ Deliverers: []*message.NameAndId{ deliverer }, Gamepads: []*message.GamepadInfo{ gamepad } },
+			newPresence: &message.ClusterPresence{ Deliverers: []*message.NameAndId{ renamedDeliverer }, Gamepads: []*message.GamepadInfo{ reservedGamepad } },
+			expected:    []string{ "update:deliverer:d1", "update:gamepad:g1" },
+		},
+		{
+			name:        "replace",
+			oldPresence: &message.ClusterPresence{ Controllers: []*message.NameAndId{ controller } },
+			newPresence: &message.ClusterPresence{ Controllers: []*message.NameAndId{ { Name: "controller", Id: "c2" } } },
+			expected:    []string{ "add:controller:c2", "delete:controller:c1" },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events := make([]string, 0)
+			for _, event := range diffPresence(tt.oldPresence, tt.newPresence) {
+				id := ""
+				if event.Client != nil {
+					id = event.Client.Id
+				} else if event.Gamepad != nil {
+					id = event.Gamepad.Id
+				}
+				events = append(events, event.Event + ":" + event.ClientType + ":" + id)
+			}
+			sort.Strings(events)
+			if !reflect.DeepEqual(events, tt.expected) {
+				t.Fatalf("unexpected events: got %v, want %v", events, tt.expected)
+			}
+		})
+	}
+}
+
+func newTestCluster(t *testing.T, hub *LoopbackClusterHub, nodeId string) (*Cluster, ClientsStore) {
+	localStore := NewMemoryClientsStore()
+	cluster, err := NewCluster(nodeId, hub.NewBus(nodeId), localStore, ClusterPresenceInterval(20 * time.Millisecond))
+	if err != nil {
+		t.Fatalf("can not create cluster: %v", err)
+	}
+	if err := cluster.Start(); err != nil {
+		t.Fatalf("can not start cluster: %v", err)
+	}
+	t.Cleanup(cluster.Stop)
+	return cluster, cluster.ClientsStore()
+}
+
+func waitFor(t *testing.T, what string, fn func() bool) {
+	deadline := time.Now().Add(2 * time.Second)
+	for !fn() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout: %v", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestLoopbackCluster(t *testing.T) {
+	hub := NewLoopbackClusterHub()
+	clusterA, storeA := newTestCluster(t, hub, "node-a")
+	_, storeB := newTestCluster(t, hub, "node-b")
+	var eventsMutex sync.Mutex
+	events := make([]string, 0)
+	subscriptionId := storeB.Subscribe(func(event *message.PresenceEvent) {
+		if event.ClientType != message.ClientTypeGamepad {
+			return
+		}
+		eventsMutex.Lock()
+		defer eventsMutex.Unlock()
+		events = append(events, event.Event + ":" + event.Gamepad.Status)
+	})
+	defer storeB.Unsubscribe(subscriptionId)
+	hasEvent := func(expected string) func() bool {
+		return func() bool {
+			eventsMutex.Lock()
+			defer eventsMutex.Unlock()
+			for _, event := range events {
+				if event == expected {
+					return true
+				}
+			}
+			return false
+		}
+	}
+
+	storeA.AddGamepad("g1", "gamepad", message.DefaultRoom, nil)
+	waitFor(t, "remote gamepad is added", hasEvent("add:" + message.GamepadStatusAvailable))
+	if clnt := storeB.GetClient(message.ClientTypeGamepad, "g1"); clnt == nil || clnt.Name != "gamepad" {
+		t.Fatalf("can not get remote gamepad: %+v", clnt)
+	}
+	if nodeId := clusterA.LookupNode("g1"); nodeId != "" {
+		t.Fatalf("local gamepad is owned by the remote node: %v", nodeId)
+	}
+
+	// the store operation of the remote gamepad is sent to the node that owns it
+	if err := storeB.ReserveGamepad("g1", "d1", "c1"); err != nil {
+		t.Fatalf("can not reserve remote gamepad: %v", err)
+	}
+	if clnt := clusterA.localStore.GetGamepads()[0]; clnt.Status != message.GamepadStatusReserved || clnt.DelivererId != "d1" {
+		t.Fatalf("gamepad is not reserved in the owner: %+v", clnt)
+	}
+	if err := storeB.ReserveGamepad("g1", "d2", "c2"); err == nil {
+		t.Fatalf("gamepad reserved by another deliverer is reserved")
+	}
+	waitFor(t, "remote gamepad is updated", hasEvent("update:" + message.GamepadStatusReserved))
+
+	storeA.DeleteGamepad("g1")
+	waitFor(t, "remote gamepad is deleted", hasEvent("delete:" + message.GamepadStatusReserved))
+	if clnt := storeB.GetClient(message.ClientTypeGamepad, "g1"); clnt != nil {
+		t.Fatalf("deleted gamepad is found: %+v", clnt)
+	}
+}
+
+func TestLoopbackClusterExpireNode(t *testing.T) {
+	hub := NewLoopbackClusterHub()
+	_, storeB := newTestCluster(t, hub, "node-b")
+	clusterA, err := NewCluster("node-a", hub.NewBus("node-a"), NewMemoryClientsStore(), ClusterPresenceInterval(20 * time.Millisecond))
+	if err != nil {
+		t.Fatalf("can not create cluster: %v", err)
+	}
+	if err := clusterA.Start(); err != nil {
+		t.Fatalf("can not start cluster: %v", err)
+	}
+	storeA := clusterA.ClientsStore()
+	storeA.AddDeliverer("d1", "deliverer", message.DefaultRoom, nil)
+	waitFor(t, "remote deliverer is added", func() bool {
+		return storeB.GetClient(message.ClientTypeDeliverer, "d1") != nil
+	})
+	// the presence is expired after the node stops announcing
+	clusterA.Stop()
+	waitFor(t, "remote deliverer is expired", func() bool {
+		return storeB.GetClient(message.ClientTypeDeliverer, "d1") == nil
+	})
+}
@@ -0,0 +1,138 @@
+package handler
+
+import (
+	"fmt"
+	"sync"
+	"github.com/potix/regapweb/message"
+)
+
+// the number of control messages that can be queued for each connection
+const connWriteQueueSize int = 256
+
+const (
+	// connect, signaling and other messages to keep the session
+	messagePriorityControl int = iota
+	// periodic input stream that only the latest one matters
+	messagePriorityBulk
+)
+
+func messagePriority(msgType string) int {
+	if msgType == message.MsgTypeGamepadState || msgType == message.MsgTypeGamepadVibration {
+		return messagePriorityBulk
+	}
+	return messagePriorityControl
+}
+
+// connWriter serializes writes to the connection in its own goroutine.
+// Control messages are written in order ahead of bulk messages,
+// bulk messages are coalesced to the latest one for each gamepad.
+type connWriter struct {
+	write     func(*message.Message) error
+	queueSize int
+	mutex     sync.Mutex
+	cond      *sync.Cond
+	controls  []*message.Message
+	bulkKeys  []string
+	bulks     map[string]*message.Message
+	closed    bool
+	err       error
+	doneChan  chan int
+}
+
+func (w *connWriter) enqueue(msg *message.Message) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.closed {
+		if w.err != nil {
+			return fmt.Errorf("can not write to closed connection: %w", w.err)
+		}
+		return fmt.Errorf("can not write to closed connection")
+	}
+	if messagePriority(msg.MsgType) == messagePriorityBulk {
+		_, _, gamepadId := gamepadMessageIds(msg)
+		key := msg.MsgType + ":" + gamepadId
+		if _, ok := w.bulks[key]; !ok {
+			w.bulkKeys = append(w.bulkKeys, key)
+		}
+		w.bulks[key] = msg
+	} else {
+		if len(w.controls) >= w.queueSize {
+			return fmt.Errorf("write queue is full")
+		}
+		w.controls = append(w.controls, msg)
+	}
+	w.cond.Signal()
+	return nil
+}
+
+// next returns the message to write, or nil after the writer is closed and flushed.
+func (w *connWriter) next() *message.Message {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for {
+		if w.err != nil {
+			return nil
+		}
+		if len(w.controls) > 0 {
+			msg := w.controls[0]
+			w.controls[0] = nil
+			w.controls = w.controls[1:]
+			return msg
+		}
+		if len(w.bulkKeys) > 0 {
+			key := w.bulkKeys[0]
+			w.bulkKeys = w.bulkKeys[1:]
+			msg := w.bulks[key]
+			delete(w.bulks, key)
+			return msg
+		}
+		if w.closed {
+			return nil
+		}
+		w.cond.Wait()
+	}
+}
+
+func (w *connWriter) run() {
+	defer close(w.doneChan)
+	for {
+		msg := w.next()
+		if msg == nil {
+			return
+		}
+		if err := w.write(msg); err != nil {
+			w.mutex.Lock()
+			w.closed = true
+			w.err = err
+			w.controls = nil
+			w.bulkKeys = nil
+			w.bulks = make(map[string]*message.Message)
+			w.mutex.Unlock()
+			return
+		}
+	}
+}
+
+// close stops accepting messages and waits for queued messages to be written.
+// Set the write deadline of the connection to bound the wait.
+func (w *connWriter) close() {
+	w.mutex.Lock()
+	w.closed = true
+	w.cond.Signal()
+	w.mutex.Unlock()
+	<-w.doneChan
+}
+
+func newConnWriter(write func(*message.Message) error, queueSize int) *connWriter {
+	w := &connWriter{
+		write:     write,
+		queueSize: queueSize,
+		controls:  make([]*message.Message, 0),
+		bulkKeys:  make([]string, 0),
+		bulks:     make(map[string]*message.Message),
+		doneChan:  make(chan int),
+	}
+	w.cond = sync.NewCond(&w.mutex)
+	go w.run()
+	return w
+}
@@ -0,0 +1,366 @@
+package handler
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+	bolt "go.etcd.io/bbolt"
+)
+
+var boltCredentialsBucket = []byte("credentials")
+
+// letters of pairing codes, confusing letters such as 0, O, 1 and I are excluded
+const pairingCodeLetters string = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+const pairingCodeLength int = 8
+
+type deviceRegistryOptions struct {
+	verbose    bool
+	pairingTtl time.Duration
+}
+
+func defaultDeviceRegistryOptions() *deviceRegistryOptions {
+	return &deviceRegistryOptions {
+		verbose:    false,
+		pairingTtl: 10 * time.Minute,
+	}
+}
+
+type DeviceRegistryOption func(*deviceRegistryOptions)
+
+func DeviceRegistryVerbose(verbose bool) DeviceRegistryOption {
+        return func(opts *deviceRegistryOptions) {
+                opts.verbose = verbose
+        }
+}
+
+// DeviceRegistryPairingTtl sets how long pairing codes can be redeemed.
+func DeviceRegistryPairingTtl(pairingTtl time.Duration) DeviceRegistryOption {
+        return func(opts *deviceRegistryOptions) {
+                opts.pairingTtl = pairingTtl
+        }
+}
+
+type DeviceCredential struct {
+	DeviceId   string
+	Name       string
+	// empty in the list of credentials
+	Secret     string `json:"Secret,omitempty"`
+	EnrolledAt int64
+	// zero if the credential is active
+	RevokedAt  int64
+}
+
+type PairingCode struct {
+	Code      string
+	// empty if the code enrolls only a new device
+	DeviceId  string `json:"DeviceId,omitempty"`
+	ExpiresAt int64
+}
+
+type pairingCodeEntry struct {
+	deviceId  string
+	expiresAt time.Time
+}
+
+// OnDeviceRevoked is called after the credential of the device is revoked.
+type OnDeviceRevoked func(deviceId string)
+
+// DeviceRegistry keeps per-device credentials that gamepads are authenticated by.
+// A device redeems the pairing code issued by an admin in its first handshake and gets the credential.
+// The pairing code issued for the device id re-pairs the enrolled device, otherwise it enrolls only a new device.
+type DeviceRegistry interface {
+	IssuePairingCode(deviceId string) (*PairingCode, error)
+	Enroll(pairingCode string, deviceId string, name string) (*DeviceCredential, error)
+	GetCredential(deviceId string) *DeviceCredential
+	GetCredentials() []*DeviceCredential
+	Revoke(deviceId string) error
+	Subscribe(onRevoked OnDeviceRevoked) int
+	Unsubscribe(subscriptionId int)
+	Close() error
+}
+
+type MemoryDeviceRegistry struct {
+	verbose            bool
+	pairingTtl         time.Duration
+	mutex              sync.Mutex
+	credentials        map[string]*DeviceCredential
+	pairingCodes       map[string]*pairingCodeEntry
+	subscribersMutex   sync.Mutex
+	subscribers        map[int]OnDeviceRevoked
+	nextSubscriptionId int
+}
+
+func copyDeviceCredential(credential *DeviceCredential) *DeviceCredential {
+	copied := *credential
+	return &copied
+}
+
+func newPairingCode() (string, error) {
+	codeBytes := make([]byte, pairingCodeLength)
+	if _, err := rand.Read(codeBytes); err != nil {
+		return "", fmt.Errorf("can not read random: %w", err)
+	}
+	for i, b := range codeBytes {
+		codeBytes[i] = pairingCodeLetters[int(b) % len(pairingCodeLetters)]
+	}
+	return string(codeBytes), nil
+}
+
+// IssuePairingCode issues the code that re-pairs the device of the device id,
+// or the code that enrolls only a new device if the device id is empty.
+func (m *MemoryDeviceRegistry) IssuePairingCode(deviceId string) (*PairingCode, error) {
+	code, err := newPairingCode()
+	if err != nil {
+		return nil, fmt.Errorf("can not create pairing code: %w", err)
+	}
+	expiresAt := time.Now().Add(m.pairingTtl)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	now := time.Now()
+	for c, e := range m.pairingCodes {
+		if now.After(e.expiresAt) {
+			delete(m.pairingCodes, c)
+		}
+	}
+	if deviceId != "" {
+		if _, ok := m.credentials[deviceId]; !ok {
+			return nil, fmt.Errorf("device is not enrolled: %v", deviceId)
+		}
+	}
+	m.pairingCodes[code] = &pairingCodeEntry{
+		deviceId:  deviceId,
+		expiresAt: expiresAt,
+	}
+	if m.verbose {
+		log.Printf("issue pairing code: deviceId = %v, expiresAt = %v", deviceId, expiresAt)
+	}
+	return &PairingCode{
+		Code:      code,
+		DeviceId:  deviceId,
+		ExpiresAt: expiresAt.Unix(),
+	}, nil
+}
+
+// baseEnroll redeems the pairing code and creates the credential of the device,
+// the credential is kept only if persist succeeds.
+func (m *MemoryDeviceRegistry) baseEnroll(pairingCode string, deviceId string, name string, persist func(*DeviceCredential) error) (*DeviceCredential, error) {
+	secretBytes := make([]byte, 32)
+	if _, err := rand.Read(secretBytes); err != nil {
+		return nil, fmt.Errorf("can not create secret: %w", err)
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	entry, ok := m.pairingCodes[pairingCode]
+	if !ok {
+		return nil, fmt.Errorf("unknown pairing code")
+	}
+	// pairing code can be used only once
+	delete(m.pairingCodes, pairingCode)
+	if time.Now().After(entry.expiresAt) {
+		return nil, fmt.Errorf("pairing code is expired")
+	}
+	if entry.deviceId != "" && entry.deviceId != deviceId {
+		return nil, fmt.Errorf("pairing code is issued for another device: deviceId = %v", deviceId)
+	}
+	// the active device must not be locked out and the revocation must not be undone without the re-pairing by an admin
+	if _, ok := m.credentials[deviceId]; ok && entry.deviceId == "" {
+		return nil, fmt.Errorf("device is already enrolled: %v", deviceId)
+	}
+	credential := &DeviceCredential{
+		DeviceId:   deviceId,
+		Name:       name,
+		Secret:     hex.EncodeToString(secretBytes),
+		EnrolledAt: time.Now().Unix(),
+	}
+	if persist != nil {
+		if err := persist(credential); err != nil {
+			return nil, err
+		}
+	}
+	m.credentials[deviceId] = credential
+	if m.verbose {
+		log.Printf("enroll device: deviceId = %v, repaired = %v", deviceId, entry.deviceId != "")
+	}
+	return copyDeviceCredential(credential), nil
+}
+
+// Enroll redeems the pairing code and creates the credential of the device.
+// The enrolled device can be enrolled again only by the pairing code issued for it.
+func (m *MemoryDeviceRegistry) Enroll(pairingCode string, deviceId string, name string) (*DeviceCredential, error) {
+	return m.baseEnroll(pairingCode, deviceId, name, nil)
+}
+
+// GetCredential returns the credential of the device including the revoked one, or nil if it is not enrolled.
+func (m *MemoryDeviceRegistry) GetCredential(deviceId string) *DeviceCredential {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	credential, ok := m.credentials[deviceId]
+	if !ok {
+		return nil
+	}
+	return copyDeviceCredential(credential)
+}
+
+// GetCredentials returns credentials without secrets.
+func (m *MemoryDeviceRegistry) GetCredentials() []*DeviceCredential {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	credentials := make([]*DeviceCredential, 0, len(m.credentials))
+	for _, credential := range m.credentials {
+		copied := copyDeviceCredential(credential)
+		copied.Secret = ""
+		credentials = append(credentials, copied)
+	}
+	sort.Slice(credentials, func(i, j int) bool {
+		return credentials[i].DeviceId < credentials[j].DeviceId
+	})
+	return credentials
+}
+
+func (m *MemoryDeviceRegistry) baseRevoke(deviceId string) (*DeviceCredential, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	credential, ok := m.credentials[deviceId]
+	if !ok {
+		return nil, fmt.Errorf("device is not enrolled: %v", deviceId)
+	}
+	if credential.RevokedAt == 0 {
+		credential.RevokedAt = time.Now().Unix()
+	}
+	if m.verbose {
+		log.Printf("revoke device: deviceId = %v", deviceId)
+	}
+	return copyDeviceCredential(credential), nil
+}
+
+func (m *MemoryDeviceRegistry) publishRevoked(deviceId string) {
+	m.subscribersMutex.Lock()
+	defer m.subscribersMutex.Unlock()
+	for _, onRevoked := range m.subscribers {
+		onRevoked(deviceId)
+	}
+}
+
+// Revoke revokes the credential of the device and notifies subscribers to disconnect it.
+func (m *MemoryDeviceRegistry) Revoke(deviceId string) error {
+	if _, err := m.baseRevoke(deviceId); err != nil {
+		return err
+	}
+	m.publishRevoked(deviceId)
+	return nil
+}
+
+func (m *MemoryDeviceRegistry) Subscribe(onRevoked OnDeviceRevoked) int {
+	m.subscribersMutex.Lock()
+	defer m.subscribersMutex.Unlock()
+	m.nextSubscriptionId += 1
+	m.subscribers[m.nextSubscriptionId] = onRevoked
+	return m.nextSubscriptionId
+}
+
+func (m *MemoryDeviceRegistry) Unsubscribe(subscriptionId int) {
+	m.subscribersMutex.Lock()
+	defer m.subscribersMutex.Unlock()
+	delete(m.subscribers, subscriptionId)
+}
+
+func (m *MemoryDeviceRegistry) Close() error {
+	return nil
+}
+
+func NewMemoryDeviceRegistry(opts ...DeviceRegistryOption) *MemoryDeviceRegistry {
+	baseOpts := defaultDeviceRegistryOptions()
+	for _, opt := range opts {
+		if opt == nil {
+			continue
+		}
+		opt(baseOpts)
+	}
+	return &MemoryDeviceRegistry{
+		verbose:      baseOpts.verbose,
+		pairingTtl:   baseOpts.pairingTtl,
+		credentials:  make(map[string]*DeviceCredential),
+		pairingCodes: make(map[string]*pairingCodeEntry),
+		subscribers:  make(map[int]OnDeviceRevoked),
+	}
+}
+
+// BoltDeviceRegistry is the DeviceRegistry that persists credentials to the bolt database.
+// Pairing codes are kept only in memory.
+type BoltDeviceRegistry struct {
+	*MemoryDeviceRegistry
+	db *bolt.DB
+}
+
+func (b *BoltDeviceRegistry) putCredential(credential *DeviceCredential) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		credentialBytes, err := json.Marshal(credential)
+		if err != nil {
+			return fmt.Errorf("can not marshal credential: %w", err)
+		}
+		return tx.Bucket(boltCredentialsBucket).Put([]byte(credential.DeviceId), credentialBytes)
+	})
+}
+
+// Enroll persists the credential before it is kept in memory, the device is not enrolled if it is not persisted.
+func (b *BoltDeviceRegistry) Enroll(pairingCode string, deviceId string, name string) (*DeviceCredential, error) {
+	return b.baseEnroll(pairingCode, deviceId, name, func(credential *DeviceCredential) error {
+		if err := b.putCredential(credential); err != nil {
+			return fmt.Errorf("can not persist credential: %w", err)
+		}
+		return nil
+	})
+}
+
+func (b *BoltDeviceRegistry) Revoke(deviceId string) error {
+	credential, err := b.baseRevoke(deviceId)
+	if err != nil {
+		return err
+	}
+	// connections are closed even if the revocation is not persisted
+	b.publishRevoked(deviceId)
+	if err := b.putCredential(credential); err != nil {
+		return fmt.Errorf("can not persist revocation: %w", err)
+	}
+	return nil
+}
+
+func (b *BoltDeviceRegistry) Close() error {
+	return b.db.Close()
+}
+
+func NewBoltDeviceRegistry(dbPath string, opts ...DeviceRegistryOption) (*BoltDeviceRegistry, error) {
+	db, err := bolt.Open(dbPath, 0600, &bolt.Options{ Timeout: 5 * time.Second })
+	if err != nil {
+		return nil, fmt.Errorf("can not open bolt database: %w", err)
+	}
+	memoryRegistry := NewMemoryDeviceRegistry(opts...)
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(boltCredentialsBucket)
+		if err != nil {
+			return fmt.Errorf("can not create bucket %s: %w", boltCredentialsBucket, err)
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			credential := new(DeviceCredential)
+			if err := json.Unmarshal(v, credential); err != nil {
+				return fmt.Errorf("can not unmarshal credential: %w", err)
+			}
+			memoryRegistry.credentials[credential.DeviceId] = credential
+			return nil
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("can not initialize bolt database: %w", err)
+	}
+	return &BoltDeviceRegistry{
+		MemoryDeviceRegistry: memoryRegistry,
+		db:                   db,
+	}, nil
+}
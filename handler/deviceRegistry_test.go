@@ -0,0 +1,230 @@
+package handler
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+	"github.com/google/uuid"
+	"github.com/potix/regapweb/message"
+)
+
+func newTestDeviceRegistries(t *testing.T, opts ...DeviceRegistryOption) map[string]DeviceRegistry {
+	boltRegistry, err := NewBoltDeviceRegistry(filepath.Join(t.TempDir(), "devices.db"), opts...)
+	if err != nil {
+		t.Fatalf("can not create bolt device registry: %v", err)
+	}
+	t.Cleanup(func() { boltRegistry.Close() })
+	return map[string]DeviceRegistry{
+		"memory": NewMemoryDeviceRegistry(opts...),
+		"bolt":   boltRegistry,
+	}
+}
+
+func TestDeviceRegistryEnroll(t *testing.T) {
+	tests := []struct {
+		name     string
+		// enrolls the device beforehand, and returns the pairing code to enroll it
+		prepare  func(t *testing.T, registry DeviceRegistry, deviceId string) string
+		accepted bool
+	}{
+		{
+			name: "new device",
+			prepare: func(t *testing.T, registry DeviceRegistry, deviceId string) string {
+				return issueTestPairingCode(t, registry, "")
+			},
+			accepted: true,
+		},
+		{
+			name: "used pairing code",
+			prepare: func(t *testing.T, registry DeviceRegistry, deviceId string) string {
+				code := issueTestPairingCode(t, registry, "")
+				if _, err := registry.Enroll(code, uuid.New().String(), "other"); err != nil {
+					t.Fatalf("can not enroll other device: %v", err)
+				}
+				return code
+			},
+			accepted: false,
+		},
+		{
+			name: "unknown pairing code",
+			prepare: func(t *testing.T, registry DeviceRegistry, deviceId string) string {
+				return "ABCDEFGH"
+			},
+			accepted: false,
+		},
+		{
+			name: "enrolled device by code for new device",
+			prepare: func(t *testing.T, registry DeviceRegistry, deviceId string) string {
+				enrollTestDevice(t, registry, deviceId)
+				return issueTestPairingCode(t, registry, "")
+			},
+			accepted: false,
+		},
+		{
+			name: "revoked device by code for new device",
+			prepare: func(t *testing.T, registry DeviceRegistry, deviceId string) string {
+				enrollTestDevice(t, registry, deviceId)
+				if err := registry.Revoke(deviceId); err != nil {
+					t.Fatalf("can not revoke device: %v", err)
+				}
+				return issueTestPairingCode(t, registry, "")
+			},
+			accepted: false,
+		},
+		{
+			name: "enrolled device by code for it",
+			prepare: func(t *testing.T, registry DeviceRegistry, deviceId string) string {
+				enrollTestDevice(t, registry, deviceId)
+				return issueTestPairingCode(t, registry, deviceId)
+			},
+			accepted: true,
+		},
+		{
+			name: "code for other device",
+			prepare: func(t *testing.T, registry DeviceRegistry, deviceId string) string {
+				otherDeviceId := uuid.New().String()
+				enrollTestDevice(t, registry, otherDeviceId)
+				return issueTestPairingCode(t, registry, otherDeviceId)
+			},
+			accepted: false,
+		},
+	}
+	for registryName, registry := range newTestDeviceRegistries(t) {
+		for _, tt := range tests {
+			t.Run(registryName + "/" + tt.name, func(t *testing.T) {
+				deviceId := uuid.New().String()
+				code := tt.prepare(t, registry, deviceId)
+				previous := registry.GetCredential(deviceId)
+				credential, err := registry.Enroll(code, deviceId, "gamepad")
+				if (err == nil) != tt.accepted {
+					t.Fatalf("unexpected result: got %v, want accepted %v", err, tt.accepted)
+				}
+				current := registry.GetCredential(deviceId)
+				if !tt.accepted {
+					if previous == nil && current != nil || previous != nil && *previous != *current {
+						t.Fatalf("credential is changed by the refused enrollment: %v", current)
+					}
+					return
+				}
+				if current == nil || current.Secret != credential.Secret || current.RevokedAt != 0 {
+					t.Fatalf("unexpected credential: got %v, want %v", current, credential)
+				}
+				if previous != nil && previous.Secret == current.Secret {
+					t.Fatalf("secret is not renewed by the re-pairing")
+				}
+			})
+		}
+	}
+}
+
+func TestDeviceRegistryPairingTtl(t *testing.T) {
+	for registryName, registry := range newTestDeviceRegistries(t, DeviceRegistryPairingTtl(time.Millisecond)) {
+		t.Run(registryName, func(t *testing.T) {
+			code := issueTestPairingCode(t, registry, "")
+			time.Sleep(10 * time.Millisecond)
+			if _, err := registry.Enroll(code, uuid.New().String(), "gamepad"); err == nil {
+				t.Fatalf("expired pairing code is redeemed")
+			}
+		})
+	}
+}
+
+func issueTestPairingCode(t *testing.T, registry DeviceRegistry, deviceId string) string {
+	pairingCode, err := registry.IssuePairingCode(deviceId)
+	if err != nil {
+		t.Fatalf("can not issue pairing code: %v", err)
+	}
+	return pairingCode.Code
+}
+
+func enrollTestDevice(t *testing.T, registry DeviceRegistry, deviceId string) *DeviceCredential {
+	credential, err := registry.Enroll(issueTestPairingCode(t, registry, ""), deviceId, "gamepad")
+	if err != nil {
+		t.Fatalf("can not enroll device: %v", err)
+	}
+	return credential
+}
+
+func TestDeviceRegistryRevoke(t *testing.T) {
+	registry := NewMemoryDeviceRegistry()
+	tcpHandler := newTestTcpHandler(t, TcpDeviceRegistry(registry))
+	deviceId := uuid.New().String()
+	other := dialTestGamepad(t, tcpHandler)
+	otherDeviceId := uuid.New().String()
+	otherCredential := enrollTestDevice(t, registry, otherDeviceId)
+	res, _ := other.handshake(&message.GamepadHandshakeRequest{ Name: "other", DeviceId: otherDeviceId }, func(nonce string) string {
+		return ChallengeDigest(otherCredential.Secret, nonce, otherDeviceId)
+	})
+	if res.Error != nil {
+		t.Fatalf("can not handshake other device: %v", res.Error.Message)
+	}
+
+	// the device redeems the pairing code in its first handshake
+	gamepad := dialTestGamepad(t, tcpHandler)
+	res, _ = gamepad.handshake(&message.GamepadHandshakeRequest{
+		Name:        "gamepad",
+		DeviceId:    deviceId,
+		PairingCode: issueTestPairingCode(t, registry, ""),
+	}, nil)
+	if res.Error != nil || res.GamepadHandshakeResponse.Credential == "" {
+		t.Fatalf("can not enroll by pairing code: %v", res.Error)
+	}
+	credential := res.GamepadHandshakeResponse.Credential
+	tests := []struct {
+		name     string
+		secret   string
+		accepted bool
+	}{
+		// the enrolled device is never authenticated by the shared secret
+		{ name: "shared secret", secret: "secret", accepted: false },
+		{ name: "credential", secret: credential, accepted: true },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gamepad := dialTestGamepad(t, tcpHandler)
+			res, _ := gamepad.handshake(&message.GamepadHandshakeRequest{ Name: "gamepad", DeviceId: deviceId }, func(nonce string) string {
+				return ChallengeDigest(tt.secret, nonce, deviceId)
+			})
+			if (res.Error == nil) != tt.accepted {
+				t.Fatalf("unexpected result: got %v, want accepted %v", res.Error, tt.accepted)
+			}
+		})
+	}
+
+	// the live session takes over the session authenticated by the credential above
+	live := dialTestGamepad(t, tcpHandler)
+	res, _ = live.handshake(&message.GamepadHandshakeRequest{ Name: "gamepad", DeviceId: deviceId }, func(nonce string) string {
+		return ChallengeDigest(credential, nonce, deviceId)
+	})
+	if res.Error != nil {
+		t.Fatalf("can not handshake by credential: %v", res.Error.Message)
+	}
+	// the pipe is not buffered, messages are read while the revocation writes them
+	received := make(chan *message.Message, 2)
+	go func() {
+		received <- live.read()
+		received <- live.read()
+	}()
+	if err := registry.Revoke(deviceId); err != nil {
+		t.Fatalf("can not revoke device: %v", err)
+	}
+	if msg := <-received; msg == nil || msg.MsgType != message.MsgTypeGamepadRevoked {
+		t.Fatalf("revoked device is not notified: %v", msg)
+	}
+	if msg := <-received; msg != nil {
+		t.Fatalf("revoked device is not disconnected: %v", msg.MsgType)
+	}
+	gamepad = dialTestGamepad(t, tcpHandler)
+	res, _ = gamepad.handshake(&message.GamepadHandshakeRequest{ Name: "gamepad", DeviceId: deviceId }, func(nonce string) string {
+		return ChallengeDigest(credential, nonce, deviceId)
+	})
+	if res.Error == nil {
+		t.Fatalf("revoked device is authenticated")
+	}
+
+	// other devices keep their sessions
+	other.write(&message.Message{ MsgType: message.MsgTypePing })
+	if tcpHandler.getClientConn(otherDeviceId) == nil {
+		t.Fatalf("other device is disconnected")
+	}
+}
@@ -1,17 +1,26 @@
 package handler
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"sort"
+	"sync"
+	"time"
 	"github.com/potix/regapweb/message"
 )
 
 type forwarderOptions struct {
-	verbose bool
+	verbose      bool
+	queueSize    int
+	drainTimeout time.Duration
 }
 
 func defaultForwarderOptions() *forwarderOptions {
 	return &forwarderOptions {
-		verbose: false,
+		verbose:      false,
+		queueSize:    64,
+		drainTimeout: 5 * time.Second,
 	}
 }
 
@@ -23,6 +32,20 @@ func ForwarderVerbose(verbose bool) ForwarderOption {
         }
 }
 
+// ForwarderQueueSize sets the number of control messages that can be queued for each gamepad.
+func ForwarderQueueSize(queueSize int) ForwarderOption {
+        return func(opts *forwarderOptions) {
+                opts.queueSize = queueSize
+        }
+}
+
+// ForwarderDrainTimeout sets how long Stop waits for queued messages to be delivered.
+func ForwarderDrainTimeout(drainTimeout time.Duration) ForwarderOption {
+        return func(opts *forwarderOptions) {
+                opts.drainTimeout = drainTimeout
+        }
+}
+
 type ErrorCb func(error)
 
 type OnFromTcp func(*message.Message) error
@@ -34,88 +57,346 @@ type msgAndErrCb struct {
 	errCb ErrorCb
 }
 
-type Forwarder struct {
-	verbose         bool
-        toTcpChan       chan *msgAndErrCb
-        toWsChan        chan *msgAndErrCb
-        stopFromTcpChan chan int
-        stopFromWsChan  chan int
-	started         bool
+const (
+	forwarderDirectionToTcp string = "toTcp"
+	forwarderDirectionToWs         = "toWs"
+)
+
+type ForwarderQueueStats struct {
+	Direction string
+	GamepadId string
+	Depth     int
+	Enqueued  uint64
+	Coalesced uint64
+	Rejected  uint64
 }
 
-func (f *Forwarder)Start() {
-	f.started = true
+type ForwarderStats struct {
+	Queues    []*ForwarderQueueStats
+	Enqueued  uint64
+	Coalesced uint64
+	Rejected  uint64
+	Link      *ForwarderLinkStats `json:",omitempty"`
 }
 
-func (f *Forwarder)Stop() {
-	f.started = false
+// forwarderQueue keeps messages to one gamepad in one direction.
+// Control messages are queued in order and delivered ahead of bulk messages,
+// bulk messages are coalesced to the latest one.
+// The queue and its counters are kept while the gamepad exists.
+type forwarderQueue struct {
+	key       string
+	direction string
+	gamepadId string
+	controls  []*msgAndErrCb
+	state     *msgAndErrCb
+	running   bool
+	// the gamepad went away, the queue is deleted when it becomes empty
+	forgotten bool
+	enqueued  uint64
+	coalesced uint64
+	rejected  uint64
 }
 
-func (f *Forwarder)ToTcp(msg *message.Message, errCb ErrorCb) {
-	if f.started {
-		f.toTcpChan <- &msgAndErrCb{ msg: msg, errCb: errCb }
+func (q *forwarderQueue) depth() int {
+	depth := len(q.controls)
+	if q.state != nil {
+		depth += 1
 	}
+	return depth
 }
 
-func (f *Forwarder)ToWs(msg *message.Message, errCb ErrorCb) {
-	if f.started {
-		f.toWsChan <- &msgAndErrCb{ msg: msg, errCb: errCb }
+// waitTimeout waits for the wait group, and returns false if it does not finish within the timeout.
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan int)
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
 	}
 }
 
-func (f *Forwarder) StartFromTcpListener(fn OnFromTcp) {
-	go func() {
+// Forwarder forwards messages between websocket clients and tcp gamepads.
+// It accepts messages until the context of Start is canceled or Stop is called,
+// and Stop waits for queued messages to be delivered.
+type Forwarder interface {
+	Start(ctx context.Context)
+	Stop()
+	ToTcp(msg *message.Message, errCb ErrorCb)
+	ToWs(msg *message.Message, errCb ErrorCb)
+	StartFromTcpListener(fn OnFromTcp)
+	StopFromTcpListener()
+	StartFromWsListener(fn OnFromWs)
+	StopFromWsListener()
+	ForgetGamepad(gamepadId string)
+	Stats() *ForwarderStats
+}
+
+// LocalForwarder is the Forwarder in the process.
+// Each queue is drained by its own goroutine, so that a slow gamepad does not block others.
+type LocalForwarder struct {
+	verbose      bool
+	queueSize    int
+	drainTimeout time.Duration
+	mutex        sync.Mutex
+	queues       map[string]*forwarderQueue
+	onFromTcp    OnFromTcp
+	onFromWs     OnFromWs
+	ctx          context.Context
+	cancel       context.CancelFunc
+	drainWg      sync.WaitGroup
+	enqueued     uint64
+	coalesced    uint64
+	rejected     uint64
+}
+
+func (f *LocalForwarder)Start(ctx context.Context) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.ctx, f.cancel = context.WithCancel(ctx)
+}
+
+func (f *LocalForwarder)Stop() {
+	f.mutex.Lock()
+	if f.cancel == nil {
+		f.mutex.Unlock()
+		return
+	}
+	// no drain goroutine is started after the cancellation
+	f.cancel()
+	f.mutex.Unlock()
+	if waitTimeout(&f.drainWg, f.drainTimeout) {
 		if f.verbose {
-			log.Printf("start from tcp listener")
+			log.Printf("drained forwarder queues")
+		}
+		return
+	}
+	// drop pending messages, running goroutines finish when queues become empty
+	dropped := make([]*msgAndErrCb, 0)
+	f.mutex.Lock()
+	for _, q := range f.queues {
+		dropped = append(dropped, q.controls...)
+		if q.state != nil {
+			dropped = append(dropped, q.state)
+		}
+		q.controls = nil
+		q.state = nil
+	}
+	f.mutex.Unlock()
+	log.Printf("can not drain forwarder queues in time, drop %v messages", len(dropped))
+	for _, v := range dropped {
+		if v.errCb != nil {
+			v.errCb(fmt.Errorf("forwarder is stopped"))
+		}
+	}
+}
+
+func (f *LocalForwarder) enqueue(direction string, msg *message.Message, errCb ErrorCb) {
+	f.mutex.Lock()
+	if f.ctx == nil || f.ctx.Err() != nil {
+		f.mutex.Unlock()
+		if errCb != nil {
+			errCb(fmt.Errorf("forwarder is stopped"))
 		}
-		for {
-			select {
-			case v := <-f.toWsChan:
-				err := fn(v.msg)
-				if err != nil && v.errCb != nil {
-					v.errCb(err)
-				}
-			case <-f.stopFromTcpChan:
-				return
+		return
+	}
+	_, _, gamepadId := gamepadMessageIds(msg)
+	key := direction + ":" + gamepadId
+	q, ok := f.queues[key]
+	if !ok {
+		q = &forwarderQueue{
+			key:       key,
+			direction: direction,
+			gamepadId: gamepadId,
+		}
+		f.queues[key] = q
+	}
+	v := &msgAndErrCb{ msg: msg, errCb: errCb }
+	if messagePriority(msg.MsgType) == messagePriorityBulk {
+		if q.state != nil {
+			q.coalesced += 1
+			f.coalesced += 1
+		}
+		q.state = v
+	} else {
+		if len(q.controls) >= f.queueSize {
+			q.rejected += 1
+			f.rejected += 1
+			f.mutex.Unlock()
+			log.Printf("forwarder queue is full: direction = %v, gamepadId = %v, msgType = %v", direction, gamepadId, msg.MsgType)
+			if errCb != nil {
+				errCb(fmt.Errorf("forwarder queue is full"))
 			}
+			return
 		}
-		if f.verbose {
-			log.Printf("finish from tcp listener")
+		q.controls = append(q.controls, v)
+	}
+	q.enqueued += 1
+	f.enqueued += 1
+	if !q.running {
+		q.running = true
+		f.drainWg.Add(1)
+		go f.drain(q)
+	}
+	f.mutex.Unlock()
+}
+
+func (f *LocalForwarder) dequeue(q *forwarderQueue) (*msgAndErrCb, func(*message.Message) error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	var v *msgAndErrCb
+	if len(q.controls) > 0 {
+		v = q.controls[0]
+		q.controls[0] = nil
+		q.controls = q.controls[1:]
+	} else if q.state != nil {
+		v = q.state
+		q.state = nil
+	} else {
+		q.running = false
+		if q.forgotten && f.queues[q.key] == q {
+			delete(f.queues, q.key)
 		}
-	}()
+		return nil, nil
+	}
+	if q.direction == forwarderDirectionToTcp {
+		if f.onFromWs == nil {
+			return v, nil
+		}
+		return v, f.onFromWs
+	}
+	if f.onFromTcp == nil {
+		return v, nil
+	}
+	return v, f.onFromTcp
+}
+
+func (f *LocalForwarder) drain(q *forwarderQueue) {
+	defer f.drainWg.Done()
+	for {
+		v, fn := f.dequeue(q)
+		if v == nil {
+			return
+		}
+		var err error
+		if fn == nil {
+			err = fmt.Errorf("no listener")
+		} else {
+			err = fn(v.msg)
+		}
+		if err != nil && v.errCb != nil {
+			v.errCb(err)
+		}
+	}
 }
 
-func (f *Forwarder) StopFromTcpListener() {
-	close(f.stopFromTcpChan)
+func (f *LocalForwarder)ToTcp(msg *message.Message, errCb ErrorCb) {
+	f.enqueue(forwarderDirectionToTcp, msg, errCb)
 }
 
-func (f *Forwarder) StartFromWsListener(fn OnFromWs) {
-	go func() {
-		if f.verbose {
-			log.Printf("start from http listener")
+func (f *LocalForwarder)ToWs(msg *message.Message, errCb ErrorCb) {
+	f.enqueue(forwarderDirectionToWs, msg, errCb)
+}
+
+// ForgetGamepad deletes queues and counters of the gamepad that went away,
+// after queued messages are delivered.
+func (f *LocalForwarder) ForgetGamepad(gamepadId string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, direction := range []string{ forwarderDirectionToTcp, forwarderDirectionToWs } {
+		key := direction + ":" + gamepadId
+		q, ok := f.queues[key]
+		if !ok {
+			continue
 		}
-		for {
-			select {
-			case v := <-f.toTcpChan:
-				err := fn(v.msg)
-				if err != nil && v.errCb != nil {
-					v.errCb(err)
-				}
-			case <-f.stopFromWsChan:
-				return
-			}
+		if q.running {
+			q.forgotten = true
+			continue
 		}
-		if f.verbose {
-			log.Printf("finish from http listener")
+		delete(f.queues, key)
+	}
+}
+
+// Stats returns depth and counters of queues of existing gamepads and total counters.
+func (f *LocalForwarder) Stats() *ForwarderStats {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	stats := &ForwarderStats{
+		Queues:    make([]*ForwarderQueueStats, 0, len(f.queues)),
+		Enqueued:  f.enqueued,
+		Coalesced: f.coalesced,
+		Rejected:  f.rejected,
+	}
+	for _, q := range f.queues {
+		stats.Queues = append(stats.Queues, &ForwarderQueueStats{
+			Direction: q.direction,
+			GamepadId: q.gamepadId,
+			Depth:     q.depth(),
+			Enqueued:  q.enqueued,
+			Coalesced: q.coalesced,
+			Rejected:  q.rejected,
+		})
+	}
+	sort.Slice(stats.Queues, func(i, j int) bool {
+		if stats.Queues[i].GamepadId != stats.Queues[j].GamepadId {
+			return stats.Queues[i].GamepadId < stats.Queues[j].GamepadId
 		}
-	}()
+		return stats.Queues[i].Direction < stats.Queues[j].Direction
+	})
+	return stats
+}
+
+// hasListener returns true if the listener of messages in the direction is started.
+func (f *LocalForwarder) hasListener(direction string) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if direction == forwarderDirectionToTcp {
+		return f.onFromWs != nil
+	}
+	return f.onFromTcp != nil
+}
+
+func (f *LocalForwarder) StartFromTcpListener(fn OnFromTcp) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.verbose {
+		log.Printf("start from tcp listener")
+	}
+	f.onFromTcp = fn
+}
+
+func (f *LocalForwarder) StopFromTcpListener() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.verbose {
+		log.Printf("finish from tcp listener")
+	}
+	f.onFromTcp = nil
 }
 
-func (f *Forwarder) StopFromWsListener() {
-	close(f.stopFromWsChan)
+func (f *LocalForwarder) StartFromWsListener(fn OnFromWs) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.verbose {
+		log.Printf("start from http listener")
+	}
+	f.onFromWs = fn
+}
+
+func (f *LocalForwarder) StopFromWsListener() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.verbose {
+		log.Printf("finish from http listener")
+	}
+	f.onFromWs = nil
 }
 
-func NewForwarder(opts ...ForwarderOption) *Forwarder {
+func NewLocalForwarder(opts ...ForwarderOption) *LocalForwarder {
 	baseOpts := defaultForwarderOptions()
         for _, opt := range opts {
                 if opt == nil {
@@ -123,12 +404,10 @@ func NewForwarder(opts ...ForwarderOption) *Forwarder {
                 }
                 opt(baseOpts)
         }
-	return &Forwarder{
-		verbose:         baseOpts.verbose,
-		toTcpChan:       make(chan *msgAndErrCb),
-		toWsChan:        make(chan *msgAndErrCb),
-		stopFromTcpChan: make(chan int),
-		stopFromWsChan:  make(chan int),
-		started:         false,
+	return &LocalForwarder{
+		verbose:      baseOpts.verbose,
+		queueSize:    baseOpts.queueSize,
+		drainTimeout: baseOpts.drainTimeout,
+		queues:       make(map[string]*forwarderQueue),
 	}
 }
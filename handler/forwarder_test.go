@@ -0,0 +1,213 @@
+package handler
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+	"github.com/potix/regapweb/message"
+)
+
+// testForwarderListener records messages delivered to tcp, and blocks the delivery of the first message until it is released.
+type testForwarderListener struct {
+	mutex     sync.Mutex
+	delivered []string
+	blocked   chan struct{}
+	release   chan struct{}
+	blockOnce sync.Once
+}
+
+func newTestForwarderListener() *testForwarderListener {
+	return &testForwarderListener{
+		delivered: make([]string, 0),
+		blocked:   make(chan struct{}),
+		release:   make(chan struct{}),
+	}
+}
+
+func (l *testForwarderListener) onFromWs(msg *message.Message) error {
+	l.blockOnce.Do(func() {
+		close(l.blocked)
+		<-l.release
+	})
+	_, controllerId, _ := gamepadMessageIds(msg)
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.delivered = append(l.delivered, controllerId)
+	return nil
+}
+
+func (l *testForwarderListener) getDelivered() []string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return append([]string{}, l.delivered...)
+}
+
+func newTestForwarder(t *testing.T, listener *testForwarderListener, opts ...ForwarderOption) *LocalForwarder {
+	forwarder := NewLocalForwarder(opts...)
+	forwarder.StartFromWsListener(listener.onFromWs)
+	forwarder.Start(context.Background())
+	t.Cleanup(forwarder.Stop)
+	return forwarder
+}
+
+// testControl and testState are labeled by the controller id.
+func testControl(label string) *message.Message {
+	return &message.Message{
+		MsgType: message.MsgTypeGamepadConnectReq,
+		GamepadConnectRequest: &message.GamepadConnectRequest{ ControllerId: label, GamepadId: "g1" },
+	}
+}
+
+func testState(label string) *message.Message {
+	return &message.Message{
+		MsgType:      message.MsgTypeGamepadState,
+		GamepadState: &message.GamepadState{ ControllerId: label, GamepadId: "g1" },
+	}
+}
+
+func TestLocalForwarderOrder(t *testing.T) {
+	listener := newTestForwarderListener()
+	forwarder := newTestForwarder(t, listener)
+	forwarder.ToTcp(testControl("c0"), nil)
+	<-listener.blocked
+	forwarder.ToTcp(testState("s1"), nil)
+	forwarder.ToTcp(testControl("c1"), nil)
+	forwarder.ToTcp(testState("s2"), nil)
+	forwarder.ToTcp(testControl("c2"), nil)
+	close(listener.release)
+	want := []string{ "c0", "c1", "c2", "s2" }
+	waitFor(t, "delivery of queued messages", func() bool { return len(listener.getDelivered()) == len(want) })
+	delivered := listener.getDelivered()
+	for i := range want {
+		if delivered[i] != want[i] {
+			t.Fatalf("unexpected order: got %v, want %v", delivered, want)
+		}
+	}
+	if stats := forwarder.Stats(); stats.Enqueued != 5 || stats.Coalesced != 1 {
+		t.Fatalf("unexpected stats: got enqueued %v, coalesced %v, want 5, 1", stats.Enqueued, stats.Coalesced)
+	}
+}
+
+func TestLocalForwarderQueueSize(t *testing.T) {
+	listener := newTestForwarderListener()
+	forwarder := newTestForwarder(t, listener, ForwarderQueueSize(1))
+	forwarder.ToTcp(testControl("c0"), nil)
+	<-listener.blocked
+	tests := []struct {
+		name     string
+		msg      *message.Message
+		rejected bool
+	}{
+		{ name: "within queue size", msg: testControl("c1"), rejected: false },
+		{ name: "over queue size", msg: testControl("c2"), rejected: true },
+		// states are coalesced instead of being rejected
+		{ name: "state", msg: testState("s1"), rejected: false },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var errCbErr error
+			forwarder.ToTcp(tt.msg, func(err error) { errCbErr = err })
+			if (errCbErr != nil) != tt.rejected {
+				t.Fatalf("unexpected error callback: got %v, want rejected %v", errCbErr, tt.rejected)
+			}
+		})
+	}
+	close(listener.release)
+	waitFor(t, "delivery of queued messages", func() bool { return len(listener.getDelivered()) == 3 })
+	if stats := forwarder.Stats(); stats.Rejected != 1 || stats.Queues[0].Rejected != 1 {
+		t.Fatalf("unexpected rejected count: got %v, want 1", stats.Rejected)
+	}
+}
+
+func TestLocalForwarderForgetGamepad(t *testing.T) {
+	tests := []struct {
+		name    string
+		running bool
+	}{
+		{ name: "drained", running: false },
+		{ name: "running", running: true },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listener := newTestForwarderListener()
+			forwarder := newTestForwarder(t, listener)
+			if !tt.running {
+				close(listener.release)
+			}
+			forwarder.ToTcp(testControl("c0"), nil)
+			forwarder.ToWs(testControl("c0"), nil)
+			<-listener.blocked
+			if tt.running {
+				forwarder.ForgetGamepad("g1")
+				// the queue of the running delivery is kept until it becomes empty
+				kept := false
+				for _, q := range forwarder.Stats().Queues {
+					if q.Direction == forwarderDirectionToTcp {
+						kept = true
+					}
+				}
+				close(listener.release)
+				if !kept {
+					t.Fatalf("queue of the running delivery is deleted")
+				}
+			} else {
+				waitFor(t, "drain of queues", func() bool {
+					forwarder.mutex.Lock()
+					defer forwarder.mutex.Unlock()
+					for _, q := range forwarder.queues {
+						if q.running {
+							return false
+						}
+					}
+					return true
+				})
+				forwarder.ForgetGamepad("g1")
+			}
+			waitFor(t, "deletion of queues", func() bool { return len(forwarder.Stats().Queues) == 0 })
+			if stats := forwarder.Stats(); stats.Enqueued != 2 {
+				t.Fatalf("unexpected total count: got %v, want 2", stats.Enqueued)
+			}
+		})
+	}
+}
+
+func TestLocalForwarderStop(t *testing.T) {
+	listener := newTestForwarderListener()
+	forwarder := NewLocalForwarder(ForwarderDrainTimeout(50 * time.Millisecond))
+	forwarder.StartFromWsListener(listener.onFromWs)
+	forwarder.Start(context.Background())
+	forwarder.ToTcp(testControl("c0"), nil)
+	<-listener.blocked
+	var errsMutex sync.Mutex
+	errs := make([]error, 0)
+	errCb := func(err error) {
+		errsMutex.Lock()
+		defer errsMutex.Unlock()
+		errs = append(errs, err)
+	}
+	forwarder.ToTcp(testControl("c1"), errCb)
+	forwarder.ToTcp(testState("s1"), errCb)
+	start := time.Now()
+	forwarder.Stop()
+	if elapsed := time.Since(start); elapsed < 50 * time.Millisecond {
+		t.Fatalf("stop does not wait for the drain timeout: %v", elapsed)
+	}
+	errsMutex.Lock()
+	if len(errs) != 2 {
+		t.Fatalf("unexpected error callbacks of dropped messages: got %v, want 2", len(errs))
+	}
+	errsMutex.Unlock()
+	close(listener.release)
+	if !waitTimeout(&forwarder.drainWg, 2 * time.Second) {
+		t.Fatalf("running delivery is not finished")
+	}
+	var stoppedErr error
+	forwarder.ToTcp(testControl("c2"), func(err error) { stoppedErr = err })
+	if stoppedErr == nil {
+		t.Fatalf("message is accepted after stop")
+	}
+	if delivered := listener.getDelivered(); len(delivered) != 1 || delivered[0] != "c0" {
+		t.Fatalf("dropped messages are delivered: %v", delivered)
+	}
+}
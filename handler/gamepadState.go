@@ -0,0 +1,67 @@
+package handler
+
+import (
+	"fmt"
+	"math"
+	"github.com/potix/regapweb/message"
+)
+
+// the upper limit of buttons and axes that gamepads can declare
+const gamepadMaxInputs int = 64
+
+// the upper limit of virtual gamepads that one device can emulate
+const gamepadMaxVirtual int = 4
+
+// validateGamepadCapabilities checks the declared capabilities and fills the default controller type.
+func validateGamepadCapabilities(capabilities *message.GamepadCapabilities) error {
+	if capabilities.Buttons < 0 || capabilities.Buttons > gamepadMaxInputs {
+		return fmt.Errorf("invalid number of buttons: %v", capabilities.Buttons)
+	}
+	if capabilities.Axes < 0 || capabilities.Axes > gamepadMaxInputs {
+		return fmt.Errorf("invalid number of axes: %v", capabilities.Axes)
+	}
+	if capabilities.ControllerType == "" {
+		capabilities.ControllerType = message.ControllerTypeStandard
+	}
+	return nil
+}
+
+func clamp(value float64, min float64, max float64) float64 {
+	if value < min {
+		return min
+	}
+	if value > max {
+		return max
+	}
+	return value
+}
+
+// normalizeGamepadState drops buttons and axes that the gamepad does not have and clamps values,
+// and returns an error if the state is malformed. States to gamepads without capabilities are not changed.
+func normalizeGamepadState(state *message.GamepadState, capabilities *message.GamepadCapabilities) error {
+	if capabilities == nil {
+		return nil
+	}
+	if len(state.Buttons) > capabilities.Buttons {
+		state.Buttons = state.Buttons[:capabilities.Buttons]
+	}
+	for i, button := range state.Buttons {
+		if button == nil {
+			return fmt.Errorf("no button state: index = %v", i)
+		}
+		if math.IsNaN(button.Value) {
+			return fmt.Errorf("invalid button value: index = %v", i)
+		}
+		button.Value = clamp(button.Value, 0, 1)
+	}
+	if len(state.Axes) > capabilities.Axes {
+		state.Axes = state.Axes[:capabilities.Axes]
+	}
+	for i, axis := range state.Axes {
+		if math.IsNaN(axis) {
+			return fmt.Errorf("invalid axis value: index = %v", i)
+		}
+		state.Axes[i] = clamp(axis, -1, 1)
+	}
+	return nil
+}
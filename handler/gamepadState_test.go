@@ -0,0 +1,102 @@
+package handler
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"github.com/potix/regapweb/message"
+)
+
+func TestNormalizeGamepadState(t *testing.T) {
+	capabilities := &message.GamepadCapabilities{
+		ControllerType: "standard",
+		Buttons:        2,
+		Axes:           2,
+	}
+	tests := []struct {
+		name         string
+		capabilities *message.GamepadCapabilities
+		state        *message.GamepadState
+		expected     *message.GamepadState
+		err          bool
+	}{
+		{
+			name:         "no capabilities",
+			capabilities: nil,
+			state:        &message.GamepadState{ Buttons: []*message.GamepadButtonState{ nil }, Axes: []float64{ 2 } },
+			expected:     &message.GamepadState{ Buttons: []*message.GamepadButtonState{ nil }, Axes: []float64{ 2 } },
+		},
+		{
+			name:         "unchanged",
+			capabilities: capabilities,
+			state:        &message.GamepadState{ Buttons: []*message.GamepadButtonState{ { Pressed: true, Value: 1 } }, Axes: []float64{ -0.5, 0.5 } },
+			expected:     &message.GamepadState{ Buttons: []*message.GamepadButtonState{ { Pressed: true, Value: 1 } }, Axes: []float64{ -0.5, 0.5 } },
+		},
+		{
+			name:         "drop extra buttons and axes",
+			capabilities: capabilities,
+			state: &message.GamepadState{
+				Buttons: []*message.GamepadButtonState{ {}, {}, { Pressed: true, Value: 1 } },
+				Axes:    []float64{ 0, 0, 1 },
+			},
+			expected: &message.GamepadState{
+				Buttons: []*message.GamepadButtonState{ {}, {} },
+				Axes:    []float64{ 0, 0 },
+			},
+		},
+		{
+			name:         "clamp values",
+			capabilities: capabilities,
+			state: &message.GamepadState{
+				Buttons: []*message.GamepadButtonState{ { Value: -1 }, { Value: 2 } },
+				Axes:    []float64{ -2, math.Inf(1) },
+			},
+			expected: &message.GamepadState{
+				Buttons: []*message.GamepadButtonState{ { Value: 0 }, { Value: 1 } },
+				Axes:    []float64{ -1, 1 },
+			},
+		},
+		{
+			name:         "nil button",
+			capabilities: capabilities,
+			state:        &message.GamepadState{ Buttons: []*message.GamepadButtonState{ {}, nil } },
+			err:          true,
+		},
+		{
+			name:         "nan button",
+			capabilities: capabilities,
+			state:        &message.GamepadState{ Buttons: []*message.GamepadButtonState{ { Value: math.NaN() } } },
+			err:          true,
+		},
+		{
+			name:         "nan axis",
+			capabilities: capabilities,
+			state:        &message.GamepadState{ Axes: []float64{ 0, math.NaN() } },
+			err:          true,
+		},
+		{
+			// values of dropped buttons and axes are not validated
+			name:         "nan in dropped axis",
+			capabilities: capabilities,
+			state:        &message.GamepadState{ Axes: []float64{ 0, 0, math.NaN() } },
+			expected:     &message.GamepadState{ Axes: []float64{ 0, 0 } },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := normalizeGamepadState(tt.state, tt.capabilities)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("no error: %+v", tt.state)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(tt.state, tt.expected) {
+				t.Fatalf("unexpected state: got %+v, want %+v", tt.state, tt.expected)
+			}
+		})
+	}
+}
@@ -2,11 +2,15 @@
 package handler
 
 import (
+        "context"
         "log"
         "fmt"
         "path"
+        "strconv"
+        "strings"
         "net/http"
 	"sync"
+	"sync/atomic"
 	"encoding/json"
 	"time"
         "github.com/gin-gonic/gin"
@@ -16,12 +20,38 @@ import (
 )
 
 type httpOptions struct {
-        verbose bool
+        verbose           bool
+        resumeGracePeriod time.Duration
+        inviteSecret      string
+        inviteTtl         time.Duration
+        cluster           *Cluster
+        rooms             map[string][]string
+        ctx               context.Context
+        shutdownTimeout   time.Duration
+        deviceRegistry    DeviceRegistry
+        deviceAdmins      []string
+        clientsHistory    ClientsHistory
+        deviceHandler     *TcpHandler
+        pingInterval      time.Duration
+        pingMaxMissed     int
 }
 
 func defaultHttpOptions() *httpOptions {
         return &httpOptions {
-                verbose: false,
+                verbose:           false,
+                resumeGracePeriod: 0,
+                inviteSecret:      "",
+                inviteTtl:         3 * time.Hour,
+                cluster:           nil,
+                rooms:             nil,
+                ctx:               context.Background(),
+                shutdownTimeout:   5 * time.Second,
+                deviceRegistry:    nil,
+                deviceAdmins:      nil,
+                clientsHistory:    nil,
+                deviceHandler:     nil,
+                pingInterval:      10 * time.Second,
+                pingMaxMissed:     3,
         }
 }
 
@@ -33,6 +63,95 @@ func HttpVerbose(verbose bool) HttpOption {
         }
 }
 
+// HttpResumeGracePeriod keeps the session of a disconnected client alive for the given period.
+// A reconnecting client can take it over with the resume token. Zero disables resuming.
+func HttpResumeGracePeriod(resumeGracePeriod time.Duration) HttpOption {
+        return func(opts *httpOptions) {
+                opts.resumeGracePeriod = resumeGracePeriod
+        }
+}
+
+// HttpInvite sets the secret to sign invite tokens and their lifetime.
+// A random secret is used if the secret is empty.
+func HttpInvite(inviteSecret string, inviteTtl time.Duration) HttpOption {
+        return func(opts *httpOptions) {
+                opts.inviteSecret = inviteSecret
+                if inviteTtl > 0 {
+                        opts.inviteTtl = inviteTtl
+                }
+        }
+}
+
+// HttpCluster routes signaling and gamepad messages to other nodes of the cluster.
+func HttpCluster(cluster *Cluster) HttpOption {
+        return func(opts *httpOptions) {
+                opts.cluster = cluster
+        }
+}
+
+// HttpRooms sets rooms that each account can join, "*" means all rooms.
+// If rooms are set, accounts without rooms can join only the default room.
+func HttpRooms(rooms map[string][]string) HttpOption {
+        return func(opts *httpOptions) {
+                opts.rooms = rooms
+        }
+}
+
+// HttpContext sets the context of the handler, websocket connections are closed when it is canceled.
+func HttpContext(ctx context.Context) HttpOption {
+        return func(opts *httpOptions) {
+                opts.ctx = ctx
+        }
+}
+
+// HttpShutdownTimeout sets how long Stop waits for websocket connections to be closed.
+func HttpShutdownTimeout(shutdownTimeout time.Duration) HttpOption {
+        return func(opts *httpOptions) {
+                opts.shutdownTimeout = shutdownTimeout
+        }
+}
+
+// HttpDeviceRegistry enables the device management by the admin accounts,
+// they can issue pairing codes to enroll gamepad devices and revoke them.
+// Revoked devices are disconnected by the tcp handler sharing the registry in the same process.
+func HttpDeviceRegistry(deviceRegistry DeviceRegistry, deviceAdmins []string) HttpOption {
+        return func(opts *httpOptions) {
+                opts.deviceRegistry = deviceRegistry
+                opts.deviceAdmins = deviceAdmins
+        }
+}
+
+// HttpClientsHistory lets the admin accounts read gamepads and history persisted by the clients store.
+func HttpClientsHistory(clientsHistory ClientsHistory, deviceAdmins []string) HttpOption {
+        return func(opts *httpOptions) {
+                opts.clientsHistory = clientsHistory
+                opts.deviceAdmins = deviceAdmins
+        }
+}
+
+// HttpDeviceWebsocket serves gamepad devices on the websocket endpoint by the tcp handler,
+// so that devices behind proxies that only allow https can connect with the same protocol.
+// Devices are authenticated by the handshake instead of basic auth.
+func HttpDeviceWebsocket(deviceHandler *TcpHandler) HttpOption {
+        return func(opts *httpOptions) {
+                opts.deviceHandler = deviceHandler
+        }
+}
+
+// HttpHeartbeat sets the interval of pings, and how many intervals without any message from the client are allowed.
+// The silent connection is closed as dead and the client is removed or suspended, 0 of maxMissed disables it.
+func HttpHeartbeat(pingInterval time.Duration, maxMissed int) HttpOption {
+        return func(opts *httpOptions) {
+                opts.pingInterval = pingInterval
+                opts.pingMaxMissed = maxMissed
+        }
+}
+
+const (
+	guestCookieName  string = "regapwebGuest"
+	guestContextKey         = "regapwebGuest"
+)
+
 type relationClient struct {
 	commit       bool
 	delivererId  string
@@ -41,26 +160,88 @@ type relationClient struct {
 }
 
 type httpClient struct {
-	writeMutex     sync.Mutex
+	writer         *connWriter
 	clientType     string
 	clientId       string
+	clientName     string
+	room           string
+	resumeToken    string
+	metadata       *message.ClientMetadata
+	lastTouch      time.Time
 	relationClient *relationClient
+	// only deliverer, pending join requests by controller id
+	joinRequests   map[string]bool
+	// only invited controller, deliverer who invited
+	inviteDelivererId string
+	// client declares presence capability
+	presence       bool
+	// only controller, capabilities of the gamepad in the relation to normalize states
+	gamepadCapabilitiesId string
+	gamepadCapabilities   *message.GamepadCapabilities
+}
+
+type suspendedClient struct {
+	clientType        string
+	clientId          string
+	clientName        string
+	room              string
+	// resume is allowed only for the same account and the same invite
+	account           string
+	inviteDelivererId string
+	relationClient    *relationClient
+	timer             *time.Timer
 }
 
 type HttpHandler struct {
-        verbose      bool
-        resourcePath string
-        accounts     map[string]string
-	clientsStore *ClientsStore
-	forwarder    *Forwarder
-	clientsMutex sync.Mutex
-	clients      map[*websocket.Conn]*httpClient
+        verbose                bool
+        resourcePath           string
+        accounts               map[string]string
+        resumeGracePeriod      time.Duration
+	clientsStore           ClientsStore
+	forwarder              Forwarder
+	clientsMutex           sync.Mutex
+	clients                map[*websocket.Conn]*httpClient
+	suspendedClientsMutex  sync.Mutex
+	suspendedClients       map[string]*suspendedClient
+	inviteStore            *inviteStore
+	cluster                *Cluster
+	rooms                  map[string][]string
+	presenceSubscriptionId int
+	presenceChan           chan *message.PresenceEvent
+	presenceResyncMutex    sync.Mutex
+	presenceResyncRooms    map[string]bool
+	presenceResyncChan     chan struct{}
+	ctx                    context.Context
+	cancel                 context.CancelFunc
+	shutdownTimeout        time.Duration
+	wg                     sync.WaitGroup
+	deviceRegistry         DeviceRegistry
+	deviceAdmins           []string
+	clientsHistory         ClientsHistory
+	deviceHandler          *TcpHandler
+	pingInterval           time.Duration
+	pingMaxMissed          int
 }
 
 func (h *HttpHandler) onFromTcp(msg *message.Message) error {
 	if h.verbose {
 		log.Printf("onFromTcp")
 	}
+	if h.cluster != nil {
+		_, controllerId, _ := gamepadMessageIds(msg)
+		conn, _ := h.getClient(controllerId)
+		if conn == nil {
+			nodeId := h.cluster.LookupNode(controllerId)
+			if nodeId != "" {
+				// controller is connected to other node
+				return h.cluster.RouteFromTcp(nodeId, msg)
+			}
+		}
+	}
+	return h.deliverFromTcp(msg)
+}
+
+func (h *HttpHandler) deliverFromTcp(msg *message.Message) error {
 	if msg.MsgType == message.MsgTypeGamepadConnectRes {
 		conn, client := h.getControllerByIds(
 			msg.GamepadConnectResponse.DelivererId,
@@ -77,7 +258,7 @@ func (h *HttpHandler) onFromTcp(msg *message.Message) error {
 			log.Printf("client relation mismatch: %v, %v", client.relationClient, msg.GamepadConnectResponse)
 			return fmt.Errorf("client relation mismatch")
 		}
-		err := h.safeWriteMessage(conn, websocket.TextMessage, msg)
+		err := h.safeWriteMessage(conn, msg)
 		if err != nil {
 			log.Printf("can not write gpConnectRes message: %v", err)
 			return fmt.Errorf("can not write gpConnectRes message")
@@ -98,11 +279,25 @@ func (h *HttpHandler) onFromTcp(msg *message.Message) error {
 			log.Printf("client relation mismatch: %v, %v", client.relationClient, msg.GamepadConnectResponse)
 			return nil
 		}
-		err := h.safeWriteMessage(conn, websocket.TextMessage, msg)
+		err := h.safeWriteMessage(conn, msg)
 		if err != nil {
 			log.Printf("can not write message: %v", err)
 			return nil
 		}
+	} else if msg.MsgType == message.MsgTypeGamepadDisconnected || msg.MsgType == message.MsgTypeGamepadDeviceStatus {
+		delivererId, controllerId, gamepadId := gamepadMessageIds(msg)
+		conn, client := h.getControllerByIds(delivererId, controllerId, gamepadId)
+		if conn == nil || client == nil {
+			if h.verbose {
+				log.Printf("not found connection for %v: gamepadId = %v", msg.MsgType, gamepadId)
+			}
+			return nil
+		}
+		err := h.safeWriteMessage(conn, msg)
+		if err != nil {
+			log.Printf("can not write %v message: %v", msg.MsgType, err)
+			return nil
+		}
 	} else {
 		log.Printf("unsupported request: %v", msg.MsgType)
 		return nil
@@ -112,11 +307,254 @@ func (h *HttpHandler) onFromTcp(msg *message.Message) error {
 
 func (h *HttpHandler) Start() error {
 	h.forwarder.StartFromTcpListener(h.onFromTcp)
+	if h.cluster != nil {
+		h.cluster.SetSignalingHandler(h.onClusterSignaling)
+		h.cluster.SetFromTcpHandler(h.deliverFromTcp)
+	}
+	h.presenceSubscriptionId = h.clientsStore.Subscribe(h.onPresenceEvent)
+	h.wg.Add(1)
+	go h.presenceLoop()
 	return nil
 }
 
 func (h *HttpHandler) Stop() {
+	h.cancel()
+	if !waitTimeout(&h.wg, h.shutdownTimeout) {
+		log.Printf("can not close websocket connections in time")
+	}
+	h.clientsStore.Unsubscribe(h.presenceSubscriptionId)
 	h.forwarder.StopFromTcpListener()
+	h.expireSuspendedClients()
+	if h.verbose {
+		log.Printf("stopped http handler")
+	}
+}
+
+// onPresenceEvent is called by the clients store, so that it only queues the event.
+func (h *HttpHandler) onPresenceEvent(event *message.PresenceEvent) {
+	select {
+	case h.presenceChan <- event:
+	default:
+		log.Printf("presence queue is full, drop presence event: event = %v, clientType = %v", event.Event, event.ClientType)
+		h.markPresenceResync(presenceEventRoom(event))
+	}
+}
+
+// markPresenceResync marks clients in the room as missing events, the presence loop sends them the snapshot.
+func (h *HttpHandler) markPresenceResync(room string) {
+	h.presenceResyncMutex.Lock()
+	h.presenceResyncRooms[room] = true
+	h.presenceResyncMutex.Unlock()
+	select {
+	case h.presenceResyncChan <- struct{}{}:
+	default:
+	}
+}
+
+func normalizeRoom(room string) string {
+	if room == "" {
+		return message.DefaultRoom
+	}
+	return room
+}
+
+func (h *HttpHandler) isRoomAllowed(account string, room string) bool {
+	if len(h.rooms) == 0 {
+		return true
+	}
+	rooms, ok := h.rooms[account]
+	if !ok {
+		return room == message.DefaultRoom
+	}
+	for _, r := range rooms {
+		if r == "*" || r == room {
+			return true
+		}
+	}
+	return false
+}
+
+// clientRoom returns the room of the client in the clients store.
+func (h *HttpHandler) clientRoom(clientType string, clientId string) (string, bool) {
+	clnt := h.clientsStore.GetClient(clientType, clientId)
+	if clnt == nil {
+		return "", false
+	}
+	return normalizeRoom(clnt.Room), true
+}
+
+func (h *HttpHandler) isInRoom(room string, clientType string, clientId string) bool {
+	clientRoom, ok := h.clientRoom(clientType, clientId)
+	return ok && clientRoom == room
+}
+
+// registerRoom decides the room of the registering client,
+// invited controller always joins the room of the deliverer who invited.
+func (h *HttpHandler) registerRoom(client *httpClient, room string) (string, error) {
+	room = normalizeRoom(room)
+	if client.inviteDelivererId != "" {
+		delivererRoom, ok := h.clientRoom(message.ClientTypeDeliverer, client.inviteDelivererId)
+		if !ok {
+			return "", fmt.Errorf("not found deliverer who invited: %v", client.inviteDelivererId)
+		}
+		room = delivererRoom
+	} else if !h.isRoomAllowed(client.metadata.Account, room) {
+		return "", fmt.Errorf("room is not allowed: account = %v, room = %v", client.metadata.Account, room)
+	}
+	if client.room != "" && client.room != room {
+		return "", fmt.Errorf("room can not be changed: %v -> %v", client.room, room)
+	}
+	return room, nil
+}
+
+func filterClientsByRoom(clients []*message.NameAndId, allowed func(room string) bool) []*message.NameAndId {
+	newClients := make([]*message.NameAndId, 0, len(clients))
+	for _, clnt := range clients {
+		if allowed(normalizeRoom(clnt.Room)) {
+			newClients = append(newClients, clnt)
+		}
+	}
+	return newClients
+}
+
+func filterGamepadsByRoom(gamepads []*message.GamepadInfo, allowed func(room string) bool) []*message.GamepadInfo {
+	newGamepads := make([]*message.GamepadInfo, 0, len(gamepads))
+	for _, gamepad := range gamepads {
+		if allowed(normalizeRoom(gamepad.Room)) {
+			newGamepads = append(newGamepads, gamepad)
+		}
+	}
+	return newGamepads
+}
+
+func presenceEventRoom(event *message.PresenceEvent) string {
+	if event.Client != nil {
+		return normalizeRoom(event.Client.Room)
+	} else if event.Gamepad != nil {
+		return normalizeRoom(event.Gamepad.Room)
+	}
+	return normalizeRoom("")
+}
+
+// newLookupResponse returns the snapshot of clients which the client can see.
+func (h *HttpHandler) newLookupResponse(clientType string, room string, inviteDelivererId string) *message.LookupResponse {
+	inRoom := func(clientRoom string) bool {
+		return room != "" && clientRoom == room
+	}
+	if clientType == message.ClientTypeController {
+		deliverers := filterClientsByRoom(h.clientsStore.GetDeliverers(), inRoom)
+		if inviteDelivererId != "" {
+			// invited controller can see only the deliverer who invited
+			invitedDeliverers := make([]*message.NameAndId, 0, 1)
+			for _, deliverer := range deliverers {
+				if deliverer.Id == inviteDelivererId {
+					invitedDeliverers = append(invitedDeliverers, deliverer)
+				}
+			}
+			deliverers = invitedDeliverers
+		}
+		return &message.LookupResponse {
+			Deliverers: deliverers,
+		}
+	}
+	return &message.LookupResponse {
+		Controllers: filterClientsByRoom(h.clientsStore.GetControllers(), inRoom),
+		Gamepads: filterGamepadsByRoom(h.clientsStore.GetGamepads(), inRoom),
+	}
+}
+
+// isPresenceTarget returns true if the client is the receiver of the event,
+// deliverers receive controllers and gamepads, controllers receive deliverers.
+func (h *HttpHandler) isPresenceTarget(client *httpClient, event *message.PresenceEvent) bool {
+	if !client.presence {
+		return false
+	}
+	if presenceEventRoom(event) != client.room {
+		return false
+	}
+	if client.clientType == message.ClientTypeDeliverer {
+		return event.ClientType == message.ClientTypeController || event.ClientType == message.ClientTypeGamepad
+	}
+	if event.ClientType != message.ClientTypeDeliverer {
+		return false
+	}
+	if client.inviteDelivererId != "" {
+		// invited controller can see only the deliverer who invited
+		return event.Client != nil && event.Client.Id == client.inviteDelivererId
+	}
+	return true
+}
+
+func (h *HttpHandler) pushPresenceEvent(event *message.PresenceEvent) {
+	msg := &message.Message{
+		MsgType:       message.MsgTypePresence,
+		PresenceEvent: event,
+	}
+	targets := make([]*httpClient, 0)
+	h.clientsMutex.Lock()
+	for _, client := range h.clients {
+		if h.isPresenceTarget(client, event) {
+			targets = append(targets, client)
+		}
+	}
+	h.clientsMutex.Unlock()
+	for _, client := range targets {
+		err := client.writer.enqueue(msg)
+		if err != nil && h.verbose {
+			log.Printf("can not write presence message: %v", err)
+		}
+	}
+}
+
+// resyncPresence sends the snapshot to clients which missed presence events.
+func (h *HttpHandler) resyncPresence() {
+	// events queued before the drop are older than the snapshot
+	for i := len(h.presenceChan); i > 0; i-- {
+		h.pushPresenceEvent(<-h.presenceChan)
+	}
+	h.presenceResyncMutex.Lock()
+	rooms := h.presenceResyncRooms
+	h.presenceResyncRooms = make(map[string]bool)
+	h.presenceResyncMutex.Unlock()
+	type resyncTarget struct {
+		client *httpClient
+		room   string
+	}
+	targets := make([]*resyncTarget, 0)
+	h.clientsMutex.Lock()
+	for _, client := range h.clients {
+		if client.presence && rooms[client.room] {
+			targets = append(targets, &resyncTarget{ client: client, room: client.room })
+		}
+	}
+	h.clientsMutex.Unlock()
+	for _, target := range targets {
+		msg := &message.Message{
+			MsgType:        message.MsgTypeLookupRes,
+			LookupResponse: h.newLookupResponse(target.client.clientType, target.room, target.client.inviteDelivererId),
+		}
+		err := target.client.writer.enqueue(msg)
+		if err != nil && h.verbose {
+			log.Printf("can not write lookup response message: %v", err)
+		}
+	}
+	if h.verbose {
+		log.Printf("resync presence: rooms = %v, clients = %v", len(rooms), len(targets))
+	}
+}
+
+func (h *HttpHandler) presenceLoop() {
+	defer h.wg.Done()
+	for {
+		select {
+		case event := <-h.presenceChan:
+			h.pushPresenceEvent(event)
+		case <-h.presenceResyncChan:
+			h.resyncPresence()
+		case <-h.ctx.Done():
+			return
+		}
+	}
 }
 
 func (h *HttpHandler) SetRouting(router *gin.Engine) {
@@ -127,13 +565,28 @@ func (h *HttpHandler) SetRouting(router *gin.Engine) {
         font := path.Join(h.resourcePath, "font")
 	templatePath := path.Join(h.resourcePath, "template", "*")
         router.LoadHTMLGlob(templatePath)
-	authGroup := router.Group("/", gin.BasicAuth(h.accounts))
+	router.GET("/invite/:token", h.inviteRedirect)
+	if h.deviceHandler != nil {
+		router.GET("/devicews", h.deviceWebsocket)
+	}
+	authGroup := router.Group("/", h.authenticate())
 	authGroup.GET("/", h.indexHtml)
 	authGroup.GET("/index.html", h.indexHtml)
 	authGroup.GET("/controller.html", h.indexHtml)
 	authGroup.GET("/deliverer.html", h.delivererHtml)
 	authGroup.GET("/controllerws", h.controllerWebsocket)
 	authGroup.GET("/delivererws", h.delivererWebsocket)
+	authGroup.GET("/clients", h.clientsJson)
+	authGroup.GET("/forwarder", h.forwarderJson)
+	if h.deviceRegistry != nil {
+		authGroup.GET("/devices", h.devicesJson)
+		authGroup.POST("/devices/pairingCode", h.issuePairingCode)
+		authGroup.POST("/devices/:deviceId/revoke", h.revokeDevice)
+	}
+	if h.clientsHistory != nil {
+		authGroup.GET("/devices/records", h.deviceRecordsJson)
+		authGroup.GET("/devices/history", h.deviceHistoryJson)
+	}
 	authGroup.StaticFile("/favicon.ico", favicon)
         authGroup.Static("/js", js)
         authGroup.Static("/css", css)
@@ -141,6 +594,53 @@ func (h *HttpHandler) SetRouting(router *gin.Engine) {
         authGroup.Static("/font", font)
 }
 
+func (h *HttpHandler) isInvitePath(urlPath string) bool {
+	switch urlPath {
+	case "/", "/index.html", "/controller.html", "/controllerws", "/favicon.ico":
+		return true
+	}
+	for _, prefix := range []string{ "/js/", "/css/", "/img/", "/font/" } {
+		if strings.HasPrefix(urlPath, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate accepts a valid guest session for the controller pages, otherwise requires basic auth.
+func (h *HttpHandler) authenticate() gin.HandlerFunc {
+	basicAuth := gin.BasicAuth(h.accounts)
+	return func(c *gin.Context) {
+		sessionId, err := c.Cookie(guestCookieName)
+		if err == nil && sessionId != "" && h.isInvitePath(c.Request.URL.Path) {
+			session, err := h.inviteStore.verifySession(sessionId)
+			if err == nil {
+				c.Set(guestContextKey, session)
+				c.Next()
+				return
+			}
+			if h.verbose {
+				log.Printf("can not verify guest session: %v", err)
+			}
+		}
+		basicAuth(c)
+	}
+}
+
+// inviteRedirect consumes the invite token once and hands the guest session to the browser instead.
+func (h *HttpHandler) inviteRedirect(c *gin.Context) {
+	token := c.Param("token")
+	session, err := h.inviteStore.openSession(token)
+	if err != nil {
+		log.Printf("can not consume invite: %v", err)
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+	// the cookie lives until the browser is closed, the session itself expires on the server
+	c.SetCookie(guestCookieName, session.sessionId, 0, "/", "", c.Request.TLS != nil, true)
+	c.Redirect(http.StatusFound, "/controller.html")
+}
+
 func (h *HttpHandler) indexHtml(c *gin.Context) {
 	c.HTML(http.StatusOK, "controller.html", gin.H{})
 }
@@ -150,12 +650,143 @@ func (h *HttpHandler) delivererHtml(c *gin.Context) {
 }
 
 
-func (h *HttpHandler) clientRegister(conn *websocket.Conn, clientType string, clientId string) *httpClient {
+// clientsJson is the operator view of clients in rooms of the account including their metadata.
+func (h *HttpHandler) clientsJson(c *gin.Context) {
+	account := c.GetString(gin.AuthUserKey)
+	allowed := func(room string) bool {
+		return h.isRoomAllowed(account, room)
+	}
+	c.JSON(http.StatusOK, &message.LookupResponse{
+		Deliverers:  filterClientsByRoom(h.clientsStore.GetDeliverers(), allowed),
+		Controllers: filterClientsByRoom(h.clientsStore.GetControllers(), allowed),
+		Gamepads:    filterGamepadsByRoom(h.clientsStore.GetGamepads(), allowed),
+	})
+}
+
+// forwarderJson is the operator view of forwarder queues of gamepads in rooms of the account.
+func (h *HttpHandler) forwarderJson(c *gin.Context) {
+	account := c.GetString(gin.AuthUserKey)
+	stats := h.forwarder.Stats()
+	queues := make([]*ForwarderQueueStats, 0, len(stats.Queues))
+	for _, queue := range stats.Queues {
+		room, ok := h.clientRoom(message.ClientTypeGamepad, queue.GamepadId)
+		if len(h.rooms) > 0 && (!ok || !h.isRoomAllowed(account, room)) {
+			continue
+		}
+		queues = append(queues, queue)
+	}
+	stats.Queues = queues
+	c.JSON(http.StatusOK, stats)
+}
+
+func (h *HttpHandler) isDeviceAdmin(c *gin.Context) bool {
+	account := c.GetString(gin.AuthUserKey)
+	if account == "" {
+		return false
+	}
+	for _, admin := range h.deviceAdmins {
+		if admin == account {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *HttpHandler) devicesJson(c *gin.Context) {
+	if !h.isDeviceAdmin(c) {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+	c.JSON(http.StatusOK, h.deviceRegistry.GetCredentials())
+}
+
+// issuePairingCode issues the pairing code of a new device, or of the enrolled device of the deviceId query to re-pair it.
+// deviceRecordsJson returns names and last seen times of gamepads including disconnected ones.
+func (h *HttpHandler) deviceRecordsJson(c *gin.Context) {
+	if !h.isDeviceAdmin(c) {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+	records, err := h.clientsHistory.GetDevices()
+	if err != nil {
+		log.Printf("can not get device records: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	c.JSON(http.StatusOK, records)
+}
+
+// deviceHistoryJson returns the latest history of the limit query, 100 records by default.
+func (h *HttpHandler) deviceHistoryJson(c *gin.Context) {
+	if !h.isDeviceAdmin(c) {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit <= 0 {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	records, err := h.clientsHistory.GetHistory(limit)
+	if err != nil {
+		log.Printf("can not get history: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	c.JSON(http.StatusOK, records)
+}
+
+func (h *HttpHandler) issuePairingCode(c *gin.Context) {
+	if !h.isDeviceAdmin(c) {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+	// the device id re-pairs the enrolled device
+	deviceId := c.Query("deviceId")
+	if deviceId != "" && h.deviceRegistry.GetCredential(deviceId) == nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	pairingCode, err := h.deviceRegistry.IssuePairingCode(deviceId)
+	if err != nil {
+		log.Printf("can not issue pairing code: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	log.Printf("issued pairing code: deviceId = %v, account = %v", deviceId, c.GetString(gin.AuthUserKey))
+	c.JSON(http.StatusOK, pairingCode)
+}
+
+// revokeDevice revokes the credential of the device, the connected device is disconnected.
+func (h *HttpHandler) revokeDevice(c *gin.Context) {
+	if !h.isDeviceAdmin(c) {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+	deviceId := c.Param("deviceId")
+	if h.deviceRegistry.GetCredential(deviceId) == nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	if err := h.deviceRegistry.Revoke(deviceId); err != nil {
+		log.Printf("can not revoke device: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	log.Printf("revoked device: deviceId = %v, account = %v", deviceId, c.GetString(gin.AuthUserKey))
+	c.Status(http.StatusOK)
+}
+
+func (h *HttpHandler) clientRegister(conn *websocket.Conn, writer *connWriter, clientType string, clientId string, metadata *message.ClientMetadata, inviteDelivererId string) *httpClient {
 	h.clientsMutex.Lock()
 	defer h.clientsMutex.Unlock()
 	client := &httpClient{
+		 writer: writer,
 		 clientType: clientType,
 		 clientId: clientId,
+		 metadata: metadata,
+		 joinRequests: make(map[string]bool),
+		 inviteDelivererId: inviteDelivererId,
 	}
 	h.clients[conn] = client
 	return client
@@ -167,6 +798,142 @@ func (h *HttpHandler) clientUnregister(conn *websocket.Conn) {
 	delete(h.clients, conn)
 }
 
+func (h *HttpHandler) updateClientId(client *httpClient, clientId string) {
+	h.clientsMutex.Lock()
+	defer h.clientsMutex.Unlock()
+	client.clientId = clientId
+}
+
+func (h *HttpHandler) addClientToStore(clientType string, clientId string, clientName string, room string, metadata *message.ClientMetadata) {
+	if clientType == message.ClientTypeDeliverer {
+		h.clientsStore.AddDeliverer(clientId, clientName, room, metadata)
+	} else if clientType == message.ClientTypeController {
+		h.clientsStore.AddController(clientId, clientName, room, metadata)
+	}
+}
+
+// touchClient records the activity of the registered client at most once a second.
+func (h *HttpHandler) touchClient(client *httpClient) {
+	if client.resumeToken == "" {
+		return
+	}
+	now := time.Now()
+	if now.Sub(client.lastTouch) < time.Second {
+		return
+	}
+	client.lastTouch = now
+	h.clientsStore.TouchClient(client.clientId)
+}
+
+func (h *HttpHandler) deleteClientFromStore(clientType string, clientId string) {
+	h.clientsStore.ReleaseGamepadsByClient(clientId)
+	if clientType == message.ClientTypeDeliverer {
+		h.inviteStore.revokeByDeliverer(clientId)
+		h.clientsStore.DeleteDeliverer(clientId)
+	} else if clientType == message.ClientTypeController {
+		h.clientsStore.DeleteController(clientId)
+	}
+}
+
+func (h *HttpHandler) suspendClient(client *httpClient) {
+	h.suspendedClientsMutex.Lock()
+	defer h.suspendedClientsMutex.Unlock()
+	resumeToken := client.resumeToken
+	suspended := &suspendedClient{
+		clientType:        client.clientType,
+		clientId:          client.clientId,
+		clientName:        client.clientName,
+		room:              client.room,
+		account:           client.metadata.Account,
+		inviteDelivererId: client.inviteDelivererId,
+		relationClient:    client.relationClient,
+	}
+	suspended.timer = time.AfterFunc(h.resumeGracePeriod, func() {
+		h.suspendedClientsMutex.Lock()
+		defer h.suspendedClientsMutex.Unlock()
+		if h.suspendedClients[resumeToken] != suspended {
+			return
+		}
+		delete(h.suspendedClients, resumeToken)
+		if h.verbose {
+			log.Printf("expire suspended client: type = %v, id = %v", suspended.clientType, suspended.clientId)
+		}
+		h.deleteClientFromStore(suspended.clientType, suspended.clientId)
+	})
+	h.suspendedClients[resumeToken] = suspended
+	if h.verbose {
+		log.Printf("suspend client: type = %v, id = %v", suspended.clientType, suspended.clientId)
+	}
+}
+
+func (h *HttpHandler) resumeClient(resumeToken string, client *httpClient, room string) *suspendedClient {
+	h.suspendedClientsMutex.Lock()
+	defer h.suspendedClientsMutex.Unlock()
+	suspended, ok := h.suspendedClients[resumeToken]
+	if !ok {
+		return nil
+	}
+	if suspended.clientType != client.clientType || suspended.room != room {
+		return nil
+	}
+	if suspended.account != client.metadata.Account || suspended.inviteDelivererId != client.inviteDelivererId {
+		log.Printf("resume token is not bound to the client: type = %v, id = %v", suspended.clientType, suspended.clientId)
+		return nil
+	}
+	if !suspended.timer.Stop() {
+		// already expired
+		return nil
+	}
+	delete(h.suspendedClients, resumeToken)
+	if h.verbose {
+		log.Printf("resume client: type = %v, id = %v", suspended.clientType, suspended.clientId)
+	}
+	return suspended
+}
+
+// expireSuspendedClients deletes suspended clients without waiting for the grace period.
+func (h *HttpHandler) expireSuspendedClients() {
+	h.suspendedClientsMutex.Lock()
+	defer h.suspendedClientsMutex.Unlock()
+	for resumeToken, suspended := range h.suspendedClients {
+		if !suspended.timer.Stop() {
+			// already expired
+			continue
+		}
+		delete(h.suspendedClients, resumeToken)
+		h.deleteClientFromStore(suspended.clientType, suspended.clientId)
+	}
+}
+
+func (h *HttpHandler) finishClient(client *httpClient) {
+	if client.resumeToken == "" {
+		// not registered
+		return
+	}
+	if h.resumeGracePeriod > 0 && h.ctx.Err() == nil {
+		h.suspendClient(client)
+		return
+	}
+	h.deleteClientFromStore(client.clientType, client.clientId)
+}
+
+func (h *HttpHandler) addJoinRequest(client *httpClient, controllerId string) {
+	h.clientsMutex.Lock()
+	defer h.clientsMutex.Unlock()
+	client.joinRequests[controllerId] = true
+}
+
+func (h *HttpHandler) removeJoinRequest(client *httpClient, controllerId string) bool {
+	h.clientsMutex.Lock()
+	defer h.clientsMutex.Unlock()
+	_, ok := client.joinRequests[controllerId]
+	if !ok {
+		return false
+	}
+	delete(client.joinRequests, controllerId)
+	return true
+}
+
 func (h *HttpHandler) updateClientRelation(client *httpClient, delivererId string, controllerId string, gamepadId string, commit bool) bool {
 	if client.relationClient == nil {
 		relationClient := &relationClient {
@@ -215,7 +982,8 @@ func (h *HttpHandler) getControllerByIds(delivererId string, controllerId string
 		if client.clientType != message.ClientTypeController {
 			continue
 		}
-		if client.relationClient.commit == true &&
+		if client.relationClient != nil &&
+		   client.relationClient.commit == true &&
 		   client.relationClient.delivererId == delivererId &&
 		   client.relationClient.controllerId == controllerId &&
 		   client.relationClient.gamepadId == gamepadId {
@@ -225,57 +993,281 @@ func (h *HttpHandler) getControllerByIds(delivererId string, controllerId string
 	return nil, nil
 }
 
-func (h *HttpHandler) safeWriteMessage(conn *websocket.Conn, messageType int, msg *message.Message) error {
+// gamepadCapabilities returns the capabilities of the gamepad that the controller sends states to,
+// it is looked up from the clients store only when the gamepad is changed.
+func (h *HttpHandler) gamepadCapabilities(client *httpClient, gamepadId string) *message.GamepadCapabilities {
+	if client.gamepadCapabilitiesId == gamepadId {
+		return client.gamepadCapabilities
+	}
+	client.gamepadCapabilitiesId = gamepadId
+	client.gamepadCapabilities = nil
+	gamepad := h.clientsStore.GetClient(message.ClientTypeGamepad, gamepadId)
+	if gamepad != nil && gamepad.Metadata != nil {
+		client.gamepadCapabilities = gamepad.Metadata.Gamepad
+	}
+	return client.gamepadCapabilities
+}
+
+func (h *HttpHandler) matchClientRelation(client *httpClient, delivererId string, controllerId string, gamepadId string) bool {
+	return client.relationClient != nil &&
+	       client.relationClient.delivererId == delivererId &&
+	       client.relationClient.controllerId == controllerId &&
+	       client.relationClient.gamepadId == gamepadId
+}
+
+func (h *HttpHandler) signalingTargetType(msgType string) string {
+	switch msgType {
+	case message.MsgTypeSignalingOfferSdpReq, message.MsgTypeSignalingAnswerSdpRes, message.MsgTypeJoinRes:
+		return message.ClientTypeController
+	case message.MsgTypeSignalingOfferSdpRes, message.MsgTypeSignalingAnswerSdpReq, message.MsgTypeJoinReq:
+		return message.ClientTypeDeliverer
+	}
+	return ""
+}
+
+func (h *HttpHandler) signalingServerErrorType(msgType string) string {
+	switch msgType {
+	case message.MsgTypeSignalingOfferSdpReq, message.MsgTypeSignalingOfferSdpRes:
+		return message.MsgTypeSignalingOfferSdpServerError
+	case message.MsgTypeSignalingAnswerSdpReq, message.MsgTypeSignalingAnswerSdpRes:
+		return message.MsgTypeSignalingAnswerSdpServerError
+	case message.MsgTypeJoinReq, message.MsgTypeJoinRes:
+		return message.MsgTypeJoinServerError
+	}
+	return ""
+}
+
+// deliverSignaling delivers the signaling message to the target client connected to this node or other node.
+// The returned error message is sent back to the source client.
+func (h *HttpHandler) deliverSignaling(targetClientId string, sourceClientId string, msg *message.Message) error {
+	foundConn, foundClient := h.getClient(targetClientId)
+	if foundConn != nil && foundClient != nil {
+		return h.deliverSignalingLocal(foundConn, foundClient, msg)
+	}
+	if h.cluster != nil {
+		nodeId := h.cluster.LookupNode(targetClientId)
+		if nodeId != "" {
+			err := h.cluster.RouteSignaling(nodeId, targetClientId, sourceClientId, msg)
+			if err != nil {
+				log.Printf("can not route %v message: %v", msg.MsgType, err)
+				return fmt.Errorf("can not forward %v message", msg.MsgType)
+			}
+			return nil
+		}
+	}
+	log.Printf("not found %v id: %v", h.signalingTargetType(msg.MsgType), targetClientId)
+	return fmt.Errorf("not found %v id", h.signalingTargetType(msg.MsgType))
+}
+
+func (h *HttpHandler) deliverSignalingLocal(conn *websocket.Conn, client *httpClient, msg *message.Message) error {
+	targetType := h.signalingTargetType(msg.MsgType)
+	if targetType != "" && client.clientType != targetType {
+		log.Printf("client type mismatch: act %v, exp %v", client.clientType, targetType)
+		return fmt.Errorf("not found %v id", targetType)
+	}
+	if msg.MsgType == message.MsgTypeSignalingOfferSdpReq {
+		if client.inviteDelivererId != "" && client.inviteDelivererId != msg.SignalingSdpRequest.DelivererId {
+			log.Printf("controller is invited by other deliverer: act %v, exp %v",
+				msg.SignalingSdpRequest.DelivererId, client.inviteDelivererId)
+			return fmt.Errorf("not found controller id")
+		}
+	} else if msg.MsgType == message.MsgTypeSignalingOfferSdpRes {
+		if !h.matchClientRelation(client,
+			msg.SignalingSdpResponse.DelivererId,
+			msg.SignalingSdpResponse.ControllerId,
+			msg.SignalingSdpResponse.GamepadId) {
+			log.Printf("found client relation mismatch: %v, %v", client.relationClient, msg.SignalingSdpResponse)
+			return fmt.Errorf("client relation mismatch")
+		}
+		if msg.Error != nil && msg.Error.Message != "" {
+			h.clientsStore.ReleaseGamepad(
+				msg.SignalingSdpResponse.GamepadId,
+				msg.SignalingSdpResponse.DelivererId,
+				msg.SignalingSdpResponse.ControllerId)
+		} else {
+			err := h.clientsStore.OccupyGamepad(
+				msg.SignalingSdpResponse.GamepadId,
+				msg.SignalingSdpResponse.DelivererId,
+				msg.SignalingSdpResponse.ControllerId)
+			if err != nil {
+				log.Printf("can not occupy gamepad: %v", err)
+				return fmt.Errorf("gamepad is not reserved")
+			}
+			if !h.commitClientRelation(client) {
+				log.Printf("can not commit found client relation: %v", msg.SignalingSdpResponse)
+				return fmt.Errorf("can not update client relation")
+			}
+		}
+	} else if msg.MsgType == message.MsgTypeSignalingAnswerSdpReq {
+		if !h.matchClientRelation(client,
+			msg.SignalingSdpRequest.DelivererId,
+			msg.SignalingSdpRequest.ControllerId,
+			msg.SignalingSdpRequest.GamepadId) {
+			log.Printf("found client relation mismatch: %v, %v", client.relationClient, msg.SignalingSdpRequest)
+			return fmt.Errorf("client relation mismatch")
+		}
+	} else if msg.MsgType == message.MsgTypeSignalingAnswerSdpRes {
+		if !h.matchClientRelation(client,
+			msg.SignalingSdpResponse.DelivererId,
+			msg.SignalingSdpResponse.ControllerId,
+			msg.SignalingSdpResponse.GamepadId) {
+			log.Printf("found client relation mismatch: %v, %v", client.relationClient, msg.SignalingSdpResponse)
+			return fmt.Errorf("client relation mismatch")
+		}
+	} else if msg.MsgType == message.MsgTypeJoinReq {
+		h.addJoinRequest(client, msg.JoinRequest.ControllerId)
+	}
+	err := h.safeWriteMessage(conn, msg)
+	if err != nil {
+		log.Printf("can not forward %v message: %v", msg.MsgType, err)
+		if msg.MsgType == message.MsgTypeJoinReq {
+			h.removeJoinRequest(client, msg.JoinRequest.ControllerId)
+		}
+		return fmt.Errorf("can not forward %v message", msg.MsgType)
+	}
+	return nil
+}
+
+// onClusterSignaling delivers the signaling message routed from other node,
+// and sends back the error to the source client.
+func (h *HttpHandler) onClusterSignaling(fromNodeId string, targetClientId string, sourceClientId string, msg *message.Message) {
+	var err error
+	foundConn, foundClient := h.getClient(targetClientId)
+	if foundConn == nil || foundClient == nil {
+		log.Printf("not found routed client id: %v", targetClientId)
+		err = fmt.Errorf("not found %v id", h.signalingTargetType(msg.MsgType))
+	} else {
+		err = h.deliverSignalingLocal(foundConn, foundClient, msg)
+	}
+	if err == nil {
+		return
+	}
+	errMsgType := h.signalingServerErrorType(msg.MsgType)
+	if errMsgType == "" {
+		return
+	}
+	errMsg := &message.Message{
+		MsgType: errMsgType,
+		Error: &message.Error{
+			Message: err.Error(),
+		},
+	}
+	err = h.cluster.RouteSignaling(fromNodeId, sourceClientId, targetClientId, errMsg)
+	if err != nil {
+		log.Printf("can not route %v message: %v", errMsgType, err)
+	}
+}
+
+func (h *HttpHandler) writeErrorMessage(conn *websocket.Conn, msgType string, errMsg string) error {
+	resMsg := &message.Message{
+		MsgType: msgType,
+		Error: &message.Error {
+			Message: errMsg,
+		},
+	}
+	return h.safeWriteMessage(conn, resMsg)
+}
+
+// safeWriteMessage queues the message to the writer of the client.
+func (h *HttpHandler) safeWriteMessage(conn *websocket.Conn, msg *message.Message) error {
+	h.clientsMutex.Lock()
+	client := h.clients[conn]
+	h.clientsMutex.Unlock()
+	if client == nil {
+		// error callback of forwarder may be called after disconnection
+		return fmt.Errorf("client is already unregistered")
+	}
+	return client.writer.enqueue(msg)
+}
+
+func (h *HttpHandler) writeMessage(conn *websocket.Conn, msg *message.Message) error {
 	msgBytes, err := json.Marshal(msg)
 	if err != nil {
 		return fmt.Errorf("can not marshal to json: %v", err)
 	}
-	h.clientsMutex.Lock()
-	client := h.clients[conn]
-	h.clientsMutex.Unlock()
-	client.writeMutex.Lock()
-	defer client.writeMutex.Unlock()
-	return conn.WriteMessage(messageType, msgBytes)
+	return conn.WriteMessage(websocket.TextMessage, msgBytes)
+}
+
+// closeWriter writes queued messages within the deadline.
+func (h *HttpHandler) closeWriter(conn *websocket.Conn, writer *connWriter) {
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	writer.close()
+}
+
+// closeOnDone sends the close frame and closes the connection when the handler is shutting down.
+func (h *HttpHandler) closeOnDone(ctx context.Context, conn *websocket.Conn, writer *connWriter) {
+	defer h.wg.Done()
+	<-ctx.Done()
+	if h.ctx.Err() == nil {
+		// the connection is finished
+		return
+	}
+	h.closeWriter(conn, writer)
+	closeMsg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server is shutting down")
+	err := conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(time.Second))
+	if err != nil && h.verbose {
+		log.Printf("can not write close message: %v", err)
+	}
+	conn.Close()
 }
 
-func (h *HttpHandler) startPingLoop(conn *websocket.Conn, pingLoopStopChan chan int) {
-	ticker := time.NewTicker(10 * time.Second)
+// startPingLoop sends pings, and closes the connection if no message is received in the missed heartbeats.
+func (h *HttpHandler) startPingLoop(ctx context.Context, conn *websocket.Conn, lastReceived *int64) {
+	defer h.wg.Done()
+	ticker := time.NewTicker(h.pingInterval)
 	defer ticker.Stop()
+	deadTimeout := h.pingInterval * time.Duration(h.pingMaxMissed)
 	for {
 		select {
 		case <-ticker.C:
+			silent := time.Since(time.Unix(0, atomic.LoadInt64(lastReceived)))
+			if h.pingMaxMissed > 0 && silent > deadTimeout {
+				log.Printf("close dead websocket connection: remoteAddr = %v, silent = %v", conn.RemoteAddr(), silent)
+				conn.Close()
+				return
+			}
 			msg := &message.Message{
 				MsgType: message.MsgTypePing,
 			}
-			err := h.safeWriteMessage(conn, websocket.TextMessage, msg)
+			err := h.safeWriteMessage(conn, msg)
 			if err != nil {
 				log.Printf("can not write ping message: %v", err)
 				return
 			}
-		case <-pingLoopStopChan:
+		case <-ctx.Done():
 			return
 		}
 	}
 }
 
-func (h *HttpHandler) websocketLoop(conn *websocket.Conn, clientType string) {
-	uuid, err := uuid.NewRandom()
+func (h *HttpHandler) websocketLoop(conn *websocket.Conn, clientType string, metadata *message.ClientMetadata, inviteDelivererId string) {
+	defer h.wg.Done()
+	clientUuid, err := uuid.NewRandom()
 	if err != nil {
 		log.Printf("can not create uuid: %v", err)
 		return
 	}
-	clientId := uuid.String()
-	client := h.clientRegister(conn, clientType, clientId)
+	clientId := clientUuid.String()
+	writer := newConnWriter(func(msg *message.Message) error {
+		return h.writeMessage(conn, msg)
+	}, connWriteQueueSize)
+	client := h.clientRegister(conn, writer, clientType, clientId, metadata, inviteDelivererId)
+	defer h.finishClient(client)
 	defer h.clientUnregister(conn)
 	defer conn.Close()
-	pingStopChan := make(chan int)
-	go h.startPingLoop(conn, pingStopChan)
-	defer close(pingStopChan)
+	defer h.closeWriter(conn, writer)
+	connCtx, connCancel := context.WithCancel(h.ctx)
+	defer connCancel()
+	lastReceived := time.Now().UnixNano()
+	h.wg.Add(2)
+	go h.closeOnDone(connCtx, conn, writer)
+	go h.startPingLoop(connCtx, conn, &lastReceived)
 	for {
 		t, msgBytes, err := conn.ReadMessage()
 		if err != nil {
 			break
 		}
+		atomic.StoreInt64(&lastReceived, time.Now().UnixNano())
 		if t != websocket.TextMessage {
 			log.Printf("unsupported message type: %v", t)
 			continue
@@ -286,6 +1278,7 @@ func (h *HttpHandler) websocketLoop(conn *websocket.Conn, clientType string) {
 			log.Printf("can not unmarshal message: %v", err)
 			continue
 		}
+		h.touchClient(client)
 		if msg.MsgType == message.MsgTypePing {
 			if h.verbose {
 				log.Printf("recieved ping")
@@ -299,43 +1292,72 @@ func (h *HttpHandler) websocketLoop(conn *websocket.Conn, clientType string) {
 						Message: "no register request parameter",
 					},
 				}
-				err = h.safeWriteMessage(conn, websocket.TextMessage, resMsg)
+				err = h.safeWriteMessage(conn, resMsg)
+				if err != nil {
+					log.Printf("can not write register response message: %v", err)
+					return
+				}
+				continue
+			}
+			room, err := h.registerRoom(client, msg.RegisterRequest.Room)
+			if err != nil {
+				log.Printf("can not decide room: %v", err)
+				err = h.writeErrorMessage(conn, message.MsgTypeRegisterRes, "room is not allowed")
 				if err != nil {
 					log.Printf("can not write register response message: %v", err)
 					return
 				}
+				continue
+			}
+			if client.resumeToken == "" && msg.RegisterRequest.ResumeToken != "" {
+				suspended := h.resumeClient(msg.RegisterRequest.ResumeToken, client, room)
+				if suspended != nil {
+					h.updateClientId(client, suspended.clientId)
+					client.relationClient = suspended.relationClient
+				} else {
+					log.Printf("can not resume client, register as new client: type = %v, id = %v", clientType, client.clientId)
+				}
+			}
+			if client.resumeToken == "" {
+				resumeToken, err := uuid.NewRandom()
+				if err != nil {
+					log.Printf("can not create resume token: %v", err)
+					return
+				}
+				client.resumeToken = resumeToken.String()
+			}
+			client.clientName = msg.RegisterRequest.ClientName
+			client.metadata.Capabilities = msg.RegisterRequest.Capabilities
+			h.clientsMutex.Lock()
+			client.room = room
+			client.presence = false
+			for _, capability := range msg.RegisterRequest.Capabilities {
+				if capability == message.CapabilityPresence {
+					client.presence = true
+				}
 			}
+			h.clientsMutex.Unlock()
 			resMsg := &message.Message {
 				MsgType: message.MsgTypeRegisterRes,
 				RegisterResponse: &message.RegisterResponse {
 					ClientType: clientType,
-					ClientId: clientId,
+					ClientId: client.clientId,
+					ResumeToken: client.resumeToken,
+					Room: client.room,
 				},
 			}
-			err = h.safeWriteMessage(conn, websocket.TextMessage, resMsg)
+			err = h.safeWriteMessage(conn, resMsg)
 			if err != nil {
 				log.Printf("can not write register response message: %v", err)
 				return
 			}
-			if clientType == message.ClientTypeDeliverer {
-				h.clientsStore.AddDeliverer(clientId, msg.RegisterRequest.ClientName)
-				defer h.clientsStore.DeleteDeliverer(clientId)
-
-			} else if clientType == message.ClientTypeController {
-				h.clientsStore.AddController(clientId, msg.RegisterRequest.ClientName)
-				defer h.clientsStore.DeleteController(clientId)
-			}
+			h.addClientToStore(clientType, client.clientId, client.clientName, client.room, client.metadata)
 		} else if msg.MsgType == message.MsgTypeLookupReq {
-			controllers := h.clientsStore.GetControllers()
-			gamepads := h.clientsStore.GetGamepads()
 			resMsg := &message.Message {
 				MsgType: message.MsgTypeLookupRes,
-				LookupResponse: &message.LookupResponse {
-					Controllers: controllers,
-					Gamepads: gamepads,
-				},
+				LookupResponse: h.newLookupResponse(clientType, client.room, client.inviteDelivererId),
 			}
-			err = h.safeWriteMessage(conn, websocket.TextMessage, resMsg)
+			err = h.safeWriteMessage(conn, resMsg)
 			if err != nil {
 				log.Printf("can not write lookup response message: %v", err)
 				return
@@ -347,13 +1369,7 @@ func (h *HttpHandler) websocketLoop(conn *websocket.Conn, clientType string) {
 			   msg.SignalingSdpRequest.GamepadId == "" ||
 			   msg.SignalingSdpRequest.Sdp == "" {
 				log.Printf("no sigOfferSdpReq parameter: %v", msg.SignalingSdpRequest)
-				resMsg := &message.Message{
-					MsgType: message.MsgTypeSignalingOfferSdpServerError,
-					Error: &message.Error {
-						Message: "no sigOfferSdpReq parameter",
-					},
-				}
-				err = h.safeWriteMessage(conn, websocket.TextMessage, resMsg)
+				err = h.writeErrorMessage(conn, message.MsgTypeSignalingOfferSdpServerError, "no sigOfferSdpReq parameter")
 				if err != nil {
 					log.Printf("can not write sigOfferSdpSrvErr message: %v", err)
 					return
@@ -363,35 +1379,42 @@ func (h *HttpHandler) websocketLoop(conn *websocket.Conn, clientType string) {
 			if msg.SignalingSdpRequest.DelivererId != client.clientId {
 				log.Printf("deliverer id mismatch: act %v, exp %v",
 					msg.SignalingSdpRequest.DelivererId, client.clientId)
-				resMsg := &message.Message{
-					MsgType: message.MsgTypeSignalingOfferSdpServerError,
-					Error: &message.Error {
-						Message: "deliverer id mismatch",
-					},
-				}
-				err = h.safeWriteMessage(conn, websocket.TextMessage, resMsg)
+				err = h.writeErrorMessage(conn, message.MsgTypeSignalingOfferSdpServerError, "deliverer id mismatch")
 				if err != nil {
 					log.Printf("can not write sigOfferSdpSrvErr message: %v", err)
 					return
 				}
 				continue
 			}
-			foundConn, _ := h.getClient(msg.SignalingSdpRequest.ControllerId)
-			if foundConn == nil {
-				log.Printf("not found controller id: %v", msg.SignalingSdpRequest.ControllerId)
-				resMsg := &message.Message{
-					MsgType: message.MsgTypeSignalingOfferSdpServerError,
-					Error: &message.Error {
-						Message: "not found controller id",
-					},
+			if !h.isInRoom(client.room, message.ClientTypeController, msg.SignalingSdpRequest.ControllerId) ||
+			   !h.isInRoom(client.room, message.ClientTypeGamepad, msg.SignalingSdpRequest.GamepadId) {
+				log.Printf("controller or gamepad is not in room: room = %v, controllerId = %v, gamepadId = %v",
+					client.room, msg.SignalingSdpRequest.ControllerId, msg.SignalingSdpRequest.GamepadId)
+				err = h.writeErrorMessage(conn, message.MsgTypeSignalingOfferSdpServerError, "not found controller or gamepad in room")
+				if err != nil {
+					log.Printf("can not write sigOfferSdpSrvErr message: %v", err)
+					return
 				}
-				err = h.safeWriteMessage(conn, websocket.TextMessage, resMsg)
+				continue
+			}
+			err = h.clientsStore.ReserveGamepad(
+				msg.SignalingSdpRequest.GamepadId,
+				msg.SignalingSdpRequest.DelivererId,
+				msg.SignalingSdpRequest.ControllerId)
+			if err != nil {
+				log.Printf("can not reserve gamepad: %v", err)
+				err = h.writeErrorMessage(conn, message.MsgTypeSignalingOfferSdpServerError, "gamepad is in use")
 				if err != nil {
 					log.Printf("can not write sigOfferSdpSrvErr message: %v", err)
 					return
 				}
 				continue
 			}
+			var prevRelationClient *relationClient
+			if client.relationClient != nil {
+				copiedRelationClient := *client.relationClient
+				prevRelationClient = &copiedRelationClient
+			}
 			ok := h.updateClientRelation(client,
 				msg.SignalingSdpRequest.DelivererId,
 				msg.SignalingSdpRequest.ControllerId,
@@ -399,30 +1422,35 @@ func (h *HttpHandler) websocketLoop(conn *websocket.Conn, clientType string) {
 				false)
 			if !ok {
 				log.Printf("can not update client relation: %v", msg.SignalingSdpRequest)
-				resMsg := &message.Message{
-					MsgType: message.MsgTypeSignalingOfferSdpServerError,
-					Error: &message.Error {
-						Message: "can not update client relation",
-					},
+				if prevRelationClient == nil || prevRelationClient.gamepadId != msg.SignalingSdpRequest.GamepadId {
+					h.clientsStore.ReleaseGamepad(
+						msg.SignalingSdpRequest.GamepadId,
+						msg.SignalingSdpRequest.DelivererId,
+						msg.SignalingSdpRequest.ControllerId)
 				}
-				err = h.safeWriteMessage(conn, websocket.TextMessage, resMsg)
+				err = h.writeErrorMessage(conn, message.MsgTypeSignalingOfferSdpServerError, "can not update client relation")
 				if err != nil {
 					log.Printf("can not write sigOfferSdpSrvErr message: %v", err)
 					return
 				}
 				continue
 			}
+			if prevRelationClient != nil && prevRelationClient.gamepadId != msg.SignalingSdpRequest.GamepadId {
+				// release previous reservation
+				h.clientsStore.ReleaseGamepad(
+					prevRelationClient.gamepadId,
+					prevRelationClient.delivererId,
+					prevRelationClient.controllerId)
+			}
 			// forward to controller
-			err = h.safeWriteMessage(foundConn, websocket.TextMessage, &msg)
+			err = h.deliverSignaling(msg.SignalingSdpRequest.ControllerId, client.clientId, &msg)
 			if err != nil {
-				log.Printf("can not forward sigOfferSdpReq message: %v", msg)
-				resMsg := &message.Message{
-					MsgType: message.MsgTypeSignalingOfferSdpServerError,
-					Error: &message.Error {
-						Message: "can not forward sigOfferSdpReq message",
-					},
-				}
-				err = h.safeWriteMessage(conn, websocket.TextMessage, resMsg)
+				log.Printf("can not deliver sigOfferSdpReq message: %v", err)
+				h.clientsStore.ReleaseGamepad(
+					msg.SignalingSdpRequest.GamepadId,
+					msg.SignalingSdpRequest.DelivererId,
+					msg.SignalingSdpRequest.ControllerId)
+				err = h.writeErrorMessage(conn, message.MsgTypeSignalingOfferSdpServerError, err.Error())
 				if err != nil {
 					log.Printf("can not write sigOfferSdpSrvErr message: %v", err)
 					return
@@ -435,13 +1463,7 @@ func (h *HttpHandler) websocketLoop(conn *websocket.Conn, clientType string) {
 			   msg.SignalingSdpResponse.ControllerId == "" ||
 			   msg.SignalingSdpResponse.GamepadId == "" {
 				log.Printf("no sigOfferSdpRes parameter: %v", msg.SignalingSdpResponse)
-				resMsg := &message.Message{
-					MsgType: message.MsgTypeSignalingOfferSdpServerError,
-					Error: &message.Error {
-						Message: "no sigOfferSdpRes parameter",
-					},
-				}
-				err = h.safeWriteMessage(conn, websocket.TextMessage, resMsg)
+				err = h.writeErrorMessage(conn, message.MsgTypeSignalingOfferSdpServerError, "no sigOfferSdpRes parameter")
 				if err != nil {
 					log.Printf("can not write sigOfferSdpSrvErr message: %v", err)
 					return
@@ -451,47 +1473,18 @@ func (h *HttpHandler) websocketLoop(conn *websocket.Conn, clientType string) {
 			if msg.SignalingSdpResponse.ControllerId != client.clientId {
 				log.Printf("controller id mismatch: act %v, exp %v",
 					msg.SignalingSdpResponse.ControllerId, client.clientId)
-				resMsg := &message.Message{
-					MsgType: message.MsgTypeSignalingOfferSdpServerError,
-					Error: &message.Error {
-						Message: "controller id mismatch",
-					},
-				}
-				err = h.safeWriteMessage(conn, websocket.TextMessage, resMsg)
-				if err != nil {
-					log.Printf("can not write sigOfferSdpSrvErr message: %v", err)
-					return
-				}
-				continue
-			}
-			foundConn, foundClient := h.getClient(msg.SignalingSdpResponse.DelivererId)
-			if foundConn == nil || foundClient == nil {
-				log.Printf("not found deliverer id: %v", msg.SignalingSdpResponse.DelivererId)
-				resMsg := &message.Message{
-					MsgType: message.MsgTypeSignalingOfferSdpServerError,
-					Error: &message.Error {
-						Message: "not found deliverer id",
-					},
-				}
-				err = h.safeWriteMessage(conn, websocket.TextMessage, resMsg)
+				err = h.writeErrorMessage(conn, message.MsgTypeSignalingOfferSdpServerError, "controller id mismatch")
 				if err != nil {
 					log.Printf("can not write sigOfferSdpSrvErr message: %v", err)
 					return
 				}
 				continue
 			}
-			if foundClient.relationClient == nil ||
-			   foundClient.relationClient.delivererId !=  msg.SignalingSdpResponse.DelivererId ||
-			   foundClient.relationClient.controllerId !=  msg.SignalingSdpResponse.ControllerId ||
-			   foundClient.relationClient.gamepadId !=  msg.SignalingSdpResponse.GamepadId {
-				log.Printf("found client relation mismatch: %v, %v", foundClient.relationClient, msg.SignalingSdpResponse)
-				resMsg := &message.Message{
-					MsgType: message.MsgTypeSignalingOfferSdpServerError,
-					Error: &message.Error {
-						Message: "client relation mismatch",
-					},
-				}
-				err = h.safeWriteMessage(conn, websocket.TextMessage, resMsg)
+			// forward to deliverer, the deliverer side commits its relation
+			err = h.deliverSignaling(msg.SignalingSdpResponse.DelivererId, client.clientId, &msg)
+			if err != nil {
+				log.Printf("can not deliver sigOfferSdpRes message: %v", err)
+				err = h.writeErrorMessage(conn, message.MsgTypeSignalingOfferSdpServerError, err.Error())
 				if err != nil {
 					log.Printf("can not write sigOfferSdpSrvErr message: %v", err)
 					return
@@ -499,72 +1492,17 @@ func (h *HttpHandler) websocketLoop(conn *websocket.Conn, clientType string) {
 				continue
 			}
 			if msg.Error != nil && msg.Error.Message != "" {
-				// forward error to deliverer
-				err = h.safeWriteMessage(foundConn, websocket.TextMessage, &msg)
-				if err != nil {
-					log.Printf("can not forward sigOfferSdpRes message: %v", msg)
-					resMsg := &message.Message{
-						MsgType: message.MsgTypeSignalingOfferSdpServerError,
-						Error: &message.Error {
-							Message: "can not forward sigOfferSdpRes message",
-						},
-					}
-					err = h.safeWriteMessage(conn, websocket.TextMessage, resMsg)
-					if err != nil {
-						log.Printf("can not write sigOfferSdpSrvErr message: %v", err)
-						return
-					}
-					continue
-				}
-				continue
-			}
-			ok := h.commitClientRelation(foundClient)
-			if !ok {
-				log.Printf("can not commit found client relation: %v", msg.SignalingSdpResponse)
-				resMsg := &message.Message{
-					MsgType: message.MsgTypeSignalingOfferSdpServerError,
-					Error: &message.Error {
-						Message: "can not update client relation",
-					},
-				}
-				err = h.safeWriteMessage(conn, websocket.TextMessage, resMsg)
-				if err != nil {
-					log.Printf("can not write sigOfferSdpSrvErr message: %v", err)
-					return
-				}
+				// rejected by controller
 				continue
 			}
-			ok = h.updateClientRelation(client,
+			ok := h.updateClientRelation(client,
 				msg.SignalingSdpResponse.DelivererId,
 				msg.SignalingSdpResponse.ControllerId,
 				msg.SignalingSdpResponse.GamepadId,
 				true)
 			if !ok {
 				log.Printf("can not update client relation: %v", msg.SignalingSdpResponse)
-				resMsg := &message.Message{
-					MsgType: message.MsgTypeSignalingOfferSdpServerError,
-					Error: &message.Error {
-						Message: "can not update client relation",
-					},
-				}
-				err = h.safeWriteMessage(conn, websocket.TextMessage, resMsg)
-				if err != nil {
-					log.Printf("can not write sigOfferSdpSrvErr message: %v", err)
-					return
-				}
-				continue
-			}
-			// forward to deliverer
-			err = h.safeWriteMessage(foundConn, websocket.TextMessage, &msg)
-			if err != nil {
-				log.Printf("can not forward sigOfferSdpRes message: %v", msg)
-				resMsg := &message.Message{
-					MsgType: message.MsgTypeSignalingOfferSdpServerError,
-					Error: &message.Error {
-						Message: "can not forward sigOfferSdpRes message",
-					},
-				}
-				err = h.safeWriteMessage(conn, websocket.TextMessage, resMsg)
+				err = h.writeErrorMessage(conn, message.MsgTypeSignalingOfferSdpServerError, "can not update client relation")
 				if err != nil {
 					log.Printf("can not write sigOfferSdpSrvErr message: %v", err)
 					return
@@ -578,13 +1516,7 @@ func (h *HttpHandler) websocketLoop(conn *websocket.Conn, clientType string) {
 			   msg.SignalingSdpRequest.GamepadId == "" ||
 			   msg.SignalingSdpRequest.Sdp == "" {
 				log.Printf("no sigAnswerSdpReq parameter: %v", msg.SignalingSdpRequest)
-				resMsg := &message.Message{
-					MsgType: message.MsgTypeSignalingAnswerSdpServerError,
-					Error: &message.Error {
-						Message: "no sigAnswerSdpReq parameter",
-					},
-				}
-				err = h.safeWriteMessage(conn, websocket.TextMessage, resMsg)
+				err = h.writeErrorMessage(conn, message.MsgTypeSignalingAnswerSdpServerError, "no sigAnswerSdpReq parameter")
 				if err != nil {
 					log.Printf("can not write sigAnswerSdpSrvErr message: %v", err)
 					return
@@ -594,52 +1526,19 @@ func (h *HttpHandler) websocketLoop(conn *websocket.Conn, clientType string) {
 			if msg.SignalingSdpRequest.ControllerId != client.clientId {
 				log.Printf("controller id mismatch: act %v, exp %v",
 					msg.SignalingSdpRequest.ControllerId, client.clientId)
-				resMsg := &message.Message{
-					MsgType: message.MsgTypeSignalingAnswerSdpServerError,
-					Error: &message.Error {
-						Message: "controller id mismatch",
-					},
-				}
-				err = h.safeWriteMessage(conn, websocket.TextMessage, resMsg)
-				if err != nil {
-					log.Printf("can not write sigAnswerSdpSrvErr message: %v", err)
-					return
-				}
-				continue
-			}
-			foundConn, foundClient := h.getClient(msg.SignalingSdpRequest.DelivererId)
-			if foundConn == nil || foundClient == nil {
-				log.Printf("not found deliverer id: %v", msg.SignalingSdpRequest.DelivererId)
-				resMsg := &message.Message{
-					MsgType: message.MsgTypeSignalingAnswerSdpServerError,
-					Error: &message.Error {
-						Message: "not found deliverer id",
-					},
-				}
-				err = h.safeWriteMessage(conn, websocket.TextMessage, resMsg)
+				err = h.writeErrorMessage(conn, message.MsgTypeSignalingAnswerSdpServerError, "controller id mismatch")
 				if err != nil {
 					log.Printf("can not write sigAnswerSdpSrvErr message: %v", err)
 					return
 				}
 				continue
 			}
-			if client.relationClient == nil ||
-			   client.relationClient.delivererId != msg.SignalingSdpRequest.DelivererId ||
-			   client.relationClient.controllerId != msg.SignalingSdpRequest.ControllerId ||
-			   client.relationClient.gamepadId != msg.SignalingSdpRequest.GamepadId ||
-			   foundClient.relationClient == nil ||
-			   foundClient.relationClient.delivererId !=  msg.SignalingSdpRequest.DelivererId ||
-			   foundClient.relationClient.controllerId !=  msg.SignalingSdpRequest.ControllerId ||
-			   foundClient.relationClient.gamepadId !=  msg.SignalingSdpRequest.GamepadId {
-				log.Printf("client relation mismatch: %v, %v, %v",
-					client.relationClient, foundClient.relationClient, msg.SignalingSdpRequest)
-				resMsg := &message.Message{
-					MsgType: message.MsgTypeSignalingAnswerSdpServerError,
-					Error: &message.Error {
-						Message: "client relation mismatch",
-					},
-				}
-				err = h.safeWriteMessage(conn, websocket.TextMessage, resMsg)
+			if !h.matchClientRelation(client,
+				msg.SignalingSdpRequest.DelivererId,
+				msg.SignalingSdpRequest.ControllerId,
+				msg.SignalingSdpRequest.GamepadId) {
+				log.Printf("client relation mismatch: %v, %v", client.relationClient, msg.SignalingSdpRequest)
+				err = h.writeErrorMessage(conn, message.MsgTypeSignalingAnswerSdpServerError, "client relation mismatch")
 				if err != nil {
 					log.Printf("can not write sigAnswerSdpSrvErr message: %v", err)
 					return
@@ -647,16 +1546,10 @@ func (h *HttpHandler) websocketLoop(conn *websocket.Conn, clientType string) {
 				continue
 			}
 			// forward to deliverer
-			err = h.safeWriteMessage(foundConn, websocket.TextMessage, &msg)
+			err = h.deliverSignaling(msg.SignalingSdpRequest.DelivererId, client.clientId, &msg)
 			if err != nil {
-				log.Printf("can not forward sigAnswerSdpReq message: %v", msg)
-				resMsg := &message.Message{
-					MsgType: message.MsgTypeSignalingAnswerSdpServerError,
-					Error: &message.Error {
-						Message: "can not forward sigAnswerSdpReq message",
-					},
-				}
-				err = h.safeWriteMessage(conn, websocket.TextMessage, resMsg)
+				log.Printf("can not deliver sigAnswerSdpReq message: %v", err)
+				err = h.writeErrorMessage(conn, message.MsgTypeSignalingAnswerSdpServerError, err.Error())
 				if err != nil {
 					log.Printf("can not write sigAnswerSdpSrvErr message: %v", err)
 					return
@@ -669,13 +1562,7 @@ func (h *HttpHandler) websocketLoop(conn *websocket.Conn, clientType string) {
 			   msg.SignalingSdpResponse.ControllerId == "" ||
 			   msg.SignalingSdpResponse.GamepadId == "" {
 				log.Printf("no sigAnswerSdpRes parameter: %v", msg.SignalingSdpResponse)
-				resMsg := &message.Message{
-					MsgType: message.MsgTypeSignalingAnswerSdpServerError,
-					Error: &message.Error {
-						Message: "no sigAnswerSdpRes parameter",
-					},
-				}
-				err = h.safeWriteMessage(conn, websocket.TextMessage, resMsg)
+				err = h.writeErrorMessage(conn, message.MsgTypeSignalingAnswerSdpServerError, "no sigAnswerSdpRes parameter")
 				if err != nil {
 					log.Printf("can not write sigAnswerSdpSrvErr message: %v", err)
 					return
@@ -685,75 +1572,207 @@ func (h *HttpHandler) websocketLoop(conn *websocket.Conn, clientType string) {
 			if msg.SignalingSdpResponse.DelivererId != client.clientId {
 				log.Printf("deliverer id mismatch: act %v, exp %v",
 					msg.SignalingSdpResponse.DelivererId, client.clientId)
-				resMsg := &message.Message{
-					MsgType: message.MsgTypeSignalingAnswerSdpServerError,
-					Error: &message.Error {
-						Message: "deliverer id mismatch",
-					},
+				err = h.writeErrorMessage(conn, message.MsgTypeSignalingAnswerSdpServerError, "deliverer id mismatch")
+				if err != nil {
+					log.Printf("can not write sigAnswerSdpSrvErr message: %v", err)
+					return
+				}
+				continue
+			}
+			if !h.matchClientRelation(client,
+				msg.SignalingSdpResponse.DelivererId,
+				msg.SignalingSdpResponse.ControllerId,
+				msg.SignalingSdpResponse.GamepadId) {
+				log.Printf("client relation mismatch: %v, %v", client.relationClient, msg.SignalingSdpResponse)
+				err = h.writeErrorMessage(conn, message.MsgTypeSignalingAnswerSdpServerError, "client relation mismatch")
+				if err != nil {
+					log.Printf("can not write sigAnswerSdpSrvErr message: %v", err)
+					return
 				}
-				err = h.safeWriteMessage(conn, websocket.TextMessage, resMsg)
+				continue
+			}
+			// forward to controller
+			err = h.deliverSignaling(msg.SignalingSdpResponse.ControllerId, client.clientId, &msg)
+			if err != nil {
+				log.Printf("can not deliver sigAnswerSdpRes message: %v", err)
+				err = h.writeErrorMessage(conn, message.MsgTypeSignalingAnswerSdpServerError, err.Error())
 				if err != nil {
 					log.Printf("can not write sigAnswerSdpSrvErr message: %v", err)
 					return
 				}
 				continue
 			}
-			foundConn, foundClient := h.getClient(msg.SignalingSdpResponse.ControllerId)
-			if foundConn == nil || foundClient == nil {
-				log.Printf("not found controller id: %v", msg.SignalingSdpResponse.ControllerId)
+		} else if msg.MsgType == message.MsgTypeJoinReq {
+			if msg.JoinRequest == nil ||
+			   msg.JoinRequest.DelivererId == "" ||
+			   msg.JoinRequest.ControllerId == "" {
+				log.Printf("no joinReq parameter: %v", msg.JoinRequest)
+				err = h.writeErrorMessage(conn, message.MsgTypeJoinServerError, "no joinReq parameter")
+				if err != nil {
+					log.Printf("can not write joinSrvErr message: %v", err)
+					return
+				}
+				continue
+			}
+			if clientType != message.ClientTypeController ||
+			   msg.JoinRequest.ControllerId != client.clientId {
+				log.Printf("controller id mismatch: act %v, exp %v",
+					msg.JoinRequest.ControllerId, client.clientId)
+				err = h.writeErrorMessage(conn, message.MsgTypeJoinServerError, "controller id mismatch")
+				if err != nil {
+					log.Printf("can not write joinSrvErr message: %v", err)
+					return
+				}
+				continue
+			}
+			if client.inviteDelivererId != "" && client.inviteDelivererId != msg.JoinRequest.DelivererId {
+				log.Printf("deliverer id is not invited: act %v, exp %v",
+					msg.JoinRequest.DelivererId, client.inviteDelivererId)
+				err = h.writeErrorMessage(conn, message.MsgTypeJoinServerError, "not found deliverer id")
+				if err != nil {
+					log.Printf("can not write joinSrvErr message: %v", err)
+					return
+				}
+				continue
+			}
+			if !h.isInRoom(client.room, message.ClientTypeDeliverer, msg.JoinRequest.DelivererId) {
+				log.Printf("deliverer is not in room: room = %v, delivererId = %v", client.room, msg.JoinRequest.DelivererId)
+				err = h.writeErrorMessage(conn, message.MsgTypeJoinServerError, "not found deliverer id")
+				if err != nil {
+					log.Printf("can not write joinSrvErr message: %v", err)
+					return
+				}
+				continue
+			}
+			if client.relationClient != nil && client.relationClient.commit {
+				log.Printf("controller is already in session: %v", client.relationClient)
+				err = h.writeErrorMessage(conn, message.MsgTypeJoinServerError, "already in session")
+				if err != nil {
+					log.Printf("can not write joinSrvErr message: %v", err)
+					return
+				}
+				continue
+			}
+			msg.JoinRequest.ControllerName = client.clientName
+			// forward to deliverer
+			err = h.deliverSignaling(msg.JoinRequest.DelivererId, client.clientId, &msg)
+			if err != nil {
+				log.Printf("can not deliver joinReq message: %v", err)
+				err = h.writeErrorMessage(conn, message.MsgTypeJoinServerError, err.Error())
+				if err != nil {
+					log.Printf("can not write joinSrvErr message: %v", err)
+					return
+				}
+				continue
+			}
+		} else if msg.MsgType == message.MsgTypeJoinRes {
+			if msg.JoinResponse == nil ||
+			   msg.JoinResponse.DelivererId == "" ||
+			   msg.JoinResponse.ControllerId == "" {
+				log.Printf("no joinRes parameter: %v", msg.JoinResponse)
+				err = h.writeErrorMessage(conn, message.MsgTypeJoinServerError, "no joinRes parameter")
+				if err != nil {
+					log.Printf("can not write joinSrvErr message: %v", err)
+					return
+				}
+				continue
+			}
+			if clientType != message.ClientTypeDeliverer ||
+			   msg.JoinResponse.DelivererId != client.clientId {
+				log.Printf("deliverer id mismatch: act %v, exp %v",
+					msg.JoinResponse.DelivererId, client.clientId)
+				err = h.writeErrorMessage(conn, message.MsgTypeJoinServerError, "deliverer id mismatch")
+				if err != nil {
+					log.Printf("can not write joinSrvErr message: %v", err)
+					return
+				}
+				continue
+			}
+			ok := h.removeJoinRequest(client, msg.JoinResponse.ControllerId)
+			if !ok {
+				log.Printf("not found join request: %v", msg.JoinResponse)
+				err = h.writeErrorMessage(conn, message.MsgTypeJoinServerError, "not found join request")
+				if err != nil {
+					log.Printf("can not write joinSrvErr message: %v", err)
+					return
+				}
+				continue
+			}
+			// forward to controller
+			err = h.deliverSignaling(msg.JoinResponse.ControllerId, client.clientId, &msg)
+			if err != nil {
+				log.Printf("can not deliver joinRes message: %v", err)
+				err = h.writeErrorMessage(conn, message.MsgTypeJoinServerError, err.Error())
+				if err != nil {
+					log.Printf("can not write joinSrvErr message: %v", err)
+					return
+				}
+				continue
+			}
+		} else if msg.MsgType == message.MsgTypeInviteReq {
+			if msg.InviteRequest == nil ||
+			   msg.InviteRequest.DelivererId == "" {
+				log.Printf("no inviteReq parameter: %v", msg.InviteRequest)
 				resMsg := &message.Message{
-					MsgType: message.MsgTypeSignalingAnswerSdpServerError,
+					MsgType: message.MsgTypeInviteRes,
 					Error: &message.Error {
-						Message: "not found controller Id",
+						Message: "no inviteReq parameter",
 					},
 				}
-				err = h.safeWriteMessage(conn, websocket.TextMessage, resMsg)
+				err = h.safeWriteMessage(conn, resMsg)
 				if err != nil {
-					log.Printf("can not write sigAnswerSdpSrvErr message: %v", err)
+					log.Printf("can not write inviteRes message: %v", err)
 					return
 				}
 				continue
 			}
-			if client.relationClient == nil ||
-			   client.relationClient.delivererId != msg.SignalingSdpResponse.DelivererId ||
-			   client.relationClient.controllerId != msg.SignalingSdpResponse.ControllerId ||
-			   client.relationClient.gamepadId != msg.SignalingSdpResponse.GamepadId ||
-			   foundClient.relationClient == nil ||
-			   foundClient.relationClient.delivererId !=  msg.SignalingSdpResponse.DelivererId ||
-			   foundClient.relationClient.controllerId !=  msg.SignalingSdpResponse.ControllerId ||
-			   foundClient.relationClient.gamepadId !=  msg.SignalingSdpResponse.GamepadId {
-				log.Printf("client relation mismatch: %v, %v, %v",
-					client.relationClient, foundClient.relationClient, msg.SignalingSdpResponse)
+			if clientType != message.ClientTypeDeliverer ||
+			   msg.InviteRequest.DelivererId != client.clientId {
+				log.Printf("deliverer id mismatch: act %v, exp %v",
+					msg.InviteRequest.DelivererId, client.clientId)
 				resMsg := &message.Message{
-					MsgType: message.MsgTypeSignalingAnswerSdpServerError,
+					MsgType: message.MsgTypeInviteRes,
 					Error: &message.Error {
-						Message: "client relation mismatch",
+						Message: "deliverer id mismatch",
 					},
 				}
-				err = h.safeWriteMessage(conn, websocket.TextMessage, resMsg)
+				err = h.safeWriteMessage(conn, resMsg)
 				if err != nil {
-					log.Printf("can not write sigAnswerSdpSrvErr message: %v", err)
+					log.Printf("can not write inviteRes message: %v", err)
 					return
 				}
 				continue
 			}
-			// forward to controller
-			err = h.safeWriteMessage(foundConn, websocket.TextMessage, &msg)
+			token, expiresAt, err := h.inviteStore.mint(client.clientId)
 			if err != nil {
-				log.Printf("can not forward sigAnswerSdpRes message: %v", msg)
+				log.Printf("can not mint invite: %v", err)
 				resMsg := &message.Message{
-					MsgType: message.MsgTypeSignalingAnswerSdpServerError,
+					MsgType: message.MsgTypeInviteRes,
 					Error: &message.Error {
-						Message: "can not forward sigAnswerSdpRes message",
+						Message: "can not mint invite",
 					},
 				}
-				err = h.safeWriteMessage(conn, websocket.TextMessage, resMsg)
+				err = h.safeWriteMessage(conn, resMsg)
 				if err != nil {
-					log.Printf("can not write sigAnswerSdpSrvErr message: %v", err)
+					log.Printf("can not write inviteRes message: %v", err)
 					return
 				}
 				continue
 			}
+			resMsg := &message.Message{
+				MsgType: message.MsgTypeInviteRes,
+				InviteResponse: &message.InviteResponse {
+					DelivererId: client.clientId,
+					Token: token,
+					Path: "/invite/" + token,
+					ExpiresAt: expiresAt.Unix(),
+				},
+			}
+			err = h.safeWriteMessage(conn, resMsg)
+			if err != nil {
+				log.Printf("can not write inviteRes message: %v", err)
+				return
+			}
 		} else if msg.MsgType == message.MsgTypeGamepadConnectReq {
 			if msg.GamepadConnectRequest == nil ||
 			   msg.GamepadConnectRequest.DelivererId == "" ||
@@ -766,7 +1785,7 @@ func (h *HttpHandler) websocketLoop(conn *websocket.Conn, clientType string) {
 						Message: "no gamepad connect request parameter",
 					},
 				}
-				err = h.safeWriteMessage(conn, websocket.TextMessage, resMsg)
+				err = h.safeWriteMessage(conn, resMsg)
 				if err != nil {
 					log.Printf("can not write gpConnectSrvErr message: %v", err)
 					return
@@ -782,7 +1801,7 @@ func (h *HttpHandler) websocketLoop(conn *websocket.Conn, clientType string) {
 						Message: "controller id mismatch",
 					},
 				}
-				err = h.safeWriteMessage(conn, websocket.TextMessage, resMsg)
+				err = h.safeWriteMessage(conn, resMsg)
 				if err != nil {
 					log.Printf("can not write gpConnectSrvErr message: %v", err)
 					return
@@ -801,13 +1820,15 @@ func (h *HttpHandler) websocketLoop(conn *websocket.Conn, clientType string) {
 						Message: "client relation mismatch",
 					},
 				}
-				err = h.safeWriteMessage(conn, websocket.TextMessage, resMsg)
+				err = h.safeWriteMessage(conn, resMsg)
 				if err != nil {
 					log.Printf("can not write gpConnectSrvErr message: %v", err)
 					return
 				}
 				continue
 			}
+			// capabilities may be changed by reconnection of the gamepad
+			client.gamepadCapabilitiesId = ""
 			h.forwarder.ToTcp(&msg, func(err error) {
 				log.Printf("error callback: %v", err)
 				resMsg := &message.Message{
@@ -816,7 +1837,7 @@ func (h *HttpHandler) websocketLoop(conn *websocket.Conn, clientType string) {
 						Message: err.Error(),
 					},
 				}
-				err = h.safeWriteMessage(conn, websocket.TextMessage, resMsg)
+				err = h.safeWriteMessage(conn, resMsg)
 				if err != nil {
 					log.Printf("can not write gpConnectSrvErr message: %v", err)
 					return
@@ -843,6 +1864,11 @@ func (h *HttpHandler) websocketLoop(conn *websocket.Conn, clientType string) {
 					client.relationClient, msg.GamepadConnectRequest)
 				continue
 			}
+			capabilities := h.gamepadCapabilities(client, msg.GamepadState.GamepadId)
+			if err := normalizeGamepadState(msg.GamepadState, capabilities); err != nil {
+				log.Printf("invalid gamepad state: %v", err)
+				continue
+			}
 			h.forwarder.ToTcp(&msg, nil)
 		} else {
 			log.Printf("unsupported request: %v", msg.MsgType)
@@ -850,6 +1876,18 @@ func (h *HttpHandler) websocketLoop(conn *websocket.Conn, clientType string) {
 	}
 }
 
+func (h *HttpHandler) newClientMetadata(c *gin.Context) *message.ClientMetadata {
+	now := time.Now().Unix()
+	return &message.ClientMetadata{
+		ConnectedAt:  now,
+		LastActivity: now,
+		RemoteAddr:   c.Request.RemoteAddr,
+		// empty if the client is authenticated by the invite
+		Account:      c.GetString(gin.AuthUserKey),
+		UserAgent:    c.Request.UserAgent(),
+	}
+}
+
 func (h *HttpHandler) delivererWebsocket(c *gin.Context) {
 	if h.verbose {
 		log.Printf("requested /delivererws")
@@ -859,13 +1897,18 @@ func (h *HttpHandler) delivererWebsocket(c *gin.Context) {
 		WriteBufferSize: 4096,
 		Subprotocols: []string{"deliverer"},
 	}
+	if h.ctx.Err() != nil {
+		c.AbortWithStatus(http.StatusServiceUnavailable)
+		return
+	}
 	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
-		log.Println("Failed to set websocket upgrade: %+v", err)
+		log.Printf("Failed to set websocket upgrade: %+v", err)
                 c.AbortWithStatus(400)
 		return
 	}
-	go h.websocketLoop(conn, message.ClientTypeDeliverer)
+	h.wg.Add(1)
+	go h.websocketLoop(conn, message.ClientTypeDeliverer, h.newClientMetadata(c), "")
 }
 
 
@@ -873,22 +1916,57 @@ func (h *HttpHandler) controllerWebsocket(c *gin.Context) {
 	if h.verbose {
 		log.Printf("requested /controllerws")
 	}
+	inviteDelivererId := ""
+	session, ok := c.Get(guestContextKey)
+	if ok {
+		inviteDelivererId = session.(*guestSession).delivererId
+	}
 	upgrader := websocket.Upgrader{
 		ReadBufferSize:  4096,
 		WriteBufferSize: 4096,
 		Subprotocols: []string{"controller"},
 	}
+	if h.ctx.Err() != nil {
+		c.AbortWithStatus(http.StatusServiceUnavailable)
+		return
+	}
 	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
-		log.Println("Failed to set websocket upgrade: %+v", err)
+		log.Printf("Failed to set websocket upgrade: %+v", err)
                 c.AbortWithStatus(400)
 		return
 	}
-	go h.websocketLoop(conn, message.ClientTypeController)
+	h.wg.Add(1)
+	go h.websocketLoop(conn, message.ClientTypeController, h.newClientMetadata(c), inviteDelivererId)
 }
 
+func (h *HttpHandler) deviceWebsocket(c *gin.Context) {
+	if h.verbose {
+		log.Printf("requested /devicews")
+	}
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:  4096,
+		WriteBufferSize: 4096,
+		Subprotocols: []string{"gamepad"},
+	}
+	if h.ctx.Err() != nil {
+		c.AbortWithStatus(http.StatusServiceUnavailable)
+		return
+	}
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Printf("Failed to set websocket upgrade: %+v", err)
+                c.AbortWithStatus(400)
+		return
+	}
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		h.deviceHandler.ServeWebsocket(conn)
+	}()
+}
 
-func NewHttpHandler(resourcePath string, accounts map[string]string, clientsStore *ClientsStore, forwarder *Forwarder, opts ...HttpOption) (*HttpHandler, error) {
+func NewHttpHandler(resourcePath string, accounts map[string]string, clientsStore ClientsStore, forwarder Forwarder, opts ...HttpOption) (*HttpHandler, error) {
         baseOpts := defaultHttpOptions()
         for _, opt := range opts {
                 if opt == nil {
@@ -896,12 +1974,37 @@ func NewHttpHandler(resourcePath string, accounts map[string]string, clientsStor
                 }
                 opt(baseOpts)
         }
+	newInviteStore, err := newInviteStore(baseOpts.inviteSecret, baseOpts.inviteTtl, baseOpts.verbose)
+	if err != nil {
+		return nil, fmt.Errorf("can not create invite store: %w", err)
+	}
+	if baseOpts.pingInterval <= 0 {
+		return nil, fmt.Errorf("invalid ping interval: %v", baseOpts.pingInterval)
+	}
+	ctx, cancel := context.WithCancel(baseOpts.ctx)
 	return &HttpHandler{
-                verbose:          baseOpts.verbose,
-                resourcePath:     resourcePath,
-                accounts:         accounts,
-		clientsStore:     clientsStore,
-                forwarder:        forwarder,
-		clients:          make(map[*websocket.Conn]*httpClient),
+                verbose:           baseOpts.verbose,
+                resourcePath:      resourcePath,
+                accounts:          accounts,
+                resumeGracePeriod: baseOpts.resumeGracePeriod,
+		clientsStore:      clientsStore,
+                forwarder:         forwarder,
+		clients:           make(map[*websocket.Conn]*httpClient),
+		suspendedClients:  make(map[string]*suspendedClient),
+		inviteStore:       newInviteStore,
+		cluster:           baseOpts.cluster,
+		rooms:             baseOpts.rooms,
+		presenceChan:      make(chan *message.PresenceEvent, 1024),
+		presenceResyncRooms: make(map[string]bool),
+		presenceResyncChan: make(chan struct{}, 1),
+		ctx:               ctx,
+		cancel:            cancel,
+		shutdownTimeout:   baseOpts.shutdownTimeout,
+		deviceRegistry:    baseOpts.deviceRegistry,
+		deviceAdmins:      baseOpts.deviceAdmins,
+		clientsHistory:    baseOpts.clientsHistory,
+		deviceHandler:     baseOpts.deviceHandler,
+		pingInterval:      baseOpts.pingInterval,
+		pingMaxMissed:     baseOpts.pingMaxMissed,
         }, nil
 }
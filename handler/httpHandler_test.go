@@ -0,0 +1,63 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"github.com/gin-gonic/gin"
+	"github.com/potix/regapweb/message"
+)
+
+func TestHttpHandlerClientsHistory(t *testing.T) {
+	store, err := NewBoltClientsStore(filepath.Join(t.TempDir(), "clients.db"))
+	if err != nil {
+		t.Fatalf("can not create store: %v", err)
+	}
+	defer store.Close()
+	store.AddGamepad("g1", "gamepad", message.DefaultRoom, nil)
+	store.DeleteGamepad("g1")
+	accounts := map[string]string{ "admin": "password", "user": "password" }
+	httpHandler, err := NewHttpHandler("../resource", accounts, store, NewLocalForwarder(), HttpClientsHistory(store, []string{ "admin" }))
+	if err != nil {
+		t.Fatalf("can not create http handler: %v", err)
+	}
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	httpHandler.SetRouting(router)
+	tests := []struct {
+		name    string
+		path    string
+		account string
+		status  int
+		records int
+	}{
+		{ name: "records", path: "/devices/records", account: "admin", status: http.StatusOK, records: 1 },
+		{ name: "history", path: "/devices/history", account: "admin", status: http.StatusOK, records: 2 },
+		{ name: "limited history", path: "/devices/history?limit=1", account: "admin", status: http.StatusOK, records: 1 },
+		{ name: "invalid limit", path: "/devices/history?limit=x", account: "admin", status: http.StatusBadRequest },
+		{ name: "not admin", path: "/devices/records", account: "user", status: http.StatusForbidden },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.SetBasicAuth(tt.account, accounts[tt.account])
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, req)
+			if recorder.Code != tt.status {
+				t.Fatalf("unexpected status: got %v, want %v", recorder.Code, tt.status)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			var records []json.RawMessage
+			if err := json.Unmarshal(recorder.Body.Bytes(), &records); err != nil {
+				t.Fatalf("can not unmarshal records: %v", err)
+			}
+			if len(records) != tt.records {
+				t.Fatalf("unexpected records: %v", recorder.Body.String())
+			}
+		})
+	}
+}
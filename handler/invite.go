@@ -0,0 +1,235 @@
+package handler
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"github.com/google/uuid"
+)
+
+type invite struct {
+	inviteId    string
+	delivererId string
+	expiresAt   time.Time
+	timer       *time.Timer
+}
+
+// guestSession is created by consuming the invite, and authorizes the invited controller afterwards,
+// so that the reload of the page and the reconnection do not need the invite again.
+type guestSession struct {
+	sessionId   string
+	delivererId string
+	timer       *time.Timer
+}
+
+type inviteStore struct {
+	verbose      bool
+	secret       []byte
+	ttl          time.Duration
+	invitesMutex sync.Mutex
+	invites      map[string]*invite
+	sessions     map[string]*guestSession
+}
+
+func (i *inviteStore) sign(payload string) string {
+	mac := hmac.New(sha256.New, i.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// mint issues the invite token bound to the deliverer.
+// token format is base64(delivererId:inviteId:expiresAt).base64(hmac)
+func (i *inviteStore) mint(delivererId string) (string, time.Time, error) {
+	inviteUuid, err := uuid.NewRandom()
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("can not create invite id: %w", err)
+	}
+	inv := &invite{
+		inviteId:    inviteUuid.String(),
+		delivererId: delivererId,
+		expiresAt:   time.Now().Add(i.ttl),
+	}
+	payload := fmt.Sprintf("%v:%v:%v", inv.delivererId, inv.inviteId, inv.expiresAt.Unix())
+	token := base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + i.sign(payload)
+	i.invitesMutex.Lock()
+	defer i.invitesMutex.Unlock()
+	inv.timer = time.AfterFunc(i.ttl, func() {
+		i.revoke(inv.inviteId)
+	})
+	i.invites[inv.inviteId] = inv
+	if i.verbose {
+		log.Printf("mint invite: inviteId = %v, delivererId = %v, expiresAt = %v", inv.inviteId, inv.delivererId, inv.expiresAt)
+	}
+	return token, inv.expiresAt, nil
+}
+
+func (i *inviteStore) parse(token string) (string, string, time.Time, error) {
+	items := strings.Split(token, ".")
+	if len(items) != 2 {
+		return "", "", time.Time{}, fmt.Errorf("invalid token format")
+	}
+	payloadBytes, err := base64.RawURLEncoding.DecodeString(items[0])
+	if err != nil {
+		return "", "", time.Time{}, fmt.Errorf("can not decode payload: %w", err)
+	}
+	payload := string(payloadBytes)
+	if !hmac.Equal([]byte(i.sign(payload)), []byte(items[1])) {
+		return "", "", time.Time{}, fmt.Errorf("signature mismatch")
+	}
+	fields := strings.Split(payload, ":")
+	if len(fields) != 3 {
+		return "", "", time.Time{}, fmt.Errorf("invalid payload format")
+	}
+	expiresAt, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return "", "", time.Time{}, fmt.Errorf("invalid expires: %w", err)
+	}
+	return fields[0], fields[1], time.Unix(expiresAt, 0), nil
+}
+
+// verify returns the invite of the token if it is neither used, revoked nor expired.
+func (i *inviteStore) verify(token string) (*invite, error) {
+	delivererId, inviteId, expiresAt, err := i.parse(token)
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(expiresAt) {
+		return nil, fmt.Errorf("invite is expired: inviteId = %v", inviteId)
+	}
+	i.invitesMutex.Lock()
+	defer i.invitesMutex.Unlock()
+	inv, ok := i.invites[inviteId]
+	if !ok || inv.delivererId != delivererId {
+		return nil, fmt.Errorf("invite is used or revoked: inviteId = %v", inviteId)
+	}
+	return inv, nil
+}
+
+// consume verifies the token and revokes it, so that it can be used only once.
+func (i *inviteStore) consume(token string) (*invite, error) {
+	inv, err := i.verify(token)
+	if err != nil {
+		return nil, err
+	}
+	if !i.revoke(inv.inviteId) {
+		return nil, fmt.Errorf("invite is already used: inviteId = %v", inv.inviteId)
+	}
+	return inv, nil
+}
+
+func (i *inviteStore) revoke(inviteId string) bool {
+	i.invitesMutex.Lock()
+	defer i.invitesMutex.Unlock()
+	inv, ok := i.invites[inviteId]
+	if !ok {
+		return false
+	}
+	inv.timer.Stop()
+	delete(i.invites, inviteId)
+	if i.verbose {
+		log.Printf("revoke invite: inviteId = %v, delivererId = %v", inv.inviteId, inv.delivererId)
+	}
+	return true
+}
+
+// openSession consumes the invite and creates the guest session bound to the deliverer who invited.
+func (i *inviteStore) openSession(token string) (*guestSession, error) {
+	inv, err := i.consume(token)
+	if err != nil {
+		return nil, err
+	}
+	sessionUuid, err := uuid.NewRandom()
+	if err != nil {
+		return nil, fmt.Errorf("can not create session id: %w", err)
+	}
+	session := &guestSession{
+		sessionId:   sessionUuid.String(),
+		delivererId: inv.delivererId,
+	}
+	i.invitesMutex.Lock()
+	defer i.invitesMutex.Unlock()
+	session.timer = time.AfterFunc(i.ttl, func() {
+		i.closeSession(session.sessionId)
+	})
+	i.sessions[session.sessionId] = session
+	if i.verbose {
+		log.Printf("open guest session: inviteId = %v, delivererId = %v", inv.inviteId, inv.delivererId)
+	}
+	return session, nil
+}
+
+// verifySession returns the guest session and extends it, the session expires after it is not used for the ttl.
+func (i *inviteStore) verifySession(sessionId string) (*guestSession, error) {
+	i.invitesMutex.Lock()
+	defer i.invitesMutex.Unlock()
+	session, ok := i.sessions[sessionId]
+	if !ok {
+		return nil, fmt.Errorf("guest session is closed or expired")
+	}
+	session.timer.Reset(i.ttl)
+	return session, nil
+}
+
+func (i *inviteStore) closeSession(sessionId string) {
+	i.invitesMutex.Lock()
+	defer i.invitesMutex.Unlock()
+	session, ok := i.sessions[sessionId]
+	if !ok {
+		return
+	}
+	session.timer.Stop()
+	delete(i.sessions, sessionId)
+	if i.verbose {
+		log.Printf("close guest session: delivererId = %v", session.delivererId)
+	}
+}
+
+// revokeByDeliverer revokes invites and guest sessions of the deliverer.
+func (i *inviteStore) revokeByDeliverer(delivererId string) {
+	i.invitesMutex.Lock()
+	inviteIds := make([]string, 0)
+	for inviteId, inv := range i.invites {
+		if inv.delivererId == delivererId {
+			inviteIds = append(inviteIds, inviteId)
+		}
+	}
+	sessionIds := make([]string, 0)
+	for sessionId, session := range i.sessions {
+		if session.delivererId == delivererId {
+			sessionIds = append(sessionIds, sessionId)
+		}
+	}
+	i.invitesMutex.Unlock()
+	for _, inviteId := range inviteIds {
+		i.revoke(inviteId)
+	}
+	for _, sessionId := range sessionIds {
+		i.closeSession(sessionId)
+	}
+}
+
+func newInviteStore(secret string, ttl time.Duration, verbose bool) (*inviteStore, error) {
+	secretBytes := []byte(secret)
+	if secret == "" {
+		// tokens are invalidated on restart
+		secretBytes = make([]byte, 32)
+		_, err := rand.Read(secretBytes)
+		if err != nil {
+			return nil, fmt.Errorf("can not create invite secret: %w", err)
+		}
+	}
+	return &inviteStore{
+		verbose:  verbose,
+		secret:   secretBytes,
+		ttl:      ttl,
+		invites:  make(map[string]*invite),
+		sessions: make(map[string]*guestSession),
+	}, nil
+}
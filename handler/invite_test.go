@@ -0,0 +1,112 @@
+package handler
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestInviteStore(t *testing.T, secret string) *inviteStore {
+	store, err := newInviteStore(secret, time.Minute, false)
+	if err != nil {
+		t.Fatalf("can not create invite store: %v", err)
+	}
+	return store
+}
+
+func signedToken(store *inviteStore, payload string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + store.sign(payload)
+}
+
+func TestInviteVerify(t *testing.T) {
+	store := newTestInviteStore(t, "secret")
+	otherStore := newTestInviteStore(t, "other secret")
+	token, _, err := store.mint("deliverer")
+	if err != nil {
+		t.Fatalf("can not mint invite: %v", err)
+	}
+	_, inviteId, _, err := store.parse(token)
+	if err != nil {
+		t.Fatalf("can not parse token: %v", err)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.Split(token, ".")[0])
+	if err != nil {
+		t.Fatalf("can not decode payload: %v", err)
+	}
+	tests := []struct {
+		name  string
+		token string
+		err   string
+	}{
+		{ name: "valid", token: token },
+		{ name: "no signature", token: strings.Split(token, ".")[0], err: "invalid token format" },
+		{ name: "tampered signature", token: token + "a", err: "signature mismatch" },
+		{ name: "other secret", token: signedToken(otherStore, string(payload)), err: "signature mismatch" },
+		{ name: "other deliverer", token: signedToken(store, strings.Replace(string(payload), "deliverer", "other", 1)), err: "invite is used or revoked" },
+		{ name: "unknown invite", token: signedToken(store, fmt.Sprintf("deliverer:unknown:%v", time.Now().Add(time.Minute).Unix())), err: "invite is used or revoked" },
+		{ name: "expired", token: signedToken(store, fmt.Sprintf("deliverer:%v:%v", inviteId, time.Now().Add(-time.Minute).Unix())), err: "invite is expired" },
+		{ name: "invalid payload", token: signedToken(store, "deliverer:" + inviteId), err: "invalid payload format" },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inv, err := store.verify(tt.token)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if inv.delivererId != "deliverer" || inv.inviteId != inviteId {
+					t.Fatalf("unexpected invite: %+v", inv)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("unexpected error: got %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestInviteConsumeOnce(t *testing.T) {
+	store := newTestInviteStore(t, "")
+	token, _, err := store.mint("deliverer")
+	if err != nil {
+		t.Fatalf("can not mint invite: %v", err)
+	}
+	if _, err := store.consume(token); err != nil {
+		t.Fatalf("can not consume invite: %v", err)
+	}
+	if _, err := store.consume(token); err == nil {
+		t.Fatalf("invite is consumed twice")
+	}
+}
+
+func TestGuestSession(t *testing.T) {
+	store := newTestInviteStore(t, "")
+	token, _, err := store.mint("deliverer")
+	if err != nil {
+		t.Fatalf("can not mint invite: %v", err)
+	}
+	session, err := store.openSession(token)
+	if err != nil {
+		t.Fatalf("can not open session: %v", err)
+	}
+	if session.delivererId != "deliverer" {
+		t.Fatalf("unexpected deliverer: %v", session.delivererId)
+	}
+	if _, err := store.openSession(token); err == nil {
+		t.Fatalf("session is opened by the consumed invite")
+	}
+	verified, err := store.verifySession(session.sessionId)
+	if err != nil {
+		t.Fatalf("can not verify session: %v", err)
+	}
+	if verified != session {
+		t.Fatalf("unexpected session: %+v", verified)
+	}
+	store.revokeByDeliverer("deliverer")
+	if _, err := store.verifySession(session.sessionId); err == nil {
+		t.Fatalf("session of the revoked deliverer is verified")
+	}
+}
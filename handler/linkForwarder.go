@@ -0,0 +1,674 @@
+package handler
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+	"github.com/google/uuid"
+	"github.com/potix/regapweb/message"
+)
+
+type linkForwarderOptions struct {
+	verbose       bool
+	sendQueueSize int
+	retryInterval time.Duration
+	errCbTimeout  time.Duration
+}
+
+func defaultLinkForwarderOptions() *linkForwarderOptions {
+	return &linkForwarderOptions{
+		verbose:       false,
+		sendQueueSize: 1024,
+		retryInterval: 3 * time.Second,
+		errCbTimeout:  30 * time.Second,
+	}
+}
+
+type LinkForwarderOption func(*linkForwarderOptions)
+
+func LinkForwarderVerbose(verbose bool) LinkForwarderOption {
+	return func(opts *linkForwarderOptions) {
+		opts.verbose = verbose
+	}
+}
+
+// LinkForwarderSendQueueSize sets the number of control messages that can be queued,
+// gamepad states are kept only the latest one for each gamepad.
+func LinkForwarderSendQueueSize(sendQueueSize int) LinkForwarderOption {
+	return func(opts *linkForwarderOptions) {
+		opts.sendQueueSize = sendQueueSize
+	}
+}
+
+// LinkForwarderRetryInterval sets the interval to retry listening or dialing the link.
+func LinkForwarderRetryInterval(retryInterval time.Duration) LinkForwarderOption {
+	return func(opts *linkForwarderOptions) {
+		opts.retryInterval = retryInterval
+	}
+}
+
+// the upper limit of hello messages, which are read before the link is authenticated
+const linkHelloMaxSize int = 4096
+
+// the upper limit of messages of the authenticated link
+const linkMaxFrameSize int = 1024 * 1024
+
+// roles of the digest in the hello
+const (
+	linkHelloRoleDial   string = "dial"
+	linkHelloRoleListen        = "listen"
+)
+
+type ForwarderLinkStats struct {
+	Connected bool
+	Sent      uint64
+	Received  uint64
+	Coalesced uint64
+	Dropped   uint64
+}
+
+// LinkForwarder is the Forwarder between two regapweb processes over a unix socket or tcp.
+// Messages are delivered to the local listener if it is started in this process,
+// otherwise they are sent to the other process, which delivers them through its local forwarder.
+// Clients stores of both processes should be shared by the cluster.
+type LinkForwarder struct {
+	verbose       bool
+	network       string
+	address       string
+	listen        bool
+	secret        string
+	retryInterval time.Duration
+	errCbTimeout  time.Duration
+	local         *LocalForwarder
+	// control messages are sent ahead of bulk messages,
+	// bulk messages are coalesced to the latest one for each gamepad
+	sendControlChan chan *message.LinkMessage
+	bulksMutex      sync.Mutex
+	bulkKeys        []string
+	bulks           map[string]*message.LinkMessage
+	bulkChan        chan struct{}
+	connMutex     sync.Mutex
+	conn          net.Conn
+	listener      net.Listener
+	errCbsMutex   sync.Mutex
+	errCbs        map[string]ErrorCb
+	statsMutex    sync.Mutex
+	sent          uint64
+	received      uint64
+	coalesced     uint64
+	dropped       uint64
+	ctx           context.Context
+	cancel        context.CancelFunc
+	wg            sync.WaitGroup
+}
+
+// digest answers the nonce of the other side, the role keeps the answer
+// of one side from being replayed as the answer of the other side.
+func (f *LinkForwarder) digest(role string, nonce string) string {
+	mac := hmac.New(sha256.New, []byte(f.secret))
+	mac.Write([]byte(role))
+	mac.Write([]byte(nonce))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func newLinkNonce() (string, error) {
+	nonceBytes := make([]byte, 32)
+	if _, err := rand.Read(nonceBytes); err != nil {
+		return "", fmt.Errorf("can not create nonce: %w", err)
+	}
+	return hex.EncodeToString(nonceBytes), nil
+}
+
+func (f *LinkForwarder) isStopped() bool {
+	return f.ctx.Err() != nil
+}
+
+func (f *LinkForwarder) sleep() bool {
+	select {
+	case <-f.ctx.Done():
+		return false
+	case <-time.After(f.retryInterval):
+		return true
+	}
+}
+
+func (f *LinkForwarder) writeLinkMessage(conn net.Conn, msg *message.LinkMessage) error {
+	msgBytes, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("can not marshal link message: %w", err)
+	}
+	msgBytes = append(msgBytes, byte('\n'))
+	err = conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if err != nil {
+		return fmt.Errorf("can not set write deadline: %w", err)
+	}
+	_, err = conn.Write(msgBytes)
+	if err != nil {
+		return fmt.Errorf("can not write link message: %w", err)
+	}
+	return nil
+}
+
+func (f *LinkForwarder) readLinkMessage(rbufio *bufio.Reader, maxFrameSize int) (*message.LinkMessage, error) {
+	lineBytes, err := message.ReadLineFrame(rbufio, maxFrameSize)
+	if err != nil {
+		return nil, fmt.Errorf("can not read link message: %w", err)
+	}
+	var msg message.LinkMessage
+	if err := json.Unmarshal(lineBytes, &msg); err != nil {
+		return nil, fmt.Errorf("can not unmarshal link message: %w", err)
+	}
+	return &msg, nil
+}
+
+func (f *LinkForwarder) readHello(conn net.Conn, rbufio *bufio.Reader) (*message.LinkHello, error) {
+	msg, err := f.readLinkMessage(rbufio, linkHelloMaxSize)
+	if err != nil {
+		return nil, err
+	}
+	if msg.Kind != message.LinkKindHello || msg.Hello == nil {
+		return nil, fmt.Errorf("invalid link hello from %v", conn.RemoteAddr())
+	}
+	return msg.Hello, nil
+}
+
+// authenticate runs the mutual challenge response. The listening side sends the nonce,
+// the dialing side answers it with its own nonce, then the listening side answers the nonce of the dialing side.
+func (f *LinkForwarder) authenticate(conn net.Conn, rbufio *bufio.Reader) error {
+	err := conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err != nil {
+		return fmt.Errorf("can not set read deadline: %w", err)
+	}
+	defer conn.SetReadDeadline(time.Time{})
+	nonce, err := newLinkNonce()
+	if err != nil {
+		return err
+	}
+	if f.listen {
+		challengeMsg := &message.LinkMessage{
+			Kind:  message.LinkKindHello,
+			Hello: &message.LinkHello{ Nonce: nonce },
+		}
+		if err := f.writeLinkMessage(conn, challengeMsg); err != nil {
+			return err
+		}
+		hello, err := f.readHello(conn, rbufio)
+		if err != nil {
+			return err
+		}
+		if hello.Nonce == "" ||
+		   !hmac.Equal([]byte(hello.Digest), []byte(f.digest(linkHelloRoleDial, nonce))) {
+			return fmt.Errorf("invalid link hello from %v", conn.RemoteAddr())
+		}
+		answerMsg := &message.LinkMessage{
+			Kind:  message.LinkKindHello,
+			Hello: &message.LinkHello{ Digest: f.digest(linkHelloRoleListen, hello.Nonce) },
+		}
+		return f.writeLinkMessage(conn, answerMsg)
+	}
+	challenge, err := f.readHello(conn, rbufio)
+	if err != nil {
+		return err
+	}
+	if challenge.Nonce == "" {
+		return fmt.Errorf("no nonce in link hello from %v", conn.RemoteAddr())
+	}
+	helloMsg := &message.LinkMessage{
+		Kind:  message.LinkKindHello,
+		Hello: &message.LinkHello{
+			Nonce:  nonce,
+			Digest: f.digest(linkHelloRoleDial, challenge.Nonce),
+		},
+	}
+	if err := f.writeLinkMessage(conn, helloMsg); err != nil {
+		return err
+	}
+	answer, err := f.readHello(conn, rbufio)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(answer.Digest), []byte(f.digest(linkHelloRoleListen, nonce))) {
+		// the listener does not know the secret, never send messages to it
+		return fmt.Errorf("invalid link hello from %v", conn.RemoteAddr())
+	}
+	return nil
+}
+
+func (f *LinkForwarder) setConn(conn net.Conn) {
+	f.connMutex.Lock()
+	defer f.connMutex.Unlock()
+	if f.conn != nil {
+		// the newest link wins
+		f.conn.Close()
+	}
+	f.conn = conn
+	if f.isStopped() {
+		// closeOnDone has already run
+		conn.Close()
+	}
+}
+
+func (f *LinkForwarder) clearConn(conn net.Conn) {
+	f.connMutex.Lock()
+	defer f.connMutex.Unlock()
+	if f.conn == conn {
+		f.conn = nil
+	}
+	conn.Close()
+}
+
+func (f *LinkForwarder) getConn() net.Conn {
+	f.connMutex.Lock()
+	defer f.connMutex.Unlock()
+	return f.conn
+}
+
+func (f *LinkForwarder) serve(conn net.Conn) {
+	rbufio := bufio.NewReader(conn)
+	if err := f.authenticate(conn, rbufio); err != nil {
+		log.Printf("can not authenticate forwarder link: %v", err)
+		conn.Close()
+		return
+	}
+	if f.verbose {
+		log.Printf("connected forwarder link: %v", conn.RemoteAddr())
+	}
+	f.setConn(conn)
+	defer f.clearConn(conn)
+	for {
+		msg, err := f.readLinkMessage(rbufio, linkMaxFrameSize)
+		if err != nil {
+			if f.verbose && !f.isStopped() {
+				log.Printf("disconnected forwarder link: %v", err)
+			}
+			return
+		}
+		f.onLinkMessage(msg)
+	}
+}
+
+func (f *LinkForwarder) listenLoop() {
+	defer f.wg.Done()
+	for {
+		if f.network == "unix" {
+			// remove the socket of the previous process
+			os.Remove(f.address)
+		}
+		listener, err := net.Listen(f.network, f.address)
+		if err != nil {
+			log.Printf("can not listen forwarder link: %v", err)
+			if !f.sleep() {
+				return
+			}
+			continue
+		}
+		f.connMutex.Lock()
+		f.listener = listener
+		f.connMutex.Unlock()
+		if f.isStopped() {
+			listener.Close()
+			return
+		}
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if f.isStopped() {
+					return
+				}
+				log.Printf("can not accept forwarder link: %v", err)
+				break
+			}
+			f.wg.Add(1)
+			go func() {
+				defer f.wg.Done()
+				f.serve(conn)
+			}()
+		}
+		listener.Close()
+		if !f.sleep() {
+			return
+		}
+	}
+}
+
+func (f *LinkForwarder) dialLoop() {
+	defer f.wg.Done()
+	for {
+		dialer := &net.Dialer{ Timeout: 5 * time.Second }
+		conn, err := dialer.DialContext(f.ctx, f.network, f.address)
+		if err != nil {
+			if f.verbose {
+				log.Printf("can not dial forwarder link: %v", err)
+			}
+		} else {
+			f.serve(conn)
+		}
+		if !f.sleep() {
+			return
+		}
+	}
+}
+
+func (f *LinkForwarder) sendLinkMessage(msg *message.LinkMessage) {
+	conn := f.getConn()
+	if conn == nil {
+		f.fail(msg.Id, fmt.Errorf("forwarder link is not connected"))
+		return
+	}
+	if err := f.writeLinkMessage(conn, msg); err != nil {
+		log.Printf("can not send to forwarder link: %v", err)
+		f.clearConn(conn)
+		f.fail(msg.Id, fmt.Errorf("forwarder link is disconnected"))
+		return
+	}
+	f.statsMutex.Lock()
+	f.sent += 1
+	f.statsMutex.Unlock()
+}
+
+// nextBulk returns the oldest pending bulk message, or nil if there is no bulk message.
+func (f *LinkForwarder) nextBulk() *message.LinkMessage {
+	f.bulksMutex.Lock()
+	defer f.bulksMutex.Unlock()
+	if len(f.bulkKeys) == 0 {
+		return nil
+	}
+	key := f.bulkKeys[0]
+	f.bulkKeys[0] = ""
+	f.bulkKeys = f.bulkKeys[1:]
+	msg := f.bulks[key]
+	delete(f.bulks, key)
+	return msg
+}
+
+func (f *LinkForwarder) sendLoop() {
+	defer f.wg.Done()
+	for {
+		// control messages first
+		select {
+		case msg := <-f.sendControlChan:
+			f.sendLinkMessage(msg)
+			continue
+		default:
+		}
+		if msg := f.nextBulk(); msg != nil {
+			f.sendLinkMessage(msg)
+			continue
+		}
+		select {
+		case msg := <-f.sendControlChan:
+			f.sendLinkMessage(msg)
+		case <-f.bulkChan:
+		case <-f.ctx.Done():
+			return
+		}
+	}
+}
+
+// enqueueBulk keeps only the latest bulk message for each gamepad, so that stale states are never sent.
+func (f *LinkForwarder) enqueueBulk(linkMsg *message.LinkMessage) {
+	_, _, gamepadId := gamepadMessageIds(linkMsg.Message)
+	key := linkMsg.Kind + ":" + linkMsg.Message.MsgType + ":" + gamepadId
+	f.bulksMutex.Lock()
+	if _, ok := f.bulks[key]; ok {
+		f.statsMutex.Lock()
+		f.coalesced += 1
+		f.statsMutex.Unlock()
+	} else {
+		f.bulkKeys = append(f.bulkKeys, key)
+	}
+	f.bulks[key] = linkMsg
+	f.bulksMutex.Unlock()
+	select {
+	case f.bulkChan <- struct{}{}:
+	default:
+	}
+}
+
+// fail calls the error callback of the sent message.
+func (f *LinkForwarder) fail(id string, err error) {
+	f.statsMutex.Lock()
+	f.dropped += 1
+	f.statsMutex.Unlock()
+	if id == "" {
+		return
+	}
+	f.errCbsMutex.Lock()
+	errCb, ok := f.errCbs[id]
+	delete(f.errCbs, id)
+	f.errCbsMutex.Unlock()
+	if ok {
+		errCb(err)
+	}
+}
+
+func (f *LinkForwarder) send(kind string, msg *message.Message, errCb ErrorCb) {
+	linkMsg := &message.LinkMessage{
+		Kind:    kind,
+		Message: msg,
+	}
+	if errCb != nil {
+		idUuid, err := uuid.NewRandom()
+		if err != nil {
+			errCb(fmt.Errorf("can not create link message id: %w", err))
+			return
+		}
+		id := idUuid.String()
+		f.errCbsMutex.Lock()
+		f.errCbs[id] = errCb
+		f.errCbsMutex.Unlock()
+		// no error is returned on success, so forget the callback later
+		time.AfterFunc(f.errCbTimeout, func() {
+			f.errCbsMutex.Lock()
+			defer f.errCbsMutex.Unlock()
+			delete(f.errCbs, id)
+		})
+		linkMsg.Id = id
+	}
+	if messagePriority(msg.MsgType) == messagePriorityBulk {
+		f.enqueueBulk(linkMsg)
+		return
+	}
+	select {
+	case f.sendControlChan <- linkMsg:
+	default:
+		log.Printf("forwarder link queue is full: kind = %v, msgType = %v", kind, msg.MsgType)
+		f.fail(linkMsg.Id, fmt.Errorf("forwarder link queue is full"))
+	}
+}
+
+// remoteErrCb returns the error callback that sends the error back to the other process.
+func (f *LinkForwarder) remoteErrCb(id string) ErrorCb {
+	if id == "" {
+		return nil
+	}
+	return func(err error) {
+		errMsg := &message.LinkMessage{
+			Kind:  message.LinkKindError,
+			Id:    id,
+			Error: &message.Error{
+				Message: err.Error(),
+			},
+		}
+		select {
+		case f.sendControlChan <- errMsg:
+		default:
+			log.Printf("forwarder link queue is full, drop error: %v", err)
+		}
+	}
+}
+
+func (f *LinkForwarder) onLinkMessage(msg *message.LinkMessage) {
+	f.statsMutex.Lock()
+	f.received += 1
+	f.statsMutex.Unlock()
+	if msg.Kind == message.LinkKindToTcp || msg.Kind == message.LinkKindToWs {
+		if msg.Message == nil {
+			log.Printf("no message in link message: %v", msg.Kind)
+			return
+		}
+		if msg.Kind == message.LinkKindToTcp {
+			f.local.ToTcp(msg.Message, f.remoteErrCb(msg.Id))
+		} else {
+			f.local.ToWs(msg.Message, f.remoteErrCb(msg.Id))
+		}
+	} else if msg.Kind == message.LinkKindForget {
+		f.local.ForgetGamepad(msg.GamepadId)
+	} else if msg.Kind == message.LinkKindError {
+		if msg.Error == nil {
+			return
+		}
+		f.errCbsMutex.Lock()
+		errCb, ok := f.errCbs[msg.Id]
+		delete(f.errCbs, msg.Id)
+		f.errCbsMutex.Unlock()
+		if ok {
+			errCb(fmt.Errorf("%v", msg.Error.Message))
+		}
+	} else {
+		log.Printf("unsupported link message: %v", msg.Kind)
+	}
+}
+
+// closeOnDone closes the listener and the link when the context is canceled.
+func (f *LinkForwarder) closeOnDone() {
+	defer f.wg.Done()
+	<-f.ctx.Done()
+	f.connMutex.Lock()
+	defer f.connMutex.Unlock()
+	if f.listener != nil {
+		f.listener.Close()
+	}
+	if f.conn != nil {
+		f.conn.Close()
+	}
+}
+
+func (f *LinkForwarder) Start(ctx context.Context) {
+	f.ctx, f.cancel = context.WithCancel(ctx)
+	f.local.Start(f.ctx)
+	f.wg.Add(3)
+	go f.closeOnDone()
+	go f.sendLoop()
+	if f.listen {
+		go f.listenLoop()
+	} else {
+		go f.dialLoop()
+	}
+}
+
+func (f *LinkForwarder) Stop() {
+	if f.cancel == nil {
+		return
+	}
+	f.cancel()
+	f.wg.Wait()
+	f.local.Stop()
+	if f.verbose {
+		log.Printf("stopped forwarder link")
+	}
+}
+
+func (f *LinkForwarder) ToTcp(msg *message.Message, errCb ErrorCb) {
+	if f.local.hasListener(forwarderDirectionToTcp) {
+		f.local.ToTcp(msg, errCb)
+		return
+	}
+	f.send(message.LinkKindToTcp, msg, errCb)
+}
+
+func (f *LinkForwarder) ToWs(msg *message.Message, errCb ErrorCb) {
+	if f.local.hasListener(forwarderDirectionToWs) {
+		f.local.ToWs(msg, errCb)
+		return
+	}
+	f.send(message.LinkKindToWs, msg, errCb)
+}
+
+func (f *LinkForwarder) StartFromTcpListener(fn OnFromTcp) {
+	f.local.StartFromTcpListener(fn)
+}
+
+func (f *LinkForwarder) StopFromTcpListener() {
+	f.local.StopFromTcpListener()
+}
+
+func (f *LinkForwarder) StartFromWsListener(fn OnFromWs) {
+	f.local.StartFromWsListener(fn)
+}
+
+func (f *LinkForwarder) StopFromWsListener() {
+	f.local.StopFromWsListener()
+}
+
+// ForgetGamepad forgets the gamepad in both processes, queues of the gamepad may be in the other process.
+func (f *LinkForwarder) ForgetGamepad(gamepadId string) {
+	f.local.ForgetGamepad(gamepadId)
+	forgetMsg := &message.LinkMessage{
+		Kind:      message.LinkKindForget,
+		GamepadId: gamepadId,
+	}
+	select {
+	case f.sendControlChan <- forgetMsg:
+	default:
+		log.Printf("forwarder link queue is full, drop forget: %v", gamepadId)
+	}
+}
+
+// Stats returns stats of the local forwarder and the link.
+func (f *LinkForwarder) Stats() *ForwarderStats {
+	stats := f.local.Stats()
+	connected := f.getConn() != nil
+	f.statsMutex.Lock()
+	defer f.statsMutex.Unlock()
+	stats.Link = &ForwarderLinkStats{
+		Connected: connected,
+		Sent:      f.sent,
+		Received:  f.received,
+		Coalesced: f.coalesced,
+		Dropped:   f.dropped,
+	}
+	return stats
+}
+
+// NewLinkForwarder creates the forwarder that listens or dials the address of the network, "unix" or "tcp".
+func NewLinkForwarder(network string, address string, listen bool, secret string, local *LocalForwarder, opts ...LinkForwarderOption) (*LinkForwarder, error) {
+	baseOpts := defaultLinkForwarderOptions()
+	for _, opt := range opts {
+		if opt == nil {
+			continue
+		}
+		opt(baseOpts)
+	}
+	if network != "unix" && network != "tcp" {
+		return nil, fmt.Errorf("unsupported network: %v", network)
+	}
+	if secret == "" {
+		return nil, fmt.Errorf("no forwarder link secret")
+	}
+	return &LinkForwarder{
+		verbose:       baseOpts.verbose,
+		network:       network,
+		address:       address,
+		listen:        listen,
+		secret:        secret,
+		retryInterval: baseOpts.retryInterval,
+		errCbTimeout:  baseOpts.errCbTimeout,
+		local:         local,
+		sendControlChan: make(chan *message.LinkMessage, baseOpts.sendQueueSize),
+		bulkKeys:        make([]string, 0),
+		bulks:           make(map[string]*message.LinkMessage),
+		bulkChan:        make(chan struct{}, 1),
+		errCbs:        make(map[string]ErrorCb),
+	}, nil
+}
@@ -0,0 +1,158 @@
+package handler
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// mutualTls authenticates gamepads by client certificates signed by the CA.
+// The common name of the certificate subject is the device id.
+type mutualTls struct {
+	verbose        bool
+	tlsConfig      *tls.Config
+	caCerts        []*x509.Certificate
+	crlPath        string
+	crlMutex       sync.Mutex
+	revokedSerials map[string]bool
+}
+
+func loadCertificates(certPath string) ([]*x509.Certificate, error) {
+	certBytes, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, fmt.Errorf("can not read certificates: %w", err)
+	}
+	certs := make([]*x509.Certificate, 0)
+	for {
+		var block *pem.Block
+		block, certBytes = pem.Decode(certBytes)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("can not parse certificate: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificate in %v", certPath)
+	}
+	return certs, nil
+}
+
+// loadCrl loads the certificate revocation list in pem or der, that is signed by the CA.
+func (m *mutualTls) loadCrl() error {
+	if m.crlPath == "" {
+		return nil
+	}
+	crlBytes, err := os.ReadFile(m.crlPath)
+	if err != nil {
+		return fmt.Errorf("can not read crl: %w", err)
+	}
+	if block, _ := pem.Decode(crlBytes); block != nil {
+		crlBytes = block.Bytes
+	}
+	crl, err := x509.ParseRevocationList(crlBytes)
+	if err != nil {
+		return fmt.Errorf("can not parse crl: %w", err)
+	}
+	signed := false
+	for _, caCert := range m.caCerts {
+		if crl.CheckSignatureFrom(caCert) == nil {
+			signed = true
+			break
+		}
+	}
+	if !signed {
+		return fmt.Errorf("crl is not signed by the ca: %v", m.crlPath)
+	}
+	revokedSerials := make(map[string]bool)
+	for _, entry := range crl.RevokedCertificateEntries {
+		revokedSerials[entry.SerialNumber.String()] = true
+	}
+	m.crlMutex.Lock()
+	defer m.crlMutex.Unlock()
+	m.revokedSerials = revokedSerials
+	if m.verbose {
+		log.Printf("loaded crl: revoked = %v", len(revokedSerials))
+	}
+	return nil
+}
+
+func (m *mutualTls) isRevoked(cert *x509.Certificate) bool {
+	m.crlMutex.Lock()
+	defer m.crlMutex.Unlock()
+	return m.revokedSerials[cert.SerialNumber.String()]
+}
+
+func (m *mutualTls) verifyConnection(state tls.ConnectionState) error {
+	if len(state.PeerCertificates) == 0 {
+		return fmt.Errorf("no client certificate")
+	}
+	if m.isRevoked(state.PeerCertificates[0]) {
+		return fmt.Errorf("client certificate is revoked: serial = %v", state.PeerCertificates[0].SerialNumber)
+	}
+	return nil
+}
+
+// server runs the tls handshake, and returns the tls connection and the certificate of the gamepad.
+func (m *mutualTls) server(conn net.Conn) (net.Conn, *x509.Certificate, error) {
+	tlsConn := tls.Server(conn, m.tlsConfig)
+	err := tlsConn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err != nil {
+		return nil, nil, fmt.Errorf("can not set deadline: %w", err)
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, nil, fmt.Errorf("can not handshake tls: %w", err)
+	}
+	if err := tlsConn.SetDeadline(time.Time{}); err != nil {
+		return nil, nil, fmt.Errorf("can not clear deadline: %w", err)
+	}
+	cert := tlsConn.ConnectionState().PeerCertificates[0]
+	if cert.Subject.CommonName == "" {
+		return nil, nil, fmt.Errorf("no common name in client certificate")
+	}
+	return tlsConn, cert, nil
+}
+
+func newMutualTls(certPath string, keyPath string, caPath string, crlPath string, verbose bool) (*mutualTls, error) {
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("can not load certs: %w", err)
+	}
+	caCerts, err := loadCertificates(caPath)
+	if err != nil {
+		return nil, fmt.Errorf("can not load ca: %w", err)
+	}
+	clientCAs := x509.NewCertPool()
+	for _, caCert := range caCerts {
+		clientCAs.AddCert(caCert)
+	}
+	m := &mutualTls{
+		verbose:        verbose,
+		caCerts:        caCerts,
+		crlPath:        crlPath,
+		revokedSerials: make(map[string]bool),
+	}
+	m.tlsConfig = &tls.Config{
+		MinVersion:       tls.VersionTLS12,
+		Certificates:     []tls.Certificate{cert},
+		ClientAuth:       tls.RequireAndVerifyClientCert,
+		ClientCAs:        clientCAs,
+		VerifyConnection: m.verifyConnection,
+	}
+	if err := m.loadCrl(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
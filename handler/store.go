@@ -1,22 +1,32 @@
 package handler
 
 import (
+	"fmt"
 	"log"
 	"sync"
+	"time"
 	"github.com/potix/regapweb/message"
 )
 
 type client struct {
-	name string
+	name     string
+	room     string
+	metadata *message.ClientMetadata
+	// only gamepad
+	status       string
+	delivererId  string
+	controllerId string
 }
 
 type clientsStoreOptions struct {
-        verbose bool
+        verbose      bool
+        historyLimit int
 }
 
 func defaultClientsStoreOptions() *clientsStoreOptions {
         return &clientsStoreOptions {
-                verbose: false,
+                verbose:      false,
+                historyLimit: 10000,
         }
 }
 
@@ -28,7 +38,43 @@ func ClientsStoreVerbose(verbose bool) ClientsStoreOption {
         }
 }
 
-type ClientsStore struct {
+// ClientsStoreHistoryLimit sets the number of history records kept by the persistent store.
+func ClientsStoreHistoryLimit(historyLimit int) ClientsStoreOption {
+        return func(opts *clientsStoreOptions) {
+                opts.historyLimit = historyLimit
+        }
+}
+
+// OnClientsEvent is called while the store is locked,
+// so it must neither block nor call the store.
+type OnClientsEvent func(event *message.PresenceEvent)
+
+// ClientsStore keeps registered deliverers, controllers and gamepads.
+type ClientsStore interface {
+	AddDeliverer(clientId string, clientName string, room string, metadata *message.ClientMetadata)
+	AddController(clientId string, clientName string, room string, metadata *message.ClientMetadata)
+	AddGamepad(clientId string, clientName string, room string, metadata *message.ClientMetadata)
+	TouchClient(clientId string)
+	UpdateDeviceStatus(gamepadId string, deviceStatus *message.GamepadDeviceStatus)
+	DeleteDeliverer(clientId string)
+	DeleteController(clientId string)
+	DeleteGamepad(clientId string)
+	GetDeliverers() []*message.NameAndId
+	GetControllers() []*message.NameAndId
+	GetGamepads() []*message.GamepadInfo
+	GetClient(clientType string, clientId string) *message.NameAndId
+	GetGamepad(gamepadId string) *message.GamepadInfo
+	ReserveGamepad(gamepadId string, delivererId string, controllerId string) error
+	OccupyGamepad(gamepadId string, delivererId string, controllerId string) error
+	ReleaseGamepad(gamepadId string, delivererId string, controllerId string)
+	ReleaseGamepadsByClient(clientId string)
+	Subscribe(onEvent OnClientsEvent) int
+	Unsubscribe(subscriptionId int)
+	Close() error
+}
+
+// MemoryClientsStore is the ClientsStore that keeps clients only in memory.
+type MemoryClientsStore struct {
 	verbose                bool
 	delivererClientsMutex  sync.Mutex
 	delivererClients       map[string]*client
@@ -36,107 +82,397 @@ type ClientsStore struct {
 	controllerClients      map[string]*client
 	gamepadClientsMutex    sync.Mutex
 	gamepadClients         map[string]*client
+	subscribersMutex       sync.Mutex
+	subscribers            map[int]OnClientsEvent
+	nextSubscriptionId     int
+}
+
+func copyDeviceStatus(deviceStatus *message.GamepadDeviceStatus) *message.GamepadDeviceStatus {
+	newDeviceStatus := *deviceStatus
+	if deviceStatus.ErrorCounters != nil {
+		newDeviceStatus.ErrorCounters = make(map[string]uint64, len(deviceStatus.ErrorCounters))
+		for k, v := range deviceStatus.ErrorCounters {
+			newDeviceStatus.ErrorCounters[k] = v
+		}
+	}
+	return &newDeviceStatus
+}
+
+func copyClientMetadata(metadata *message.ClientMetadata) *message.ClientMetadata {
+	if metadata == nil {
+		return nil
+	}
+	newMetadata := *metadata
+	if metadata.Capabilities != nil {
+		newMetadata.Capabilities = append([]string{}, metadata.Capabilities...)
+	}
+	if metadata.Gamepad != nil {
+		gamepad := *metadata.Gamepad
+		newMetadata.Gamepad = &gamepad
+	}
+	if metadata.DeviceStatus != nil {
+		newMetadata.DeviceStatus = copyDeviceStatus(metadata.DeviceStatus)
+	}
+	return &newMetadata
+}
+
+func newNameAndId(clientId string, clnt *client) *message.NameAndId {
+	return &message.NameAndId{
+		Name:     clnt.name,
+		Id:       clientId,
+		Room:     clnt.room,
+		Metadata: copyClientMetadata(clnt.metadata),
+	}
+}
+
+func newGamepadInfo(clientId string, clnt *client) *message.GamepadInfo {
+	return &message.GamepadInfo{
+		Name:         clnt.name,
+		Id:           clientId,
+		Room:         clnt.room,
+		Status:       clnt.status,
+		DelivererId:  clnt.delivererId,
+		ControllerId: clnt.controllerId,
+		Metadata:     copyClientMetadata(clnt.metadata),
+	}
+}
+
+// Subscribe registers the handler of add, update and delete events and returns the subscription id.
+func (c *MemoryClientsStore) Subscribe(onEvent OnClientsEvent) int {
+	c.subscribersMutex.Lock()
+	defer c.subscribersMutex.Unlock()
+	c.nextSubscriptionId += 1
+	c.subscribers[c.nextSubscriptionId] = onEvent
+	return c.nextSubscriptionId
+}
+
+func (c *MemoryClientsStore) Unsubscribe(subscriptionId int) {
+	c.subscribersMutex.Lock()
+	defer c.subscribersMutex.Unlock()
+	delete(c.subscribers, subscriptionId)
+}
+
+func (c *MemoryClientsStore) publish(event string, clientType string, clientId string, clnt *client) {
+	c.subscribersMutex.Lock()
+	defer c.subscribersMutex.Unlock()
+	if len(c.subscribers) == 0 {
+		return
+	}
+	presenceEvent := &message.PresenceEvent{
+		Event:      event,
+		ClientType: clientType,
+	}
+	if clientType == message.ClientTypeGamepad {
+		presenceEvent.Gamepad = newGamepadInfo(clientId, clnt)
+	} else {
+		presenceEvent.Client = newNameAndId(clientId, clnt)
+	}
+	for _, onEvent := range c.subscribers {
+		onEvent(presenceEvent)
+	}
 }
 
-func (c *ClientsStore) baseAddClient(clients map[string]*client, clientId string, clientName string) {
+func (c *MemoryClientsStore) baseAddClient(clients map[string]*client, clientType string, clientId string, clientName string, room string, metadata *message.ClientMetadata) {
 	clnt, ok := clients[clientId]
 	if !ok {
-		clients[clientId] = &client{
-			name: clientName,
+		clnt = &client{
+			name:     clientName,
+			room:     room,
+			metadata: copyClientMetadata(metadata),
+			status:   message.GamepadStatusAvailable,
 		}
+		clients[clientId] = clnt
+		c.publish(message.PresenceEventAdd, clientType, clientId, clnt)
 	} else {
 		clnt.name = clientName
+		clnt.room = room
+		if metadata != nil {
+			clnt.metadata = copyClientMetadata(metadata)
+		}
+		c.publish(message.PresenceEventUpdate, clientType, clientId, clnt)
 	}
 }
 
-func (c *ClientsStore) AddDeliverer(clientId string, clientName string) {
+func (c *MemoryClientsStore) AddDeliverer(clientId string, clientName string, room string, metadata *message.ClientMetadata) {
 	c.delivererClientsMutex.Lock()
         defer c.delivererClientsMutex.Unlock()
-	c.baseAddClient(c.delivererClients, clientId, clientName)
+	c.baseAddClient(c.delivererClients, message.ClientTypeDeliverer, clientId, clientName, room, metadata)
 	if c.verbose {
 		log.Printf("add or update deliverer: id = %v, name = %v", clientId, clientName)
 	}
 }
 
-func (c *ClientsStore) AddController(clientId string, clientName string) {
+func (c *MemoryClientsStore) AddController(clientId string, clientName string, room string, metadata *message.ClientMetadata) {
 	c.controllerClientsMutex.Lock()
         defer c.controllerClientsMutex.Unlock()
-	c.baseAddClient(c.controllerClients, clientId, clientName)
+	c.baseAddClient(c.controllerClients, message.ClientTypeController, clientId, clientName, room, metadata)
 	if c.verbose {
 		log.Printf("add or update controller: id = %v, name = %v", clientId, clientName)
 	}
 }
 
-func (c *ClientsStore) AddGamepad(clientId string, clientName string) {
+func (c *MemoryClientsStore) AddGamepad(clientId string, clientName string, room string, metadata *message.ClientMetadata) {
 	c.gamepadClientsMutex.Lock()
         defer c.gamepadClientsMutex.Unlock()
-	c.baseAddClient(c.gamepadClients, clientId, clientName)
+	c.baseAddClient(c.gamepadClients, message.ClientTypeGamepad, clientId, clientName, room, metadata)
 	if c.verbose {
 		log.Printf("add or update gamepad: id = %v, name = %v", clientId, clientName)
 	}
 }
 
-func (c *ClientsStore) baseDeleteClient(clients map[string]*client, clientId string) {
-	_, ok := clients[clientId]
+func (c *MemoryClientsStore) baseTouchClient(clientsMutex *sync.Mutex, clients map[string]*client, clientId string, now int64) bool {
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
+	clnt, ok := clients[clientId]
+	if !ok {
+		return false
+	}
+	if clnt.metadata == nil {
+		clnt.metadata = new(message.ClientMetadata)
+	}
+	clnt.metadata.LastActivity = now
+	return true
+}
+
+// TouchClient updates the last activity of the client.
+func (c *MemoryClientsStore) TouchClient(clientId string) {
+	now := time.Now().Unix()
+	if c.baseTouchClient(&c.delivererClientsMutex, c.delivererClients, clientId, now) {
+		return
+	}
+	if c.baseTouchClient(&c.controllerClientsMutex, c.controllerClients, clientId, now) {
+		return
+	}
+	c.baseTouchClient(&c.gamepadClientsMutex, c.gamepadClients, clientId, now)
+}
+
+// UpdateDeviceStatus retains the latest status of the gamepad device and publishes the update.
+func (c *MemoryClientsStore) UpdateDeviceStatus(gamepadId string, deviceStatus *message.GamepadDeviceStatus) {
+	c.gamepadClientsMutex.Lock()
+        defer c.gamepadClientsMutex.Unlock()
+	clnt, ok := c.gamepadClients[gamepadId]
+	if !ok {
+		return
+	}
+	if clnt.metadata == nil {
+		clnt.metadata = new(message.ClientMetadata)
+	}
+	clnt.metadata.DeviceStatus = copyDeviceStatus(deviceStatus)
+	c.publish(message.PresenceEventUpdate, message.ClientTypeGamepad, gamepadId, clnt)
+	if c.verbose {
+		log.Printf("update device status: id = %v, hostLink = %v", gamepadId, deviceStatus.HostLink)
+	}
+}
+
+func (c *MemoryClientsStore) baseDeleteClient(clients map[string]*client, clientType string, clientId string) {
+	clnt, ok := clients[clientId]
 	if ok {
 		delete(clients, clientId)
+		c.publish(message.PresenceEventDelete, clientType, clientId, clnt)
 	}
 }
 
-func (c *ClientsStore) DeleteDeliverer(clientId string) {
+func (c *MemoryClientsStore) DeleteDeliverer(clientId string) {
 	c.delivererClientsMutex.Lock()
         defer c.delivererClientsMutex.Unlock()
 	if c.verbose {
 		log.Printf("delete deliverer: id = %v", clientId)
 	}
-	c.baseDeleteClient(c.delivererClients, clientId)
+	c.baseDeleteClient(c.delivererClients, message.ClientTypeDeliverer, clientId)
 }
 
-func (c *ClientsStore) DeleteController(clientId string) {
+func (c *MemoryClientsStore) DeleteController(clientId string) {
 	c.controllerClientsMutex.Lock()
         defer c.controllerClientsMutex.Unlock()
 	if c.verbose {
 		log.Printf("delete controller: id = %v", clientId)
 	}
-	c.baseDeleteClient(c.controllerClients, clientId)
+	c.baseDeleteClient(c.controllerClients, message.ClientTypeController, clientId)
 }
 
-func (c *ClientsStore) DeleteGamepad(clientId string) {
+func (c *MemoryClientsStore) DeleteGamepad(clientId string) {
 	c.gamepadClientsMutex.Lock()
         defer c.gamepadClientsMutex.Unlock()
 	if c.verbose {
 		log.Printf("delete gamepad: id = %v", clientId)
 	}
-	c.baseDeleteClient(c.gamepadClients, clientId)
+	c.baseDeleteClient(c.gamepadClients, message.ClientTypeGamepad, clientId)
 }
 
-func (c *ClientsStore) baseGetClients(clients map[string]*client) []*message.NameAndId {
+func (c *MemoryClientsStore) baseGetClients(clients map[string]*client) []*message.NameAndId {
 	newClients := make([]*message.NameAndId, 0, len(clients))
 	for id, clnt := range clients {
-		newClients = append(newClients, &message.NameAndId{ Name: clnt.name, Id: id})
+		newClients = append(newClients, newNameAndId(id, clnt))
 	}
 	return newClients
 }
 
-func (c *ClientsStore) GetDeliverers() []*message.NameAndId {
+func (c *MemoryClientsStore) GetDeliverers() []*message.NameAndId {
 	c.delivererClientsMutex.Lock()
         defer c.delivererClientsMutex.Unlock()
 	return c.baseGetClients(c.delivererClients)
 }
 
-func (c *ClientsStore) GetControllers() []*message.NameAndId {
+func (c *MemoryClientsStore) GetControllers() []*message.NameAndId {
 	c.controllerClientsMutex.Lock()
         defer c.controllerClientsMutex.Unlock()
 	return c.baseGetClients(c.controllerClients)
 }
 
-func (c *ClientsStore) GetGamepads() []*message.NameAndId {
+func (c *MemoryClientsStore) GetGamepads() []*message.GamepadInfo {
+	c.gamepadClientsMutex.Lock()
+        defer c.gamepadClientsMutex.Unlock()
+	gamepads := make([]*message.GamepadInfo, 0, len(c.gamepadClients))
+	for id, clnt := range c.gamepadClients {
+		gamepads = append(gamepads, newGamepadInfo(id, clnt))
+	}
+	return gamepads
+}
+
+// GetClient returns the client of the type, or nil if not found.
+func (c *MemoryClientsStore) GetClient(clientType string, clientId string) *message.NameAndId {
+	clientsMutex := &c.gamepadClientsMutex
+	clients := c.gamepadClients
+	if clientType == message.ClientTypeDeliverer {
+		clientsMutex = &c.delivererClientsMutex
+		clients = c.delivererClients
+	} else if clientType == message.ClientTypeController {
+		clientsMutex = &c.controllerClientsMutex
+		clients = c.controllerClients
+	}
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
+	clnt, ok := clients[clientId]
+	if !ok {
+		return nil
+	}
+	return newNameAndId(clientId, clnt)
+}
+
+// GetGamepad returns the gamepad with the session bound to it, or nil if not found.
+func (c *MemoryClientsStore) GetGamepad(gamepadId string) *message.GamepadInfo {
+	c.gamepadClientsMutex.Lock()
+	defer c.gamepadClientsMutex.Unlock()
+	clnt, ok := c.gamepadClients[gamepadId]
+	if !ok {
+		return nil
+	}
+	return newGamepadInfo(gamepadId, clnt)
+}
+
+// ReserveGamepad reserves the gamepad for the session of deliverer and controller.
+// The reservation of the same deliverer can be moved to another controller until the gamepad becomes busy.
+func (c *MemoryClientsStore) ReserveGamepad(gamepadId string, delivererId string, controllerId string) error {
+	c.gamepadClientsMutex.Lock()
+        defer c.gamepadClientsMutex.Unlock()
+	clnt, ok := c.gamepadClients[gamepadId]
+	if !ok {
+		return fmt.Errorf("not found gamepad: id = %v", gamepadId)
+	}
+	if clnt.status == message.GamepadStatusBusy {
+		if clnt.delivererId == delivererId && clnt.controllerId == controllerId {
+			return nil
+		}
+		return fmt.Errorf("gamepad is busy: id = %v, delivererId = %v, controllerId = %v",
+			gamepadId, clnt.delivererId, clnt.controllerId)
+	}
+	if clnt.status == message.GamepadStatusReserved && clnt.delivererId != delivererId {
+		return fmt.Errorf("gamepad is reserved: id = %v, delivererId = %v, controllerId = %v",
+			gamepadId, clnt.delivererId, clnt.controllerId)
+	}
+	clnt.status = message.GamepadStatusReserved
+	clnt.delivererId = delivererId
+	clnt.controllerId = controllerId
+	c.publish(message.PresenceEventUpdate, message.ClientTypeGamepad, gamepadId, clnt)
+	if c.verbose {
+		log.Printf("reserve gamepad: id = %v, delivererId = %v, controllerId = %v", gamepadId, delivererId, controllerId)
+	}
+	return nil
+}
+
+// OccupyGamepad makes the gamepad reserved by the session busy.
+func (c *MemoryClientsStore) OccupyGamepad(gamepadId string, delivererId string, controllerId string) error {
+	c.gamepadClientsMutex.Lock()
+        defer c.gamepadClientsMutex.Unlock()
+	clnt, ok := c.gamepadClients[gamepadId]
+	if !ok {
+		return fmt.Errorf("not found gamepad: id = %v", gamepadId)
+	}
+	if clnt.status == message.GamepadStatusAvailable ||
+	   clnt.delivererId != delivererId ||
+	   clnt.controllerId != controllerId {
+		return fmt.Errorf("gamepad is not reserved by session: id = %v, status = %v, delivererId = %v, controllerId = %v",
+			gamepadId, clnt.status, clnt.delivererId, clnt.controllerId)
+	}
+	clnt.status = message.GamepadStatusBusy
+	c.publish(message.PresenceEventUpdate, message.ClientTypeGamepad, gamepadId, clnt)
+	if c.verbose {
+		log.Printf("occupy gamepad: id = %v, delivererId = %v, controllerId = %v", gamepadId, delivererId, controllerId)
+	}
+	return nil
+}
+
+func (c *MemoryClientsStore) baseReleaseGamepad(gamepadId string, clnt *client) {
+	clnt.status = message.GamepadStatusAvailable
+	clnt.delivererId = ""
+	clnt.controllerId = ""
+	c.publish(message.PresenceEventUpdate, message.ClientTypeGamepad, gamepadId, clnt)
+	if c.verbose {
+		log.Printf("release gamepad: id = %v", gamepadId)
+	}
+}
+
+// releaseGamepad returns true if the gamepad owned by the session is released.
+func (c *MemoryClientsStore) releaseGamepad(gamepadId string, delivererId string, controllerId string) bool {
+	c.gamepadClientsMutex.Lock()
+        defer c.gamepadClientsMutex.Unlock()
+	clnt, ok := c.gamepadClients[gamepadId]
+	if !ok {
+		return false
+	}
+	if clnt.status == message.GamepadStatusAvailable {
+		return false
+	}
+	if clnt.delivererId != delivererId || clnt.controllerId != controllerId {
+		return false
+	}
+	c.baseReleaseGamepad(gamepadId, clnt)
+	return true
+}
+
+// ReleaseGamepad makes the gamepad available if it is owned by the session.
+func (c *MemoryClientsStore) ReleaseGamepad(gamepadId string, delivererId string, controllerId string) {
+	c.releaseGamepad(gamepadId, delivererId, controllerId)
+}
+
+// releaseGamepadsByClient returns gamepads released with the session that owned them.
+func (c *MemoryClientsStore) releaseGamepadsByClient(clientId string) []*message.GamepadInfo {
 	c.gamepadClientsMutex.Lock()
         defer c.gamepadClientsMutex.Unlock()
-	return c.baseGetClients(c.gamepadClients)
+	released := make([]*message.GamepadInfo, 0)
+	for id, clnt := range c.gamepadClients {
+		if clnt.status == message.GamepadStatusAvailable {
+			continue
+		}
+		if clnt.delivererId != clientId && clnt.controllerId != clientId {
+			continue
+		}
+		released = append(released, newGamepadInfo(id, clnt))
+		c.baseReleaseGamepad(id, clnt)
+	}
+	return released
+}
+
+// ReleaseGamepadsByClient makes all gamepads owned by the deliverer or the controller available.
+func (c *MemoryClientsStore) ReleaseGamepadsByClient(clientId string) {
+	c.releaseGamepadsByClient(clientId)
+}
+
+func (c *MemoryClientsStore) Close() error {
+	return nil
 }
 
-func NewClientsStore(opts ...ClientsStoreOption) *ClientsStore {
+func NewMemoryClientsStore(opts ...ClientsStoreOption) *MemoryClientsStore {
 	baseOpts := defaultClientsStoreOptions()
         for _, opt := range opts {
                 if opt == nil {
@@ -144,10 +480,11 @@ func NewClientsStore(opts ...ClientsStoreOption) *ClientsStore {
                 }
                 opt(baseOpts)
         }
-	return &ClientsStore {
+	return &MemoryClientsStore {
 		verbose:           baseOpts.verbose,
 		delivererClients:  make(map[string]*client),
 		controllerClients: make(map[string]*client),
 		gamepadClients:    make(map[string]*client),
+		subscribers:       make(map[int]OnClientsEvent),
 	}
 }
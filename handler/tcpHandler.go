@@ -1,25 +1,75 @@
 package handler
 
 import (
+        "context"
         "log"
         "fmt"
         "net"
         "time"
         "bufio"
         "sync"
+        "sync/atomic"
+        "errors"
         "github.com/google/uuid"
+        "github.com/gorilla/websocket"
+        "math"
+        "strconv"
+        "crypto/hmac"
+        "crypto/rand"
+        "crypto/x509"
+        "encoding/hex"
         "crypto/sha256"
         "encoding/json"
 	"github.com/potix/regapweb/message"
 )
 
+const (
+	DuplicateDeviceTakeover string = "takeover"
+	DuplicateDeviceReject          = "reject"
+)
+
+const (
+	// only the challenge response
+	AuthModeChallenge string = "challenge"
+	// the challenge response and static digests of legacy devices
+	AuthModeMigration        = "migration"
+	// only the challenge response by credentials of enrolled devices
+	AuthModeCredential       = "credential"
+)
+
 type tcpOptions struct {
-        verbose bool
+        verbose             bool
+        cluster             *Cluster
+        duplicateDevice     string
+        roomSecrets         map[string]string
+        ctx                 context.Context
+        shutdownTimeout     time.Duration
+        authMode            string
+        deviceRegistry      DeviceRegistry
+        mutualTlsCertPath   string
+        mutualTlsKeyPath    string
+        mutualTlsCaPath     string
+        mutualTlsCrlPath    string
+        mutualTlsSkipDigest bool
+        udpAddrPort         string
+        pingInterval        time.Duration
+        pingMaxMissed       int
+        maxFrameSize        int
 }
 
 func defaultTcpOptions() *tcpOptions {
         return &tcpOptions {
-                verbose: false,
+                verbose:         false,
+                cluster:         nil,
+                duplicateDevice: DuplicateDeviceTakeover,
+                roomSecrets:     nil,
+                ctx:             context.Background(),
+                shutdownTimeout: 5 * time.Second,
+                authMode:        AuthModeChallenge,
+                deviceRegistry:  nil,
+                pingInterval:    10 * time.Second,
+                pingMaxMissed:   3,
+                maxFrameSize:    64 * 1024,
         }
 }
 
@@ -31,23 +81,187 @@ func TcpVerbose(verbose bool) TcpOption {
         }
 }
 
+// TcpCluster routes gamepad messages to the gamepad connected to other node of the cluster.
+func TcpCluster(cluster *Cluster) TcpOption {
+        return func(opts *tcpOptions) {
+                opts.cluster = cluster
+        }
+}
+
+// TcpDuplicateDevice sets how to handle the connection of the device that is already connected.
+// takeover closes the stale connection, reject refuses the new connection.
+func TcpDuplicateDevice(duplicateDevice string) TcpOption {
+        return func(opts *tcpOptions) {
+                opts.duplicateDevice = duplicateDevice
+        }
+}
+
+// TcpRoomSecrets sets secrets of rooms, gamepads join the room by the digest of the room secret.
+// If room secrets are set, gamepads can join only the default room and rooms that have the secret.
+func TcpRoomSecrets(roomSecrets map[string]string) TcpOption {
+        return func(opts *tcpOptions) {
+                opts.roomSecrets = roomSecrets
+        }
+}
+
+// TcpAuthMode sets how to authenticate gamepads, the default is the challenge.
+// Opt in to the migration mode until all devices are updated to the challenge,
+// static digests can be replayed, so that they never take over live connections.
+func TcpAuthMode(authMode string) TcpOption {
+        return func(opts *tcpOptions) {
+                opts.authMode = authMode
+        }
+}
+
+// TcpDeviceRegistry sets the registry of per-device credentials and enables the enrollment by pairing codes.
+func TcpDeviceRegistry(deviceRegistry DeviceRegistry) TcpOption {
+        return func(opts *tcpOptions) {
+                opts.deviceRegistry = deviceRegistry
+        }
+}
+
+// TcpMutualTls authenticates gamepads by client certificates signed by the CA,
+// the common name of the certificate subject is the device id.
+// If skipDigest is true, the certificate is enough, otherwise the digest is also required.
+// The crl can be reloaded by ReloadCrl. Disable tls of the tcp server, the handler runs tls by itself.
+func TcpMutualTls(certPath string, keyPath string, caPath string, crlPath string, skipDigest bool) TcpOption {
+        return func(opts *tcpOptions) {
+                opts.mutualTlsCertPath = certPath
+                opts.mutualTlsKeyPath = keyPath
+                opts.mutualTlsCaPath = caPath
+                opts.mutualTlsCrlPath = crlPath
+                opts.mutualTlsSkipDigest = skipDigest
+        }
+}
+
+// TcpUdp enables the udp channel of gpState and gpVibration for gamepads that request it in the handshake.
+func TcpUdp(addrPort string) TcpOption {
+        return func(opts *tcpOptions) {
+                opts.udpAddrPort = addrPort
+        }
+}
+
+// TcpHeartbeat sets the interval of pings, and how many intervals without any message from the gamepad are allowed.
+// The silent connection is closed as dead and the gamepad is removed, 0 of maxMissed disables it.
+func TcpHeartbeat(pingInterval time.Duration, maxMissed int) TcpOption {
+        return func(opts *tcpOptions) {
+                opts.pingInterval = pingInterval
+                opts.pingMaxMissed = maxMissed
+        }
+}
+
+// TcpMaxFrameSize sets the maximum size of messages from gamepads,
+// the connection sending the larger message is closed with the protocol error.
+func TcpMaxFrameSize(maxFrameSize int) TcpOption {
+        return func(opts *tcpOptions) {
+                opts.maxFrameSize = maxFrameSize
+        }
+}
+
+// TcpContext sets the context of the handler, connections are closed when it is canceled.
+// Cancel it before stopping the tcp server, which waits for all connections to be finished.
+func TcpContext(ctx context.Context) TcpOption {
+        return func(opts *tcpOptions) {
+                opts.ctx = ctx
+        }
+}
+
+// TcpShutdownTimeout sets how long Stop waits for connections to be closed.
+func TcpShutdownTimeout(shutdownTimeout time.Duration) TcpOption {
+        return func(opts *tcpOptions) {
+                opts.shutdownTimeout = shutdownTimeout
+        }
+}
+
+// DeviceDigest returns the static digest that the device with the device id sends in the legacy handshake.
+func DeviceDigest(secret string, deviceId string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(deviceId))
+	return fmt.Sprintf("%x", mac.Sum(nil))
+}
+
+// ChallengeDigest returns the digest that the device answers to the challenge of the nonce.
+// It is message.ChallengeDigest that the device computes.
+func ChallengeDigest(secret string, nonce string, deviceId string) string {
+	return message.ChallengeDigest(secret, nonce, deviceId)
+}
+
 type tcpClient struct {
-        gamepadId string
+        // empty until the handshake succeeds
+        deviceId   string
+        // gamepads emulated by the device, empty until the handshake succeeds
+        gamepadIds []string
+        // taken over by new connection of the same device
+        replaced   bool
+        writer     *connWriter
+        // client certificate of mutual tls
+        cert       *x509.Certificate
+        // token of the udp session, empty if udp is not negotiated
+        udpToken   string
+        // latest status of the device, shared by its gamepads
+        deviceStatus *message.GamepadDeviceStatus
+        // framing of reads negotiated in the handshake
+        framing    string
+}
+
+func containsGamepadId(gamepadIds []string, gamepadId string) bool {
+	for _, id := range gamepadIds {
+		if id == gamepadId {
+			return true
+		}
+	}
+	return false
 }
 
 type TcpHandler struct {
         verbose          bool
-        digest           string
-	clientsStore     *ClientsStore
-        forwarder        *Forwarder
+        secret           string
+        duplicateDevice  string
+        authMode         string
+        deviceRegistry   DeviceRegistry
+        deviceRegistrySubscriptionId int
+        clientsStoreSubscriptionId int
+        mutualTls        *mutualTls
+        mutualTlsSkipDigest bool
+        udp              *udpTransport
+        pingInterval     time.Duration
+        pingMaxMissed    int
+        maxFrameSize     int
+        roomSecrets      map[string]string
+	clientsStore     ClientsStore
+        forwarder        Forwarder
 	tcpClientsMutex  sync.Mutex
         tcpClients       map[net.Conn]*tcpClient
+        // device ids by gamepad ids derived from them, other devices can not present them as device ids
+        derivedGamepadIds map[string]string
+        boundGamepadsMutex sync.Mutex
+        // sessions bound to gamepads of local connections, the gamepad is notified when its session is released
+        boundGamepads    map[string]*message.GamepadDisconnected
+        cluster          *Cluster
+        ctx              context.Context
+        cancel           context.CancelFunc
+        shutdownTimeout  time.Duration
+        connWg           sync.WaitGroup
 }
 
 func (t *TcpHandler) onFromWs(msg *message.Message) error {
 	if t.verbose {
 		log.Printf("onFromWs")
 	}
+	if t.cluster != nil {
+		_, _, gamepadId := gamepadMessageIds(msg)
+		if t.getClientConn(gamepadId) == nil {
+			nodeId := t.cluster.LookupNode(gamepadId)
+			if nodeId != "" {
+				// gamepad is connected to other node
+				return t.cluster.RouteFromWs(nodeId, msg)
+			}
+		}
+	}
+	return t.deliverFromWs(msg)
+}
+
+func (t *TcpHandler) deliverFromWs(msg *message.Message) error {
 	if msg.MsgType == message.MsgTypeGamepadConnectReq {
 		conn := t.getClientConn(msg.GamepadConnectRequest.GamepadId)
 		if conn == nil {
@@ -65,7 +279,7 @@ func (t *TcpHandler) onFromWs(msg *message.Message) error {
 			log.Printf("can not find client connection: gamepadId = %v", msg.GamepadState.GamepadId)
 			return nil
 		}
-		err := t.writeMessage(conn, msg)
+		err := t.writeStateMessage(conn, msg)
 		if err != nil {
 			log.Printf("can not write gamepad state message: %v", err)
 			return nil
@@ -79,63 +293,434 @@ func (t *TcpHandler) onFromWs(msg *message.Message) error {
 
 func (t *TcpHandler) Start() error {
         t.forwarder.StartFromWsListener(t.onFromWs)
+	if t.deviceRegistry != nil {
+		t.deviceRegistrySubscriptionId = t.deviceRegistry.Subscribe(t.onDeviceRevoked)
+	}
+	t.clientsStoreSubscriptionId = t.clientsStore.Subscribe(t.onPresenceEvent)
+	if t.cluster != nil {
+		t.cluster.SetFromWsHandler(t.deliverFromWs)
+	}
+	if t.udp != nil {
+		if err := t.udp.start(t.ctx); err != nil {
+			return fmt.Errorf("can not start udp: %w", err)
+		}
+	}
 	return nil
 }
 
 func (t *TcpHandler) Stop() {
+	if t.deviceRegistry != nil {
+		t.deviceRegistry.Unsubscribe(t.deviceRegistrySubscriptionId)
+	}
+	t.clientsStore.Unsubscribe(t.clientsStoreSubscriptionId)
+	t.cancel()
+	if !waitTimeout(&t.connWg, t.shutdownTimeout) {
+		log.Printf("can not close tcp connections in time")
+	}
+	if t.udp != nil {
+		t.udp.stop()
+	}
         t.forwarder.StopFromWsListener()
+	if t.verbose {
+		log.Printf("stopped tcp handler")
+	}
 }
 
-func (t *TcpHandler) clientRegister(conn net.Conn, gamepadId string) {
+// clientAccept adds the accepted connection with its writer.
+func (t *TcpHandler) clientAccept(conn net.Conn, cert *x509.Certificate) *connWriter {
         t.tcpClientsMutex.Lock()
         defer t.tcpClientsMutex.Unlock()
+	// the framing of writes is switched after the handshake response is written
+	writeFraming := message.FramingLine
+	writer := newConnWriter(func(msg *message.Message) error {
+		err := t.writeRawMessage(conn, msg, writeFraming)
+		if msg.MsgType == message.MsgTypeGamepadHandshakeRes &&
+		   msg.GamepadHandshakeResponse != nil &&
+		   msg.GamepadHandshakeResponse.Framing != "" {
+			writeFraming = msg.GamepadHandshakeResponse.Framing
+		}
+		return err
+	}, connWriteQueueSize)
         t.tcpClients[conn] = &tcpClient {
-		gamepadId: gamepadId,
+		writer:  writer,
+		cert:    cert,
+		framing: message.FramingLine,
+	}
+	return writer
+}
+
+// clientRegister registers the connection of gamepads of the device,
+// and returns stale connections that have any of the gamepads if they are taken over.
+// Only the same device can take over, the connection that can not take over is rejected instead.
+func (t *TcpHandler) clientRegister(conn net.Conn, deviceId string, gamepadIds []string, canTakeover bool) ([]net.Conn, error) {
+        t.tcpClientsMutex.Lock()
+        defer t.tcpClientsMutex.Unlock()
+	if owner, ok := t.derivedGamepadIds[deviceId]; ok && owner != deviceId {
+		return nil, fmt.Errorf("device id is the gamepad id of other device: deviceId = %v, owner = %v", deviceId, owner)
+	}
+	staleConns := make([]net.Conn, 0)
+	for k, v := range t.tcpClients {
+		if v.replaced {
+			continue
+		}
+		for _, gamepadId := range gamepadIds {
+			if !containsGamepadId(v.gamepadIds, gamepadId) {
+				continue
+			}
+			if v.deviceId != deviceId {
+				return nil, fmt.Errorf("gamepad is connected by other device: id = %v, deviceId = %v", gamepadId, v.deviceId)
+			}
+			if t.duplicateDevice == DuplicateDeviceReject || !canTakeover {
+				return nil, fmt.Errorf("gamepad is already connected: id = %v", gamepadId)
+			}
+			staleConns = append(staleConns, k)
+			break
+		}
+	}
+	client, ok := t.tcpClients[conn]
+	if !ok {
+		return nil, fmt.Errorf("connection is already unregistered: ids = %v", gamepadIds)
+	}
+	for _, staleConn := range staleConns {
+		t.tcpClients[staleConn].replaced = true
+	}
+	if deviceId != "" {
+		// the device may add virtual gamepads later
+		derivedGamepadIds, err := newGamepadIds(deviceId, gamepadMaxVirtual)
+		if err != nil {
+			return nil, err
+		}
+		for _, gamepadId := range derivedGamepadIds[1:] {
+			t.derivedGamepadIds[gamepadId] = deviceId
+		}
 	}
+	client.deviceId = deviceId
+	client.gamepadIds = gamepadIds
 	if t.verbose {
-		log.Printf("register gamepad client: conn = %p, id = %v", conn, gamepadId)
+		log.Printf("register gamepad client: conn = %p, ids = %v", conn, gamepadIds)
 	}
+	return staleConns, nil
 }
 
-func (t *TcpHandler) clientUnregister(conn net.Conn) {
+// clientUnregister unregisters the connection,
+// and returns ids of its gamepads that are not taken over by other connections.
+func (t *TcpHandler) clientUnregister(conn net.Conn) []string {
         t.tcpClientsMutex.Lock()
         defer t.tcpClientsMutex.Unlock()
 	if t.verbose {
 		log.Printf("unregister gamepad client: conn = %p", conn)
 	}
+	client, ok := t.tcpClients[conn]
+	if !ok {
+		return nil
+	}
         delete(t.tcpClients, conn)
+	if client.udpToken != "" {
+		t.udp.deleteSession(client.udpToken)
+	}
+	if !client.replaced {
+		return client.gamepadIds
+	}
+	// the device may come back with fewer gamepads
+	lostGamepadIds := make([]string, 0)
+	for _, gamepadId := range client.gamepadIds {
+		if t.findClientConn(gamepadId) == nil {
+			lostGamepadIds = append(lostGamepadIds, gamepadId)
+		}
+	}
+	return lostGamepadIds
 }
 
 func (t *TcpHandler) getClientConn(gamepadId string) net.Conn {
         t.tcpClientsMutex.Lock()
         defer t.tcpClientsMutex.Unlock()
+        return t.findClientConn(gamepadId)
+}
+
+// findClientConn returns the connection of the gamepad, tcpClientsMutex must be locked.
+func (t *TcpHandler) findClientConn(gamepadId string) net.Conn {
 	for k, v := range t.tcpClients {
-		if v.gamepadId == gamepadId {
+		if !v.replaced && containsGamepadId(v.gamepadIds, gamepadId) {
 			return k
 		}
 	}
         return nil
 }
 
+// writeMessage queues the message to the writer of the connection.
 func (t *TcpHandler) writeMessage(conn net.Conn, msg *message.Message) error {
+        t.tcpClientsMutex.Lock()
+	client, ok := t.tcpClients[conn]
+        t.tcpClientsMutex.Unlock()
+	if !ok {
+		// error callback of forwarder may be called after disconnection
+		return fmt.Errorf("client is already unregistered")
+	}
+	return client.writer.enqueue(msg)
+}
+
+// writeStateMessage writes the message over udp if it is negotiated, otherwise queues it to the writer.
+func (t *TcpHandler) writeStateMessage(conn net.Conn, msg *message.Message) error {
+        t.tcpClientsMutex.Lock()
+	client, ok := t.tcpClients[conn]
+        t.tcpClientsMutex.Unlock()
+	if !ok {
+		return fmt.Errorf("client is already unregistered")
+	}
+	if client.udpToken != "" {
+		sent, err := t.udp.send(client.udpToken, msg)
+		if sent {
+			return err
+		}
+		// the gamepad has not sent any datagram yet
+	}
+	return client.writer.enqueue(msg)
+}
+
+// newUdpSession creates the udp session of the registered connection, that is shared by its gamepads.
+func (t *TcpHandler) newUdpSession(conn net.Conn, gamepadIds []string) (string, error) {
+	token, err := t.udp.newSession(gamepadIds)
+	if err != nil {
+		return "", err
+	}
+        t.tcpClientsMutex.Lock()
+        defer t.tcpClientsMutex.Unlock()
+	client, ok := t.tcpClients[conn]
+	if !ok {
+		t.udp.deleteSession(token)
+		return "", fmt.Errorf("connection is already unregistered: ids = %v", gamepadIds)
+	}
+	client.udpToken = token
+	return token, nil
+}
+
+// boundSession returns ids of the deliverer and the controller that the gamepad is reserved for.
+func (t *TcpHandler) boundSession(gamepadId string) (string, string, bool) {
+	gamepad := t.clientsStore.GetGamepad(gamepadId)
+	if gamepad == nil || gamepad.ControllerId == "" {
+		return "", "", false
+	}
+	return gamepad.DelivererId, gamepad.ControllerId, true
+}
+
+// onPresenceEvent notifies the gamepad of the local connection that the session bound to it is released,
+// so that the device stops sending vibrations to the controller that has left.
+// It is called while the store is locked, the message is only queued to the writer.
+func (t *TcpHandler) onPresenceEvent(event *message.PresenceEvent) {
+	if event.ClientType != message.ClientTypeGamepad || event.Gamepad == nil {
+		return
+	}
+	gamepadId := event.Gamepad.Id
+	t.boundGamepadsMutex.Lock()
+	defer t.boundGamepadsMutex.Unlock()
+	bound, ok := t.boundGamepads[gamepadId]
+	if event.Event != message.PresenceEventDelete && event.Gamepad.ControllerId != "" {
+		if ok && bound.DelivererId == event.Gamepad.DelivererId && bound.ControllerId == event.Gamepad.ControllerId {
+			return
+		}
+		if t.getClientConn(gamepadId) == nil {
+			return
+		}
+		t.boundGamepads[gamepadId] = &message.GamepadDisconnected{
+			DelivererId:  event.Gamepad.DelivererId,
+			ControllerId: event.Gamepad.ControllerId,
+			GamepadId:    gamepadId,
+		}
+		if !ok {
+			return
+		}
+	} else if ok {
+		delete(t.boundGamepads, gamepadId)
+	} else {
+		return
+	}
+	conn := t.getClientConn(gamepadId)
+	if conn == nil {
+		return
+	}
+	msg := &message.Message{
+		MsgType:             message.MsgTypeGamepadDisconnected,
+		GamepadDisconnected: bound,
+	}
+	if err := t.writeMessage(conn, msg); err != nil {
+		log.Printf("can not write gpDisconnected message: %v", err)
+	}
+}
+
+// notifyDisconnected notifies the controller bound to the gamepad that the gamepad is lost.
+func (t *TcpHandler) notifyDisconnected(gamepadId string) {
+	delivererId, controllerId, ok := t.boundSession(gamepadId)
+	if !ok {
+		return
+	}
+	msg := &message.Message{
+		MsgType: message.MsgTypeGamepadDisconnected,
+		GamepadDisconnected: &message.GamepadDisconnected{
+			DelivererId:  delivererId,
+			ControllerId: controllerId,
+			GamepadId:    gamepadId,
+		},
+	}
+	t.forwarder.ToWs(msg, func(err error) {
+		if t.verbose {
+			log.Printf("can not notify disconnected gamepad: %v", err)
+		}
+	})
+}
+
+// deviceStatusChanged returns true if the status is worth pushing to the controller.
+// Temperature is compared in 1 degree to ignore fluctuation.
+func deviceStatusChanged(prev *message.GamepadDeviceStatus, next *message.GamepadDeviceStatus) bool {
+	if prev == nil ||
+	   prev.HostLink != next.HostLink ||
+	   prev.DeviceType != next.DeviceType ||
+	   prev.Firmware != next.Firmware ||
+	   math.Abs(prev.Temperature - next.Temperature) >= 1 ||
+	   len(prev.ErrorCounters) != len(next.ErrorCounters) {
+		return true
+	}
+	for k, v := range next.ErrorCounters {
+		if prev.ErrorCounters[k] != v {
+			return true
+		}
+	}
+	return false
+}
+
+// updateDeviceStatus retains the status of the device for each of its gamepads,
+// and pushes it to bound controllers if it is changed.
+func (t *TcpHandler) updateDeviceStatus(conn net.Conn, gamepadIds []string, deviceStatus *message.GamepadDeviceStatus) {
+	deviceStatus.DelivererId = ""
+	deviceStatus.ControllerId = ""
+	deviceStatus.GamepadId = ""
+	deviceStatus.UpdatedAt = time.Now().Unix()
+        t.tcpClientsMutex.Lock()
+	client, ok := t.tcpClients[conn]
+	changed := ok && deviceStatusChanged(client.deviceStatus, deviceStatus)
+	if changed {
+		client.deviceStatus = deviceStatus
+	}
+        t.tcpClientsMutex.Unlock()
+	if !changed {
+		return
+	}
+	for _, gamepadId := range gamepadIds {
+		gamepadStatus := copyDeviceStatus(deviceStatus)
+		gamepadStatus.GamepadId = gamepadId
+		t.clientsStore.UpdateDeviceStatus(gamepadId, gamepadStatus)
+		delivererId, controllerId, ok := t.boundSession(gamepadId)
+		if !ok {
+			continue
+		}
+		t.pushDeviceStatus(delivererId, controllerId, gamepadId, deviceStatus)
+	}
+}
+
+func (t *TcpHandler) getDeviceStatus(conn net.Conn) *message.GamepadDeviceStatus {
+        t.tcpClientsMutex.Lock()
+        defer t.tcpClientsMutex.Unlock()
+	client, ok := t.tcpClients[conn]
+	if !ok {
+		return nil
+	}
+	return client.deviceStatus
+}
+
+func (t *TcpHandler) pushDeviceStatus(delivererId string, controllerId string, gamepadId string, deviceStatus *message.GamepadDeviceStatus) {
+	pushed := copyDeviceStatus(deviceStatus)
+	pushed.DelivererId = delivererId
+	pushed.ControllerId = controllerId
+	pushed.GamepadId = gamepadId
+	msg := &message.Message{
+		MsgType:             message.MsgTypeGamepadDeviceStatus,
+		GamepadDeviceStatus: pushed,
+	}
+	t.forwarder.ToWs(msg, func(err error) {
+		if t.verbose {
+			log.Printf("can not push device status: %v", err)
+		}
+	})
+}
+
+// onUdpMessage handles messages from gamepads over udp.
+func (t *TcpHandler) onUdpMessage(gamepadIds []string, msg *message.Message) {
+	if msg.MsgType != message.MsgTypeGamepadVibration {
+		log.Printf("unsupported udp message: %v", msg.MsgType)
+		return
+	}
+	t.forwardVibration(gamepadIds, msg)
+}
+
+// forwardVibration forwards the vibration of one of gamepads of the connection.
+func (t *TcpHandler) forwardVibration(gamepadIds []string, msg *message.Message) {
+	if msg.GamepadVibration == nil ||
+	   msg.GamepadVibration.GamepadId == "" ||
+	   msg.GamepadVibration.DelivererId == "" ||
+	   msg.GamepadVibration.ControllerId == "" {
+		log.Printf("no gamepad vibration parameter: %v",  msg.GamepadVibration)
+		return
+	}
+	if !containsGamepadId(gamepadIds, msg.GamepadVibration.GamepadId) {
+		log.Printf("gamepad id is mismatch: act %v, exp %v",  msg.GamepadVibration.GamepadId, gamepadIds)
+		return
+	}
+	t.forwarder.ToWs(msg, nil)
+}
+
+func (t *TcpHandler) writeRawMessage(conn net.Conn, msg *message.Message, framing string) error {
 	msgBytes, err := json.Marshal(msg)
 	if err != nil {
 		return fmt.Errorf("can not marshal to json for tcp: %w", err)
 	}
-	msgBytes = append(msgBytes, byte('\n'))
-	_, err = conn.Write(msgBytes)
+	_, err = conn.Write(message.EncodeFrame(msgBytes, framing))
 	if err != nil {
 		return fmt.Errorf("can not write to tcp: %w", err)
 	}
 	return nil
 }
 
-func (t *TcpHandler) startPingLoop(conn net.Conn, pingLoopStopChan chan int) {
-        ticker := time.NewTicker(10 * time.Second)
+// closeOnDone notifies the gamepad and closes the connection when the handler is shutting down.
+func (t *TcpHandler) closeOnDone(ctx context.Context, conn net.Conn, writer *connWriter) {
+	defer t.connWg.Done()
+	<-ctx.Done()
+	if t.ctx.Err() == nil {
+		// the connection is finished
+		return
+	}
+	msg := &message.Message{
+		MsgType: message.MsgTypeShutdown,
+		Error: &message.Error{
+			Message: "server is shutting down",
+		},
+	}
+	if err := writer.enqueue(msg); err != nil && t.verbose {
+		log.Printf("can not write shutdown message: %v", err)
+	}
+	t.closeWriter(conn, writer)
+	conn.Close()
+}
+
+// closeWriter writes queued messages within the deadline.
+func (t *TcpHandler) closeWriter(conn net.Conn, writer *connWriter) {
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	writer.close()
+}
+
+// startPingLoop sends pings, and closes the connection if no message is received in the missed heartbeats.
+func (t *TcpHandler) startPingLoop(ctx context.Context, conn net.Conn, lastReceived *int64) {
+	defer t.connWg.Done()
+        ticker := time.NewTicker(t.pingInterval)
         defer ticker.Stop()
+	deadTimeout := t.pingInterval * time.Duration(t.pingMaxMissed)
         for {
                 select {
                 case <-ticker.C:
+			silent := time.Since(time.Unix(0, atomic.LoadInt64(lastReceived)))
+			if t.pingMaxMissed > 0 && silent > deadTimeout {
+				log.Printf("close dead gamepad connection: remoteAddr = %v, silent = %v", conn.RemoteAddr(), silent)
+				conn.Close()
+				return
+			}
                         msg := &message.Message{
                                 MsgType: "ping",
                         }
@@ -144,96 +729,482 @@ func (t *TcpHandler) startPingLoop(conn net.Conn, pingLoopStopChan chan int) {
 				log.Printf("can not write ping message: %v", err)
 				return
                         }
-                case <-pingLoopStopChan:
+                case <-ctx.Done():
                         return
                 }
         }
 }
 
-func (t *TcpHandler) handshake(conn net.Conn, gamepadId string) (error) {
-        msgBytes := make([]byte, 0, 2048)
-        rbufio := bufio.NewReader(conn)
-        for {
-		err := conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+// legacyDigest returns the sha256 of the secret, that old devices send in the handshake.
+func legacyDigest(secret string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(secret)))
+}
+
+// brokenLegacyDigest returns the digest that old servers expected,
+// it is the hex of the secret followed by the sha256 of nothing.
+func brokenLegacyDigest(secret string) string {
+	sha := sha256.New()
+	return fmt.Sprintf("%x", sha.Sum([]byte(secret)))
+}
+
+func (t *TcpHandler) roomSecret(room string) (string, error) {
+	if secret, ok := t.roomSecrets[room]; ok {
+		return secret, nil
+	}
+	if room == message.DefaultRoom || len(t.roomSecrets) == 0 {
+		return t.secret, nil
+	}
+	return "", fmt.Errorf("no secret of room: %v", room)
+}
+
+func (t *TcpHandler) writeHandshakeError(conn net.Conn, errMsg string) error {
+	resMsg := &message.Message{
+		MsgType: message.MsgTypeGamepadHandshakeRes,
+		Error: &message.Error{
+			Message: errMsg,
+		},
+	}
+	err := t.writeMessage(conn, resMsg)
+	if err != nil {
+		return fmt.Errorf("can not write gpHandshakeRes: %w", err)
+	}
+	return nil
+}
+
+func (t *TcpHandler) readHandshakeMessage(conn net.Conn, rbufio *bufio.Reader) (*message.Message, error) {
+	err := conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err != nil {
+		return nil, fmt.Errorf("can not set read deadline: %w", err)
+	}
+	// the handshake is always framed by lines
+	msgBytes, err := message.ReadLineFrame(rbufio, t.maxFrameSize)
+	if err != nil {
+		if errors.Is(err, message.ErrFrameTooLarge) {
+			t.writeProtocolError(conn, err.Error())
+		}
+		return nil, fmt.Errorf("can not read handshake message: %w", err)
+	}
+	var msg message.Message
+	if err = json.Unmarshal(msgBytes, &msg); err != nil {
+		return nil, fmt.Errorf("can not unmarshal message: %w", err)
+	}
+	return &msg, nil
+}
+
+// writeProtocolError queues the protocol error, the connection should be closed after it.
+func (t *TcpHandler) writeProtocolError(conn net.Conn, errMsg string) {
+	msg := &message.Message{
+		MsgType: message.MsgTypeProtocolError,
+		Error: &message.Error{
+			Message: errMsg,
+		},
+	}
+	if err := t.writeMessage(conn, msg); err != nil {
+		log.Printf("can not write protocol error message: %v", err)
+	}
+}
+
+// setFraming sets the framing of reads negotiated in the handshake.
+func (t *TcpHandler) setFraming(conn net.Conn, framing string) {
+        t.tcpClientsMutex.Lock()
+        defer t.tcpClientsMutex.Unlock()
+	client, ok := t.tcpClients[conn]
+	if !ok {
+		return
+	}
+	client.framing = framing
+}
+
+func (t *TcpHandler) getFraming(conn net.Conn) string {
+        t.tcpClientsMutex.Lock()
+        defer t.tcpClientsMutex.Unlock()
+	client, ok := t.tcpClients[conn]
+	if !ok {
+		return message.FramingLine
+	}
+	return client.framing
+}
+
+// challenge sends the nonce and verifies the hmac of the nonce and the device id.
+func (t *TcpHandler) challenge(conn net.Conn, rbufio *bufio.Reader, secret string, deviceId string) error {
+	nonceBytes := make([]byte, 32)
+	if _, err := rand.Read(nonceBytes); err != nil {
+		return fmt.Errorf("can not create nonce: %w", err)
+	}
+	nonce := hex.EncodeToString(nonceBytes)
+	reqMsg := &message.Message{
+		MsgType: message.MsgTypeGamepadChallengeReq,
+		GamepadChallengeRequest: &message.GamepadChallengeRequest{
+			Nonce: nonce,
+		},
+	}
+	if err := t.writeMessage(conn, reqMsg); err != nil {
+		return fmt.Errorf("can not write gpChallengeReq: %w", err)
+	}
+	msg, err := t.readHandshakeMessage(conn, rbufio)
+	if err != nil {
+		return err
+	}
+	if msg.MsgType != message.MsgTypeGamepadChallengeRes ||
+	   msg.GamepadChallengeResponse == nil {
+		return fmt.Errorf("recieved invalid message: %v", msg.MsgType)
+	}
+	digest := ChallengeDigest(secret, nonce, deviceId)
+	if !hmac.Equal([]byte(msg.GamepadChallengeResponse.Digest), []byte(digest)) {
+		return fmt.Errorf("digest mismatch: deviceId = %v", deviceId)
+	}
+	return nil
+}
+
+// verifyStaticDigest verifies the digest of the legacy handshake, it is allowed only in the migration mode.
+func (t *TcpHandler) verifyStaticDigest(staticDigest string, secret string, deviceId string) error {
+	if t.authMode != AuthModeMigration {
+		return fmt.Errorf("static digest is not allowed: deviceId = %v", deviceId)
+	}
+	digests := []string{ legacyDigest(secret), brokenLegacyDigest(secret) }
+	if deviceId != "" {
+		digests = []string{ DeviceDigest(secret, deviceId) }
+	}
+	for _, digest := range digests {
+		if hmac.Equal([]byte(staticDigest), []byte(digest)) {
+			log.Printf("gamepad is authenticated by static digest, it should be updated to the challenge: deviceId = %v", deviceId)
+			return nil
+		}
+	}
+	return fmt.Errorf("digest mismatch: deviceId = %v", deviceId)
+}
+
+// authenticate authenticates the gamepad by the pairing code, the credential of the device or the shared secret,
+// and returns the credential issued if the device is enrolled by the pairing code,
+// and true if the gamepad is authenticated by the replayable static digest.
+// Enrolled devices are never authenticated by the shared secret.
+// The gamepad with the client certificate skips them if the mutual tls is configured so.
+func (t *TcpHandler) authenticate(conn net.Conn, rbufio *bufio.Reader, req *message.GamepadHandshakeRequest, secret string, certified bool) (string, bool, error) {
+	deviceId := req.DeviceId
+	if req.PairingCode != "" {
+		if t.deviceRegistry == nil {
+			return "", false, fmt.Errorf("no device registry to enroll: deviceId = %v", deviceId)
+		}
+		if deviceId == "" {
+			return "", false, fmt.Errorf("no device id to enroll")
+		}
+		credential, err := t.deviceRegistry.Enroll(req.PairingCode, deviceId, req.Name)
 		if err != nil {
-			return fmt.Errorf("can not set read deadline: %w", err)
+			return "", false, fmt.Errorf("can not enroll device: %w", err)
 		}
-                patialMsgBytes, isPrefix, err := rbufio.ReadLine()
-                if err != nil {
-			return fmt.Errorf("can not read gpHandshakeRquest: %w", err)
-                } else if isPrefix {
-                        // patial message
-                        msgBytes = append(msgBytes, patialMsgBytes...)
-                        continue
-                } else {
-                        // entire message
-                        msgBytes = append(msgBytes, patialMsgBytes...)
-                        var msg message.Message
-                        if err = json.Unmarshal(msgBytes, &msg); err != nil {
-                                msgBytes = msgBytes[:0]
-                                return fmt.Errorf("can not unmarshal message: %w", err)
-                        }
-                        msgBytes = msgBytes[:0]
-                        if msg.MsgType != message.MsgTypeGamepadHandshakeReq {
-				return fmt.Errorf("recieved invalid message: %w", msg.MsgType)
+		log.Printf("enrolled device: deviceId = %v", deviceId)
+		return credential.Secret, false, nil
+	}
+	if t.deviceRegistry != nil && deviceId != "" {
+		credential := t.deviceRegistry.GetCredential(deviceId)
+		if credential != nil {
+			if credential.RevokedAt != 0 {
+				return "", false, fmt.Errorf("device is revoked: %v", deviceId)
 			}
-			if msg.GamepadHandshakeRequest == nil ||
-			   msg.GamepadHandshakeRequest.Digest == "" {
-				resMsg := &message.Message{
-					MsgType: message.MsgTypeGamepadHandshakeRes,
-					Error: &message.Error{
-						Message: "no parameter in gpHandshakeRquest",
-					},
-				}
-				err = t.writeMessage(conn, resMsg)
-				if err != nil {
-					return fmt.Errorf("can not write gpHandshakeRes: %w", err)
-				}
-				return fmt.Errorf("no parameter in gpHandshakeRquest: %v", msg.GamepadHandshakeRequest)
+			if certified && t.mutualTlsSkipDigest {
+				return "", false, nil
 			}
-			if msg.GamepadHandshakeRequest.Digest != t.digest {
-				resMsg := &message.Message{
-					MsgType: message.MsgTypeGamepadHandshakeRes,
-					Error: &message.Error{
-						Message: "digest mismatch",
-					},
-				}
-				err = t.writeMessage(conn, resMsg)
-				if err != nil {
-					return fmt.Errorf("can not write gpHandshakeRes: %w", err)
-				}
-				return fmt.Errorf("digest mismatch: act: %v, exp: %v", msg.GamepadHandshakeRequest.Digest, t.digest)
+			return "", false, t.challenge(conn, rbufio, credential.Secret, deviceId)
+		}
+	}
+	if certified && t.mutualTlsSkipDigest {
+		return "", false, nil
+	}
+	if t.authMode == AuthModeCredential {
+		return "", false, fmt.Errorf("device is not enrolled: %v", deviceId)
+	}
+	if req.Digest == "" {
+		return "", false, t.challenge(conn, rbufio, secret, deviceId)
+	}
+	return "", true, t.verifyStaticDigest(req.Digest, secret, deviceId)
+}
+
+func (t *TcpHandler) isRevoked(deviceId string) bool {
+	if t.deviceRegistry == nil {
+		return false
+	}
+	credential := t.deviceRegistry.GetCredential(deviceId)
+	return credential != nil && credential.RevokedAt != 0
+}
+
+// disconnectRevoked disconnects gamepads that the predicate reports as revoked.
+func (t *TcpHandler) disconnectRevoked(isRevoked func(client *tcpClient) bool) {
+	t.tcpClientsMutex.Lock()
+	revoked := make(map[net.Conn]*tcpClient)
+	for conn, client := range t.tcpClients {
+		if isRevoked(client) {
+			revoked[conn] = client
+		}
+	}
+	t.tcpClientsMutex.Unlock()
+	for conn, client := range revoked {
+		writer := client.writer
+		log.Printf("disconnect revoked device: gamepadIds = %v, remoteAddr = %v", client.gamepadIds, conn.RemoteAddr())
+		msg := &message.Message{
+			MsgType: message.MsgTypeGamepadRevoked,
+			Error: &message.Error{
+				Message: "device is revoked",
+			},
+		}
+		if err := writer.enqueue(msg); err != nil && t.verbose {
+			log.Printf("can not write revoked message: %v", err)
+		}
+		t.closeWriter(conn, writer)
+		conn.Close()
+	}
+}
+
+// onDeviceRevoked disconnects the revoked device immediately.
+func (t *TcpHandler) onDeviceRevoked(deviceId string) {
+	t.disconnectRevoked(func(client *tcpClient) bool {
+		return client.deviceId == deviceId
+	})
+}
+
+// ReloadCrl reloads the certificate revocation list of the mutual tls,
+// and disconnects gamepads whose certificates are revoked.
+func (t *TcpHandler) ReloadCrl() error {
+	if t.mutualTls == nil {
+		return nil
+	}
+	if err := t.mutualTls.loadCrl(); err != nil {
+		return fmt.Errorf("can not reload crl: %w", err)
+	}
+	t.disconnectRevoked(func(client *tcpClient) bool {
+		return client.cert != nil && t.mutualTls.isRevoked(client.cert)
+	})
+	return nil
+}
+
+// newGamepadIds returns ids of gamepads emulated by the device.
+// The first gamepad has the device id, and others have ids derived from it to keep them over reconnections.
+// Gamepads of the device without the device id get random ids.
+func newGamepadIds(deviceId string, count int) ([]string, error) {
+	gamepadIds := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		if deviceId == "" {
+			gamepadUuid, err := uuid.NewRandom()
+			if err != nil {
+				return nil, fmt.Errorf("can not create gamepad id: %w", err)
 			}
-			// create gamepad id
-		        resMsg := &message.Message{
-			        MsgType: message.MsgTypeGamepadHandshakeRes,
-				GamepadHandshakeResponse: &message.GamepadHandshakeResponse{
-					GamepadId: gamepadId,
-				},
+			gamepadIds = append(gamepadIds, gamepadUuid.String())
+		} else if i == 0 {
+			gamepadIds = append(gamepadIds, deviceId)
+		} else {
+			deviceUuid, err := uuid.Parse(deviceId)
+			if err != nil {
+				return nil, fmt.Errorf("can not parse device id: %w", err)
 			}
-			err = t.writeMessage(conn, resMsg)
-		        if err != nil {
-				return fmt.Errorf("can not write gpHandshakeRes: %w", err)
+			gamepadIds = append(gamepadIds, uuid.NewSHA1(deviceUuid, []byte(strconv.Itoa(i))).String())
+		}
+	}
+	return gamepadIds, nil
+}
+
+// handshake authenticates the gamepad and registers the connection.
+// The gamepad without the digest is authenticated by the challenge,
+// otherwise by the static digest of the legacy handshake.
+// The device id becomes the gamepad id, the gamepad without the device id gets a random gamepad id.
+// The device emulating virtual gamepads registers all of them, and gets ids of them in the requested order.
+func (t *TcpHandler) handshake(conn net.Conn, rbufio *bufio.Reader, cert *x509.Certificate) ([]string, error) {
+	msg, err := t.readHandshakeMessage(conn, rbufio)
+	if err != nil {
+		return nil, err
+	}
+	if msg.MsgType != message.MsgTypeGamepadHandshakeReq {
+		return nil, fmt.Errorf("recieved invalid message: %v", msg.MsgType)
+	}
+	if msg.GamepadHandshakeRequest == nil {
+		if err := t.writeHandshakeError(conn, "no parameter in gpHandshakeRquest"); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("no parameter in gpHandshakeRquest: %v", msg.GamepadHandshakeRequest)
+	}
+	room := msg.GamepadHandshakeRequest.Room
+	if room == "" {
+		room = message.DefaultRoom
+	}
+	secret, err := t.roomSecret(room)
+	if err != nil {
+		if err := t.writeHandshakeError(conn, "room is not allowed"); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("can not join room: %w", err)
+	}
+	if cert != nil {
+		// the device is identified by the certificate
+		if msg.GamepadHandshakeRequest.DeviceId == "" {
+			msg.GamepadHandshakeRequest.DeviceId = cert.Subject.CommonName
+		} else if msg.GamepadHandshakeRequest.DeviceId != cert.Subject.CommonName {
+			if err := t.writeHandshakeError(conn, "device id mismatch with certificate"); err != nil {
+				return nil, err
 			}
-			t.clientsStore.AddGamepad(gamepadId, msg.GamepadHandshakeRequest.Name)
-			return nil
+			return nil, fmt.Errorf("device id mismatch with certificate: %v, %v",
+				msg.GamepadHandshakeRequest.DeviceId, cert.Subject.CommonName)
 		}
 	}
+	virtualGamepads := msg.GamepadHandshakeRequest.VirtualGamepads
+	if len(virtualGamepads) == 0 {
+		// the device emulates the single gamepad
+		virtualGamepads = []*message.VirtualGamepad{
+			{
+				Name:                msg.GamepadHandshakeRequest.Name,
+				GamepadCapabilities: msg.GamepadHandshakeRequest.GamepadCapabilities,
+			},
+		}
+	} else if len(virtualGamepads) > gamepadMaxVirtual {
+		if err := t.writeHandshakeError(conn, "too many virtual gamepads"); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("too many virtual gamepads: %v", len(virtualGamepads))
+	}
+	for i, virtualGamepad := range virtualGamepads {
+		if virtualGamepad == nil {
+			if err := t.writeHandshakeError(conn, "no virtual gamepad parameter"); err != nil {
+				return nil, err
+			}
+			return nil, fmt.Errorf("no virtual gamepad parameter: index = %v", i)
+		}
+		if virtualGamepad.Name == "" && len(msg.GamepadHandshakeRequest.VirtualGamepads) > 0 {
+			virtualGamepad.Name = fmt.Sprintf("%v #%v", msg.GamepadHandshakeRequest.Name, i + 1)
+		}
+		if capabilities := virtualGamepad.GamepadCapabilities; capabilities != nil {
+			if err := validateGamepadCapabilities(capabilities); err != nil {
+				if err := t.writeHandshakeError(conn, "invalid gamepad capabilities"); err != nil {
+					return nil, err
+				}
+				return nil, fmt.Errorf("invalid gamepad capabilities: index = %v, %w", i, err)
+			}
+		}
+	}
+	deviceId := msg.GamepadHandshakeRequest.DeviceId
+	if deviceId != "" {
+		if _, err := uuid.Parse(deviceId); err != nil {
+			if err := t.writeHandshakeError(conn, "invalid device id"); err != nil {
+				return nil, err
+			}
+			return nil, fmt.Errorf("invalid device id: %v, %w", deviceId, err)
+		}
+	}
+	credential, static, err := t.authenticate(conn, rbufio, msg.GamepadHandshakeRequest, secret, cert != nil)
+	if err != nil {
+		if err := t.writeHandshakeError(conn, "authentication failed"); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("can not authenticate: %w", err)
+	}
+	gamepadIds, err := newGamepadIds(deviceId, len(virtualGamepads))
+	if err != nil {
+		return nil, err
+	}
+	staleConns, err := t.clientRegister(conn, deviceId, gamepadIds, !static)
+	if err != nil {
+		if err := t.writeHandshakeError(conn, "gamepad is already connected"); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("can not register gamepad: %w", err)
+	}
+	for _, staleConn := range staleConns {
+		log.Printf("take over gamepad from stale connection: ids = %v, stale = %v", gamepadIds, staleConn.RemoteAddr())
+		staleConn.Close()
+	}
+	if t.isRevoked(deviceId) {
+		// revoked during the handshake
+		if err := t.writeHandshakeError(conn, "authentication failed"); err != nil {
+			return gamepadIds, err
+		}
+		return gamepadIds, fmt.Errorf("device is revoked: %v", deviceId)
+	}
+	resMsg := &message.Message{
+		MsgType: message.MsgTypeGamepadHandshakeRes,
+		GamepadHandshakeResponse: &message.GamepadHandshakeResponse{
+			GamepadId:    gamepadIds[0],
+			Room:         room,
+			Credential:   credential,
+			MaxFrameSize: t.maxFrameSize,
+		},
+	}
+	if len(msg.GamepadHandshakeRequest.VirtualGamepads) > 0 {
+		resMsg.GamepadHandshakeResponse.GamepadIds = gamepadIds
+	}
+	if _, ok := conn.(*wsNetConn); !ok && msg.GamepadHandshakeRequest.Framing == message.FramingLength {
+		// websocket has its own framing
+		resMsg.GamepadHandshakeResponse.Framing = message.FramingLength
+		t.setFraming(conn, message.FramingLength)
+	}
+	if msg.GamepadHandshakeRequest.Udp && t.udp != nil {
+		// devices without udp keep using tcp for states
+		udpToken, err := t.newUdpSession(conn, gamepadIds)
+		if err != nil {
+			return gamepadIds, fmt.Errorf("can not create udp session: %w", err)
+		}
+		resMsg.GamepadHandshakeResponse.UdpPort = t.udp.port()
+		resMsg.GamepadHandshakeResponse.UdpToken = udpToken
+	}
+	err = t.writeMessage(conn, resMsg)
+	if err != nil {
+		return gamepadIds, fmt.Errorf("can not write gpHandshakeRes: %w", err)
+	}
+	now := time.Now().Unix()
+	for i, virtualGamepad := range virtualGamepads {
+		metadata := &message.ClientMetadata{
+			ConnectedAt:  now,
+			LastActivity: now,
+			RemoteAddr:   conn.RemoteAddr().String(),
+			Firmware:     msg.GamepadHandshakeRequest.Firmware,
+			Capabilities: msg.GamepadHandshakeRequest.Capabilities,
+			Gamepad:      virtualGamepad.GamepadCapabilities,
+		}
+		t.clientsStore.AddGamepad(gamepadIds[i], virtualGamepad.Name, room, metadata)
+	}
+	return gamepadIds, nil
 }
 
 func (t *TcpHandler) OnAccept(conn net.Conn) {
-	uuid, err := uuid.NewRandom()
-	if err != nil {
-		log.Printf("can not create gamepad id")
-		return
+	defer conn.Close()
+	var cert *x509.Certificate
+	if t.mutualTls != nil {
+		tlsConn, tlsCert, err := t.mutualTls.server(conn)
+		if err != nil {
+			log.Printf("can not accept mutual tls: %v", err)
+			return
+		}
+		defer tlsConn.Close()
+		conn = tlsConn
+		cert = tlsCert
 	}
-	gamepadId := uuid.String()
-	t.clientRegister(conn, gamepadId)
-	defer t.clientUnregister(conn)
+	t.serveConn(conn, cert)
+}
+
+// ServeWebsocket serves the gamepad device connected by the websocket with the same protocol as tcp,
+// and returns after the connection is closed.
+func (t *TcpHandler) ServeWebsocket(conn *websocket.Conn) {
+	// the larger message is rejected by the protocol error instead of the close code of the websocket
+	wsConn := newWsNetConn(conn, t.maxFrameSize)
+	defer wsConn.Close()
+	t.serveConn(wsConn, nil)
+}
+
+func (t *TcpHandler) serveConn(conn net.Conn, cert *x509.Certificate) {
+	writer := t.clientAccept(conn, cert)
+	// write queued messages such as the handshake error before closing
+	defer t.closeWriter(conn, writer)
+	defer func() {
+		for _, gamepadId := range t.clientUnregister(conn) {
+			t.notifyDisconnected(gamepadId)
+			t.clientsStore.DeleteGamepad(gamepadId)
+			t.forwarder.ForgetGamepad(gamepadId)
+		}
+	}()
+	connCtx, connCancel := context.WithCancel(t.ctx)
+	defer connCancel()
+	t.connWg.Add(1)
+	go t.closeOnDone(connCtx, conn, writer)
 	if t.verbose {
 		log.Printf("start handshake")
 	}
-	err = t.handshake(conn, gamepadId)
+        rbufio := bufio.NewReader(conn)
+	gamepadIds, err := t.handshake(conn, rbufio, cert)
 	if err != nil {
 		log.Printf("can not handshake: %v", err)
 		return
@@ -241,32 +1212,38 @@ func (t *TcpHandler) OnAccept(conn net.Conn) {
 	if t.verbose {
 		log.Printf("end handshake")
 	}
-	defer t.clientsStore.DeleteGamepad(gamepadId)
 	conn.SetDeadline(time.Time{})
-	pingStopChan := make(chan int)
-        go t.startPingLoop(conn, pingStopChan)
-	defer close(pingStopChan)
-        msgBytes := make([]byte, 0, 2048)
-        rbufio := bufio.NewReader(conn)
+	lastReceived := time.Now().UnixNano()
+	t.connWg.Add(1)
+        go t.startPingLoop(connCtx, conn, &lastReceived)
+	framing := t.getFraming(conn)
+	lastTouch := time.Now()
         for {
-                patialMsgBytes, isPrefix, err := rbufio.ReadLine()
+		msgBytes, err := message.ReadFrame(rbufio, framing, t.maxFrameSize)
                 if err != nil {
-			log.Printf("can not read message: %v", err)
+			if errors.Is(err, message.ErrFrameTooLarge) {
+				log.Printf("close connection sending too large frame: gamepadIds = %v", gamepadIds)
+				t.writeProtocolError(conn, err.Error())
+				return
+			}
+			if t.ctx.Err() == nil {
+				log.Printf("can not read message: %v", err)
+			}
 			return
-                } else if isPrefix {
-                        // patial message
-                        msgBytes = append(msgBytes, patialMsgBytes...)
-                        continue
                 } else {
                         // entire message
-                        msgBytes = append(msgBytes, patialMsgBytes...)
+			atomic.StoreInt64(&lastReceived, time.Now().UnixNano())
 			var msg message.Message
                         if err := json.Unmarshal(msgBytes, &msg); err != nil {
                                 log.Printf("can not unmarshal message: %v, %v", string(msgBytes), err)
-                                msgBytes = msgBytes[:0]
                                 continue
                         }
-                        msgBytes = msgBytes[:0]
+			if now := time.Now(); now.Sub(lastTouch) >= time.Second {
+				lastTouch = now
+				for _, gamepadId := range gamepadIds {
+					t.clientsStore.TouchClient(gamepadId)
+				}
+			}
                         if msg.MsgType == message.MsgTypePing {
 				if t.verbose {
 					log.Printf("recieved ping")
@@ -291,8 +1268,8 @@ func (t *TcpHandler) OnAccept(conn net.Conn) {
 					}
 					continue
 				}
-				if msg.GamepadConnectResponse.GamepadId != gamepadId {
-					log.Printf("gamepad id is mismatch: act %v, exp %v",  msg.GamepadConnectResponse.GamepadId, gamepadId)
+				if !containsGamepadId(gamepadIds, msg.GamepadConnectResponse.GamepadId) {
+					log.Printf("gamepad id is mismatch: act %v, exp %v",  msg.GamepadConnectResponse.GamepadId, gamepadIds)
 					resMsg := &message.Message{
 						MsgType: message.MsgTypeGamepadConnectServerError,
 						Error: &message.Error {
@@ -320,19 +1297,23 @@ func (t *TcpHandler) OnAccept(conn net.Conn) {
 						return
 					}
 				})
-                        } else if msg.MsgType == message.MsgTypeGamepadVibration {
-				if msg.GamepadVibration == nil ||
-				   msg.GamepadVibration.GamepadId == "" ||
-				   msg.GamepadVibration.DelivererId == "" ||
-				   msg.GamepadVibration.ControllerId == "" {
-					log.Printf("no gamepad vibration parameter: %v",  msg.GamepadVibration)
-					continue
+				if deviceStatus := t.getDeviceStatus(conn); deviceStatus != nil {
+					// the controller is newly bound
+					t.pushDeviceStatus(
+						msg.GamepadConnectResponse.DelivererId,
+						msg.GamepadConnectResponse.ControllerId,
+						msg.GamepadConnectResponse.GamepadId,
+						deviceStatus,
+					)
 				}
-				if msg.GamepadVibration.GamepadId != gamepadId {
-					log.Printf("gamepad id is mismatch: act %v, exp %v",  msg.GamepadVibration.GamepadId, gamepadId)
+                        } else if msg.MsgType == message.MsgTypeGamepadDeviceStatus {
+				if msg.GamepadDeviceStatus == nil {
+					log.Printf("no gamepad device status parameter")
 					continue
 				}
-				t.forwarder.ToWs(&msg, nil)
+				t.updateDeviceStatus(conn, gamepadIds, msg.GamepadDeviceStatus)
+                        } else if msg.MsgType == message.MsgTypeGamepadVibration {
+				t.forwardVibration(gamepadIds, &msg)
                         } else {
 				log.Printf("unsupportede message: %v", msg.MsgType)
 			}
@@ -340,7 +1321,7 @@ func (t *TcpHandler) OnAccept(conn net.Conn) {
         }
 }
 
-func NewTcpHandler(secret string, clientsStore *ClientsStore, forwarder *Forwarder, opts ...TcpOption) (*TcpHandler, error) {
+func NewTcpHandler(secret string, clientsStore ClientsStore, forwarder Forwarder, opts ...TcpOption) (*TcpHandler, error) {
         baseOpts := defaultTcpOptions()
         for _, opt := range opts {
                 if opt == nil {
@@ -348,14 +1329,63 @@ func NewTcpHandler(secret string, clientsStore *ClientsStore, forwarder *Forward
                 }
                 opt(baseOpts)
         }
-	sha := sha256.New()
-	digest := fmt.Sprintf("%x", sha.Sum([]byte(secret)))
-        return &TcpHandler{
-                verbose:      baseOpts.verbose,
-                digest:       digest,
+	if baseOpts.duplicateDevice != DuplicateDeviceTakeover && baseOpts.duplicateDevice != DuplicateDeviceReject {
+		return nil, fmt.Errorf("invalid duplicate device policy: %v", baseOpts.duplicateDevice)
+	}
+	if baseOpts.authMode != AuthModeChallenge &&
+	   baseOpts.authMode != AuthModeMigration &&
+	   baseOpts.authMode != AuthModeCredential {
+		return nil, fmt.Errorf("invalid auth mode: %v", baseOpts.authMode)
+	}
+	if baseOpts.pingInterval <= 0 {
+		return nil, fmt.Errorf("invalid ping interval: %v", baseOpts.pingInterval)
+	}
+	if baseOpts.maxFrameSize <= 0 {
+		return nil, fmt.Errorf("invalid max frame size: %v", baseOpts.maxFrameSize)
+	}
+	if baseOpts.authMode == AuthModeCredential && baseOpts.deviceRegistry == nil {
+		return nil, fmt.Errorf("no device registry for auth mode: %v", baseOpts.authMode)
+	}
+	var newMutualTlsConfig *mutualTls
+	if baseOpts.mutualTlsCertPath != "" {
+		m, err := newMutualTls(
+			baseOpts.mutualTlsCertPath,
+			baseOpts.mutualTlsKeyPath,
+			baseOpts.mutualTlsCaPath,
+			baseOpts.mutualTlsCrlPath,
+			baseOpts.verbose,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("can not setup mutual tls: %w", err)
+		}
+		newMutualTlsConfig = m
+	}
+	ctx, cancel := context.WithCancel(baseOpts.ctx)
+        t := &TcpHandler{
+                verbose:         baseOpts.verbose,
+                secret:          secret,
+                duplicateDevice: baseOpts.duplicateDevice,
+                authMode:        baseOpts.authMode,
+                deviceRegistry:  baseOpts.deviceRegistry,
+                mutualTls:       newMutualTlsConfig,
+                mutualTlsSkipDigest: baseOpts.mutualTlsSkipDigest,
+                roomSecrets:     baseOpts.roomSecrets,
                 clientsStore: clientsStore,
                 forwarder:    forwarder,
 		tcpClients:   make(map[net.Conn]*tcpClient),
-        }, nil
+		derivedGamepadIds: make(map[string]string),
+		boundGamepads: make(map[string]*message.GamepadDisconnected),
+                cluster:      baseOpts.cluster,
+                ctx:             ctx,
+                cancel:          cancel,
+                shutdownTimeout: baseOpts.shutdownTimeout,
+                pingInterval:    baseOpts.pingInterval,
+                pingMaxMissed:   baseOpts.pingMaxMissed,
+                maxFrameSize:    baseOpts.maxFrameSize,
+        }
+	if baseOpts.udpAddrPort != "" {
+		t.udp = newUdpTransport(baseOpts.udpAddrPort, t.onUdpMessage, t.clientsStore.TouchClient, baseOpts.verbose)
+	}
+	return t, nil
 }
 
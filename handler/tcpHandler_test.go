@@ -0,0 +1,266 @@
+package handler
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+	"github.com/google/uuid"
+	"github.com/potix/regapweb/message"
+)
+
+// testGamepad plays the device side of one connection served by the tcp handler.
+type testGamepad struct {
+	t      *testing.T
+	conn   net.Conn
+	rbufio *bufio.Reader
+}
+
+func dialTestGamepad(t *testing.T, tcpHandler *TcpHandler) *testGamepad {
+	clientConn, serverConn := net.Pipe()
+	go tcpHandler.serveConn(serverConn, nil)
+	t.Cleanup(func() { clientConn.Close() })
+	return &testGamepad{ t: t, conn: clientConn, rbufio: bufio.NewReader(clientConn) }
+}
+
+func (g *testGamepad) write(msg *message.Message) {
+	msgBytes, err := json.Marshal(msg)
+	if err != nil {
+		g.t.Fatalf("can not marshal message: %v", err)
+	}
+	g.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := g.conn.Write(message.EncodeFrame(msgBytes, message.FramingLine)); err != nil {
+		g.t.Fatalf("can not write message: %v", err)
+	}
+}
+
+// read returns the next message other than pings, or nil if the connection is closed.
+func (g *testGamepad) read() *message.Message {
+	g.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		msgBytes, err := message.ReadLineFrame(g.rbufio, 64 * 1024)
+		if err != nil {
+			return nil
+		}
+		var msg message.Message
+		if err := json.Unmarshal(msgBytes, &msg); err != nil {
+			g.t.Fatalf("can not unmarshal message: %v", err)
+		}
+		if msg.MsgType != message.MsgTypePing {
+			return &msg
+		}
+	}
+}
+
+// handshake sends the request, answers the challenge if it is sent, and returns the gpHandshakeRes and the nonce.
+func (g *testGamepad) handshake(req *message.GamepadHandshakeRequest, answer func(nonce string) string) (*message.Message, string) {
+	g.write(&message.Message{
+		MsgType:                 message.MsgTypeGamepadHandshakeReq,
+		GamepadHandshakeRequest: req,
+	})
+	nonce := ""
+	for {
+		msg := g.read()
+		if msg == nil {
+			g.t.Fatalf("connection is closed in the handshake")
+		}
+		if msg.MsgType != message.MsgTypeGamepadChallengeReq {
+			return msg, nonce
+		}
+		nonce = msg.GamepadChallengeRequest.Nonce
+		g.write(&message.Message{
+			MsgType: message.MsgTypeGamepadChallengeRes,
+			GamepadChallengeResponse: &message.GamepadChallengeResponse{
+				Digest: answer(nonce),
+			},
+		})
+	}
+}
+
+func newTestTcpHandler(t *testing.T, opts ...TcpOption) *TcpHandler {
+	tcpHandler, err := NewTcpHandler("secret", NewMemoryClientsStore(), NewLocalForwarder(), opts...)
+	if err != nil {
+		t.Fatalf("can not create tcp handler: %v", err)
+	}
+	if err := tcpHandler.Start(); err != nil {
+		t.Fatalf("can not start tcp handler: %v", err)
+	}
+	t.Cleanup(tcpHandler.Stop)
+	return tcpHandler
+}
+
+func TestTcpHandlerAuthenticate(t *testing.T) {
+	tests := []struct {
+		name       string
+		authMode   string
+		digest     func(deviceId string) string
+		answer     func(deviceId string, nonce string) string
+		challenged bool
+		accepted   bool
+	}{
+		{
+			name:       "challenge",
+			answer:     func(deviceId string, nonce string) string { return ChallengeDigest("secret", nonce, deviceId) },
+			challenged: true,
+			accepted:   true,
+		},
+		{
+			name:       "wrong digest",
+			answer:     func(deviceId string, nonce string) string { return ChallengeDigest("wrong", nonce, deviceId) },
+			challenged: true,
+			accepted:   false,
+		},
+		{
+			name:       "answer of other device",
+			answer:     func(deviceId string, nonce string) string { return ChallengeDigest("secret", nonce, uuid.New().String()) },
+			challenged: true,
+			accepted:   false,
+		},
+		{
+			// the default mode is the challenge
+			name:       "static digest in default mode",
+			digest:     func(deviceId string) string { return DeviceDigest("secret", deviceId) },
+			challenged: false,
+			accepted:   false,
+		},
+		{
+			name:       "static digest in challenge mode",
+			authMode:   AuthModeChallenge,
+			digest:     func(deviceId string) string { return DeviceDigest("secret", deviceId) },
+			challenged: false,
+			accepted:   false,
+		},
+		{
+			name:       "static digest in migration mode",
+			authMode:   AuthModeMigration,
+			digest:     func(deviceId string) string { return DeviceDigest("secret", deviceId) },
+			challenged: false,
+			accepted:   true,
+		},
+		{
+			name:       "wrong static digest in migration mode",
+			authMode:   AuthModeMigration,
+			digest:     func(deviceId string) string { return DeviceDigest("wrong", deviceId) },
+			challenged: false,
+			accepted:   false,
+		},
+		{
+			name:       "challenge in migration mode",
+			authMode:   AuthModeMigration,
+			answer:     func(deviceId string, nonce string) string { return ChallengeDigest("secret", nonce, deviceId) },
+			challenged: true,
+			accepted:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var opts []TcpOption
+			if tt.authMode != "" {
+				opts = append(opts, TcpAuthMode(tt.authMode))
+			}
+			tcpHandler := newTestTcpHandler(t, opts...)
+			deviceId := uuid.New().String()
+			req := &message.GamepadHandshakeRequest{ Name: "gamepad", DeviceId: deviceId }
+			if tt.digest != nil {
+				req.Digest = tt.digest(deviceId)
+			}
+			gamepad := dialTestGamepad(t, tcpHandler)
+			res, nonce := gamepad.handshake(req, func(nonce string) string {
+				return tt.answer(deviceId, nonce)
+			})
+			if (nonce != "") != tt.challenged {
+				t.Fatalf("unexpected challenge: got %v, want %v", nonce != "", tt.challenged)
+			}
+			if res.MsgType != message.MsgTypeGamepadHandshakeRes {
+				t.Fatalf("unexpected message: got %v, want %v", res.MsgType, message.MsgTypeGamepadHandshakeRes)
+			}
+			if (res.Error == nil) != tt.accepted {
+				t.Fatalf("unexpected result: got %v, want accepted %v", res.Error, tt.accepted)
+			}
+		})
+	}
+}
+
+func TestTcpHandlerChallengeReplay(t *testing.T) {
+	tcpHandler := newTestTcpHandler(t)
+	deviceId := uuid.New().String()
+	req := &message.GamepadHandshakeRequest{ Name: "gamepad", DeviceId: deviceId }
+	first := dialTestGamepad(t, tcpHandler)
+	var recordedDigest string
+	res, recordedNonce := first.handshake(req, func(nonce string) string {
+		recordedDigest = ChallengeDigest("secret", nonce, deviceId)
+		return recordedDigest
+	})
+	if res.Error != nil {
+		t.Fatalf("can not handshake: %v", res.Error.Message)
+	}
+	first.conn.Close()
+	second := dialTestGamepad(t, tcpHandler)
+	res, nonce := second.handshake(req, func(nonce string) string { return recordedDigest })
+	if nonce == recordedNonce {
+		t.Fatalf("nonce is reused: %v", nonce)
+	}
+	if res.Error == nil {
+		t.Fatalf("replayed digest is accepted")
+	}
+}
+
+func TestTcpHandlerMigrationTakeover(t *testing.T) {
+	tcpHandler := newTestTcpHandler(t, TcpAuthMode(AuthModeMigration))
+	deviceId := uuid.New().String()
+	answer := func(nonce string) string { return ChallengeDigest("secret", nonce, deviceId) }
+	live := dialTestGamepad(t, tcpHandler)
+	res, _ := live.handshake(&message.GamepadHandshakeRequest{ Name: "gamepad", DeviceId: deviceId }, answer)
+	if res.Error != nil {
+		t.Fatalf("can not handshake: %v", res.Error.Message)
+	}
+	tests := []struct {
+		name     string
+		digest   string
+		accepted bool
+	}{
+		// the replayable static digest can not take over the live connection
+		{ name: "static digest", digest: DeviceDigest("secret", deviceId), accepted: false },
+		{ name: "challenge", digest: "", accepted: true },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gamepad := dialTestGamepad(t, tcpHandler)
+			res, _ := gamepad.handshake(&message.GamepadHandshakeRequest{ Name: "gamepad", DeviceId: deviceId, Digest: tt.digest }, answer)
+			if (res.Error == nil) != tt.accepted {
+				t.Fatalf("unexpected result: got %v, want accepted %v", res.Error, tt.accepted)
+			}
+		})
+	}
+	// the live connection is closed by the takeover
+	if msg := live.read(); msg != nil {
+		t.Fatalf("unexpected message to the connection taken over: %v", msg.MsgType)
+	}
+}
+
+func TestTcpHandlerReleasedSession(t *testing.T) {
+	tcpHandler := newTestTcpHandler(t)
+	deviceId := uuid.New().String()
+	gamepad := dialTestGamepad(t, tcpHandler)
+	res, _ := gamepad.handshake(&message.GamepadHandshakeRequest{ Name: "gamepad", DeviceId: deviceId }, func(nonce string) string {
+		return ChallengeDigest("secret", nonce, deviceId)
+	})
+	if res.Error != nil {
+		t.Fatalf("can not handshake: %v", res.Error.Message)
+	}
+	store := tcpHandler.clientsStore
+	for _, controllerId := range []string{ "c1", "c2" } {
+		if err := store.ReserveGamepad(deviceId, "d1", controllerId); err != nil {
+			t.Fatalf("can not reserve gamepad: %v", err)
+		}
+		store.ReleaseGamepad(deviceId, "d1", controllerId)
+		msg := gamepad.read()
+		if msg == nil || msg.MsgType != message.MsgTypeGamepadDisconnected {
+			t.Fatalf("released session is not notified: %v", msg)
+		}
+		if msg.GamepadDisconnected.ControllerId != controllerId || msg.GamepadDisconnected.GamepadId != deviceId {
+			t.Fatalf("unexpected gpDisconnected: got %+v, want controller %v", msg.GamepadDisconnected, controllerId)
+		}
+	}
+}
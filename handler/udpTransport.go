@@ -0,0 +1,204 @@
+package handler
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+	"github.com/potix/regapweb/message"
+)
+
+// the maximum size of udp datagrams
+const udpDatagramSize int = 65535
+
+type OnUdpMessage func(gamepadIds []string, msg *message.Message)
+
+// udpSession is the udp channel of one gamepad connection keyed by the token,
+// that is shared by gamepads emulated over the connection.
+type udpSession struct {
+	token      string
+	gamepadIds []string
+	// address of the gamepad learned from the latest valid datagram
+	addr       net.Addr
+	recvSeq    uint64
+	sendSeq    uint64
+	lastTouch  time.Time
+}
+
+// udpTransport exchanges gpState and gpVibration with gamepads over udp,
+// so that a lost packet does not delay following states.
+// Control messages are kept on the tcp connection.
+type udpTransport struct {
+	verbose   bool
+	addrPort  string
+	conn      net.PacketConn
+	mutex     sync.Mutex
+	sessions  map[string]*udpSession
+	onMessage OnUdpMessage
+	onTouch   func(gamepadId string)
+	wg        sync.WaitGroup
+}
+
+func (u *udpTransport) start(ctx context.Context) error {
+	conn, err := net.ListenPacket("udp", u.addrPort)
+	if err != nil {
+		return fmt.Errorf("can not listen udp: %w", err)
+	}
+	u.conn = conn
+	u.wg.Add(2)
+	go u.closeOnDone(ctx)
+	go u.readLoop()
+	return nil
+}
+
+func (u *udpTransport) stop() {
+	if u.conn == nil {
+		return
+	}
+	u.conn.Close()
+	u.wg.Wait()
+}
+
+func (u *udpTransport) closeOnDone(ctx context.Context) {
+	defer u.wg.Done()
+	<-ctx.Done()
+	u.conn.Close()
+}
+
+func (u *udpTransport) port() int {
+	addr, ok := u.conn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return 0
+	}
+	return addr.Port
+}
+
+func (u *udpTransport) newSession(gamepadIds []string) (string, error) {
+	tokenBytes := make([]byte, 16)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return "", fmt.Errorf("can not create udp token: %w", err)
+	}
+	token := hex.EncodeToString(tokenBytes)
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.sessions[token] = &udpSession{
+		token:      token,
+		gamepadIds: gamepadIds,
+	}
+	return token, nil
+}
+
+func (u *udpTransport) deleteSession(token string) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	delete(u.sessions, token)
+}
+
+// send writes the message to the gamepad,
+// and returns false if the address of the gamepad is not learned yet.
+func (u *udpTransport) send(token string, msg *message.Message) (bool, error) {
+	u.mutex.Lock()
+	session, ok := u.sessions[token]
+	if !ok || session.addr == nil {
+		u.mutex.Unlock()
+		return false, nil
+	}
+	session.sendSeq += 1
+	datagram := &message.UdpDatagram{
+		Token:   token,
+		Seq:     session.sendSeq,
+		Message: msg,
+	}
+	addr := session.addr
+	u.mutex.Unlock()
+	datagramBytes, err := json.Marshal(datagram)
+	if err != nil {
+		return true, fmt.Errorf("can not marshal to json for udp: %w", err)
+	}
+	if _, err := u.conn.WriteTo(datagramBytes, addr); err != nil {
+		return true, fmt.Errorf("can not write to udp: %w", err)
+	}
+	return true, nil
+}
+
+// accept verifies the token and the sequence number of the datagram, and learns the address of the gamepad.
+func (u *udpTransport) accept(datagram *message.UdpDatagram, addr net.Addr) (*udpSession, bool, error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	session, ok := u.sessions[datagram.Token]
+	if !ok {
+		return nil, false, fmt.Errorf("unknown udp token: addr = %v", addr)
+	}
+	if datagram.Seq <= session.recvSeq {
+		// duplicated or reordered datagram
+		return nil, false, nil
+	}
+	session.recvSeq = datagram.Seq
+	session.addr = addr
+	touch := false
+	if now := time.Now(); now.Sub(session.lastTouch) >= time.Second {
+		session.lastTouch = now
+		touch = true
+	}
+	return session, touch, nil
+}
+
+func (u *udpTransport) readLoop() {
+	defer u.wg.Done()
+	buf := make([]byte, udpDatagramSize)
+	for {
+		n, addr, err := u.conn.ReadFrom(buf)
+		if err != nil {
+			if u.verbose {
+				log.Printf("finish udp read loop: %v", err)
+			}
+			return
+		}
+		var datagram message.UdpDatagram
+		// anyone can send datagrams, they must not flood the log
+		if err := json.Unmarshal(buf[:n], &datagram); err != nil {
+			if u.verbose {
+				log.Printf("can not unmarshal udp datagram: %v", err)
+			}
+			continue
+		}
+		session, touch, err := u.accept(&datagram, addr)
+		if err != nil {
+			if u.verbose {
+				log.Printf("can not accept udp datagram: %v", err)
+			}
+			continue
+		}
+		if session == nil {
+			if u.verbose {
+				log.Printf("drop stale udp datagram: seq = %v", datagram.Seq)
+			}
+			continue
+		}
+		if touch {
+			for _, gamepadId := range session.gamepadIds {
+				u.onTouch(gamepadId)
+			}
+		}
+		if datagram.Message == nil || datagram.Message.MsgType == message.MsgTypePing {
+			// keep the address of the gamepad
+			continue
+		}
+		u.onMessage(session.gamepadIds, datagram.Message)
+	}
+}
+
+func newUdpTransport(addrPort string, onMessage OnUdpMessage, onTouch func(gamepadId string), verbose bool) *udpTransport {
+	return &udpTransport{
+		verbose:   verbose,
+		addrPort:  addrPort,
+		sessions:  make(map[string]*udpSession),
+		onMessage: onMessage,
+		onTouch:   onTouch,
+	}
+}
@@ -0,0 +1,125 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"github.com/potix/regapweb/message"
+)
+
+func TestUdpTransportAccept(t *testing.T) {
+	var receivedMutex sync.Mutex
+	received := make([]string, 0)
+	touched := make([]string, 0)
+	onMessage := func(gamepadIds []string, msg *message.Message) {
+		receivedMutex.Lock()
+		defer receivedMutex.Unlock()
+		received = append(received, strings.Join(gamepadIds, ",") + ":" + msg.GamepadVibration.ControllerId)
+	}
+	onTouch := func(gamepadId string) {
+		receivedMutex.Lock()
+		defer receivedMutex.Unlock()
+		touched = append(touched, gamepadId)
+	}
+	transport := newUdpTransport("127.0.0.1:0", onMessage, onTouch, false)
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := transport.start(ctx); err != nil {
+		cancel()
+		t.Fatalf("can not start udp transport: %v", err)
+	}
+	// the transport is stopped after the cancellation as the tcp handler does
+	defer func() {
+		cancel()
+		transport.stop()
+	}()
+	token, err := transport.newSession([]string{ "g1", "g2" })
+	if err != nil {
+		t.Fatalf("can not create udp session: %v", err)
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("can not listen udp: %v", err)
+	}
+	defer conn.Close()
+	writeDatagram := func(token string, seq uint64, label string) {
+		datagramBytes, err := json.Marshal(&message.UdpDatagram{
+			Token: token,
+			Seq:   seq,
+			Message: &message.Message{
+				MsgType:          message.MsgTypeGamepadVibration,
+				GamepadVibration: &message.GamepadVibration{ ControllerId: label, GamepadId: "g1" },
+			},
+		})
+		if err != nil {
+			t.Fatalf("can not marshal datagram: %v", err)
+		}
+		if _, err := conn.WriteTo(datagramBytes, transport.conn.LocalAddr()); err != nil {
+			t.Fatalf("can not write datagram: %v", err)
+		}
+	}
+	tests := []struct {
+		name      string
+		token     string
+		seq       uint64
+		delivered bool
+	}{
+		{ name: "unknown token", token: "unknown", seq: 1, delivered: false },
+		{ name: "valid", token: token, seq: 2, delivered: true },
+		{ name: "duplicated seq", token: token, seq: 2, delivered: false },
+		{ name: "stale seq", token: token, seq: 1, delivered: false },
+		{ name: "next seq", token: token, seq: 5, delivered: true },
+	}
+	want := make([]string, 0)
+	for _, tt := range tests {
+		writeDatagram(tt.token, tt.seq, tt.name)
+		if tt.delivered {
+			want = append(want, "g1,g2:" + tt.name)
+		}
+	}
+	// datagrams are read in order, the last one arrives after the others are handled
+	writeDatagram(token, 100, "last")
+	want = append(want, "g1,g2:last")
+	waitFor(t, "the last datagram", func() bool {
+		receivedMutex.Lock()
+		defer receivedMutex.Unlock()
+		return len(received) > 0 && received[len(received) - 1] == "g1,g2:last"
+	})
+	receivedMutex.Lock()
+	if strings.Join(received, " ") != strings.Join(want, " ") {
+		t.Fatalf("unexpected messages: got %v, want %v", received, want)
+	}
+	// the activity is recorded at most once a second
+	if strings.Join(touched, ",") != "g1,g2" {
+		t.Fatalf("unexpected touched gamepads: got %v, want %v", touched, []string{ "g1", "g2" })
+	}
+	receivedMutex.Unlock()
+
+	// the address of the gamepad is learned from valid datagrams
+	sent, err := transport.send(token, &message.Message{
+		MsgType:      message.MsgTypeGamepadState,
+		GamepadState: &message.GamepadState{ GamepadId: "g1" },
+	})
+	if !sent || err != nil {
+		t.Fatalf("can not send datagram: %v, %v", sent, err)
+	}
+	buf := make([]byte, udpDatagramSize)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("can not read datagram: %v", err)
+	}
+	var datagram message.UdpDatagram
+	if err := json.Unmarshal(buf[:n], &datagram); err != nil {
+		t.Fatalf("can not unmarshal datagram: %v", err)
+	}
+	if datagram.Token != token || datagram.Seq != 1 || datagram.Message.MsgType != message.MsgTypeGamepadState {
+		t.Fatalf("unexpected datagram: %+v", datagram)
+	}
+	if sent, _ := transport.send("unknown", datagram.Message); sent {
+		t.Fatalf("datagram is sent to unknown session")
+	}
+}
@@ -0,0 +1,105 @@
+package handler
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"time"
+	"github.com/gorilla/websocket"
+	"github.com/potix/regapweb/message"
+)
+
+// wsNetConn adapts the websocket of the gamepad device to the line protocol of the tcp handler.
+// Each websocket message is read as one line, and each written line is sent as one text message.
+// Read must not be called concurrently, writes and write deadlines are serialized.
+// Read returns message.ErrFrameTooLarge for the message larger than maxMessageSize
+// so that the tcp handler can respond the protocol error before closing.
+type wsNetConn struct {
+	conn           *websocket.Conn
+	maxMessageSize int
+	readBuf        []byte
+	writeMutex sync.Mutex
+	writeBuf   []byte
+}
+
+func (w *wsNetConn) Read(p []byte) (int, error) {
+	if len(w.readBuf) == 0 {
+		_, reader, err := w.conn.NextReader()
+		if err != nil {
+			return 0, err
+		}
+		// the rest of the larger message is not read, the connection is closed
+		data, err := io.ReadAll(io.LimitReader(reader, int64(w.maxMessageSize) + 1))
+		if err != nil {
+			return 0, err
+		}
+		if len(data) > w.maxMessageSize {
+			return 0, message.ErrFrameTooLarge
+		}
+		w.readBuf = append(data, '\n')
+	}
+	n := copy(p, w.readBuf)
+	w.readBuf = w.readBuf[n:]
+	return n, nil
+}
+
+func (w *wsNetConn) Write(p []byte) (int, error) {
+	w.writeMutex.Lock()
+	defer w.writeMutex.Unlock()
+	w.writeBuf = append(w.writeBuf, p...)
+	for {
+		idx := bytes.IndexByte(w.writeBuf, '\n')
+		if idx < 0 {
+			return len(p), nil
+		}
+		err := w.conn.WriteMessage(websocket.TextMessage, w.writeBuf[:idx])
+		w.writeBuf = w.writeBuf[idx + 1:]
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Close sends the close frame if possible, and closes the websocket.
+func (w *wsNetConn) Close() error {
+	closeMsg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	w.conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(time.Second))
+	return w.conn.Close()
+}
+
+func (w *wsNetConn) LocalAddr() net.Addr {
+	return w.conn.LocalAddr()
+}
+
+func (w *wsNetConn) RemoteAddr() net.Addr {
+	return w.conn.RemoteAddr()
+}
+
+func (w *wsNetConn) SetDeadline(t time.Time) error {
+	if err := w.conn.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return w.SetWriteDeadline(t)
+}
+
+func (w *wsNetConn) SetReadDeadline(t time.Time) error {
+	return w.conn.SetReadDeadline(t)
+}
+
+func (w *wsNetConn) SetWriteDeadline(t time.Time) error {
+	// interrupt the blocked write, the websocket applies its deadline on each write
+	if err := w.conn.UnderlyingConn().SetWriteDeadline(t); err != nil {
+		return err
+	}
+	w.writeMutex.Lock()
+	defer w.writeMutex.Unlock()
+	return w.conn.SetWriteDeadline(t)
+}
+
+func newWsNetConn(conn *websocket.Conn, maxMessageSize int) *wsNetConn {
+	return &wsNetConn{
+		conn:           conn,
+		maxMessageSize: maxMessageSize,
+	}
+}
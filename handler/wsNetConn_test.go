@@ -0,0 +1,102 @@
+package handler
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"github.com/gorilla/websocket"
+	"github.com/potix/regapweb/message"
+)
+
+func dialTestWebsocket(t *testing.T, handler func(conn *websocket.Conn)) *websocket.Conn {
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		handler(conn)
+	}))
+	t.Cleanup(server.Close)
+	conn, _, err := websocket.DefaultDialer.Dial("ws" + strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("can not dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestWsNetConnLines(t *testing.T) {
+	conn := dialTestWebsocket(t, func(conn *websocket.Conn) {
+		wsConn := newWsNetConn(conn, 64 * 1024)
+		defer wsConn.Close()
+		rbufio := bufio.NewReader(wsConn)
+		for {
+			line, err := rbufio.ReadString('\n')
+			if err != nil {
+				return
+			}
+			// the line written in parts is sent as one message
+			half := len(line) / 2
+			if _, err := wsConn.Write([]byte("echo " + line[:half])); err != nil {
+				return
+			}
+			if _, err := wsConn.Write([]byte(line[half:])); err != nil {
+				return
+			}
+		}
+	})
+	tests := []string{ `{"MsgType":"ping"}`, "", strings.Repeat("a", 8192) }
+	for _, msg := range tests {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatalf("can not write message: %v", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("can not read message: %v", err)
+		}
+		if string(data) != "echo " + msg {
+			t.Fatalf("unexpected message: got %.32q, want %.32q", data, "echo " + msg)
+		}
+	}
+}
+
+func TestServeWebsocketTooLargeFrame(t *testing.T) {
+	tcpHandler, err := NewTcpHandler("secret", NewMemoryClientsStore(), NewLocalForwarder(), TcpMaxFrameSize(64))
+	if err != nil {
+		t.Fatalf("can not create tcp handler: %v", err)
+	}
+	tests := []struct {
+		name string
+		size int
+	}{
+		{ name: "just over", size: 65 },
+		// the rest of the message is not read
+		{ name: "far over", size: 16 * 1024 },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := dialTestWebsocket(t, tcpHandler.ServeWebsocket)
+			if err := conn.WriteMessage(websocket.TextMessage, []byte(strings.Repeat("a", tt.size))); err != nil {
+				t.Fatalf("can not write message: %v", err)
+			}
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatalf("can not read protocol error: %v", err)
+			}
+			var msg message.Message
+			if err := json.Unmarshal(data, &msg); err != nil {
+				t.Fatalf("can not unmarshal message: %v", err)
+			}
+			if msg.MsgType != message.MsgTypeProtocolError {
+				t.Fatalf("unexpected message: %v", string(data))
+			}
+		})
+	}
+}
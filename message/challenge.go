@@ -0,0 +1,16 @@
+package message
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+)
+
+// ChallengeDigest returns the digest that the device answers to the challenge of the nonce.
+// The server and the device share it so that they can not disagree on the digest.
+func ChallengeDigest(secret string, nonce string, deviceId string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(nonce))
+	mac.Write([]byte(deviceId))
+	return fmt.Sprintf("%x", mac.Sum(nil))
+}
@@ -0,0 +1,67 @@
+package message
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// the size of the length prefix of the length framing
+const frameLengthSize int = 4
+
+// ErrFrameTooLarge is returned by reads of the frame larger than the max frame size.
+var ErrFrameTooLarge = errors.New("frame is too large")
+
+// ReadLineFrame reads the line without the newline, up to the max frame size.
+func ReadLineFrame(rbufio *bufio.Reader, maxFrameSize int) ([]byte, error) {
+	frame := make([]byte, 0, 2048)
+	for {
+		partialFrame, isPrefix, err := rbufio.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		if len(frame) + len(partialFrame) > maxFrameSize {
+			return nil, ErrFrameTooLarge
+		}
+		frame = append(frame, partialFrame...)
+		if !isPrefix {
+			return frame, nil
+		}
+	}
+}
+
+// ReadLengthFrame reads the length prefix and the frame, the frame is never buffered over the max frame size.
+func ReadLengthFrame(rbufio *bufio.Reader, maxFrameSize int) ([]byte, error) {
+	header := make([]byte, frameLengthSize)
+	if _, err := io.ReadFull(rbufio, header); err != nil {
+		return nil, err
+	}
+	frameSize := binary.BigEndian.Uint32(header)
+	if uint64(frameSize) > uint64(maxFrameSize) {
+		return nil, ErrFrameTooLarge
+	}
+	frame := make([]byte, frameSize)
+	if _, err := io.ReadFull(rbufio, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// ReadFrame reads the message in the framing negotiated in the handshake, the handshake itself is framed by lines.
+func ReadFrame(rbufio *bufio.Reader, framing string, maxFrameSize int) ([]byte, error) {
+	if framing == FramingLength {
+		return ReadLengthFrame(rbufio, maxFrameSize)
+	}
+	return ReadLineFrame(rbufio, maxFrameSize)
+}
+
+// EncodeFrame appends the newline or prepends the length prefix to the message.
+func EncodeFrame(msgBytes []byte, framing string) []byte {
+	if framing == FramingLength {
+		frame := make([]byte, frameLengthSize, frameLengthSize + len(msgBytes))
+		binary.BigEndian.PutUint32(frame, uint32(len(msgBytes)))
+		return append(frame, msgBytes...)
+	}
+	return append(msgBytes, byte('\n'))
+}
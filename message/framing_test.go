@@ -0,0 +1,94 @@
+package message
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestReadLineFrame(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		max     int
+		frame   string
+		err     error
+	}{
+		{ name: "line", input: "hello\n", max: 16, frame: "hello" },
+		{ name: "max size", input: "0123456789\n", max: 10, frame: "0123456789" },
+		{ name: "too large", input: "0123456789a\n", max: 10, err: ErrFrameTooLarge },
+		// the line longer than the buffer of the reader is read in parts
+		{ name: "too large in parts", input: strings.Repeat("a", 64) + "\n", max: 40, err: ErrFrameTooLarge },
+		{ name: "long line", input: strings.Repeat("a", 64) + "\n", max: 64, frame: strings.Repeat("a", 64) },
+		{ name: "empty", input: "", max: 16, err: io.EOF },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rbufio := bufio.NewReaderSize(strings.NewReader(tt.input), 16)
+			frame, err := ReadLineFrame(rbufio, tt.max)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("unexpected error: got %v, want %v", err, tt.err)
+			}
+			if string(frame) != tt.frame {
+				t.Fatalf("unexpected frame: got %q, want %q", frame, tt.frame)
+			}
+		})
+	}
+}
+
+func TestReadLengthFrame(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+		max   int
+		frame string
+		err   error
+	}{
+		{ name: "frame", input: EncodeFrame([]byte("hello"), FramingLength), max: 16, frame: "hello" },
+		{ name: "empty frame", input: []byte{ 0, 0, 0, 0 }, max: 16, frame: "" },
+		{ name: "max size", input: EncodeFrame([]byte("0123456789"), FramingLength), max: 10, frame: "0123456789" },
+		{ name: "too large", input: EncodeFrame([]byte("0123456789a"), FramingLength), max: 10, err: ErrFrameTooLarge },
+		// the length is checked before the frame is buffered
+		{ name: "too large header", input: []byte{ 0xff, 0xff, 0xff, 0xff }, max: 10, err: ErrFrameTooLarge },
+		{ name: "truncated header", input: []byte{ 0, 0 }, max: 16, err: io.ErrUnexpectedEOF },
+		{ name: "no header", input: []byte{}, max: 16, err: io.EOF },
+		{ name: "truncated frame", input: []byte{ 0, 0, 0, 5, 'h', 'e' }, max: 16, err: io.ErrUnexpectedEOF },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rbufio := bufio.NewReader(bytes.NewReader(tt.input))
+			frame, err := ReadLengthFrame(rbufio, tt.max)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("unexpected error: got %v, want %v", err, tt.err)
+			}
+			if string(frame) != tt.frame {
+				t.Fatalf("unexpected frame: got %q, want %q", frame, tt.frame)
+			}
+		})
+	}
+}
+
+func TestReadFrameRoundTrip(t *testing.T) {
+	for _, framing := range []string{ FramingLine, FramingLength } {
+		t.Run(framing, func(t *testing.T) {
+			var buf bytes.Buffer
+			msgs := []string{ `{"MsgType":"ping"}`, `{"MsgType":"pong"}` }
+			for _, msg := range msgs {
+				buf.Write(EncodeFrame([]byte(msg), framing))
+			}
+			rbufio := bufio.NewReader(&buf)
+			for _, msg := range msgs {
+				frame, err := ReadFrame(rbufio, framing, 1024)
+				if err != nil {
+					t.Fatalf("can not read frame: %v", err)
+				}
+				if string(frame) != msg {
+					t.Fatalf("unexpected frame: got %q, want %q", frame, msg)
+				}
+			}
+		})
+	}
+}
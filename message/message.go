@@ -4,21 +4,35 @@ const (
 	MsgTypePing                   string = "ping"              // client     <------> server (periodic 10 sec)
 	MsgTypeRegisterReq                   = "registerReq"       // client      ------> server
 	MsgTypeRegisterRes                   = "registerRes"       // client      ------> server
-	MsgTypeLookupReq                     = "lookupReq"         // deliverer   ------> server (periodic 3 sec)
-	MsgTypeLookupRes                     = "lookupRes"         // deliverer  <------  server
+	MsgTypeLookupReq                     = "lookupReq"         // client      ------> server (periodic 30 sec with presence capability, otherwise 3 sec)
+	MsgTypeLookupRes                     = "lookupRes"         // client     <------  server
+	MsgTypePresence                      = "presence"          // client     <------  server (only client with presence capability)
 	MsgTypeSignalingOfferSdpReq          = "sigOfferSdpReq"    // deliverer   ------> server  ------> controller
 	MsgTypeSignalingOfferSdpRes          = "sigOfferSdpRes"    // deliverer  <------  server <------  controller
 	MsgTypeSignalingOfferSdpServerError  = "sigOfferSdpSrvErr" // deliverer  <------  server ------>  controller
 	MsgTypeSignalingAnswerSdpReq         = "sigAnswerSdpReq"    // deliverer  <------  server <------  controller
 	MsgTypeSignalingAnswerSdpRes         = "sigAnswerSdpRes"    // deliverer   ------> server  ------> controller
 	MsgTypeSignalingAnswerSdpServerError = "sigAnswerSdpSrvErr" // deliverer  <------  server  ------> controller
+	MsgTypeJoinReq                       = "joinReq"           // controller  ------> server  ------> deliverer
+	MsgTypeJoinRes                       = "joinRes"           // controller <------  server <------  deliverer
+	MsgTypeJoinServerError               = "joinSrvErr"        // controller <------  server ------>  deliverer
+	MsgTypeInviteReq                     = "inviteReq"         // deliverer   ------> server
+	MsgTypeInviteRes                     = "inviteRes"         // deliverer  <------  server
 	MsgTypeGamepadHandshakeReq           = "gpHandshakeReq"    // gamepad     ------> server
 	MsgTypeGamepadHandshakeRes           = "gpHandshakeRes"    // gamepad    <------> server
+	MsgTypeGamepadChallengeReq           = "gpChallengeReq"    // gamepad    <------  server (if gpHandshakeReq has no digest)
+	MsgTypeGamepadChallengeRes           = "gpChallengeRes"    // gamepad     ------> server
 	MsgTypeGamepadConnectReq             = "gpConnectReq"      // controller  ------> server  ------> gamepad
 	MsgTypeGamepadConnectRes             = "gpConnectRes"      // controller <------  server <------  gamepad
 	MsgTypeGamepadConnectServerError     = "gpConnectSrvErr"   // controller <------  server ------>  gamepad
 	MsgTypeGamepadState                  = "gpState"           // controller  ------> server  ------> gamepad (perodic 1000 / 60 msec)
 	MsgTypeGamepadVibration              = "gpVibration"       // controller <------  server <------  gamepad
+	MsgTypeGamepadDisconnected           = "gpDisconnected"    // controller <------  server <------  gamepad (after the connection of the bound gamepad is lost)
+	                                                           //                     server  ------> gamepad (after the session bound to the gamepad is released)
+	MsgTypeGamepadDeviceStatus           = "gpDeviceStatus"    // controller <------  server <------  gamepad (periodic from gamepad, only changes to controller)
+	MsgTypeShutdown                      = "shutdown"          // gamepad    <------  server (before closing the connection on shutdown)
+	MsgTypeGamepadRevoked                = "gpRevoked"         // gamepad    <------  server (before closing the connection of the revoked device)
+	MsgTypeProtocolError                 = "protocolError"     // gamepad    <------  server (before closing the connection on the protocol violation)
 	// TODO
 	// MsgTypeUpdateClientReq // name change
 	// MsgTypeUpdateClientRes // name change
@@ -31,27 +45,105 @@ const (
 	ClientTypeGamepad           = "gamepad"
 )
 
+const (
+	GamepadStatusAvailable string = "available"
+	GamepadStatusReserved         = "reserved"
+	GamepadStatusBusy             = "busy"
+)
+
+const (
+	CapabilityPresence string = "presence"
+)
+
+const (
+	DefaultRoom string = "default"
+)
+
+const (
+	// json followed by the newline
+	FramingLine   string = "line"
+	// 4 bytes big endian length followed by the json
+	FramingLength        = "length"
+)
+
+const (
+	HostLinkUp   string = "up"
+	HostLinkDown        = "down"
+)
+
+const (
+	ControllerTypeStandard   string = "standard"
+	ControllerTypeXbox360           = "xbox360"
+	ControllerTypeDualShock4        = "dualshock4"
+	ControllerTypeSwitchPro         = "switchPro"
+)
+
+const (
+	PresenceEventAdd    string = "add"
+	PresenceEventUpdate        = "update"
+	PresenceEventDelete        = "delete"
+)
+
 type Error struct {
 	Message string
 }
 
 type RegisterRequest struct {
-	ClientName string
+	ClientName   string
+	ResumeToken  string
+	Capabilities []string
+	Room         string
 }
 
 type RegisterResponse struct {
-	ClientType string
-	ClientId   string
+	ClientType  string
+	ClientId    string
+	ResumeToken string
+	Room        string
 }
 
 type LookupResponse struct {
+	Deliverers  []*NameAndId
 	Controllers []*NameAndId
-	Gamepads []*NameAndId
+	Gamepads []*GamepadInfo
+}
+
+type ClientMetadata struct {
+	ConnectedAt  int64
+	LastActivity int64
+	RemoteAddr   string
+	Account      string
+	UserAgent    string // deliverer and controller
+	Firmware     string // gamepad
+	Capabilities []string
+	Gamepad      *GamepadCapabilities `json:"Gamepad,omitempty"` // gamepad
+	DeviceStatus *GamepadDeviceStatus `json:"DeviceStatus,omitempty"` // gamepad
 }
 
 type NameAndId struct {
-	Name string
-	Id  string
+	Name     string
+	Id       string
+	Room     string
+	Metadata *ClientMetadata `json:"Metadata,omitempty"`
+}
+
+type GamepadInfo struct {
+	Name         string
+	Id           string
+	Room         string
+	Status       string
+	DelivererId  string
+	ControllerId string
+	Metadata     *ClientMetadata `json:"Metadata,omitempty"`
+}
+
+type PresenceEvent struct {
+	Event      string
+	ClientType string
+	// deliverer or controller
+	Client     *NameAndId   `json:"Client,omitempty"`
+	// gamepad
+	Gamepad    *GamepadInfo `json:"Gamepad,omitempty"`
 }
 
 type SignalingSdpRequest struct {
@@ -68,13 +160,91 @@ type SignalingSdpResponse struct {
 	GamepadId    string
 }
 
+type JoinRequest struct {
+	ControllerName string
+	DelivererId    string
+	ControllerId   string
+	GamepadId      string
+}
+
+type JoinResponse struct {
+	DelivererId  string
+	ControllerId string
+	// false if the deliverer rejects the join request
+	Accepted     bool
+}
+
+type InviteRequest struct {
+	DelivererId string
+}
+
+type InviteResponse struct {
+	DelivererId string
+	Token       string
+	Path        string
+	ExpiresAt   int64
+}
+
 type GamepadHandshakeRequest struct {
-	Name string
-	Digest string
+	Name                string
+	// persistent uuid of the device
+	DeviceId            string
+	// static digest of the legacy handshake, empty to authenticate by the challenge
+	Digest              string
+	// one-time code to enroll the device instead of the authentication
+	PairingCode         string `json:"PairingCode,omitempty"`
+	// nil if the device does not declare, states are forwarded as they are
+	GamepadCapabilities *GamepadCapabilities `json:"GamepadCapabilities,omitempty"`
+	// true if the device can exchange gpState and gpVibration over udp
+	Udp                 bool   `json:"Udp,omitempty"`
+	// framing after the handshake, the handshake itself is always framed by lines
+	Framing             string `json:"Framing,omitempty"`
+	// gamepads emulated over the connection, empty for the single gamepad of Name and GamepadCapabilities
+	VirtualGamepads     []*VirtualGamepad `json:"VirtualGamepads,omitempty"`
+	Room                string
+	Firmware            string
+	Capabilities        []string
+}
+
+// VirtualGamepad is one of gamepads that the device emulates over one connection.
+type VirtualGamepad struct {
+	// name of the device with the index is used if empty
+	Name                string
+	GamepadCapabilities *GamepadCapabilities `json:"GamepadCapabilities,omitempty"`
+}
+
+// GamepadCapabilities is what the gamepad device can emulate.
+// Buttons and axes of states beyond them are dropped, values are clamped to their ranges.
+type GamepadCapabilities struct {
+	ControllerType string
+	Buttons        int
+	Axes           int
+	Rumble         bool
 }
 
 type GamepadHandshakeResponse struct {
-	GamepadId string
+	// id of the first gamepad
+	GamepadId    string
+	// ids of virtual gamepads in the requested order
+	GamepadIds   []string `json:"GamepadIds,omitempty"`
+	Room         string
+	// secret of the device issued by the enrollment, the device answers challenges with it
+	Credential   string `json:"Credential,omitempty"`
+	// port and session token of the udp channel, empty if udp is not negotiated
+	UdpPort      int    `json:"UdpPort,omitempty"`
+	UdpToken     string `json:"UdpToken,omitempty"`
+	// framing that both sides switch to after this response, empty is the line
+	Framing      string `json:"Framing,omitempty"`
+	MaxFrameSize int    `json:"MaxFrameSize,omitempty"`
+}
+
+type GamepadChallengeRequest struct {
+	Nonce string
+}
+
+type GamepadChallengeResponse struct {
+	// hmac of the nonce and the device id
+	Digest string
 }
 
 type GamepadConnectRequest struct {
@@ -113,21 +283,136 @@ type GamepadVibration struct {
         WeakMagnitude   float64
 }
 
+// GamepadDeviceStatus is the telemetry of the gamepad device.
+// Ids are filled by the server.
+type GamepadDeviceStatus struct {
+	DelivererId   string
+	ControllerId  string
+	GamepadId     string
+	// link to the host that the device emulates the gamepad for
+	HostLink      string
+	// emulated device type such as xbox360
+	DeviceType    string
+	// celsius
+	Temperature   float64
+	Firmware      string
+	// error counts by kind
+	ErrorCounters map[string]uint64 `json:"ErrorCounters,omitempty"`
+	UpdatedAt     int64
+}
+
+type GamepadDisconnected struct {
+	DelivererId  string
+	ControllerId string
+	GamepadId    string
+}
+
+// UdpDatagram carries gpState to the gamepad and ping or gpVibration from the gamepad.
+// Datagrams whose sequence number is not greater than the last one received are dropped.
+type UdpDatagram struct {
+	Token   string
+	Seq     uint64
+	Message *Message
+}
+
 type Message struct {
 	MsgType                  string
 	Error                    *Error                    `json:"Error,omitempty"`
 	RegisterRequest          *RegisterRequest          `json:"RegisterRequest,omitempty"`
 	RegisterResponse         *RegisterResponse         `json:"RegisterResponse,omitempty"`
 	LookupResponse           *LookupResponse           `json:"LookupResponse,omitempty"`
+	PresenceEvent            *PresenceEvent            `json:"PresenceEvent,omitempty"`
 	SignalingSdpRequest      *SignalingSdpRequest      `json:"SignalingSdpRequest,omitempty"`
 	SignalingSdpResponse     *SignalingSdpResponse     `json:"SignalingSdpResponse,omitempty"`
+	JoinRequest              *JoinRequest              `json:"JoinRequest,omitempty"`
+	JoinResponse             *JoinResponse             `json:"JoinResponse,omitempty"`
+	InviteRequest            *InviteRequest            `json:"InviteRequest,omitempty"`
+	InviteResponse           *InviteResponse           `json:"InviteResponse,omitempty"`
 	GamepadHandshakeRequest  *GamepadHandshakeRequest  `json:"GamepadHandshakeRequest,omitempty"`
 	GamepadHandshakeResponse *GamepadHandshakeResponse `json:"GamepadHandshakeResponse,omitempty"`
+	GamepadChallengeRequest  *GamepadChallengeRequest  `json:"GamepadChallengeRequest,omitempty"`
+	GamepadChallengeResponse *GamepadChallengeResponse `json:"GamepadChallengeResponse,omitempty"`
 	GamepadConnectRequest    *GamepadConnectRequest    `json:"GamepadConnectRequest,omitempty"`
 	GamepadConnectResponse   *GamepadConnectResponse   `json:"GamepadConnectResponse,omitempty"`
 	GamepadState             *GamepadState             `json:"GamepadState,omitempty"`
 	GamepadVibration         *GamepadVibration         `json:"GamepadVibration,omitempty"`
+	GamepadDisconnected      *GamepadDisconnected      `json:"GamepadDisconnected,omitempty"`
+	GamepadDeviceStatus      *GamepadDeviceStatus      `json:"GamepadDeviceStatus,omitempty"`
+}
+
+const (
+	ClusterKindHello     string = "hello"
+	ClusterKindPresence         = "presence"
+	ClusterKindSignaling        = "signaling"
+	ClusterKindFromWs           = "fromWs"
+	ClusterKindFromTcp          = "fromTcp"
+	ClusterKindStoreReq         = "storeReq"
+	ClusterKindStoreRes         = "storeRes"
+)
+
+const (
+	ClusterStoreOpReserve         string = "reserve"
+	ClusterStoreOpOccupy                 = "occupy"
+	ClusterStoreOpRelease                = "release"
+	ClusterStoreOpReleaseByClient        = "releaseByClient"
+)
+
+// ClusterHello is the challenge response of nodes, nonces are exchanged so that it can not be replayed.
+type ClusterHello struct {
+	NodeId string
+	Nonce  string `json:"Nonce,omitempty"`
+	Digest string `json:"Digest,omitempty"`
 }
 
+type ClusterPresence struct {
+	Deliverers  []*NameAndId
+	Controllers []*NameAndId
+	Gamepads    []*GamepadInfo
+}
 
+type ClusterStoreRequest struct {
+	Op           string
+	ClientId     string
+	GamepadId    string
+	DelivererId  string
+	ControllerId string
+}
+
+// ClusterMessage is exchanged between regapweb nodes
+type ClusterMessage struct {
+	Kind           string
+	FromNodeId     string
+	ToNodeId       string
+	RequestId      string
+	TargetClientId string
+	SourceClientId string
+	Error          *Error               `json:"Error,omitempty"`
+	Hello          *ClusterHello        `json:"Hello,omitempty"`
+	Presence       *ClusterPresence     `json:"Presence,omitempty"`
+	StoreRequest   *ClusterStoreRequest `json:"StoreRequest,omitempty"`
+	Message        *Message             `json:"Message,omitempty"`
+}
+
+const (
+	LinkKindHello string = "hello"
+	LinkKindToTcp        = "toTcp"
+	LinkKindToWs         = "toWs"
+	LinkKindError        = "error"
+	LinkKindForget       = "forget"
+)
 
+type LinkHello struct {
+	Nonce  string `json:"Nonce,omitempty"`
+	Digest string `json:"Digest,omitempty"`
+}
+
+// LinkMessage is exchanged between forwarders of regapweb processes.
+type LinkMessage struct {
+	Kind    string
+	Id      string    `json:"Id,omitempty"`
+	Hello   *LinkHello `json:"Hello,omitempty"`
+	Error   *Error    `json:"Error,omitempty"`
+	Message *Message  `json:"Message,omitempty"`
+	// only forget
+	GamepadId string  `json:"GamepadId,omitempty"`
+}
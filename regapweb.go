@@ -1,6 +1,7 @@
 package main
 
 import (
+        "context"
         "encoding/json"
         "flag"
         "github.com/potix/utils/signal"
@@ -9,6 +10,7 @@ import (
         "github.com/potix/regapweb/handler"
         "log"
         "log/syslog"
+        "time"
 )
 
 type regapwebHttpServerConfig struct {
@@ -16,23 +18,75 @@ type regapwebHttpServerConfig struct {
         AddrPort    string `toml:"addrPort"`
         TlsCertPath string `toml:"tlsCertPath"`
         TlsKeyPath  string `toml:"tlsKeyPath"`
-	SkipVerify  bool   `toml:"skipVerify`
+	SkipVerify  bool   `toml:"skipVerify"`
 }
 
 type regapwebHttpHandlerConfig struct {
-        ResourcePath string `toml:"resourcePath"`
-        Accounts     map[string]string `toml:"accounts"`
+        ResourcePath      string            `toml:"resourcePath"`
+        Accounts          map[string]string `toml:"accounts"`
+        ResumeGracePeriod int               `toml:"resumeGracePeriod"`
+        InviteSecret      string            `toml:"inviteSecret"`
+        InviteTtl         int               `toml:"inviteTtl"`
+        Rooms             map[string][]string `toml:"rooms"`
+        DeviceAdmins      []string          `toml:"deviceAdmins"`
+        DeviceWebsocket   bool              `toml:"deviceWebsocket"`
+        // seconds, used with pingMaxMissed, 0 of pingMaxMissed disables the dead peer detection
+        PingInterval      int               `toml:"pingInterval"`
+        PingMaxMissed     int               `toml:"pingMaxMissed"`
 }
 
 type regapwebTcpServerConfig struct {
         AddrPort    string `toml:"addrPort"`
         TlsCertPath string `toml:"tlsCertPath"`
         TlsKeyPath  string `toml:"tlsKeyPath"`
-	SkipVerify  bool   `toml:"skipVerify`
+	SkipVerify  bool   `toml:"skipVerify"`
 }
 
 type regapwebTcpHandlerConfig struct {
-        Secret string `toml:"secret"`
+        Secret              string            `toml:"secret"`
+        DuplicateDevice     string            `toml:"duplicateDevice"`
+        RoomSecrets         map[string]string `toml:"roomSecrets"`
+        AuthMode            string            `toml:"authMode"`
+        MutualTlsCertPath   string            `toml:"mutualTlsCertPath"`
+        MutualTlsKeyPath    string            `toml:"mutualTlsKeyPath"`
+        MutualTlsCaPath     string            `toml:"mutualTlsCaPath"`
+        MutualTlsCrlPath    string            `toml:"mutualTlsCrlPath"`
+        MutualTlsSkipDigest bool              `toml:"mutualTlsSkipDigest"`
+        UdpAddrPort         string            `toml:"udpAddrPort"`
+        // seconds, used with pingMaxMissed, 0 of pingMaxMissed disables the dead peer detection
+        PingInterval        int               `toml:"pingInterval"`
+        PingMaxMissed       int               `toml:"pingMaxMissed"`
+        // bytes, 0 uses the default
+        MaxFrameSize        int               `toml:"maxFrameSize"`
+}
+
+type regapwebForwarderConfig struct {
+        QueueSize int    `toml:"queueSize"`
+        Type      string `toml:"type"`
+        Network   string `toml:"network"`
+        Address   string `toml:"address"`
+        Listen    bool   `toml:"listen"`
+        Secret    string `toml:"secret"`
+}
+
+type regapwebClientsStoreConfig struct {
+        Type         string `toml:"type"`
+        DbPath       string `toml:"dbPath"`
+        HistoryLimit int    `toml:"historyLimit"`
+}
+
+type regapwebDeviceRegistryConfig struct {
+        Type       string `toml:"type"`
+        DbPath     string `toml:"dbPath"`
+        PairingTtl int    `toml:"pairingTtl"`
+}
+
+type regapwebClusterConfig struct {
+        NodeId           string            `toml:"nodeId"`
+        AddrPort         string            `toml:"addrPort"`
+        Secret           string            `toml:"secret"`
+        Peers            map[string]string `toml:"peers"`
+        PresenceInterval int               `toml:"presenceInterval"`
 }
 
 type regapwebLogConfig struct {
@@ -45,6 +99,10 @@ type regapwebConfig struct {
         HttpHandler *regapwebHttpHandlerConfig `toml:"httpHandler"`
         TcpServer   *regapwebTcpServerConfig   `toml:"tcpServer"`
         TcpHandler  *regapwebTcpHandlerConfig  `toml:"tcpHandler"`
+        Forwarder   *regapwebForwarderConfig   `toml:"forwarder"`
+        ClientsStore *regapwebClientsStoreConfig `toml:"clientsStore"`
+        DeviceRegistry *regapwebDeviceRegistryConfig `toml:"deviceRegistry"`
+        Cluster     *regapwebClusterConfig     `toml:"cluster"`
         Log         *regapwebLogConfig         `toml:"log"`
 }
 
@@ -77,7 +135,10 @@ func main() {
         if err != nil {
                 log.Fatalf("can not load config: %v", err)
         }
-        if conf.HttpServer == nil || conf.HttpHandler == nil || conf.TcpServer == nil || conf.TcpHandler == nil {
+	// web and device servers can run as separate processes linked by the forwarder
+	runHttp := conf.HttpServer != nil && conf.HttpHandler != nil
+	runTcp := conf.TcpServer != nil && conf.TcpHandler != nil
+        if !runHttp && !runTcp {
                 log.Fatalf("invalid config")
         }
         if conf.Log != nil && conf.Log.UseSyslog {
@@ -88,77 +149,292 @@ func main() {
                 log.SetOutput(logger)
         }
         verboseLoadedConfig(&conf)
+	// handlers and the forwarder finish connections when the context is canceled
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	// setup clinets store
 	csVerbose := handler.ClientsStoreVerbose(conf.Verbose)
-	newClientsStore := handler.NewClientsStore(csVerbose)
+	var newClientsStore handler.ClientsStore
+	var newClientsHistory handler.ClientsHistory
+	if conf.ClientsStore != nil && conf.ClientsStore.Type == "bolt" {
+		var csHistoryLimitOpt handler.ClientsStoreOption
+		if conf.ClientsStore.HistoryLimit > 0 {
+			csHistoryLimitOpt = handler.ClientsStoreHistoryLimit(conf.ClientsStore.HistoryLimit)
+		}
+		newBoltClientsStore, err := handler.NewBoltClientsStore(
+			conf.ClientsStore.DbPath,
+			csVerbose,
+			csHistoryLimitOpt,
+		)
+		if err != nil {
+			log.Fatalf("can not create bolt clients store: %v", err)
+		}
+		newClientsStore = newBoltClientsStore
+		newClientsHistory = newBoltClientsStore
+	} else {
+		newClientsStore = handler.NewMemoryClientsStore(csVerbose)
+	}
+	defer newClientsStore.Close()
+	// setup device registry
+	var newDeviceRegistry handler.DeviceRegistry
+	if conf.DeviceRegistry != nil {
+		drVerboseOpt := handler.DeviceRegistryVerbose(conf.Verbose)
+		var drPairingTtlOpt handler.DeviceRegistryOption
+		if conf.DeviceRegistry.PairingTtl > 0 {
+			drPairingTtlOpt = handler.DeviceRegistryPairingTtl(time.Duration(conf.DeviceRegistry.PairingTtl) * time.Second)
+		}
+		if conf.DeviceRegistry.Type == "bolt" {
+			newBoltDeviceRegistry, err := handler.NewBoltDeviceRegistry(
+				conf.DeviceRegistry.DbPath,
+				drVerboseOpt,
+				drPairingTtlOpt,
+			)
+			if err != nil {
+				log.Fatalf("can not create bolt device registry: %v", err)
+			}
+			newDeviceRegistry = newBoltDeviceRegistry
+		} else {
+			newDeviceRegistry = handler.NewMemoryDeviceRegistry(drVerboseOpt, drPairingTtlOpt)
+		}
+		defer newDeviceRegistry.Close()
+	}
+	// setup cluster
+	var newCluster *handler.Cluster
+	if conf.Cluster != nil {
+		cbVerboseOpt := handler.TcpClusterBusVerbose(conf.Verbose)
+		newClusterBus, err := handler.NewTcpClusterBus(
+			conf.Cluster.NodeId,
+			conf.Cluster.AddrPort,
+			conf.Cluster.Secret,
+			conf.Cluster.Peers,
+			cbVerboseOpt,
+		)
+		if err != nil {
+			log.Fatalf("can not create cluster bus: %v", err)
+		}
+		clVerboseOpt := handler.ClusterVerbose(conf.Verbose)
+		var clPresenceIntervalOpt handler.ClusterOption
+		if conf.Cluster.PresenceInterval > 0 {
+			clPresenceIntervalOpt = handler.ClusterPresenceInterval(time.Duration(conf.Cluster.PresenceInterval) * time.Second)
+		}
+		newCluster, err = handler.NewCluster(
+			conf.Cluster.NodeId,
+			newClusterBus,
+			newClientsStore,
+			clVerboseOpt,
+			clPresenceIntervalOpt,
+		)
+		if err != nil {
+			log.Fatalf("can not create cluster: %v", err)
+		}
+		newClientsStore = newCluster.ClientsStore()
+	}
 	// setup forwarder
 	fVerboseOpt := handler.ForwarderVerbose(conf.Verbose)
-	newForwarder := handler.NewForwarder(fVerboseOpt)
-	// setup tcp handler
-	thVerboseOpt := handler.TcpVerbose(conf.Verbose)
-	newTcpHandler, err := handler.NewTcpHandler(
-                conf.TcpHandler.Secret,
-		newClientsStore,
-		newForwarder,
-                thVerboseOpt,
-        )
-        if err != nil {
-                log.Fatalf("can not create tcp handler: %v", err)
-        }
-	// setup tcp server
-        tsVerboseOpt := server.TcpServerVerbose(conf.Verbose)
-        tsTlsOpt := server.TcpServerTls(conf.TcpServer.TlsCertPath, conf.TcpServer.TlsKeyPath)
-        tsSkipVerifyOpt := server.TcpServerSkipVerify(conf.TcpServer.SkipVerify)
-        newTcpServer, err := server.NewTcpServer(
-                conf.TcpServer.AddrPort,
-                newTcpHandler,
-                tsTlsOpt,
-		tsSkipVerifyOpt,
-                tsVerboseOpt,
-        )
-        if err != nil {
-                log.Fatalf("can not create tcp server: %v", err)
-        }
-	// setup http handler
-	hhVerboseOpt := handler.HttpVerbose(conf.Verbose)
-	newHttpHandler, err := handler.NewHttpHandler(
-                conf.HttpHandler.ResourcePath,
-                conf.HttpHandler.Accounts,
-		newClientsStore,
-		newForwarder,
-                hhVerboseOpt,
-        )
-        if err != nil {
-                log.Fatalf("can not create http handler: %v", err)
-        }
-	// setup http server
-        hsVerboseOpt := server.HttpServerVerbose(conf.Verbose)
-        hsTlsOpt := server.HttpServerTls(conf.HttpServer.TlsCertPath, conf.HttpServer.TlsKeyPath)
-        hsSkipVerifyOpt := server.HttpServerSkipVerify(conf.HttpServer.SkipVerify)
-        hsModeOpt := server.HttpServerMode(conf.HttpServer.Mode)
-        newHttpServer, err := server.NewHttpServer(
-                conf.HttpServer.AddrPort,
-                newHttpHandler,
-                hsTlsOpt,
-		hsSkipVerifyOpt,
-                hsModeOpt,
-                hsVerboseOpt,
-        )
-        if err != nil {
-                log.Fatalf("can not create http server: %v", err)
-        }
-        err = newTcpServer.Start()
-        if err != nil {
-                log.Fatalf("can not start tcp server: %v", err)
-        }
-        err = newHttpServer.Start()
-        if err != nil {
-                log.Fatalf("can not start http server: %v", err)
-        }
-	newForwarder.Start()
-        signal.SignalWait(nil)
+	var fQueueSizeOpt handler.ForwarderOption
+	if conf.Forwarder != nil && conf.Forwarder.QueueSize > 0 {
+		fQueueSizeOpt = handler.ForwarderQueueSize(conf.Forwarder.QueueSize)
+	}
+	newLocalForwarder := handler.NewLocalForwarder(fVerboseOpt, fQueueSizeOpt)
+	var newForwarder handler.Forwarder = newLocalForwarder
+	if conf.Forwarder != nil && conf.Forwarder.Type == "link" {
+		lfVerboseOpt := handler.LinkForwarderVerbose(conf.Verbose)
+		newLinkForwarder, err := handler.NewLinkForwarder(
+			conf.Forwarder.Network,
+			conf.Forwarder.Address,
+			conf.Forwarder.Listen,
+			conf.Forwarder.Secret,
+			newLocalForwarder,
+			lfVerboseOpt,
+		)
+		if err != nil {
+			log.Fatalf("can not create link forwarder: %v", err)
+		}
+		newForwarder = newLinkForwarder
+	}
+	var newTcpHandler *handler.TcpHandler
+	var newTcpServer *server.TcpServer
+	if runTcp {
+		// setup tcp handler
+		thVerboseOpt := handler.TcpVerbose(conf.Verbose)
+		thClusterOpt := handler.TcpCluster(newCluster)
+		var thDuplicateDeviceOpt handler.TcpOption
+		if conf.TcpHandler.DuplicateDevice != "" {
+			thDuplicateDeviceOpt = handler.TcpDuplicateDevice(conf.TcpHandler.DuplicateDevice)
+		}
+		thRoomSecretsOpt := handler.TcpRoomSecrets(conf.TcpHandler.RoomSecrets)
+		thContextOpt := handler.TcpContext(ctx)
+		var thDeviceRegistryOpt handler.TcpOption
+		if newDeviceRegistry != nil {
+			thDeviceRegistryOpt = handler.TcpDeviceRegistry(newDeviceRegistry)
+		}
+		var thAuthModeOpt handler.TcpOption
+		if conf.TcpHandler.AuthMode != "" {
+			thAuthModeOpt = handler.TcpAuthMode(conf.TcpHandler.AuthMode)
+		}
+		var thMutualTlsOpt handler.TcpOption
+		if conf.TcpHandler.MutualTlsCertPath != "" {
+			if conf.TcpServer.TlsCertPath != "" || conf.TcpServer.TlsKeyPath != "" {
+				log.Fatalf("can not use both tls of tcp server and mutual tls of tcp handler")
+			}
+			thMutualTlsOpt = handler.TcpMutualTls(
+				conf.TcpHandler.MutualTlsCertPath,
+				conf.TcpHandler.MutualTlsKeyPath,
+				conf.TcpHandler.MutualTlsCaPath,
+				conf.TcpHandler.MutualTlsCrlPath,
+				conf.TcpHandler.MutualTlsSkipDigest,
+			)
+		}
+		var thUdpOpt handler.TcpOption
+		if conf.TcpHandler.UdpAddrPort != "" {
+			thUdpOpt = handler.TcpUdp(conf.TcpHandler.UdpAddrPort)
+		}
+		var thHeartbeatOpt handler.TcpOption
+		if conf.TcpHandler.PingInterval > 0 {
+			thHeartbeatOpt = handler.TcpHeartbeat(time.Duration(conf.TcpHandler.PingInterval) * time.Second, conf.TcpHandler.PingMaxMissed)
+		}
+		var thMaxFrameSizeOpt handler.TcpOption
+		if conf.TcpHandler.MaxFrameSize > 0 {
+			thMaxFrameSizeOpt = handler.TcpMaxFrameSize(conf.TcpHandler.MaxFrameSize)
+		}
+		newTcpHandler, err = handler.NewTcpHandler(
+			conf.TcpHandler.Secret,
+			newClientsStore,
+			newForwarder,
+			thVerboseOpt,
+			thClusterOpt,
+			thDuplicateDeviceOpt,
+			thRoomSecretsOpt,
+			thContextOpt,
+			thAuthModeOpt,
+			thDeviceRegistryOpt,
+			thMutualTlsOpt,
+			thUdpOpt,
+			thHeartbeatOpt,
+			thMaxFrameSizeOpt,
+		)
+		if err != nil {
+			log.Fatalf("can not create tcp handler: %v", err)
+		}
+		// setup tcp server
+		tsVerboseOpt := server.TcpServerVerbose(conf.Verbose)
+		tsTlsOpt := server.TcpServerTls(conf.TcpServer.TlsCertPath, conf.TcpServer.TlsKeyPath)
+		tsSkipVerifyOpt := server.TcpServerSkipVerify(conf.TcpServer.SkipVerify)
+		newTcpServer, err = server.NewTcpServer(
+			conf.TcpServer.AddrPort,
+			newTcpHandler,
+			tsTlsOpt,
+			tsSkipVerifyOpt,
+			tsVerboseOpt,
+		)
+		if err != nil {
+			log.Fatalf("can not create tcp server: %v", err)
+		}
+	}
+	var newHttpServer *server.HttpServer
+	if runHttp {
+		// setup http handler
+		hhVerboseOpt := handler.HttpVerbose(conf.Verbose)
+		hhResumeGracePeriodOpt := handler.HttpResumeGracePeriod(time.Duration(conf.HttpHandler.ResumeGracePeriod) * time.Second)
+		hhInviteOpt := handler.HttpInvite(conf.HttpHandler.InviteSecret, time.Duration(conf.HttpHandler.InviteTtl) * time.Second)
+		hhClusterOpt := handler.HttpCluster(newCluster)
+		hhRoomsOpt := handler.HttpRooms(conf.HttpHandler.Rooms)
+		hhContextOpt := handler.HttpContext(ctx)
+		var hhDeviceRegistryOpt handler.HttpOption
+		if newDeviceRegistry != nil {
+			hhDeviceRegistryOpt = handler.HttpDeviceRegistry(newDeviceRegistry, conf.HttpHandler.DeviceAdmins)
+		}
+		var hhClientsHistoryOpt handler.HttpOption
+		if newClientsHistory != nil {
+			hhClientsHistoryOpt = handler.HttpClientsHistory(newClientsHistory, conf.HttpHandler.DeviceAdmins)
+		}
+		var hhDeviceWebsocketOpt handler.HttpOption
+		if conf.HttpHandler.DeviceWebsocket {
+			if newTcpHandler == nil {
+				log.Fatalf("can not serve device websocket without tcp handler")
+			}
+			hhDeviceWebsocketOpt = handler.HttpDeviceWebsocket(newTcpHandler)
+		}
+		var hhHeartbeatOpt handler.HttpOption
+		if conf.HttpHandler.PingInterval > 0 {
+			hhHeartbeatOpt = handler.HttpHeartbeat(time.Duration(conf.HttpHandler.PingInterval) * time.Second, conf.HttpHandler.PingMaxMissed)
+		}
+		newHttpHandler, err := handler.NewHttpHandler(
+			conf.HttpHandler.ResourcePath,
+			conf.HttpHandler.Accounts,
+			newClientsStore,
+			newForwarder,
+			hhVerboseOpt,
+			hhResumeGracePeriodOpt,
+			hhInviteOpt,
+			hhClusterOpt,
+			hhRoomsOpt,
+			hhContextOpt,
+			hhDeviceRegistryOpt,
+			hhClientsHistoryOpt,
+			hhDeviceWebsocketOpt,
+			hhHeartbeatOpt,
+		)
+		if err != nil {
+			log.Fatalf("can not create http handler: %v", err)
+		}
+		// setup http server
+		hsVerboseOpt := server.HttpServerVerbose(conf.Verbose)
+		hsTlsOpt := server.HttpServerTls(conf.HttpServer.TlsCertPath, conf.HttpServer.TlsKeyPath)
+		hsSkipVerifyOpt := server.HttpServerSkipVerify(conf.HttpServer.SkipVerify)
+		hsModeOpt := server.HttpServerMode(conf.HttpServer.Mode)
+		newHttpServer, err = server.NewHttpServer(
+			conf.HttpServer.AddrPort,
+			newHttpHandler,
+			hsTlsOpt,
+			hsSkipVerifyOpt,
+			hsModeOpt,
+			hsVerboseOpt,
+		)
+		if err != nil {
+			log.Fatalf("can not create http server: %v", err)
+		}
+	}
+	if newTcpServer != nil {
+		err = newTcpServer.Start()
+		if err != nil {
+			log.Fatalf("can not start tcp server: %v", err)
+		}
+	}
+	if newHttpServer != nil {
+		err = newHttpServer.Start()
+		if err != nil {
+			log.Fatalf("can not start http server: %v", err)
+		}
+	}
+	newForwarder.Start(ctx)
+	if newCluster != nil {
+		err = newCluster.Start()
+		if err != nil {
+			log.Fatalf("can not start cluster: %v", err)
+		}
+	}
+	// reload the crl of mutual tls by SIGHUP
+        signal.SignalWait(func() {
+		if newTcpHandler == nil {
+			return
+		}
+		if err := newTcpHandler.ReloadCrl(); err != nil {
+			log.Printf("can not reload crl: %v", err)
+		}
+	})
+	log.Printf("shutting down")
+	// stop accepting messages and close connections, then wait for them
+	cancel()
+	if newTcpServer != nil {
+		newTcpServer.Stop()
+	}
+	if newHttpServer != nil {
+		newHttpServer.Stop()
+	}
 	newForwarder.Stop()
-        newHttpServer.Stop()
-        newTcpServer.Stop()
+	if newCluster != nil {
+		newCluster.Stop()
+	}
+	log.Printf("shutdown completed")
 }
-
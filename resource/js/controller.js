@@ -1,5 +1,6 @@
 let websocket = null;
 let stopPingLoopValue = null;
+let stopLookupLoopValue = null;
 let peerConnection = null;
 let remoteStream = new MediaStream();
 let started = false;
@@ -7,6 +8,9 @@ let gamepads = {};
 let completeSdpOffer = false;
 let completeAnswerSdp = false;
 let completeConnectGamepad = false;
+let resumeToken = "";
+// room is given by the query parameter, e.g. controller.html?room=teamA
+const room = new URLSearchParams(location.search).get("room") || "";
 
 // performance
 const controllerId = document.getElementById('uid');
@@ -63,6 +67,19 @@ let audioOutputDeviceApp = new Vue({
 	}
 });
 
+let delivererApp = new Vue({
+	el: '#div_for_deliverers',
+	data: {
+		selectedDeliverer: '',
+		deliverers: [],
+		progress: false
+	},
+	mounted : function(){
+	},
+	methods: {
+	}
+});
+
 let gamepadApp = new Vue({
 	el: '#div_for_gamepads',
 	data: {
@@ -173,8 +190,59 @@ function startWebsocket() {
 			return
 		}
                 controllerId.value =  msg.RegisterResponse.ClientId
+		resumeToken = msg.RegisterResponse.ResumeToken
+		stopLookupLoop(stopLookupLoopValue);
+		stopLookupLoopValue = lookupLoop(websocket);
+		websocket.send(JSON.stringify({ MsgType : "lookupReq" }));
                 console.log("done register");
 		return
+	} else if (msg.MsgType == "lookupRes") {
+		if (msg.Error && msg.Error.Message != "") {
+			console.log("could not lookup: " + msg.Error.Message);
+			return
+		}
+		if (!msg.LookupResponse) {
+			console.log("no parameter in lookupRes");
+			return
+		}
+		delivererApp.deliverers = msg.LookupResponse.Deliverers;
+		console.log("done lookup deliverers");
+		return
+	} else if (msg.MsgType == "presence") {
+		if (!msg.PresenceEvent) {
+			console.log("no parameter in presence");
+			return
+		}
+		if (msg.PresenceEvent.ClientType == "deliverer") {
+			delivererApp.deliverers = applyPresenceEvent(delivererApp.deliverers, msg.PresenceEvent.Event, msg.PresenceEvent.Client);
+		}
+		console.log("done presence " + msg.PresenceEvent.Event);
+		return
+	} else if (msg.MsgType == "joinSrvErr") {
+		if (msg.Error && msg.Error.Message != "") {
+			console.log("failed in join: " + msg.Error.Message);
+		}
+		delivererApp.progress = false;
+		return
+	} else if (msg.MsgType == "joinRes") {
+		delivererApp.progress = false;
+		if (!msg.JoinResponse ||
+		    msg.JoinResponse.DelivererId != delivererApp.selectedDeliverer ||
+		    msg.JoinResponse.ControllerId != controllerId.value) {
+			console.log("ids are mismatch in joinRes");
+			return
+		}
+		if (msg.Error && msg.Error.Message != "") {
+			console.log("failed in join: " + msg.Error.Message);
+			return
+		}
+		if (!msg.JoinResponse.Accepted) {
+			alert("rejected by deliverer");
+			return
+		}
+		// deliverer starts offer
+		console.log("join accepted");
+		return
 	} else if (msg.MsgType == "sigOfferSdpReq") {
 		if (!msg.SignalingSdpRequest ||
 		    msg.SignalingSdpRequest.DelivererId == "" ||
@@ -325,19 +393,47 @@ function startWebsocket() {
 			console.log("unsupported vibration");
 		}
 		return
+	} else if (msg.MsgType == "gpDisconnected") {
+		if (!msg.GamepadDisconnected ||
+                    msg.GamepadDisconnected.DelivererId != delivererId.value ||
+                    msg.GamepadDisconnected.ControllerId != controllerId.value ||
+                    msg.GamepadDisconnected.GamepadId != gamepadId.value) {
+                        console.log("ids are mismatch in gpDisconnected");
+			return
+		}
+		console.log("gamepad is disconnected");
+		completeConnectGamepad = false
+		return
+	} else if (msg.MsgType == "gpDeviceStatus") {
+		if (!msg.GamepadDeviceStatus ||
+                    msg.GamepadDeviceStatus.GamepadId != gamepadId.value) {
+                        console.log("ids are mismatch in gpDeviceStatus");
+			return
+		}
+		console.log("gamepad device status: hostLink = " + msg.GamepadDeviceStatus.HostLink +
+			    ", temperature = " + msg.GamepadDeviceStatus.Temperature);
+		return
 	} else {
 		console.log("unsupported message: " + msg.MsgType);
 	}
     }
     websocket.onerror = event => {
         stopPingLoop(stopPingLoopValue);
+        stopLookupLoop(stopLookupLoopValue);
         console.log("signaling error");
         console.log(event);
     }
     websocket.onclose = event => {
         stopPingLoop(stopPingLoopValue);
+        stopLookupLoop(stopLookupLoopValue);
         console.log("signaling close");
         console.log(event);
+	if (resumeToken != "") {
+		// try to resume session
+		setTimeout( () => {
+			startWebsocket();
+		}, 1000);
+	}
     }
 }
 
@@ -352,10 +448,49 @@ function stopPingLoop(value) {
         clearInterval(value);
 }
 
+// presence events are pushed, lookup only resynchronizes the list
+function lookupLoop(socket) {
+	return setInterval(() => {
+		let req = { MsgType : "lookupReq" };
+		socket.send(JSON.stringify(req));
+	}, 30000);
+}
+
+function applyPresenceEvent(items, event, item) {
+	let newItems = (items || []).filter(i => i.Id != item.Id);
+	if (event != "delete") {
+		newItems.push(item);
+	}
+	return newItems;
+}
+
+function stopLookupLoop(value) {
+	clearInterval(value);
+}
+
+function join() {
+	if (controllerId.value == "") {
+		console.log("no uid");
+		return
+	}
+	if (delivererApp.selectedDeliverer == "") {
+		console.log("no select deliverer");
+		return
+	}
+	delivererApp.progress = true;
+	let req = { MsgType: "joinReq",
+		    JoinRequest: {
+			    DelivererId: delivererApp.selectedDeliverer,
+			    ControllerId: controllerId.value,
+		    }
+	          };
+	websocket.send(JSON.stringify(req));
+}
+
 function startRegister() {
 	if (started == true) {
 		console.log("start register")
-		let req = { MsgType: "registerReq", RegisterRequest: { ClientName: nameApp.value } };
+		let req = { MsgType: "registerReq", RegisterRequest: { ClientName: nameApp.value, ResumeToken: resumeToken, Capabilities: [ "webrtc", "gamepad", "presence" ], Room: room } };
 		websocket.send(JSON.stringify(req));
 	} else {
 		console.log("retry register")
@@ -5,6 +5,8 @@ let stopLookupLoopValue = null;
 let peerConnection = null;
 let completeSdpOffer = false;
 let completeAnswerSdp = false;
+// room is given by the query parameter, e.g. deliverer.html?room=teamA
+const room = new URLSearchParams(location.search).get("room") || "";
 
 let nameApp = new Vue({
         el: '#name',
@@ -122,7 +124,7 @@ function startWebsocket() {
         console.log("websocket open");
         stopPingLoopValue = pingLoop(websocket)
         stopLookupLoopValue = lookupLoop(websocket)
-        let req = { MsgType: "registerReq", RegisterRequest: { ClientName: nameApp.value } };
+        let req = { MsgType: "registerReq", RegisterRequest: { ClientName: nameApp.value, Capabilities: [ "webrtc", "video", "presence" ], Room: room } };
         websocket.send(JSON.stringify(req));
     };
     websocket.onmessage = event => {
@@ -147,6 +149,7 @@ function startWebsocket() {
                 }
 		const delivererId = document.getElementById('uid');
 		delivererId.value =  msg.RegisterResponse.ClientId
+		websocket.send(JSON.stringify({ MsgType : "lookupReq" }));
                 console.log("done register");
                 return
         } else if (msg.MsgType == "lookupRes") {
@@ -161,6 +164,64 @@ function startWebsocket() {
 		controllerApp.controllers = msg.LookupResponse.Controllers;
 		gamepadApp.gamepads = msg.LookupResponse.Gamepads;
 		console.log("done lookup clients");
+        } else if (msg.MsgType == "presence") {
+		if (!msg.PresenceEvent) {
+			console.log("no parameter in presence");
+			return
+		}
+		if (msg.PresenceEvent.ClientType == "controller") {
+			controllerApp.controllers = applyPresenceEvent(controllerApp.controllers, msg.PresenceEvent.Event, msg.PresenceEvent.Client);
+		} else if (msg.PresenceEvent.ClientType == "gamepad") {
+			gamepadApp.gamepads = applyPresenceEvent(gamepadApp.gamepads, msg.PresenceEvent.Event, msg.PresenceEvent.Gamepad);
+		}
+		console.log("done presence " + msg.PresenceEvent.Event);
+        } else if (msg.MsgType == "inviteRes") {
+		if (msg.Error && msg.Error.Message != "") {
+			console.log("could not invite: " + msg.Error.Message);
+			return
+		}
+		if (!msg.InviteResponse || msg.InviteResponse.Path == "") {
+			console.log("no parameter in inviteRes");
+			return
+		}
+		const inviteUrl = document.getElementById('invite_url');
+		inviteUrl.value = "https://" + location.host + msg.InviteResponse.Path;
+		console.log("done invite");
+		return
+        } else if (msg.MsgType == "joinSrvErr") {
+		if (msg.Error && msg.Error.Message != "") {
+			console.log("failed in join: " + msg.Error.Message);
+		}
+		return
+        } else if (msg.MsgType == "joinReq") {
+		if (!msg.JoinRequest ||
+		    msg.JoinRequest.DelivererId == "" ||
+		    msg.JoinRequest.ControllerId == "") {
+			console.log("no parameter in joinReq");
+			return
+		}
+		const delivererId = document.getElementById('uid');
+		let res = { MsgType : "joinRes",
+			    JoinResponse : {
+				    DelivererId: delivererId.value,
+				    ControllerId: msg.JoinRequest.ControllerId,
+				    Accepted: false
+			    }
+		          };
+		if (controllerApp.progress ||
+		    !confirm(msg.JoinRequest.ControllerName + " (" + msg.JoinRequest.ControllerId + ") wants to join")) {
+			websocket.send(JSON.stringify(res));
+			return
+		}
+		res.JoinResponse.Accepted = true;
+		websocket.send(JSON.stringify(res));
+		controllerApp.selectedController = msg.JoinRequest.ControllerId;
+		if (msg.JoinRequest.GamepadId != "") {
+			gamepadApp.selectedGamepad = msg.JoinRequest.GamepadId;
+		}
+		// start offer
+		startLocalVideo();
+		return
         } else if (msg.MsgType == "sigOfferSdpSrvErr") {
 		if (msg.Error && msg.Error.Message != "") {
 			console.log("failed in offerSdp: " + msg.Error.Message);
@@ -292,17 +353,36 @@ function stopPingLoop(stopPingLoopValue) {
 	clearInterval(stopPingLoopValue);
 }
 
+// presence events are pushed, lookup only resynchronizes the lists
 function lookupLoop(socket) {
         return setInterval(() => {
 		let req = { MsgType : "lookupReq" };
                 socket.send(JSON.stringify(req));
-        }, 2000);
+        }, 30000);
+}
+
+function applyPresenceEvent(items, event, item) {
+	let newItems = (items || []).filter(i => i.Id != item.Id);
+	if (event != "delete") {
+		newItems.push(item);
+	}
+	return newItems;
 }
 
 function stopLookupLoop(stopLookupLoopValue) {
 	clearInterval(stopLookupLoopValue);
 }
 
+function invite() {
+	const delivererId = document.getElementById('uid');
+	if (delivererId.value == "") {
+		console.log("no uid");
+		return
+	}
+	let req = { MsgType: "inviteReq", InviteRequest: { DelivererId: delivererId.value } };
+	websocket.send(JSON.stringify(req));
+}
+
 function startLocalVideo() {
 	const delivererId = document.getElementById('uid');
 	if (delivererId.value == "") {